@@ -27,6 +27,25 @@ type (
 		NoLchown         bool
 		Name             string
 		IncludeSourceDir bool
+		// ChownOpts, if set, overrides the owner of every archived entry.
+		ChownOpts *TarChownOptions
+		// ChmodOpts, if set, overrides the unix permission bits, including
+		// the setuid, setgid and sticky bits, of every archived entry other
+		// than symbolic links.
+		ChmodOpts *os.FileMode
+		// ExcludeBaseDir, if set, is the directory which ExcludePatterns
+		// are relative to instead of the archived directory.
+		ExcludeBaseDir string
+		// RootDir, if set, is a directory which the archived files must
+		// not resolve to a location outside of, even by following
+		// symbolic links. A symbolic link found while walking a directory
+		// is archived as a link, and fails the archive if it resolves to
+		// a location outside of RootDir. A dangling link is archived.
+		RootDir string
+	}
+	// TarChownOptions wraps the chown options UID and GID.
+	TarChownOptions struct {
+		UID, GID int
 	}
 )
 
@@ -36,6 +55,10 @@ type tarAppender struct {
 
 	// for hardlink mapping
 	SeenFiles map[uint64]string
+
+	// for overriding the owner and permissions of each entry
+	ChownOpts *TarChownOptions
+	ChmodOpts *os.FileMode
 }
 
 // canonicalTarName provides a platform-independent and consistent posix-style
@@ -72,12 +95,24 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 	}
 	hdr.Mode = int64(chmodTarEntry(os.FileMode(hdr.Mode)))
 
+	if ta.ChmodOpts != nil && hdr.Typeflag != tar.TypeSymlink {
+		// An explicit mode takes precedence over any platform-specific
+		// adjustment.
+		hdr.Mode = hdr.Mode&^07777 | int64(*ta.ChmodOpts&07777)
+	}
+
 	name, err = canonicalTarName(name, fi.IsDir())
 	if err != nil {
 		return fmt.Errorf("tar: cannot canonicalize path: %v", err)
 	}
 	hdr.Name = name
 
+	if ta.ChownOpts != nil {
+		// The names of the original owner no longer apply.
+		hdr.Uid, hdr.Gid = ta.ChownOpts.UID, ta.ChownOpts.GID
+		hdr.Uname, hdr.Gname = "", ""
+	}
+
 	nlink, inode, err := setHeaderForSpecialDevice(hdr, ta, name, fi.Sys())
 	if err != nil {
 		return err
@@ -139,6 +174,16 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 		return nil, err
 	}
 
+	var root string
+	if options.RootDir != "" {
+		if root, err = filepath.EvalSymlinks(options.RootDir); err != nil {
+			return nil, err
+		}
+		if err := checkWithinRoot(root, srcPath, options.IncludeFiles); err != nil {
+			return nil, err
+		}
+	}
+
 	pipeReader, pipeWriter := io.Pipe()
 
 	go func() {
@@ -146,6 +191,8 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 			TarWriter: tar.NewWriter(pipeWriter),
 			Buffer:    pools.BufioWriter32KPool.Get(nil),
 			SeenFiles: make(map[uint64]string),
+			ChownOpts: options.ChownOpts,
+			ChmodOpts: options.ChmodOpts,
 		}
 
 		defer func() {
@@ -196,7 +243,7 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 			// We can't use filepath.Join(srcPath, include) because this will
 			// clean away a trailing "." or "/" which may be important.
 			walkRoot := strings.Join([]string{srcPath, include}, string(filepath.Separator))
-			filepath.Walk(walkRoot, func(filePath string, f os.FileInfo, err error) error {
+			walkErr := filepath.Walk(walkRoot, func(filePath string, f os.FileInfo, err error) error {
 				if err != nil {
 					log.Debugf("Tar: Can't stat file %s to tar: %s", srcPath, err)
 					return nil
@@ -221,10 +268,21 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 				// is asking for that file no matter what - which is true
 				// for some files, like .dockerignore and Dockerfile (sometimes)
 				if include != relFilePath {
-					skip, err = fileutils.OptimizedMatches(relFilePath, patterns, patDirs)
-					if err != nil {
-						log.Debugf("Error matching %s", relFilePath, err)
-						return err
+					matchPath := relFilePath
+					if options.ExcludeBaseDir != "" {
+						if matchPath, err = filepath.Rel(options.ExcludeBaseDir, filePath); err != nil {
+							return err
+						}
+						matchPath = filepath.ToSlash(matchPath)
+					}
+
+					// The base directory itself is never excluded.
+					if options.ExcludeBaseDir == "" || matchPath != "." {
+						skip, err = fileutils.OptimizedMatches(matchPath, patterns, patDirs)
+						if err != nil {
+							log.Debugf("Error matching %s: %s", matchPath, err)
+							return err
+						}
 					}
 				}
 
@@ -249,13 +307,85 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 					relFilePath = strings.Replace(relFilePath, renamedRelFilePath, options.Name, 1)
 				}
 
+				// Every entry must be reached without passing through a
+				// symbolic link out of the root, which a directory swapped
+				// for a link during the walk would otherwise allow, and a
+				// link must not point out of the root.
+				if root != "" {
+					err := withinRoot(root, filepath.Dir(filePath))
+					if err == nil && f.Mode()&os.ModeSymlink != 0 {
+						err = withinRoot(root, filePath)
+					}
+					if err != nil {
+						pipeWriter.CloseWithError(err)
+						return err
+					}
+				}
+
 				if err := ta.addTarFile(filePath, relFilePath); err != nil {
 					log.Debugf("Can't add file %s to tar: %s", filePath, err)
+					if err == io.ErrClosedPipe {
+						// The reader has gone away so there is no
+						// point in archiving any more files.
+						return err
+					}
 				}
 				return nil
 			})
+			if walkErr == io.ErrClosedPipe || isOutsideRoot(walkErr) {
+				return
+			}
 		}
 	}()
 
 	return pipeReader, nil
 }
+
+// checkWithinRoot returns an error if the source path or any of the files to
+// include from it resolve to a location outside of the resolved root directory
+// after following symbolic links. Files which do not exist are left for the
+// archiver to skip.
+func checkWithinRoot(root, srcPath string, includes []string) error {
+	if len(includes) == 0 {
+		includes = []string{"."}
+	}
+
+	for _, include := range includes {
+		if err := withinRoot(root, filepath.Join(srcPath, include)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// outsideRootError is returned for a path which resolves to a location
+// outside of the root directory.
+type outsideRootError string
+
+func (e outsideRootError) Error() string {
+	return fmt.Sprintf("forbidden path outside the build context: %s", string(e))
+}
+
+func isOutsideRoot(err error) bool {
+	_, ok := err.(outsideRootError)
+	return ok
+}
+
+// withinRoot returns an error if filePath resolves to a location outside of
+// the resolved root directory. A path which does not exist is allowed.
+func withinRoot(root, filePath string) error {
+	resolved, err := filepath.EvalSymlinks(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return outsideRootError(filePath)
+	}
+
+	return nil
+}
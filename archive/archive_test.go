@@ -0,0 +1,236 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTarResourceWithChownOpts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-chown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "sub", "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := TarResourceWithOptions(srcDir, &TarOptions{
+		ChownOpts: &TarChownOptions{UID: 1234, GID: 5678},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+
+	tr := tar.NewReader(content)
+
+	var numEntries int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		numEntries++
+
+		if hdr.Uid != 1234 || hdr.Gid != 5678 {
+			t.Fatalf("entry %s has owner %d:%d, expected 1234:5678", hdr.Name, hdr.Uid, hdr.Gid)
+		}
+		if hdr.Uname != "" || hdr.Gname != "" {
+			t.Fatalf("entry %s has owner names %q:%q, expected none", hdr.Name, hdr.Uname, hdr.Gname)
+		}
+	}
+
+	if numEntries != 3 {
+		t.Fatalf("expected 3 entries, got %d", numEntries)
+	}
+}
+
+func TestTarResourceWithChmodOpts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-chmod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	mode := os.FileMode(0755)
+	content, err := TarResourceWithOptions(dir+string(filepath.Separator), &TarOptions{
+		ChmodOpts: &mode,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+
+	tr := tar.NewReader(content)
+
+	modes := map[string]int64{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		modes[filepath.Base(hdr.Name)] = hdr.Mode & 07777
+	}
+
+	if modes["file"] != 0755 {
+		t.Fatalf("expected file mode 0755, got %#o", modes["file"])
+	}
+	if modes["link"] == 0755 {
+		t.Fatal("expected symbolic link mode to be left unchanged")
+	}
+}
+
+func TestTarWithOptionsRootDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-rootdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootDir := filepath.Join(dir, "root")
+	outsideDir := filepath.Join(dir, "outside")
+	for _, d := range []string{rootDir, outsideDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootDir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outsideDir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outsideDir, filepath.Join(rootDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	options := &TarOptions{RootDir: rootDir}
+
+	content, err := TarResourceWithOptions(filepath.Join(rootDir, "file"), options)
+	if err != nil {
+		t.Fatalf("unable to archive file within root: %s", err)
+	}
+	content.Close()
+
+	for _, srcPath := range []string{"link", "link/", "link/secret"} {
+		// Don't use filepath.Join, which would remove a trailing separator.
+		if content, err := TarResourceWithOptions(rootDir+string(filepath.Separator)+srcPath, options); err == nil {
+			content.Close()
+			t.Fatalf("expected an error archiving %s which is outside of the root", srcPath)
+		}
+	}
+}
+
+func TestTarWithOptionsRootDirNestedSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-rootdir-nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootDir := filepath.Join(dir, "root")
+	outsideDir := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(rootDir, "dir"), outsideDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootDir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outsideDir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// readArchive reads the archive of the root, returning the names of its
+	// entries and any error reading it.
+	readArchive := func() (map[string]byte, error) {
+		content, err := TarWithOptions(rootDir, &TarOptions{RootDir: rootDir})
+		if err != nil {
+			return nil, err
+		}
+		defer content.Close()
+
+		entries := map[string]byte{}
+		tr := tar.NewReader(content)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return entries, nil
+			}
+			if err != nil {
+				return entries, err
+			}
+			entries[hdr.Name] = hdr.Typeflag
+		}
+	}
+
+	// A nested link within the root is archived as a link.
+	if err := os.Symlink("../file", filepath.Join(rootDir, "dir", "link")); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readArchive()
+	if err != nil {
+		t.Fatalf("unable to archive root: %s", err)
+	}
+	if entries["dir/link"] != tar.TypeSymlink {
+		t.Fatalf("expected dir/link to be archived as a symlink, got entries %q", entries)
+	}
+
+	// A nested link out of the root fails the archive.
+	if err := os.Symlink(outsideDir, filepath.Join(rootDir, "dir", "sub")); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = readArchive()
+	if err == nil || !strings.Contains(err.Error(), "forbidden path outside the build context") {
+		t.Fatalf("expected an error archiving a nested symlink out of the root, got %v", err)
+	}
+	if _, ok := entries["dir/sub/secret"]; ok {
+		t.Fatal("archived a file from outside of the root through a nested symlink")
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	testCases := []struct {
+		source      []byte
+		compression Compression
+	}{
+		{[]byte{0x1F, 0x8B, 0x08, 0x00}, Gzip},
+		{[]byte("BZh91AY"), Bzip2},
+		{[]byte("file.txt\x00\x00"), Uncompressed},
+		{[]byte{0x1F}, Uncompressed},
+		{nil, Uncompressed},
+	}
+
+	for _, tc := range testCases {
+		if compression := DetectCompression(tc.source); compression != tc.compression {
+			t.Errorf("detecting %q: expected %d, got %d", tc.source, tc.compression, compression)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+)
+
+// Compression is the compression algorithm of an archive.
+type Compression int
+
+// Compression algorithms which can be detected and decompressed.
+const (
+	Uncompressed Compression = iota
+	Bzip2
+	Gzip
+)
+
+var compressionMagic = map[Compression][]byte{
+	Bzip2: {0x42, 0x5A, 0x68},
+	Gzip:  {0x1F, 0x8B, 0x08},
+}
+
+// DetectCompression returns the compression algorithm of an archive which
+// begins with the given bytes.
+func DetectCompression(source []byte) Compression {
+	for compression, magic := range compressionMagic {
+		if bytes.HasPrefix(source, magic) {
+			return compression
+		}
+	}
+
+	return Uncompressed
+}
+
+// DecompressStream returns a reader of the decompressed content of the given
+// archive, which may be compressed with gzip or bzip2. An uncompressed archive
+// is read as is.
+func DecompressStream(archive io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(archive)
+
+	// An error here means the archive is too short to be compressed, in
+	// which case any problem is left for the reader of the tar stream.
+	magic, _ := buf.Peek(3)
+
+	switch DetectCompression(magic) {
+	case Gzip:
+		return gzip.NewReader(buf)
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(buf)), nil
+	default:
+		return ioutil.NopCloser(buf), nil
+	}
+}
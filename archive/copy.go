@@ -92,6 +92,13 @@ func SplitPathDirEntry(localizedPath string) (dir, base string) {
 // requires a directory as the source path. TarResource accepts either a
 // directory or a file path and correctly sets the Tar options.
 func TarResource(sourcePath string) (content Archive, err error) {
+	return TarResourceWithOptions(sourcePath, &TarOptions{})
+}
+
+// TarResourceWithOptions is like TarResource but also applies the given
+// options when archiving. The IncludeFiles and IncludeSourceDir options are
+// always set to archive only the resource at sourcePath.
+func TarResourceWithOptions(sourcePath string, options *TarOptions) (content Archive, err error) {
 	if _, err = os.Lstat(sourcePath); err != nil {
 		// Catches the case where the source does not exist or is not a
 		// directory if asserted to be a directory, as this also causes an
@@ -123,10 +130,12 @@ func TarResource(sourcePath string) (content Archive, err error) {
 
 	log.Debugf("copying %q from %q", sourceBase, sourceDir)
 
-	return TarWithOptions(sourceDir, &TarOptions{
-		IncludeFiles:     filter,
-		IncludeSourceDir: true,
-	})
+	// Copy the options so that the caller's are not modified.
+	resourceOptions := *options
+	resourceOptions.IncludeFiles = filter
+	resourceOptions.IncludeSourceDir = true
+
+	return TarWithOptions(sourceDir, &resourceOptions)
 }
 
 // CopyInfo holds basic info about the source
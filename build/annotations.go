@@ -0,0 +1,60 @@
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// reverseDNSKey matches keys in reverse domain notation, such as
+// `org.opencontainers.image.source`.
+var reverseDNSKey = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*(\.[a-z0-9]+(-[a-z0-9]+)*)+$`)
+
+// SetAnnotations sets metadata, given as `key=value` strings, to attach to every
+// image committed by the build. The Remote API has no separate field for image
+// annotations, so they are stored as image labels which take precedence over
+// any label with the same key. If strict is set, every key must be in reverse
+// domain notation.
+func (b *Builder) SetAnnotations(annotations []string, strict bool) error {
+	parsed := make(map[string]string, len(annotations))
+
+	for _, annotation := range annotations {
+		parts := strings.SplitN(annotation, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid annotation %q: must be key=value", annotation)
+		}
+
+		key, value := parts[0], parts[1]
+		if strict && !reverseDNSKey.MatchString(key) {
+			return fmt.Errorf("invalid annotation key %q: must be in reverse domain notation, e.g., com.example.key", key)
+		}
+
+		parsed[key] = value
+	}
+
+	b.config.Annotations = parsed
+
+	return nil
+}
+
+// annotationsString returns the annotations in a form which is stable for use
+// in the cache key, or an empty string if there are none.
+func (c *config) annotationsString() string {
+	if c == nil || len(c.Annotations) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(c.Annotations))
+	for key := range c.Annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%q=%q", key, c.Annotations[key])
+	}
+
+	return "ANNOTATIONS " + strings.Join(pairs, " ")
+}
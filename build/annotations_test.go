@@ -0,0 +1,83 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestAnnotationsOnCommittedImage(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nLABEL com.example.team builders\nLABEL org.opencontainers.image.source old\nCOPY a /a\n",
+		"a":          "a",
+	}
+
+	build := func(annotations ...string) *Builder {
+		b := d.newBuilder(t, files, "")
+		if err := b.SetAnnotations(annotations, true); err != nil {
+			t.Fatalf("unable to set annotations: %s", err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b
+	}
+
+	b := build("org.opencontainers.image.source=https://example.com/repo", "org.opencontainers.image.revision=abc123")
+
+	labels := d.images[b.ImageID()].Config.Labels
+	expected := map[string]string{
+		"com.example.team":                  "builders",
+		"org.opencontainers.image.source":   "https://example.com/repo",
+		"org.opencontainers.image.revision": "abc123",
+	}
+
+	for key, value := range expected {
+		if labels[key] != value {
+			t.Errorf("expected label %s=%q, got %q", key, value, labels[key])
+		}
+	}
+
+	// A build with different annotations must not reuse the cached image.
+	if other := build("org.opencontainers.image.revision=def456"); other.ImageID() == b.ImageID() {
+		t.Fatal("expected a different image for different annotations")
+	}
+
+	// The same annotations hit the cache.
+	if again := build("org.opencontainers.image.revision=abc123", "org.opencontainers.image.source=https://example.com/repo"); again.ImageID() != b.ImageID() {
+		t.Fatalf("expected cached image %s, got %s", b.ImageID(), again.ImageID())
+	}
+}
+
+func TestSetAnnotationsValidation(t *testing.T) {
+	b := &Builder{config: &config{}}
+
+	for _, annotation := range []string{"", "novalue", "=value"} {
+		if err := b.SetAnnotations([]string{annotation}, false); err == nil {
+			t.Errorf("expected an error for annotation %q", annotation)
+		}
+	}
+
+	if err := b.SetAnnotations([]string{"version=1.0", "empty="}, false); err != nil {
+		t.Errorf("unexpected error for non-strict annotations: %s", err)
+	}
+
+	for _, key := range []string{"version", "Com.Example.key", "com..example", ".com.example", "com.example.", "com.example_key"} {
+		if err := b.SetAnnotations([]string{key + "=x"}, true); err == nil {
+			t.Errorf("expected an error for strict annotation key %q", key)
+		}
+	}
+
+	for _, key := range []string{"com.example.key", "org.opencontainers.image.base-name", "io.k8s.v1"} {
+		if err := b.SetAnnotations([]string{key + "=x"}, true); err != nil {
+			t.Errorf("unexpected error for strict annotation key %q: %s", key, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jlhawn/dockramp/build/commands"
+)
+
+// SetBuildArgs sets the values, given as `name=value` strings, of build
+// arguments declared in the Dockerfile with ARG. A bare `name` takes its value
+// from the environment of the current process so that secrets need not be
+// given on the command line. If that variable is not set, a warning is logged
+// and the argument keeps its default.
+func (b *Builder) SetBuildArgs(buildArgs []string) error {
+	parsed := make(map[string]string, len(buildArgs))
+
+	for _, buildArg := range buildArgs {
+		parts := strings.SplitN(buildArg, "=", 2)
+		if parts[0] == "" {
+			return fmt.Errorf("invalid build arg %q: must be name=value or name", buildArg)
+		}
+
+		name := parts[0]
+		if len(parts) == 2 {
+			parsed[name] = parts[1]
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			log.Warnf("build arg %s is not set in the environment", name)
+			continue
+		}
+
+		parsed[name] = value
+	}
+
+	b.buildArgs = parsed
+
+	return nil
+}
+
+func (b *Builder) handleArg(args []string, heredoc string) error {
+	log.Debugf("handling %s with args: %#v", commands.Arg, args)
+
+	parts := strings.SplitN(args[0], "=", 2)
+	name := parts[0]
+	if name == "" {
+		return fmt.Errorf("%s requires a name, e.g., NAME or NAME=default", commands.Arg)
+	}
+
+	if err := validateKey(commands.Arg, name); err != nil {
+		return err
+	}
+
+	value, ok := b.buildArgs[name]
+	if !ok {
+		if len(parts) != 2 {
+			// The argument has no value.
+			return nil
+		}
+
+		value = parts[1]
+	}
+
+	b.args[name] = value
+	b.usedBuildArgs[name] = struct{}{}
+
+	// The value of the argument, which may not be in the Dockerfile, affects
+	// the result of the build. Secret values are hashed.
+	cacheValue := fmt.Sprintf("%q", value)
+	if b.isSecretArg(name) {
+		cacheValue = hashSecret(value)
+	}
+	b.uncommittedCommands = append(b.uncommittedCommands, fmt.Sprintf("ARG value: %s=%s", name, cacheValue))
+
+	return nil
+}
+
+// argEnv returns the values of the build arguments of the current stage as
+// `name=value` strings, excluding any which are overridden by an environment
+// variable of the same name.
+func (b *Builder) argEnv() []string {
+	names := make([]string, 0, len(b.args))
+	for name := range b.args {
+		if !b.config.hasEnv(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	env := make([]string, len(names))
+	for i, name := range names {
+		env[i] = fmt.Sprintf("%s=%s", name, b.args[name])
+	}
+
+	return env
+}
+
+// shellEnv returns the variables available for interpolation in the arguments
+// of commands. Environment variables take precedence over build arguments.
+func (b *Builder) shellEnv() []string {
+	return append(b.config.Env[:len(b.config.Env):len(b.config.Env)], b.argEnv()...)
+}
+
+// hasEnv returns whether the environment variable with the given name is set.
+func (c *config) hasEnv(name string) bool {
+	for _, env := range c.Env {
+		if strings.SplitN(env, "=", 2)[0] == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// warnUnusedBuildArgs logs a warning for each build arg which was set but never
+// declared with ARG in the Dockerfile.
+func (b *Builder) warnUnusedBuildArgs() {
+	var unused []string
+	for name := range b.buildArgs {
+		if _, ok := b.usedBuildArgs[name]; !ok {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+
+	for _, name := range unused {
+		log.Warnf("build arg %s was not declared with %s in the Dockerfile", name, commands.Arg)
+	}
+}
@@ -0,0 +1,119 @@
+package build
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestBuildArgs(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nARG VERSION=1\nARG TOKEN\nENV APP_VERSION $VERSION\nCOPY app-${VERSION} /app\n",
+		"app-1":      "version 1",
+		"app-2":      "version 2",
+	}
+
+	build := func(buildArgs ...string) *Builder {
+		b := d.newBuilder(t, files, "")
+		if err := b.SetBuildArgs(buildArgs); err != nil {
+			t.Fatalf("unable to set build args: %s", err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b
+	}
+
+	checkImage := func(b *Builder, version string) {
+		image := d.images[b.ImageID()]
+		if content := d.imageFiles[b.ImageID()]["/app"]; content != "version "+version {
+			t.Fatalf("expected version %s of the app, got %q", version, content)
+		}
+
+		// Build args are not stored in the image config.
+		env := strings.Join(image.Config.Env, " ")
+		if !strings.HasSuffix(env, " APP_VERSION="+version) || strings.Count(env, "VERSION=") != 1 {
+			t.Fatalf("expected APP_VERSION=%s and no build args in the image environment, got %q", version, env)
+		}
+	}
+
+	defaultImage := build()
+	checkImage(defaultImage, "1")
+
+	given := build("VERSION=2")
+	checkImage(given, "2")
+
+	// A bare name takes its value from the environment.
+	os.Setenv("DOCKRAMP_TEST_VERSION", "2")
+	defer os.Unsetenv("DOCKRAMP_TEST_VERSION")
+	files["Dockerfile"] = "FROM base\nARG DOCKRAMP_TEST_VERSION=1\nENV APP_VERSION $DOCKRAMP_TEST_VERSION\nCOPY app-${DOCKRAMP_TEST_VERSION} /app\n"
+
+	imported := build("DOCKRAMP_TEST_VERSION")
+	checkImage(imported, "2")
+
+	// The argument is set in the environment of build containers.
+	if env := strings.Join(imported.argEnv(), " "); env != "DOCKRAMP_TEST_VERSION=2" {
+		t.Fatalf("unexpected build container environment %q", env)
+	}
+
+	// An unset environment variable leaves the default.
+	os.Unsetenv("DOCKRAMP_TEST_VERSION")
+	checkImage(build("DOCKRAMP_TEST_VERSION"), "1")
+}
+
+func TestBuildArgsCache(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nARG TOKEN\nCOPY a /a\n",
+		"a":          "a",
+	}
+
+	build := func(buildArgs ...string) string {
+		b := d.newBuilder(t, files, "")
+		if err := b.SetBuildArgs(buildArgs); err != nil {
+			t.Fatalf("unable to set build args: %s", err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b.ImageID()
+	}
+
+	first := build("TOKEN=abc")
+	if build("TOKEN=abc") != first {
+		t.Fatal("expected the same build arg to hit the cache")
+	}
+	if build("TOKEN=def") == first {
+		t.Fatal("expected a different build arg to miss the cache")
+	}
+}
+
+func TestSetBuildArgsValidation(t *testing.T) {
+	b := &Builder{config: &config{}}
+
+	if err := b.SetBuildArgs([]string{"=value"}); err == nil {
+		t.Fatal("expected an error for a build arg without a name")
+	}
+
+	if err := b.SetBuildArgs([]string{"EMPTY=", "A=b=c"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if b.buildArgs["EMPTY"] != "" || b.buildArgs["A"] != "b=c" {
+		t.Fatalf("unexpected build args: %v", b.buildArgs)
+	}
+}
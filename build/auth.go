@@ -0,0 +1,103 @@
+package build
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jlhawn/dockramp/util"
+)
+
+// authConfig is the credentials for a registry, in the form of an entry in
+// the auths of a Docker client config file.
+type authConfig struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+}
+
+// LoadAuthConfig loads the registry credentials in the Docker client config
+// file at the given path, which are used to pull and push images. It is not
+// an error if the file does not exist.
+func (b *Builder) LoadAuthConfig(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open auth config: %s", err)
+	}
+	defer file.Close()
+
+	var config struct {
+		Auths map[string]authConfig `json:"auths"`
+	}
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return fmt.Errorf("unable to decode auth config %s: %s", path, err)
+	}
+
+	b.authConfigs = make(map[string]authConfig, len(config.Auths))
+	for server, auth := range config.Auths {
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return fmt.Errorf("invalid auth for %s in %s: %s", server, path, err)
+			}
+
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid auth for %s in %s: must be username:password", server, path)
+			}
+
+			auth.Username, auth.Password, auth.Auth = parts[0], parts[1], ""
+		}
+
+		auth.ServerAddress = server
+		b.authConfigs[registryHost(server)] = auth
+	}
+
+	return nil
+}
+
+// registryHost returns the host of the given registry server address, which
+// may be a URL as used for Docker Hub in client config files.
+func registryHost(server string) string {
+	host := server
+	if strings.Contains(server, "://") {
+		if u, err := url.Parse(server); err == nil {
+			host = u.Host
+		}
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return util.DefaultRegistry
+	}
+
+	return host
+}
+
+// registryAuth returns the value of the X-Registry-Auth header with the
+// credentials for the registry of the given image. The header is always set
+// as the daemon requires it to push, even when there are no credentials.
+func (b *Builder) registryAuth(imageName string) string {
+	var auth authConfig
+
+	if repo, _, _, err := util.Canonicalize(imageName); err == nil {
+		registry := strings.SplitN(repo, "/", 2)[0]
+		if found, ok := b.authConfigs[registry]; ok {
+			log.Debugf("using credentials for %s", found.ServerAddress)
+			auth = found
+		}
+	}
+
+	encoded, _ := json.Marshal(auth) // Encoding a struct of strings cannot fail.
+
+	return base64.URLEncoding.EncodeToString(encoded)
+}
@@ -0,0 +1,114 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jlhawn/dockramp/build/commands"
+	"github.com/jlhawn/dockramp/build/parser"
+)
+
+// batchInputDir is the directory in the container which holds the input of
+// each command in a batch of RUN commands. It is removed before the container
+// is committed.
+const batchInputDir = "/.dockramp-runs"
+
+// pendingRun is a RUN command which is run later in the same container as the
+// following RUN commands.
+type pendingRun struct {
+	args  []string
+	input string
+}
+
+// SetCompressRuns sets whether consecutive RUN commands are run in the same
+// container so that only one image is committed for all of them. RUN commands
+// with options other than --check are always run on their own.
+func (b *Builder) SetCompressRuns(compressRuns bool) {
+	b.compressRuns = compressRuns
+}
+
+// isCompressibleRun returns whether the given command is a RUN command which
+// may be run in the same container as other RUN commands.
+func isCompressibleRun(command *parser.Command) bool {
+	if strings.ToUpper(command.Args[0]) != commands.Run || len(command.Heredocs) > 1 {
+		return false
+	}
+
+	for _, arg := range command.Args[1:] {
+		if arg == "--" || !strings.HasPrefix(arg, "--") {
+			break
+		}
+
+		if name := strings.SplitN(arg[2:], "=", 2)[0]; name != "check" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// batchEntrypoint returns the entrypoint of a container which runs each of the
+// given commands in turn with its input read from the file with its index in
+// the given directory. It stops at the first command which fails, and exits
+// with its status after removing the directory.
+func batchEntrypoint(inputDir string, runs []pendingRun) []string {
+	var script bytes.Buffer
+
+	cleanup := "rm -rf -- " + shellQuote(inputDir)
+	for i, run := range runs {
+		quoted := make([]string, len(run.args))
+		for j, arg := range run.args {
+			quoted[j] = shellQuote(arg)
+		}
+
+		fmt.Fprintf(&script, "%s < %s || { status=$?; %s; exit $status; }\n",
+			strings.Join(quoted, " "), shellQuote(path.Join(inputDir, fmt.Sprint(i))), cleanup)
+	}
+	script.WriteString(cleanup + "\n")
+
+	return []string{"/bin/sh", "-c", script.String()}
+}
+
+// inputDirArchive returns a tar archive of the given directory holding each of
+// the given inputs in a file named by its index plus offset, to be extracted at
+// the root of the container.
+func inputDirArchive(inputDir string, inputs []string, offset int) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	dir := strings.TrimPrefix(inputDir, "/")
+	if err := tw.WriteHeader(&tar.Header{Name: dir + "/", Mode: 0700, ModTime: time.Now(), Typeflag: tar.TypeDir}); err != nil {
+		return nil, err
+	}
+
+	for i, input := range inputs {
+		header := &tar.Header{
+			Name:     path.Join(dir, fmt.Sprint(i+offset)),
+			Mode:     0600,
+			Size:     int64(len(input)),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write([]byte(input)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
+
+// shellQuote quotes the given string as a single word for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,98 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/jlhawn/dockramp/build/parser"
+)
+
+func TestIsCompressibleRun(t *testing.T) {
+	for _, test := range []struct {
+		args         []string
+		compressible bool
+	}{
+		{[]string{"RUN", "make"}, true},
+		{[]string{"run", "/bin/sh", "-c", "make"}, true},
+		{[]string{"RUN", "--check", "/bin/sh"}, true},
+		{[]string{"RUN", "--", "--version"}, true},
+		{[]string{"RUN", "--network=none", "make"}, false},
+		{[]string{"RUN", "--check", "--mount=target=/src", "/bin/sh"}, false},
+		{[]string{"COPY", "a", "/a"}, false},
+	} {
+		if compressible := isCompressibleRun(&parser.Command{Args: test.args}); compressible != test.compressible {
+			t.Errorf("expected compressible %t for %q, got %t", test.compressible, test.args, compressible)
+		}
+	}
+
+	// The heredocs after the first are written to files for the command.
+	command := &parser.Command{Args: []string{"RUN", "sh"}, Heredocs: []string{"a\n", "b\n"}}
+	if isCompressibleRun(command) {
+		t.Errorf("expected a command with two heredocs not to be compressible")
+	}
+}
+
+func TestBatchEntrypoint(t *testing.T) {
+	if _, err := exec.LookPath("/bin/sh"); err != nil {
+		t.Skip(err)
+	}
+
+	dir, err := ioutil.TempDir("", "dockramp-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inputDir := filepath.Join(dir, "it's the input")
+	output := filepath.Join(dir, "output")
+
+	for _, test := range []struct {
+		runs   []pendingRun
+		err    string
+		output string
+	}{
+		// Each command reads its own input, in order.
+		{
+			runs: []pendingRun{
+				{args: []string{"sh", "-c", "cat >> " + output}, input: "one\n"},
+				{args: []string{"sh"}, input: "echo two >> " + output + "\n"},
+			},
+			output: "one\ntwo\n",
+		},
+		// The batch stops at the first command which fails.
+		{
+			runs: []pendingRun{
+				{args: []string{"sh", "-c", "echo one >> " + output}},
+				{args: []string{"sh", "-c", "exit 3"}},
+				{args: []string{"sh", "-c", "echo three >> " + output}},
+			},
+			err:    "exit status 3",
+			output: "one\n",
+		},
+	} {
+		os.Remove(output)
+		for i, run := range test.runs {
+			writeContextFile(t, inputDir, strconv.Itoa(i), run.input)
+		}
+
+		args := batchEntrypoint(inputDir, test.runs)
+		err := exec.Command(args[0], args[1:]...).Run()
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Fatalf("expected error %q, got %v", test.err, err)
+		}
+
+		if content, err := ioutil.ReadFile(output); err != nil {
+			t.Fatal(err)
+		} else if string(content) != test.output {
+			t.Fatalf("expected output %q, got %q", test.output, content)
+		}
+
+		if _, err := os.Stat(inputDir); !os.IsNotExist(err) {
+			t.Fatalf("expected the input directory to be removed, got %v", err)
+		}
+	}
+}
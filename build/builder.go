@@ -1,17 +1,22 @@
 package build
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/docker/distribution/reference"
+	log "github.com/Sirupsen/logrus"
 	"github.com/jlhawn/dockramp/build/commands"
 	"github.com/jlhawn/dockramp/build/parser"
+	"github.com/jlhawn/dockramp/tarsum"
 	"github.com/samalba/dockerclient"
 )
 
@@ -24,9 +29,23 @@ type config struct {
 	User         string
 	Volumes      map[string]struct{}
 	WorkingDir   string
+
+	// Annotations are stored as labels on every committed image.
+	Annotations map[string]string
 }
 
 func (c *config) toDocker() *dockerclient.ContainerConfig {
+	labels := c.Labels
+	if len(c.Annotations) > 0 {
+		labels = make(map[string]string, len(c.Labels)+len(c.Annotations))
+		for key, value := range c.Labels {
+			labels[key] = value
+		}
+		for key, value := range c.Annotations {
+			labels[key] = value
+		}
+	}
+
 	return &dockerclient.ContainerConfig{
 		User:         c.User,
 		ExposedPorts: c.ExposedPorts,
@@ -35,7 +54,7 @@ func (c *config) toDocker() *dockerclient.ContainerConfig {
 		Volumes:      c.Volumes,
 		WorkingDir:   c.WorkingDir,
 		Entrypoint:   c.Entrypoint,
-		Labels:       c.Labels,
+		Labels:       labels,
 	}
 }
 
@@ -49,9 +68,32 @@ type Builder struct {
 	client           *dockerclient.DockerClient
 	contextDirectory string
 	dockerfilePath   string
-	ref              reference.Reference
+	// dockerfile is the content of a Dockerfile read from stdin.
+	dockerfile []byte
+	// excludePatterns are the patterns in the .dockerignore file of files
+	// which are excluded from the build context.
+	excludePatterns []string
+	// contextWarnSize is the size of the archive of the whole build
+	// context above which copying it is warned about, or 0 to never warn.
+	contextWarnSize int64
+
+	// tags are the names to give the built image.
+	tags []imageTag
 
 	out io.Writer
+	// quiet suppresses all output other than the ID of the built image.
+	quiet bool
+
+	// noComment commits images without the commands of each layer as the
+	// comment.
+	noComment bool
+	// format is the format of the build output.
+	format string
+	// step is the number of the step being dispatched.
+	step int
+	// maxSteps is the maximum number of commands in the Dockerfile, or 0
+	// if there is no limit.
+	maxSteps int
 
 	config              *config
 	maintainer          string
@@ -60,13 +102,197 @@ type Builder struct {
 	uncommitted         bool
 	uncommittedCommands []string
 
-	cache map[string]string
+	// layerCommands are the printed commands of the steps which create the
+	// uncommitted layer: the current step, or each RUN command of a batch.
+	// Unlike uncommittedCommands, which is the cache key of the layer, they
+	// are the comment of the committed image.
+	layerCommands []string
+
+	// labels are added to the config of the final image.
+	labels map[string]string
+
+	// configPatch is merged into the config of each committed image, and
+	// configPatchString is its canonical encoding.
+	configPatch       map[string]interface{}
+	configPatchString string
+
+	// flags holds the options given to the command being dispatched.
+	flags instructionFlags
+	// normalizeCache is set if the build cache should use the normalized
+	// form of the command being dispatched.
+	normalizeCache bool
+
+	// stages are the completed stages of a multi-stage build, and
+	// stageName is the name of the current stage, if any.
+	stages    []buildStage
+	stageName string
+
+	// buildArgs are the values of build arguments given for the build,
+	// usedBuildArgs are those declared in the Dockerfile, and args are the
+	// values of the arguments declared in the current stage.
+	buildArgs     map[string]string
+	usedBuildArgs map[string]struct{}
+	args          map[string]string
+	// secretArgs are the names of build args whose values are masked.
+	secretArgs map[string]struct{}
+	// noProxyInherit is set if the proxy variables in the environment are
+	// not passed to RUN commands.
+	noProxyInherit bool
+
+	// cache is the build cache, by default the file in the home directory
+	// of the current user.
+	cache CacheBackend
+
+	// storageDriver is the storage driver of the daemon, which is asked for
+	// once storageDriverDetected is set.
+	storageDriver         string
+	storageDriverDetected bool
+
+	// apiVersion is the API version of the daemon.
+	apiVersion string
+
+	// authConfigs maps registry hosts to their credentials.
+	authConfigs map[string]authConfig
+
+	networkRetries int
+	networkTimeout time.Duration
+
+	// daemonRetries is the number of times a failed request to the daemon
+	// is retried, waiting daemonRetryDelay before the first retry.
+	daemonRetries    int
+	daemonRetryDelay time.Duration
+
+	registryMirror string
+
+	// pull pulls every base image, even if it exists locally.
+	pull bool
+
+	// platform is the platform of the pulled images and of the containers
+	// which run commands, or nil to use that of the daemon.
+	platform *platform
+
+	// rm removes the containers and images created by a build which fails,
+	// and committedImages are the images committed by the build. forceRm
+	// removes the containers when the build ends whether or not it fails,
+	// and containers are the containers created by the build which have
+	// not been removed.
+	rm              bool
+	committedImages []string
+	forceRm         bool
+	containers      []string
+
+	// squash squashes the built image into a single layer.
+	squash bool
+
+	// tarsumVersion is the version of tarsum used to digest files for the
+	// build cache.
+	tarsumVersion tarsum.Version
+
+	// iidFile is the path of a file to which the ID of the built image is
+	// written.
+	iidFile string
+
+	// metadataFile is the path of a file to which the metadata of the build
+	// is written. currentStep is the metadata of the step being dispatched.
+	metadataFile string
+	metadata     buildMetadata
+	currentStep  *stepMetadata
+
+	// compressRuns runs consecutive RUN commands in the same container.
+	// batchNext is set while dispatching a RUN command which is followed by
+	// another in the same batch, and pendingRuns are the commands of the
+	// batch which have not been run yet.
+	compressRuns bool
+	batchNext    bool
+	pendingRuns  []pendingRun
+
+	// heredocFiles are the heredocs after the first of the command being
+	// dispatched, which RUN writes to files.
+	heredocFiles []string
+
+	// limits are the limits on the resources of RUN containers, and
+	// ulimits are their ulimits.
+	limits  resourceLimits
+	ulimits []dockerclient.Ulimit
+
+	// push pushes each tag of the built image to its registry.
+	push bool
+
+	// dryRun plans the build without contacting the daemon.
+	dryRun bool
+
+	// interpolateRun substitutes variables into the arguments of RUN
+	// commands.
+	interpolateRun bool
+
+	// ctx cancels the build when it is done.
+	ctx context.Context
+
+	// observer is notified of the progress of the build.
+	observer Observer
+
+	stats buildStats
 
 	handlers map[string]handlerFunc
 }
 
-// NewBuilder creates a new builder.
+// DockerfileStdin is the Dockerfile path which means the Dockerfile is read
+// from stdin.
+const DockerfileStdin = "-"
+
+// BuilderOptions configures a builder created with NewBuilderWithOptions. The
+// other settings of a builder have setters.
+type BuilderOptions struct {
+	// DaemonURL is the URL of the Docker daemon, which is connected to with
+	// TLSConfig if it is not nil.
+	DaemonURL string
+	TLSConfig *tls.Config
+
+	// ContextDirectory is the build context directory. DockerfilePath is
+	// the path of the Dockerfile, by default Dockerfile in the context
+	// directory. If it is DockerfileStdin, the Dockerfile is read from
+	// stdin.
+	ContextDirectory string
+	DockerfilePath   string
+
+	// Tags are the names to give the built image, as given to AddTag.
+	Tags []string
+
+	// Output receives the build output, by default os.Stdout.
+	Output io.Writer
+
+	// CacheBackend is the build cache to use, as given to NewCacheBackend.
+	// By default it is the build cache file of the current user.
+	CacheBackend string
+
+	// BuildArgs are the build arguments, as given to SetBuildArgs.
+	BuildArgs []string
+}
+
+// NewBuilder creates a new builder. If dockerfilePath is DockerfileStdin, the
+// Dockerfile is read from stdin. The built image is named repoTag unless it is
+// empty.
 func NewBuilder(daemonURL string, tlsConfig *tls.Config, contextDirectory, dockerfilePath, repoTag string) (*Builder, error) {
+	opts := BuilderOptions{
+		DaemonURL:        daemonURL,
+		TLSConfig:        tlsConfig,
+		ContextDirectory: contextDirectory,
+		DockerfilePath:   dockerfilePath,
+	}
+
+	if repoTag != "" {
+		opts.Tags = []string{repoTag}
+	}
+
+	return NewBuilderWithOptions(opts)
+}
+
+// NewBuilderWithOptions creates a new builder with the given options, for use
+// of the builder as a library.
+func NewBuilderWithOptions(opts BuilderOptions) (*Builder, error) {
+	daemonURL, tlsConfig := opts.DaemonURL, opts.TLSConfig
+	contextDirectory, dockerfilePath := opts.ContextDirectory, opts.DockerfilePath
+
 	// Validate that the context directory exists.
 	stat, err := os.Stat(contextDirectory)
 	if err != nil {
@@ -81,20 +307,24 @@ func NewBuilder(daemonURL string, tlsConfig *tls.Config, contextDirectory, docke
 		dockerfilePath = filepath.Join(contextDirectory, "Dockerfile")
 	}
 
-	if _, err := os.Stat(dockerfilePath); err != nil {
+	var dockerfile []byte
+	if dockerfilePath == DockerfileStdin {
+		// Read it all now, as the build may be run more than once.
+		if dockerfile, err = ioutil.ReadAll(os.Stdin); err != nil {
+			return nil, fmt.Errorf("unable to read build file from stdin: %s", err)
+		}
+	} else if _, err := os.Stat(dockerfilePath); err != nil {
 		return nil, fmt.Errorf("unable to access build file: %s", err)
 	}
 
-	ref, err := reference.Parse(repoTag)
+	client, err := dockerclient.NewDockerClient(daemonURL, tlsConfig)
 	if err != nil {
-		if err != reference.ErrNameEmpty {
-			return nil, fmt.Errorf("invalid tag: %s", err)
-		}
+		return nil, fmt.Errorf("unable to initialize client: %s", err)
 	}
 
-	client, err := dockerclient.NewDockerClient(daemonURL, tlsConfig)
+	excludePatterns, err := readDockerignore(contextDirectory)
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize client: %s", err)
+		return nil, err
 	}
 
 	b := &Builder{
@@ -103,8 +333,16 @@ func NewBuilder(daemonURL string, tlsConfig *tls.Config, contextDirectory, docke
 		client:           client,
 		contextDirectory: contextDirectory,
 		dockerfilePath:   dockerfilePath,
-		ref:              ref,
+		dockerfile:       dockerfile,
+		excludePatterns:  excludePatterns,
+		contextWarnSize:  defaultContextWarnSize,
 		out:              os.Stdout,
+		format:           FormatText,
+		usedBuildArgs:    map[string]struct{}{},
+		args:             map[string]string{},
+		ctx:              context.Background(),
+		rm:               true,
+		tarsumVersion:    tarsum.Version1,
 		config: &config{
 			Labels:       map[string]string{},
 			ExposedPorts: map[string]struct{}{},
@@ -114,6 +352,7 @@ func NewBuilder(daemonURL string, tlsConfig *tls.Config, contextDirectory, docke
 
 	// Register Dockerfile Directive Handlers
 	b.handlers = map[string]handlerFunc{
+		commands.Arg:        b.handleArg,
 		commands.Cmd:        b.handleCmd,
 		commands.Copy:       b.handleCopy,
 		commands.Entrypoint: b.handleEntrypoint,
@@ -133,71 +372,257 @@ func NewBuilder(daemonURL string, tlsConfig *tls.Config, contextDirectory, docke
 		commands.Onbuild: b.handleOnbuild,
 	}
 
-	if err := b.loadCache(); err != nil {
+	for _, repoTag := range opts.Tags {
+		if err := b.AddTag(repoTag); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Output != nil {
+		b.SetOutput(opts.Output)
+	}
+
+	if b.cache, err = NewCacheBackend(opts.CacheBackend); err != nil {
 		return nil, fmt.Errorf("unable to load build cache: %s", err)
 	}
 
+	if err := b.SetBuildArgs(opts.BuildArgs); err != nil {
+		return nil, err
+	}
+
 	return b, nil
 }
 
 // Run executes the build process.
-func (b *Builder) Run() error {
-	// Parse the Dockerfile.
-	dockerfile, err := os.Open(b.dockerfilePath)
-	if err != nil {
-		return fmt.Errorf("unable to open Dockerfile: %s", err)
+func (b *Builder) Run() (err error) {
+	b.stats = buildStats{start: time.Now()}
+	b.metadata = buildMetadata{}
+	b.currentStep = nil
+
+	if b.ctx == nil {
+		b.ctx = context.Background()
 	}
-	defer dockerfile.Close()
 
-	commands, err := parser.Parse(dockerfile)
+	// built is set once the image has been built and tagged.
+	var built bool
+
+	defer func() {
+		if err != nil {
+			b.removeIntermediates()
+			// The image of the last completed step is not the result
+			// of the build.
+			if !built {
+				b.imageID = ""
+			}
+			err = b.maskError(err)
+			b.observe().OnError(err)
+		}
+
+		if b.forceRm {
+			b.removeContainers()
+		}
+	}()
+
+	commands, err := b.parseDockerfile()
 	if err != nil {
-		return fmt.Errorf("unable to parse Dockerfile: %s", err)
+		return err
 	}
 
-	if len(commands) == 0 {
-		return fmt.Errorf("no commands found in Dockerfile")
+	if !b.dryRun {
+		// Remove the files written by a previous build so that they do
+		// not remain if this build fails.
+		for _, path := range []string{b.iidFile, b.metadataFile} {
+			if err := removeOutputFile(path); err != nil {
+				return fmt.Errorf("unable to remove output of previous build: %s", err)
+			}
+		}
+
+		if err := b.detectAPIVersion(); err != nil {
+			return err
+		}
+
+		if err := b.checkPlatformSupport(); err != nil {
+			return err
+		}
+	}
+
+	if b.maxSteps > 0 && len(commands) > b.maxSteps {
+		return fmt.Errorf("Dockerfile has %d steps, which exceeds the maximum of %d", len(commands), b.maxSteps)
+	}
+
+	// Find any mistake in the Dockerfile before doing any work.
+	if err := validateDockerfile(commands); err != nil {
+		return err
 	}
 
 	for i, command := range commands {
+		if err := b.ctx.Err(); err != nil {
+			return fmt.Errorf("build cancelled: %s", err)
+		}
+
+		b.batchNext = b.compressRuns && i+1 < len(commands) && isCompressibleRun(command) && isCompressibleRun(commands[i+1])
+
 		if err := b.dispatch(i, command); err != nil {
 			return err
 		}
 	}
 
-	// create container and commit if we need to (because of trailing
-	// metadata directives).
-	if b.uncommitted && !b.probeCache() {
+	// The final stage is the image being built.
+	b.applyLabels()
+	if err := b.endStage(); err != nil {
+		return err
+	}
+	b.currentStep = nil
 
-		b.containerID, err = b.createContainer([]string{"/bin/sh", "-c"}, []string{"#(nop)"}, false)
-		if err != nil {
-			return fmt.Errorf("unable to create container: %s", err)
-		}
+	if b.dryRun {
+		b.warnUnusedBuildArgs()
+		b.printPlanSummary()
+		return nil
+	}
 
-		if err := b.commit(); err != nil {
-			return fmt.Errorf("unable to commit container image: %s", err)
+	if b.squash {
+		if err := b.squashImage(); err != nil {
+			return fmt.Errorf("unable to squash image: %s", err)
 		}
 	}
 
+	b.warnUnusedBuildArgs()
+
 	imageName := b.imageID
-	if named, hasName := b.ref.(reference.Named); hasName {
-		imageName = b.ref.String()
+	if len(b.tags) > 0 {
+		imageName = b.tags[0].name
+	}
 
-		var tag string
-		if tagged, isTagged := named.(reference.Tagged); isTagged {
-			tag = tagged.Tag()
+	for _, tag := range b.tags {
+		if err := b.setTag(b.imageID, tag.repo, tag.tag); err != nil {
+			return fmt.Errorf("unable to tag built image as %s: %s", tag.name, err)
 		}
-		if err := b.setTag(b.imageID, named.Name(), tag); err != nil {
-			return fmt.Errorf("unable to tag built image: %s", err)
+	}
+
+	b.emit(&event{Type: eventImage, Image: imageName, ImageID: b.imageID})
+
+	// The build has succeeded, so the image is kept even if a push fails.
+	b.committedImages = nil
+	built = true
+
+	if err := b.writeIIDFile(); err != nil {
+		return err
+	}
+
+	if err := b.writeMetadataFile(); err != nil {
+		return err
+	}
+
+	if b.push {
+		for _, tag := range b.tags {
+			if err := b.pushImage(tag); err != nil {
+				return fmt.Errorf("unable to push %s: %s", tag.name, err)
+			}
+		}
+	}
+
+	b.printSummary(imageName)
+
+	return nil
+}
+
+// removeIntermediates removes the containers and the images created by a
+// build which failed, unless they are to be kept for debugging.
+func (b *Builder) removeIntermediates() {
+	if !b.rm {
+		return
+	}
+
+	b.removeContainers()
+
+	// Remove children before their parents.
+	for i := len(b.committedImages) - 1; i >= 0; i-- {
+		if _, err := b.client.RemoveImage(b.committedImages[i], false); err != nil {
+			log.Warnf("unable to remove image %s: %s", b.committedImages[i], err)
 		}
 	}
+	b.committedImages = nil
+}
+
+// SetRemoveIntermediates sets whether to remove the containers and the images
+// created by a build which fails. They are removed by default.
+func (b *Builder) SetRemoveIntermediates(rm bool) {
+	b.rm = rm
+}
+
+// parseDockerfile parses the commands in the Dockerfile.
+func (b *Builder) parseDockerfile() ([]*parser.Command, error) {
+	var dockerfile io.Reader = bytes.NewReader(b.dockerfile)
+	if b.dockerfilePath != DockerfileStdin {
+		f, err := os.Open(b.dockerfilePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open Dockerfile: %s", err)
+		}
+		defer f.Close()
+
+		dockerfile = f
+	}
+
+	commands, err := parser.Parse(dockerfile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse Dockerfile: %s", err)
+	}
+
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("no commands found in Dockerfile")
+	}
+
+	return commands, nil
+}
+
+// SetContext sets a context which cancels the build when it is done. The
+// build stops before the next step, and a running RUN command is stopped.
+func (b *Builder) SetContext(ctx context.Context) {
+	b.ctx = ctx
+}
+
+// context returns the context of the build, which requests made on behalf of
+// the build are tied to so that they are abandoned if it is cancelled.
+func (b *Builder) context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
 
-	fmt.Fprintf(b.out, "Successfully built %s\n", imageName)
+	return b.ctx
+}
+
+// sleep waits for the given duration, returning early with an error if the
+// build is cancelled first.
+func (b *Builder) sleep(d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-b.context().Done():
+		return fmt.Errorf("build cancelled: %s", b.context().Err())
+	}
+}
+
+// SetQuiet sets whether to suppress the progress of the build, in which case
+// the only output is the ID of the built image.
+func (b *Builder) SetQuiet(quiet bool) {
+	b.quiet = quiet
+}
+
+// SetMaxSteps sets the maximum number of commands in the Dockerfile. A build
+// with more commands fails before any are executed. Zero means no limit.
+func (b *Builder) SetMaxSteps(maxSteps int) error {
+	if maxSteps < 0 {
+		return fmt.Errorf("maximum steps must not be negative: %d", maxSteps)
+	}
+
+	b.maxSteps = maxSteps
 
 	return nil
 }
 
-// ImageID returns the image id of the build image, returns
-// empty if the build has not run successfully.
+// ImageID returns the ID of the built image once Run has succeeded, for use
+// of the builder as a library. It is empty if the build has not run or has
+// failed, other than by a failed push of the built image.
 func (b *Builder) ImageID() string {
 	return b.imageID
 }
@@ -205,9 +630,17 @@ func (b *Builder) ImageID() string {
 func (b *Builder) dispatch(stepNum int, command *parser.Command) error {
 	cmd, args := strings.ToUpper(command.Args[0]), command.Args[1:]
 
-	// FROM must be the first and only the first command.
-	if (stepNum == 0) != (cmd == commands.From) {
-		return fmt.Errorf("FROM must be the first Dockerfile command")
+	// The parser removes the quotes around arguments, so the JSON array form
+	// of VOLUME is taken from the elements it decoded.
+	if cmd == commands.Volume && command.JSONArgs != nil {
+		args = append([]string(nil), command.JSONArgs...)
+	}
+
+	// Any FROM other than the first begins a new stage.
+	if stepNum > 0 && cmd == commands.From {
+		if err := b.endStage(); err != nil {
+			return err
+		}
 	}
 
 	handler, exists := b.handlers[cmd]
@@ -215,10 +648,42 @@ func (b *Builder) dispatch(stepNum int, command *parser.Command) error {
 		return fmt.Errorf("unknown command: %q", cmd)
 	}
 
+	b.normalizeCache = false
+	for _, annotation := range command.Annotations {
+		if annotation == commands.CacheIgnoreNext {
+			b.normalizeCache = true
+		}
+	}
+
+	// Separate any options from the positional arguments so that they are
+	// not subject to environment variable interpolation.
+	var flagArgs []string
+	b.flags = nil
+
+	b.heredocFiles = nil
+	if len(command.Heredocs) > 1 {
+		b.heredocFiles = command.Heredocs[1:]
+	}
+	if allowed, ok := commands.Flags[cmd]; ok {
+		var err error
+		if b.flags, flagArgs, args, err = parseFlags(cmd, args, allowed); err != nil {
+			return err
+		}
+	}
+
 	if _, ok := commands.ReplaceEnvAllowed[cmd]; ok {
 		// Expand environment variables in the arguments.
 		for i, arg := range args {
-			arg, err := processShellWord(arg, b.config.Env)
+			arg, err := processShellWord(arg, b.shellEnv())
+			if err != nil {
+				return err
+			}
+
+			args[i] = arg
+		}
+	} else if cmd == commands.Run && b.interpolateRun {
+		for i, arg := range args {
+			arg, err := interpolateRunWord(arg, b.shellEnv())
 			if err != nil {
 				return err
 			}
@@ -227,22 +692,44 @@ func (b *Builder) dispatch(stepNum int, command *parser.Command) error {
 		}
 	}
 
-	// Print the current step.
-	commandStr := makeCommandString(cmd, args...)
+	// Print the current step. The capacity of flagArgs is limited so that
+	// append does not write into the backing array shared with args.
+	commandStr := b.maskSecrets(makeCommandString(cmd, append(flagArgs[:len(flagArgs):len(flagArgs)], args...)...))
 
-	fmt.Fprintf(b.out, "Step %d: %s\n", stepNum, commandStr)
+	b.step = stepNum
+	b.observe().OnStepStart(stepNum, commandStr)
+	b.stats.steps++
+	b.recordStep(commandStr)
+
+	cacheStr := commandStr
+	if b.normalizeCache {
+		cacheStr = b.maskSecrets(normalizeCommandString(cmd, b.flags, args))
+	}
 
 	b.uncommitted = true
-	b.uncommittedCommands = append(b.uncommittedCommands, commandStr)
+	b.uncommittedCommands = append(b.uncommittedCommands, cacheStr)
 
-	if err := handler(args, command.Heredoc); err != nil {
+	// A RUN command which is not the first of a batch shares a layer with
+	// the commands before it.
+	if len(b.pendingRuns) == 0 {
+		b.layerCommands = nil
+	}
+	b.layerCommands = append(b.layerCommands, commandStr)
+
+	if err := handler(args, command.Heredoc()); err != nil {
 		return err
 	}
 
 	// We may not need to commit now but we should if the current command may
 	// have modified the filesystem. `b.uncommitted` will be set back to false
-	// if there was a cache hit.
-	if _, needCommit := commands.FilesystemModifierCommands[cmd]; needCommit && b.uncommitted {
+	// if there was a cache hit. A RUN command in a batch is committed with
+	// the last command of the batch.
+	if _, needCommit := commands.FilesystemModifierCommands[cmd]; needCommit && b.uncommitted && !b.batchNext {
+		if b.dryRun {
+			b.planCommit()
+			return nil
+		}
+
 		if err := b.commit(); err != nil {
 			return fmt.Errorf("unable to commit container image: %s", err)
 		}
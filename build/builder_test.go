@@ -0,0 +1,299 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestMaxSteps(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nCOPY a /a\nCOPY a /b\nLABEL foo bar\n",
+		"a":          "a",
+	}
+
+	b := d.newBuilder(t, files, "")
+	if err := b.SetMaxSteps(3); err != nil {
+		t.Fatal(err)
+	}
+
+	err := b.Run()
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum of 3") {
+		t.Fatalf("expected max steps error, got %v", err)
+	}
+
+	// The build fails before any command is executed.
+	if d.numContainers != 0 || d.numImages != 0 {
+		t.Fatalf("expected no containers or images, got %d containers and %d images", d.numContainers, d.numImages)
+	}
+
+	// A limit equal to the number of steps is allowed.
+	b = d.newBuilder(t, files, "")
+	if err := b.SetMaxSteps(4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	if err := b.SetMaxSteps(-1); err == nil {
+		t.Fatal("expected error for negative maximum steps")
+	}
+}
+
+func TestDockerfileFromStdin(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	const dockerfile = "FROM base\nCOPY a /a\n"
+
+	// Build from a Dockerfile in the context first.
+	fromFile := d.newBuilder(t, map[string]string{"Dockerfile": dockerfile, "a": "a"}, "")
+	if err := fromFile.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	contextDir := newContextDir(t, map[string]string{"a": "a"})
+	defer os.RemoveAll(contextDir)
+
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinReader.Close()
+
+	stdin := os.Stdin
+	os.Stdin = stdinReader
+	defer func() { os.Stdin = stdin }()
+
+	go func() {
+		stdinWriter.Write([]byte(dockerfile))
+		stdinWriter.Close()
+	}()
+
+	b, err := NewBuilder(d.URL, nil, contextDir, DockerfileStdin, "")
+	if err != nil {
+		t.Fatalf("unable to create builder: %s", err)
+	}
+	b.out = ioutil.Discard
+	if b.cache, err = newFileCache(filepath.Join(d.dir, "cache")); err != nil {
+		t.Fatalf("unable to load cache: %s", err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	// The same Dockerfile from stdin uses the same cache.
+	if b.ImageID() != fromFile.ImageID() {
+		t.Fatalf("expected cached image %s, got %s", fromFile.ImageID(), b.ImageID())
+	}
+}
+
+func TestMultipleTags(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nCOPY a /a\n",
+		"a":          "a",
+	}
+
+	b := d.newBuilder(t, files, "app:latest")
+	for _, repoTag := range []string{"app:1.2.3", "registry.example.com/app", "app:latest"} {
+		if err := b.AddTag(repoTag); err != nil {
+			t.Fatalf("unable to add tag %s: %s", repoTag, err)
+		}
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	for _, repoTag := range []string{"app:latest", "app:1.2.3", "registry.example.com/app:latest"} {
+		if id := d.tags[canonicalName(repoTag)]; id != b.ImageID() {
+			t.Fatalf("expected %s to be the built image %s, got %q", repoTag, b.ImageID(), id)
+		}
+	}
+
+	// An invalid tag is rejected before the build.
+	for _, repoTag := range []string{"App:latest", "app@sha256:" + strings.Repeat("a", 64)} {
+		if err := d.newBuilder(t, files, "").AddTag(repoTag); err == nil {
+			t.Fatalf("expected an error for tag %q", repoTag)
+		}
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	b := d.newBuilder(t, map[string]string{
+		"Dockerfile": "FROM base\nCOPY a /a\n",
+		"a":          "a",
+	}, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.SetContext(ctx)
+
+	err := b.Run()
+	if err == nil || !strings.Contains(err.Error(), "build cancelled") {
+		t.Fatalf("expected the build to be cancelled, got %v", err)
+	}
+
+	if d.numContainers != 0 {
+		t.Fatalf("expected no containers to be created, got %d", d.numContainers)
+	}
+}
+
+func TestRemoveIntermediatesOnFailure(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		// The RUN fails after its container is created.
+		"Dockerfile": "FROM base\nCOPY a /a\nRUN false\n",
+		"a":          "a",
+	}
+	d.runExitCode = 1
+
+	b := d.newBuilder(t, files, "")
+	if err := b.Run(); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	if len(d.containers) != 0 {
+		t.Fatalf("expected the container to be removed, got %d containers", len(d.containers))
+	}
+	if _, ok := d.images["image1"]; ok {
+		t.Fatal("expected the intermediate image to be removed")
+	}
+	if _, ok := d.images["base-id"]; !ok {
+		t.Fatal("expected the base image to be kept")
+	}
+
+	// Intermediates may be kept for debugging.
+	b = d.newBuilder(t, files, "")
+	b.SetRemoveIntermediates(false)
+	if err := b.Run(); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	if len(d.containers) != 1 {
+		t.Fatalf("expected the container to be kept, got %d containers", len(d.containers))
+	}
+	if _, ok := d.images["image2"]; !ok {
+		t.Fatal("expected the intermediate image to be kept")
+	}
+
+	// With -force-rm, only the images are kept.
+	for id := range d.containers {
+		delete(d.containers, id)
+	}
+
+	b = d.newBuilder(t, files, "")
+	b.SetRemoveIntermediates(false)
+	b.SetForceRemove(true)
+	if err := b.Run(); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	if len(d.containers) != 0 {
+		t.Fatalf("expected the container to be removed, got %d containers", len(d.containers))
+	}
+	if _, ok := d.images["image2"]; !ok {
+		t.Fatal("expected the intermediate image to be kept")
+	}
+}
+
+func TestNewBuilderWithOptions(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	contextDir := newContextDir(t, map[string]string{"build.Dockerfile": "FROM base\nARG VERSION=1\nENV VERSION $VERSION\n"})
+	defer os.RemoveAll(contextDir)
+
+	var out bytes.Buffer
+	b, err := NewBuilderWithOptions(BuilderOptions{
+		DaemonURL:        d.URL,
+		ContextDirectory: contextDir,
+		DockerfilePath:   filepath.Join(contextDir, "build.Dockerfile"),
+		Tags:             []string{"example/app", "example/app:v2"},
+		Output:           &out,
+		CacheBackend:     "dir:" + filepath.Join(d.dir, "dir-cache"),
+		BuildArgs:        []string{"VERSION=2"},
+	})
+	if err != nil {
+		t.Fatalf("unable to create builder: %s", err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	if env := d.images[b.ImageID()].Config.Env; env[len(env)-1] != "VERSION=2" {
+		t.Fatalf("expected the build arg to be used, got %q", env)
+	}
+
+	for _, name := range []string{"example/app:latest", "example/app:v2"} {
+		if id := d.tags[canonicalName(name)]; id != b.ImageID() {
+			t.Fatalf("expected %s to be tagged as %s, got %q", b.ImageID(), name, id)
+		}
+	}
+
+	if !strings.Contains(out.String(), "Step 2: ENV VERSION 2") {
+		t.Fatalf("expected the build output to be written to the given writer, got:\n%s", out.String())
+	}
+
+	if _, ok := b.cache.(*dirCache); !ok {
+		t.Fatalf("expected the given cache backend, got %T", b.cache)
+	}
+
+	if _, err := NewBuilderWithOptions(BuilderOptions{DaemonURL: d.URL, ContextDirectory: contextDir, Tags: []string{"Invalid Name"}}); err == nil {
+		t.Fatal("expected an error for an invalid tag")
+	}
+}
+
+func TestImageIDAfterFailure(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nCOPY a /a\nCOPY missing /missing\n", "a": "a"}, "")
+	if b.ImageID() != "" {
+		t.Fatalf("expected no image ID before the build, got %s", b.ImageID())
+	}
+
+	if err := b.Run(); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	// The image of the first COPY is not the result of the build.
+	if b.ImageID() != "" {
+		t.Fatalf("expected no image ID after a failed build, got %s", b.ImageID())
+	}
+}
@@ -2,15 +2,29 @@ package build
 
 import (
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jlhawn/dockramp/tarsum"
+	"github.com/jlhawn/dockramp/util"
+	"github.com/samalba/dockerclient"
 )
 
 func (b *Builder) probeCache() bool {
-	imageID, cacheHit := b.cache[b.getCacheKey()]
+	if b.dryRun {
+		// The cache can't be checked without the daemon.
+		return false
+	}
+
+	imageID, cacheHit := b.cache.Get(b.getCacheKey())
 	if !cacheHit {
 		return false
 	}
@@ -22,8 +36,10 @@ func (b *Builder) probeCache() bool {
 	b.imageID = imageID
 	b.uncommitted = false
 	b.uncommittedCommands = nil
+	b.stats.cacheHits++
+	b.recordCache(stepCacheHit)
 
-	fmt.Fprintf(b.out, " cache hit ---> %s\n", b.imageID)
+	b.observe().OnCacheHit(b.imageID)
 
 	return true
 }
@@ -31,62 +47,337 @@ func (b *Builder) probeCache() bool {
 func (b *Builder) getCacheKey() string {
 	hasher := sha256.New()
 
-	// Note: hash.Hash never returns an error.
+	// Note: hash.Hash never returns an error. Each part is terminated so
+	// that moving text from one part to the next, such as from an empty
+	// image ID to the first command, changes the key.
 	hasher.Write([]byte(b.imageID))
+	hasher.Write([]byte{0})
 
 	for _, command := range b.uncommittedCommands {
 		hasher.Write([]byte(command))
+		hasher.Write([]byte{0})
 	}
 
+	// Annotations and the config patch are part of every committed image.
+	hasher.Write([]byte(b.config.annotationsString()))
+	hasher.Write([]byte(b.configPatchString))
+
 	return fmt.Sprintf("%x", hasher.Sum(nil))
 }
 
 func (b *Builder) setCache(imageID string) error {
-	b.cache[b.getCacheKey()] = imageID
+	return b.cache.Set(b.getCacheKey(), imageID)
+}
+
+// tarsumVersions maps the names accepted by SetTarsumVersion to versions of
+// tarsum.
+var tarsumVersions = map[string]tarsum.Version{
+	"v1": tarsum.Version1,
+	"v2": tarsum.Version2,
+}
+
+// SetTarsumVersion sets the version of tarsum used to digest the files of COPY,
+// EXTRACT, and RUN --mount for the build cache: "v1", the default, which uses
+// SHA-256, or "v2", which uses SHA-512. SHA-512 is the stronger hash. It is
+// usually also faster on 64-bit machines, except those with instructions for
+// SHA-256. The version is part of each digest, so a layer cached with one
+// version is not found with the other.
+func (b *Builder) SetTarsumVersion(name string) error {
+	if name == "" {
+		name = "v1"
+	}
+
+	version, ok := tarsumVersions[name]
+	if !ok {
+		return fmt.Errorf("unknown tarsum version %q: must be v1 or v2", name)
+	}
+
+	b.tarsumVersion = version
+
+	return nil
+}
+
+// digestTar returns the tarsum of the complete tar archive read from the given
+// reader for use in the build cache, along with the checksums of the files in
+// the archive. The tarsum is labeled with its version and hash algorithm.
+func digestTar(r io.Reader, version tarsum.Version) (string, []tarsum.FileSum, error) {
+	digester, err := tarsum.NewDigest(version)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to get new tarsum digester: %s", err)
+	}
 
-	return b.saveCache()
+	if _, err := io.Copy(digester, r); err != nil {
+		return "", nil, err
+	}
+
+	// A truncated archive must not be cached with the digest of its partial
+	// content.
+	if err := digester.Close(); err != nil {
+		return "", nil, err
+	}
+
+	return digester.SumString(nil), digester.FileSums(), nil
 }
 
-func (b *Builder) loadCache() (err error) {
-	b.cache = map[string]string{}
+// logFileSums logs the checksum of each file of the given sources after a
+// cache miss so that comparing the debug output of two builds shows which file
+// changed.
+func logFileSums(srcPaths []string, fileSums map[string][]tarsum.FileSum) {
+	if log.GetLevel() < log.DebugLevel {
+		return
+	}
+
+	for _, srcPath := range srcPaths {
+		for _, fileSum := range fileSums[srcPath] {
+			log.Debugf("cache miss: %s: file %q has checksum %s", srcPath, fileSum.Name, fileSum.Sum)
+		}
+	}
+}
+
+// normalizeCommandString returns a form of the command for use in the cache
+// key which is unaffected by cosmetic changes: options are sorted by name and
+// runs of whitespace within arguments are collapsed to a single space.
+func normalizeCommandString(cmd string, flags instructionFlags, args []string) string {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	normalizedArgs := make([]string, 0, len(flags)+len(args))
+	for _, name := range names {
+		normalizedArgs = append(normalizedArgs, fmt.Sprintf("--%s=%s", name, flags[name]))
+	}
+
+	for _, arg := range args {
+		normalizedArgs = append(normalizedArgs, strings.Join(strings.Fields(arg), " "))
+	}
 
+	return makeCommandString(cmd, normalizedArgs...)
+}
+
+// normalizeHeredoc returns a form of the given heredoc for use in the cache key
+// which is unaffected by cosmetic changes: runs of whitespace are collapsed to
+// a single space, and blank lines and shell comments other than an initial
+// interpreter line are removed.
+func normalizeHeredoc(heredoc string) string {
+	var lines []string
+	for i, line := range strings.Split(heredoc, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+
+		if line == "" || (strings.HasPrefix(line, "#") && !(i == 0 && strings.HasPrefix(line, "#!"))) {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// cacheVersion is the version of the format of the build cache file.
+const cacheVersion = 1
+
+// versionedCache is the format of the build cache file, which maps cache keys
+// to image IDs. The first version of the file had only the entries.
+type versionedCache struct {
+	Version int               `json:"version"`
+	Entries map[string]string `json:"entries"`
+}
+
+// defaultCachePath returns the path to the build cache file in the current
+// user's home directory.
+func defaultCachePath() (string, error) {
 	usr, err := user.Current()
 	if err != nil {
-		return fmt.Errorf("unable to get current user: %s", err)
+		return "", fmt.Errorf("unable to get current user: %s", err)
 	}
 
-	cacheFilename := fmt.Sprintf("%s%c%s", usr.HomeDir, filepath.Separator, ".dockrampcache")
-	cacheFile, err := os.Open(cacheFilename)
-	if os.IsNotExist(err) {
-		// No cache file exists to load.
-		return nil
+	return fmt.Sprintf("%s%c%s", usr.HomeDir, filepath.Separator, ".dockrampcache"), nil
+}
+
+// cachePruner is a CacheBackend whose entries can be listed, so that those
+// whose images no longer exist can be removed.
+type cachePruner interface {
+	prune(client dockerclient.Client) (int, error)
+}
+
+// PruneCache removes the entries of the given build cache, as given to
+// NewCacheBackend, whose images no longer exist in the daemon at the given URL,
+// returning the number of entries removed. A cache kept by an HTTP server can't
+// be pruned as its entries can't be listed.
+func PruneCache(daemonURL string, tlsConfig *tls.Config, cacheSpec string) (int, error) {
+	client, err := dockerclient.NewDockerClient(daemonURL, tlsConfig)
+	if err != nil {
+		return 0, fmt.Errorf("unable to initialize client: %s", err)
 	}
+
+	cache, err := NewCacheBackend(cacheSpec)
 	if err != nil {
-		return fmt.Errorf("unable to open cache file: %s", err)
+		return 0, err
 	}
-	defer func() {
-		if closeErr := cacheFile.Close(); err == nil {
-			err = closeErr
+
+	pruner, ok := cache.(cachePruner)
+	if !ok {
+		return 0, fmt.Errorf("cache backend %q can't be pruned: only file and dir caches can be", cacheSpec)
+	}
+
+	return pruner.prune(client)
+}
+
+// imageExistence records whether images exist in the daemon, so that an image
+// with several cache entries is only inspected once.
+type imageExistence struct {
+	client dockerclient.Client
+	exists map[string]bool
+}
+
+func newImageExistence(client dockerclient.Client) *imageExistence {
+	return &imageExistence{client: client, exists: map[string]bool{}}
+}
+
+// check returns whether the image with the given ID exists.
+func (e *imageExistence) check(imageID string) (bool, error) {
+	if exists, ok := e.exists[imageID]; ok {
+		return exists, nil
+	}
+
+	_, err := e.client.InspectImage(imageID)
+	if err != nil && !isImageNotFound(err) {
+		return false, fmt.Errorf("unable to inspect image %s: %s", imageID, err)
+	}
+
+	e.exists[imageID] = err == nil
+
+	return err == nil, nil
+}
+
+// fileCache is a build cache kept in a JSON file, which is the default.
+type fileCache struct {
+	path    string
+	entries map[string]string
+}
+
+// newFileCache returns the build cache kept in the file at the given path,
+// which need not exist.
+func newFileCache(path string) (*fileCache, error) {
+	c := &fileCache{path: path}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *fileCache) Get(key string) (string, bool) {
+	imageID, ok := c.entries[key]
+	return imageID, ok
+}
+
+func (c *fileCache) Set(key, imageID string) error {
+	c.entries[key] = imageID
+
+	return c.save()
+}
+
+// prune removes the entries of the build cache whose images no longer exist
+// and saves the cache if any were removed.
+func (c *fileCache) prune(client dockerclient.Client) (int, error) {
+	lock, err := c.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+
+	if c.entries, err = c.read(); err != nil {
+		return 0, fmt.Errorf("unable to load build cache: %s", err)
+	}
+
+	images := newImageExistence(client)
+
+	removed := 0
+	for key, imageID := range c.entries {
+		exists, err := images.check(imageID)
+		if err != nil {
+			return 0, err
 		}
-	}()
 
-	if err := json.NewDecoder(cacheFile).Decode(&b.cache); err != nil {
-		return fmt.Errorf("unable to decode build cache: %s", err)
+		if !exists {
+			delete(c.entries, key)
+			removed++
+		}
 	}
 
-	return nil
+	if removed == 0 {
+		return 0, nil
+	}
+
+	// The cache is not merged with the file, which would restore the
+	// removed entries, but no other build can change it while it is
+	// locked.
+	if err := c.write(c.entries); err != nil {
+		return 0, err
+	}
+
+	return removed, nil
 }
 
-func (b *Builder) saveCache() (err error) {
-	usr, err := user.Current()
+// lock acquires an exclusive lock on the build cache so that builds which run
+// at the same time do not lose each other's entries. The lock is held on a
+// separate file as the cache file is replaced when it is saved.
+func (c *fileCache) lock() (*util.FileLock, error) {
+	lock, err := util.LockFile(c.path+".lock", nil)
 	if err != nil {
-		return fmt.Errorf("unable to get current user: %s", err)
+		return nil, fmt.Errorf("unable to lock build cache: %s", err)
 	}
 
-	cacheFilename := fmt.Sprintf("%s%c%s", usr.HomeDir, filepath.Separator, ".dockrampcache")
-	cacheFile, err := os.OpenFile(cacheFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0600))
+	return lock, nil
+}
+
+func (c *fileCache) load() (err error) {
+	lock, err := c.lock()
 	if err != nil {
-		return fmt.Errorf("unable to open cache file: %s", err)
+		return err
+	}
+	defer lock.Unlock()
+
+	c.entries, err = c.read()
+
+	return err
+}
+
+// save saves the entries of the build cache, along with any entries which were
+// saved by another build since the cache was loaded.
+func (c *fileCache) save() (err error) {
+	lock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	saved, err := c.read()
+	if err != nil {
+		return err
+	}
+
+	for key, imageID := range saved {
+		if _, ok := c.entries[key]; !ok {
+			c.entries[key] = imageID
+		}
+	}
+
+	return c.write(c.entries)
+}
+
+// read reads the entries of the build cache file, which must be locked.
+func (c *fileCache) read() (entries map[string]string, err error) {
+	cacheFile, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		// No cache file exists to load.
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open cache file: %s", err)
 	}
 	defer func() {
 		if closeErr := cacheFile.Close(); err == nil {
@@ -94,9 +385,49 @@ func (b *Builder) saveCache() (err error) {
 		}
 	}()
 
-	if err := json.NewEncoder(cacheFile).Encode(b.cache); err != nil {
+	var data json.RawMessage
+	if err := json.NewDecoder(cacheFile).Decode(&data); err != nil {
+		return nil, fmt.Errorf("unable to decode build cache: %s", err)
+	}
+
+	// The entries of an unversioned cache are ignored as unknown fields.
+	var cache versionedCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("unable to decode build cache: %s", err)
+	}
+
+	switch {
+	case cache.Version == 0:
+		// The cache was written without a version.
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("unable to decode unversioned build cache: %s", err)
+		}
+	case cache.Version > cacheVersion:
+		return nil, fmt.Errorf("unsupported build cache version %d: the newest supported version is %d", cache.Version, cacheVersion)
+	default:
+		entries = cache.Entries
+	}
+
+	if entries == nil {
+		entries = map[string]string{}
+	}
+
+	return entries, nil
+}
+
+// write replaces the build cache file, which must be locked, with the given
+// entries. The file is replaced by renaming a new file over it, so a build
+// which fails while writing it, such as when the disk is full, leaves the
+// previous cache intact.
+func (c *fileCache) write(entries map[string]string) error {
+	data, err := json.Marshal(versionedCache{Version: cacheVersion, Entries: entries})
+	if err != nil {
 		return fmt.Errorf("unable to encode build cache: %s", err)
 	}
 
+	if err := writeOutputFile(c.path, append(data, '\n'), os.FileMode(0600)); err != nil {
+		return fmt.Errorf("unable to write cache file: %s", err)
+	}
+
 	return nil
 }
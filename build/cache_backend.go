@@ -0,0 +1,199 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/samalba/dockerclient"
+)
+
+// CacheBackend stores the build cache, which maps cache keys to the IDs of the
+// images built for them. An image found in the cache is only used if it exists
+// in the daemon.
+type CacheBackend interface {
+	// Get returns the ID of the image with the given cache key, if any.
+	Get(key string) (imageID string, ok bool)
+	// Set records the ID of the image with the given cache key.
+	Set(key, imageID string) error
+}
+
+// NewCacheBackend returns the build cache given by spec, which is one of:
+//
+//	file:path       a JSON file, by default ~/.dockrampcache
+//	dir:path        a directory with a file for each entry
+//	http(s)://url   an HTTP server, to share the cache between machines
+func NewCacheBackend(spec string) (CacheBackend, error) {
+	switch {
+	case spec == "":
+		cachePath, err := defaultCachePath()
+		if err != nil {
+			return nil, fmt.Errorf("unable to locate build cache: %s", err)
+		}
+
+		return newFileCache(cachePath)
+	case strings.HasPrefix(spec, "file:"):
+		return newFileCache(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "dir:"):
+		return newDirCache(strings.TrimPrefix(spec, "dir:"))
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &httpCache{url: strings.TrimSuffix(spec, "/"), client: http.DefaultClient}, nil
+	default:
+		return nil, fmt.Errorf("invalid cache backend %q: must be file:path, dir:path, or an http or https URL", spec)
+	}
+}
+
+// SetCacheBackend sets the build cache used by the builder in place of the
+// build cache file of the current user.
+func (b *Builder) SetCacheBackend(cache CacheBackend) {
+	b.cache = cache
+}
+
+// dirCache is a build cache kept in a directory with a file for each entry,
+// named by its cache key and containing the image ID. The directory may be
+// shared by builds on several machines, such as on a network filesystem.
+type dirCache struct {
+	dir string
+}
+
+func newDirCache(dir string) (*dirCache, error) {
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return nil, fmt.Errorf("unable to create cache directory: %s", err)
+	}
+
+	return &dirCache{dir: dir}, nil
+}
+
+func (c *dirCache) Get(key string) (string, bool) {
+	imageID, err := ioutil.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("unable to read cache entry %s: %s", key, err)
+		}
+		return "", false
+	}
+
+	return strings.TrimSpace(string(imageID)), true
+}
+
+func (c *dirCache) Set(key, imageID string) error {
+	// The entry is renamed into place so that it is never read partially
+	// written.
+	tmpFile, err := ioutil.TempFile(c.dir, ".tmp-"+key)
+	if err != nil {
+		return fmt.Errorf("unable to create cache entry: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(imageID + "\n")
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write cache entry: %s", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), filepath.Join(c.dir, key)); err != nil {
+		return fmt.Errorf("unable to write cache entry: %s", err)
+	}
+
+	return nil
+}
+
+// prune removes the entries of the cache whose images no longer exist.
+func (c *dirCache) prune(client dockerclient.Client) (int, error) {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read cache directory: %s", err)
+	}
+
+	images := newImageExistence(client)
+
+	removed := 0
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".tmp-") {
+			// Not an entry, or one which is still being written.
+			continue
+		}
+
+		imageID, ok := c.Get(file.Name())
+		if !ok {
+			continue
+		}
+
+		exists, err := images.check(imageID)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(c.dir, file.Name())); err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("unable to remove cache entry: %s", err)
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// httpCache is a build cache kept by an HTTP server. The entry with a cache
+// key is at the URL of the cache followed by `/key`: a GET returns the image
+// ID, or 404 Not Found if there is none, and a PUT stores it.
+type httpCache struct {
+	url    string
+	client *http.Client
+}
+
+func (c *httpCache) Get(key string) (string, bool) {
+	resp, err := c.client.Get(c.url + "/" + key)
+	if err != nil {
+		log.Warnf("unable to get cache entry %s: %s", key, err)
+		return "", false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode != http.StatusNotFound {
+			log.Warnf("unable to get cache entry %s: request failed with status code %d", key, resp.StatusCode)
+		}
+		return "", false
+	}
+
+	imageID, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Warnf("unable to read cache entry %s: %s", key, err)
+		return "", false
+	}
+
+	return strings.TrimSpace(string(imageID)), true
+}
+
+func (c *httpCache) Set(key, imageID string) error {
+	req, err := http.NewRequest("PUT", c.url+"/"+key, strings.NewReader(imageID))
+	if err != nil {
+		return fmt.Errorf("unable to create cache request: %s", err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to set cache entry: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		// Read the body if possible. Unlike the daemon, a cache server
+		// may not send a Content-Length.
+		body, _ := ioutil.ReadAll(resp.Body) // It's okay if this fails.
+
+		return fmt.Errorf("request failed with status code %d: %s", resp.StatusCode, body)
+	}
+
+	return nil
+}
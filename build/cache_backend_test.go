@@ -0,0 +1,216 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestNewCacheBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockramp-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for spec, expected := range map[string]string{
+		"file:" + dir + "/cache":    "*build.fileCache",
+		"dir:" + dir + "/entries":   "*build.dirCache",
+		"http://cache.example.com/": "*build.httpCache",
+		"https://cache.example.com": "*build.httpCache",
+	} {
+		cache, err := NewCacheBackend(spec)
+		if err != nil {
+			t.Fatalf("unable to create cache backend %q: %s", spec, err)
+		}
+		if backend := fmt.Sprintf("%T", cache); backend != expected {
+			t.Errorf("expected %s for %q, got %s", expected, spec, backend)
+		}
+	}
+
+	if _, err := NewCacheBackend("s3://bucket"); err == nil || !strings.Contains(err.Error(), "invalid cache backend") {
+		t.Fatalf("expected an invalid cache backend error, got %v", err)
+	}
+}
+
+// testCacheBackend checks that entries set in the given cache can be gotten
+// from it.
+func testCacheBackend(t *testing.T, cache CacheBackend) {
+	if _, ok := cache.Get("key1"); ok {
+		t.Fatal("expected a cache miss for a new cache")
+	}
+
+	for key, imageID := range map[string]string{"key1": "image1", "key2": "image2"} {
+		if err := cache.Set(key, imageID); err != nil {
+			t.Fatalf("unable to set %s: %s", key, err)
+		}
+	}
+	if err := cache.Set("key1", "image3"); err != nil {
+		t.Fatalf("unable to replace key1: %s", err)
+	}
+
+	for key, expected := range map[string]string{"key1": "image3", "key2": "image2"} {
+		if imageID, ok := cache.Get(key); !ok || imageID != expected {
+			t.Errorf("expected %s for %s, got %q, %t", expected, key, imageID, ok)
+		}
+	}
+}
+
+func TestDirCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockramp-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := newDirCache(dir + "/entries")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCacheBackend(t, cache)
+}
+
+func TestPruneCacheBackend(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("kept", &dockerclient.ImageInfo{Id: "kept-id"})
+
+	entries := d.dir + "/entries"
+	cache, err := newDirCache(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, imageID := range map[string]string{"a": "kept-id", "b": "removed-id", "c": "removed-id"} {
+		if err := cache.Set(key, imageID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := PruneCache(d.URL, nil, "dir:"+entries)
+	if err != nil {
+		t.Fatalf("unable to prune cache: %s", err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 entries to be removed, got %d", removed)
+	}
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": false} {
+		if _, ok := cache.Get(key); ok != expected {
+			t.Errorf("expected entry %s to be kept: %t, got %t", key, expected, ok)
+		}
+	}
+
+	// The entries of a cache kept by an HTTP server can't be listed.
+	if _, err := PruneCache(d.URL, nil, "http://cache.example.com"); err == nil || !strings.Contains(err.Error(), "can't be pruned") {
+		t.Fatalf("expected an error for an HTTP cache, got %v", err)
+	}
+}
+
+func TestHTTPCache(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		entries = map[string]string{}
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		key := strings.TrimPrefix(r.URL.Path, "/cache/")
+		switch r.Method {
+		case "GET":
+			imageID, ok := entries[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(imageID))
+		case "PUT":
+			imageID, _ := ioutil.ReadAll(r.Body)
+			entries[key] = string(imageID)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	cache, err := NewCacheBackend(server.URL + "/cache/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCacheBackend(t, cache)
+
+	// The cache misses if the server cannot be reached, and setting an
+	// entry fails.
+	server.Close()
+	if _, ok := cache.Get("key1"); ok {
+		t.Fatal("expected a cache miss when the server cannot be reached")
+	}
+	if err := cache.Set("key1", "image1"); err == nil {
+		t.Fatal("expected an error when the server cannot be reached")
+	}
+}
+
+func TestHTTPCacheChunkedError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before writing the body sends it chunked, without a
+		// Content-Length.
+		w.WriteHeader(http.StatusInternalServerError)
+		w.(http.Flusher).Flush()
+		w.Write([]byte("cache unavailable"))
+	}))
+	defer server.Close()
+
+	cache, err := NewCacheBackend(server.URL + "/cache/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.Set("key1", "image1")
+	if err == nil || !strings.Contains(err.Error(), "status code 500: cache unavailable") {
+		t.Fatalf("expected the failed request to be reported, got %v", err)
+	}
+}
+
+func TestBuildWithCacheBackend(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	cache, err := newDirCache(d.dir + "/shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{"Dockerfile": "FROM base\nCOPY file /file\n", "file": "content"}
+
+	first := d.newBuilder(t, files, "")
+	first.SetCacheBackend(cache)
+	if err := first.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	// A build on another machine would not have the same cache file, but
+	// shares the cache directory.
+	numImages := d.numImages
+	second := d.newBuilder(t, files, "")
+	second.cache = &fileCache{path: d.dir + "/other", entries: map[string]string{}}
+	second.SetCacheBackend(cache)
+	if err := second.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	if second.ImageID() != first.ImageID() || d.numImages != numImages {
+		t.Fatalf("expected cached image %s, got %s", first.ImageID(), second.ImageID())
+	}
+}
@@ -0,0 +1,409 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestCacheIgnoreNextAnnotation(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"a": "aaaa",
+	}
+
+	build := func(dockerfile string) int {
+		files["Dockerfile"] = dockerfile
+		b := d.newBuilder(t, files, "")
+
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b.stats.cacheHits
+	}
+
+	const annotated = "FROM base\n# dockramp:cache-ignore-next\nCOPY --chown=1000 --chmod=0644 a /a\nLABEL foo bar\n"
+
+	if hits := build(annotated); hits != 0 {
+		t.Fatalf("expected no cache hits on the first build, got %d", hits)
+	}
+
+	// Reordering the options and respacing arguments is cosmetic.
+	cosmetic := "FROM base\n# dockramp:cache-ignore-next\nCOPY --chmod=0644 --chown=1000 a /a\nLABEL foo bar\n"
+	if hits := build(cosmetic); hits != 2 {
+		t.Fatalf("expected a cosmetic change to hit the cache for both steps, got %d hits", hits)
+	}
+
+	// Changing an option value is not.
+	semantic := "FROM base\n# dockramp:cache-ignore-next\nCOPY --chmod=0600 --chown=1000 a /a\nLABEL foo bar\n"
+	if hits := build(semantic); hits != 0 {
+		t.Fatalf("expected a semantic change to miss the cache, got %d hits", hits)
+	}
+
+	// Without the annotation, a cosmetic change also misses the cache.
+	build("FROM base\nCOPY --chown=1000 --chmod=0640 a /a\n")
+	if hits := build("FROM base\nCOPY --chmod=0640 --chown=1000 a /a\n"); hits != 0 {
+		t.Fatalf("expected a cosmetic change to miss the cache without the annotation, got %d hits", hits)
+	}
+}
+
+func TestUnknownAnnotation(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	b := d.newBuilder(t, map[string]string{
+		"Dockerfile": "FROM base\n# dockramp:no-such-thing\nLABEL foo=bar\n",
+	}, "")
+
+	if err := b.Run(); err == nil {
+		t.Fatal("expected an error for an unknown annotation")
+	}
+}
+
+func TestNormalizeHeredoc(t *testing.T) {
+	testCases := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"set -e\napt-get  update\n", "set -e\n\n  apt-get update   \n", true},
+		{"set -e\n# update the index\napt-get update\n", "set -e\napt-get update\n", true},
+		{"#!/bin/bash\necho hi\n", "#!/bin/sh\necho hi\n", false},
+		{"apt-get update\n", "apt-get upgrade\n", false},
+	}
+
+	for _, tc := range testCases {
+		if equal := normalizeHeredoc(tc.a) == normalizeHeredoc(tc.b); equal != tc.equal {
+			t.Errorf("normalized %q and %q: expected equal to be %t", tc.a, tc.b, tc.equal)
+		}
+	}
+}
+
+func TestCacheMissAfterEnvChange(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	build := func(value string) *Builder {
+		files := map[string]string{
+			"Dockerfile": "FROM base\nENV VERSION " + value + "\nCOPY file /file\nRUN make\n",
+			"file":       "content",
+		}
+
+		b := d.newBuilder(t, files, "")
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b
+	}
+
+	first := build("1")
+	if len(d.runs) != 1 {
+		t.Fatalf("expected 1 run, got %d", len(d.runs))
+	}
+	if env := d.runs[0].env; env[len(env)-1] != "VERSION=1" {
+		t.Fatalf("expected the RUN environment to end with VERSION=1, got %q", env)
+	}
+
+	if again := build("1"); again.ImageID() != first.ImageID() || len(d.runs) != 1 {
+		t.Fatalf("expected cached image %s without running again, got %s after %d runs", first.ImageID(), again.ImageID(), len(d.runs))
+	}
+
+	// Changing the ENV value is a cache miss for the following COPY and
+	// RUN.
+	numImages := d.numImages
+	if changed := build("2"); changed.ImageID() == first.ImageID() || len(d.runs) != 2 {
+		t.Fatalf("expected a new image after changing the ENV, got %s after %d runs", changed.ImageID(), len(d.runs))
+	}
+	if d.numImages != numImages+2 {
+		t.Fatalf("expected 2 new images after changing the ENV, got %d", d.numImages-numImages)
+	}
+}
+
+func TestCacheMissAfterBaseImageUpdate(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addRegistryImage("base", &dockerclient.ImageInfo{Id: "base-v1", Config: &dockerclient.ContainerConfig{}})
+
+	build := func(pull bool) *Builder {
+		files := map[string]string{
+			"Dockerfile": "FROM base\nENV VERSION 1\nRUN make\nCOPY file /file\n",
+			"file":       "content",
+		}
+
+		b := d.newBuilder(t, files, "")
+		b.SetPull(pull)
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b
+	}
+
+	first := build(false)
+
+	// The base image is updated in the registry.
+	d.addRegistryImage("base", &dockerclient.ImageInfo{Id: "base-v2", Config: &dockerclient.ContainerConfig{}})
+
+	// Without -pull, the local base image and the cache are used.
+	if again := build(false); again.ImageID() != first.ImageID() || len(d.runs) != 1 {
+		t.Fatalf("expected cached image %s, got %s after %d runs", first.ImageID(), again.ImageID(), len(d.runs))
+	}
+
+	// With -pull, the new base image misses the cache of every step.
+	numImages := d.numImages
+	pulled := build(true)
+	if pulled.ImageID() == first.ImageID() || len(d.runs) != 2 {
+		t.Fatalf("expected a new image after pulling the base, got %s after %d runs", pulled.ImageID(), len(d.runs))
+	}
+	if d.numImages != numImages+2 {
+		t.Fatalf("expected 2 new images after pulling the base, got %d", d.numImages-numImages)
+	}
+	if parent := d.images[d.images[pulled.ImageID()].Parent].Parent; parent != "base-v2" {
+		t.Fatalf("expected the image to be built on base-v2, got %s", parent)
+	}
+
+	// Pulling again finds the same base image, so the cache is used.
+	if again := build(true); again.ImageID() != pulled.ImageID() || len(d.runs) != 2 {
+		t.Fatalf("expected cached image %s, got %s after %d runs", pulled.ImageID(), again.ImageID(), len(d.runs))
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("kept", &dockerclient.ImageInfo{Id: "kept-id"})
+
+	cache := &fileCache{
+		path:    filepath.Join(d.dir, "cache"),
+		entries: map[string]string{"a": "kept-id", "b": "removed-id", "c": "removed-id", "d": "kept-id"},
+	}
+	if err := cache.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := d.builder(t).client
+	removed, err := cache.prune(client)
+	if err != nil {
+		t.Fatalf("unable to prune cache: %s", err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 entries to be removed, got %d", removed)
+	}
+
+	if err := cache.load(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"a": "kept-id", "d": "kept-id"}; !reflect.DeepEqual(cache.entries, expected) {
+		t.Fatalf("expected cache %v after pruning, got %v", expected, cache.entries)
+	}
+
+	// The cache is kept if the daemon cannot be reached.
+	d.Server.Close()
+	if _, err := cache.prune(client); err == nil {
+		t.Fatal("expected an error when the daemon cannot be reached")
+	}
+	if err := cache.load(); err != nil || len(cache.entries) != 2 {
+		t.Fatalf("expected the cache to be kept, got %v, %v", cache.entries, err)
+	}
+}
+
+// tempCachePath returns the path of a build cache file in a new temporary
+// directory, which is removed by the returned function.
+func tempCachePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "dockramp-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "cache"), func() { os.RemoveAll(dir) }
+}
+
+func TestCacheFileVersion(t *testing.T) {
+	cachePath, cleanup := tempCachePath(t)
+	defer cleanup()
+
+	for _, test := range []struct {
+		content string
+		cache   map[string]string
+		err     string
+	}{
+		// The unversioned format is still read.
+		{`{"key1":"image1","key2":"image2"}`, map[string]string{"key1": "image1", "key2": "image2"}, ""},
+		{`{"version":1,"entries":{"key1":"image1"}}`, map[string]string{"key1": "image1"}, ""},
+		{`{"version":1}`, map[string]string{}, ""},
+		{`null`, map[string]string{}, ""},
+		{`{"version":2,"entries":{}}`, nil, "unsupported build cache version 2"},
+		{`{"key1":1}`, nil, "unable to decode unversioned build cache"},
+	} {
+		if err := ioutil.WriteFile(cachePath, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		cache, err := newFileCache(cachePath)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error containing %q for %s, got %v", test.err, test.content, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unable to load cache %s: %s", test.content, err)
+		}
+		if !reflect.DeepEqual(cache.entries, test.cache) {
+			t.Errorf("expected cache %v for %s, got %v", test.cache, test.content, cache.entries)
+		}
+	}
+
+	// The cache is always saved with a version.
+	os.Remove(cachePath)
+	cache, err := newFileCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("key1", "image1"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"version":1,"entries":{"key1":"image1"}}` + "\n"; string(content) != expected {
+		t.Fatalf("expected cache file %q, got %q", expected, content)
+	}
+}
+
+func TestCacheFileReplaced(t *testing.T) {
+	cachePath, cleanup := tempCachePath(t)
+	defer cleanup()
+
+	cache, err := newFileCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("key1", "image1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader of the cache file sees the whole of the cache it opened,
+	// even if the cache is saved while it reads.
+	reader, err := os.Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if err := cache.Set("key2", "image2"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"version":1,"entries":{"key1":"image1"}}` + "\n"; string(content) != expected {
+		t.Fatalf("expected the open cache file to be unchanged, got %q", content)
+	}
+
+	info, err := os.Stat(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("expected the cache file to have mode 0600, got %o", mode)
+	}
+
+	// No temporary file is left beside the cache and its lock.
+	names, err := filepath.Glob(filepath.Join(filepath.Dir(cachePath), "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("expected only the cache file and its lock, got %q", names)
+	}
+}
+
+func TestSaveCacheMergesConcurrentBuilds(t *testing.T) {
+	cachePath, cleanup := tempCachePath(t)
+	defer cleanup()
+
+	// Both builds load the cache before either saves it.
+	first, err := newFileCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newFileCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Set("key1", "image1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Set("key2", "image2"); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := newFileCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"key1": "image1", "key2": "image2"}; !reflect.DeepEqual(cache.entries, expected) {
+		t.Fatalf("expected cache %v with the entries of both builds, got %v", expected, cache.entries)
+	}
+}
+
+func TestTarsumVersion(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{"Dockerfile": "FROM base\nCOPY a /a\n", "a": "a"}
+
+	build := func(version string) *Builder {
+		b := d.newBuilder(t, files, "")
+		if err := b.SetTarsumVersion(version); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b
+	}
+
+	v1 := build("")
+	if again := build("v1"); again.ImageID() != v1.ImageID() {
+		t.Fatalf("expected cached image %s, got %s", v1.ImageID(), again.ImageID())
+	}
+
+	// A layer cached with one version is not found with another.
+	v2 := build("v2")
+	if v2.ImageID() == v1.ImageID() {
+		t.Fatal("expected a new image with another tarsum version")
+	}
+	if again := build("v2"); again.ImageID() != v2.ImageID() {
+		t.Fatalf("expected cached image %s, got %s", v2.ImageID(), again.ImageID())
+	}
+
+	if err := d.newBuilder(t, files, "").SetTarsumVersion("v3"); err == nil || !strings.Contains(err.Error(), `unknown tarsum version "v3"`) {
+		t.Fatalf("expected an error for an unknown version, got %v", err)
+	}
+}
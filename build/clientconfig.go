@@ -0,0 +1,142 @@
+package build
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultDockerSocket       = "unix:///var/run/docker.sock"
+	defaultConfigDir          = "$HOME/.docker"
+	defaultCACertFilename     = "ca.pem"
+	defaultClientCertFilename = "cert.pem"
+	defaultClientKeyFilename  = "key.pem"
+)
+
+// DockerConfigDir returns the Docker config directory given by the
+// DOCKER_CONFIG environment variable, or ~/.docker if it is not set.
+func DockerConfigDir() string {
+	if configDir := os.Getenv("DOCKER_CONFIG"); configDir != "" {
+		return configDir
+	}
+
+	return os.ExpandEnv(defaultConfigDir)
+}
+
+// TLSOptions configure the TLS connection to the daemon, as with the TLS
+// flags of the docker CLI. Certificate files which are not given default to
+// those in the cert directory, if they exist.
+type TLSOptions struct {
+	// UseTLS connects to the daemon with TLS without verifying the server
+	// certificate, unless VerifyTLS is also set.
+	UseTLS bool
+	// VerifyTLS connects to the daemon with TLS and verifies the server
+	// certificate.
+	VerifyTLS bool
+
+	CACertFile, ClientCertFile, ClientKeyFile string
+}
+
+// ClientConfigFromEnv returns the TLS config and URL for connecting to the
+// daemon, as the docker CLI would. The URL defaults to DOCKER_HOST, then to
+// the local daemon socket. The TLS config is nil if TLS was not asked for
+// with opts or DOCKER_TLS_VERIFY. TLS certificates are read from
+// DOCKER_CERT_PATH, then from the Docker config directory.
+func ClientConfigFromEnv(daemonURL string, opts TLSOptions) (*tls.Config, string, error) {
+	// The given URL takes preference, then fallback to environment var,
+	// then fallback to default.
+	if daemonURL == "" {
+		if daemonURL = os.Getenv("DOCKER_HOST"); daemonURL == "" {
+			daemonURL = defaultDockerSocket
+		}
+	}
+
+	tlsConfig, err := loadTLSConfig(opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return tlsConfig, daemonURL, nil
+}
+
+// loadTLSConfig returns the TLS config for connecting to the daemon, or nil
+// if TLS was not asked for.
+func loadTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	verifyTLS := opts.VerifyTLS || os.Getenv("DOCKER_TLS_VERIFY") != ""
+	if !opts.UseTLS && !verifyTLS {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !verifyTLS,
+	}
+
+	// Get the cert path specified by environment variable or default
+	// to the Docker config directory, as the docker CLI does.
+	certDir := os.Getenv("DOCKER_CERT_PATH")
+	if certDir == "" {
+		certDir = DockerConfigDir()
+	}
+	certDir = os.ExpandEnv(certDir)
+
+	// Get CA cert bundle.
+	if opts.CACertFile == "" { // Not given.
+		// If the CA cert bundle does not exist in the default location,
+		// the system default root CAs are used instead.
+		opts.CACertFile = defaultCertFile(certDir, defaultCACertFilename)
+	}
+
+	if opts.CACertFile != "" {
+		certBytes, err := ioutil.ReadFile(opts.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca cert file: %s", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(certBytes) {
+			return nil, fmt.Errorf("unable to load ca cert file")
+		}
+	}
+
+	// Get client cert and key.
+	if opts.ClientCertFile == "" { // Not given.
+		opts.ClientCertFile = defaultCertFile(certDir, defaultClientCertFilename)
+	}
+	if opts.ClientKeyFile == "" { // Not given.
+		opts.ClientKeyFile = defaultCertFile(certDir, defaultClientKeyFilename)
+	}
+
+	// If one of client cert/key is specified then both must be.
+	certSpecified := opts.ClientCertFile != ""
+	keySpecified := opts.ClientKeyFile != ""
+	if certSpecified != keySpecified {
+		return nil, fmt.Errorf("must specify both client certificate and key")
+	}
+
+	// If both are specified, load them into the tls config.
+	if certSpecified && keySpecified {
+		tlsClientCert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client cert/key pair: %s", err)
+		}
+
+		tlsConfig.Certificates = append(tlsConfig.Certificates, tlsClientCert)
+	}
+
+	return tlsConfig, nil
+}
+
+// defaultCertFile returns the path of the named file in the cert directory,
+// or an empty string if it does not exist.
+func defaultCertFile(certDir, filename string) string {
+	path := filepath.Join(certDir, filename)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ""
+	}
+
+	return path
+}
@@ -0,0 +1,140 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setClientEnv sets the environment variables used to connect to the daemon,
+// unsetting those which are not given, and returns a function which restores
+// them.
+func setClientEnv(values map[string]string) func() {
+	var restore []func()
+	for _, name := range []string{"DOCKER_HOST", "DOCKER_TLS_VERIFY", "DOCKER_CERT_PATH", "DOCKER_CONFIG"} {
+		name := name
+		if value, ok := os.LookupEnv(name); ok {
+			restore = append(restore, func() { os.Setenv(name, value) })
+		} else {
+			restore = append(restore, func() { os.Unsetenv(name) })
+		}
+
+		if value, ok := values[name]; ok {
+			os.Setenv(name, value)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+
+	return func() {
+		for _, fn := range restore {
+			fn()
+		}
+	}
+}
+
+func TestClientConfigFromEnv(t *testing.T) {
+	emptyDir, err := ioutil.TempDir("", "dockramp-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(emptyDir)
+
+	for _, test := range []struct {
+		opts       TLSOptions
+		env        map[string]string
+		useTLS     bool
+		skipVerify bool
+	}{
+		{TLSOptions{}, nil, false, false},
+		{TLSOptions{UseTLS: true}, nil, true, true},
+		{TLSOptions{VerifyTLS: true}, nil, true, false},
+		{TLSOptions{UseTLS: true, VerifyTLS: true}, nil, true, false},
+		{TLSOptions{}, map[string]string{"DOCKER_TLS_VERIFY": "1"}, true, false},
+		{TLSOptions{UseTLS: true}, map[string]string{"DOCKER_TLS_VERIFY": "1"}, true, false},
+		{TLSOptions{}, map[string]string{"DOCKER_TLS_VERIFY": ""}, false, false},
+		// Cert files are not read unless TLS is used.
+		{TLSOptions{CACertFile: "/nonexistent/ca.pem"}, nil, false, false},
+	} {
+		env := map[string]string{"DOCKER_CERT_PATH": emptyDir}
+		for name, value := range test.env {
+			env[name] = value
+		}
+		restore := setClientEnv(env)
+
+		tlsConfig, _, err := ClientConfigFromEnv("", test.opts)
+		restore()
+		if err != nil {
+			t.Fatalf("unable to load TLS config for %+v with env %v: %s", test.opts, test.env, err)
+		}
+
+		if (tlsConfig != nil) != test.useTLS {
+			t.Errorf("expected TLS to be used (%t) for %+v with env %v, got %v", test.useTLS, test.opts, test.env, tlsConfig)
+			continue
+		}
+		if tlsConfig != nil && tlsConfig.InsecureSkipVerify != test.skipVerify {
+			t.Errorf("expected InsecureSkipVerify %t for %+v with env %v", test.skipVerify, test.opts, test.env)
+		}
+	}
+}
+
+func TestClientConfigDaemonURL(t *testing.T) {
+	for _, test := range []struct {
+		daemonURL, dockerHost, expected string
+	}{
+		{"", "", "unix:///var/run/docker.sock"},
+		{"", "tcp://docker:2375", "tcp://docker:2375"},
+		{"unix:///tmp/docker.sock", "tcp://docker:2375", "unix:///tmp/docker.sock"},
+	} {
+		restore := setClientEnv(map[string]string{"DOCKER_HOST": test.dockerHost})
+		_, daemonURL, err := ClientConfigFromEnv(test.daemonURL, TLSOptions{})
+		restore()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if daemonURL != test.expected {
+			t.Errorf("expected daemon URL %s for %q with DOCKER_HOST %q, got %s", test.expected, test.daemonURL, test.dockerHost, daemonURL)
+		}
+	}
+}
+
+func TestClientConfigCertDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockramp-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certDir := filepath.Join(dir, "certs")
+	configDir := filepath.Join(dir, "config")
+	for _, path := range []string{filepath.Join(certDir, "cert.pem"), filepath.Join(configDir, "ca.pem")} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("invalid"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		opts     TLSOptions
+		env      map[string]string
+		expected string
+	}{
+		// DOCKER_CERT_PATH takes precedence over DOCKER_CONFIG.
+		{TLSOptions{VerifyTLS: true}, map[string]string{"DOCKER_CERT_PATH": certDir, "DOCKER_CONFIG": configDir}, "must specify both client certificate and key"},
+		{TLSOptions{VerifyTLS: true}, map[string]string{"DOCKER_CONFIG": configDir}, "unable to load ca cert file"},
+		{TLSOptions{VerifyTLS: true, CACertFile: filepath.Join(dir, "missing.pem")}, map[string]string{"DOCKER_CERT_PATH": certDir}, "unable to read ca cert file"},
+	} {
+		restore := setClientEnv(test.env)
+		_, _, err := ClientConfigFromEnv("", test.opts)
+		restore()
+
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("expected error containing %q for %+v with env %v, got %v", test.expected, test.opts, test.env, err)
+		}
+	}
+}
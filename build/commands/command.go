@@ -4,6 +4,7 @@ package commands
 // List of Dockerfile commands.
 const (
 	Add        = "ADD"
+	Arg        = "ARG"
 	Cmd        = "CMD"
 	Copy       = "COPY"
 	Entrypoint = "ENTRYPOINT"
@@ -23,6 +24,7 @@ const (
 // Commands is a set of all Dockerfile commands.
 var Commands = map[string]struct{}{
 	Add:        {},
+	Arg:        {},
 	Cmd:        {},
 	Copy:       {},
 	Entrypoint: {},
@@ -39,6 +41,22 @@ var Commands = map[string]struct{}{
 	Workdir:    {},
 }
 
+// Flags is the set of options accepted by each command which takes options.
+// Options are given as `--name=value` arguments before any positional
+// arguments. Commands which are not listed here take no options.
+var Flags = map[string]map[string]struct{}{
+	Copy: {
+		"chmod": {},
+		"chown": {},
+		"from":  {},
+	},
+	Run: {
+		"check":   {},
+		"mount":   {},
+		"network": {},
+	},
+}
+
 // FilesystemModifierCommands is a subset of commands that typically modify the
 // filesystem of a container and require a commit.
 var FilesystemModifierCommands = map[string]struct{}{
@@ -52,6 +70,7 @@ var FilesystemModifierCommands = map[string]struct{}{
 // interpolation will happen.
 var ReplaceEnvAllowed = map[string]struct{}{
 	Add:     {},
+	Arg:     {},
 	Copy:    {},
 	Env:     {},
 	Expose:  {},
@@ -61,3 +80,17 @@ var ReplaceEnvAllowed = map[string]struct{}{
 	Volume:  {},
 	Workdir: {},
 }
+
+// List of annotations. An annotation is given as a `# dockramp:name` comment
+// and applies to the command which follows it.
+const (
+	// CacheIgnoreNext causes the build cache to use a normalized form of
+	// the next command so that cosmetic changes to it do not cause a cache
+	// miss.
+	CacheIgnoreNext = "cache-ignore-next"
+)
+
+// Annotations is a set of all annotations.
+var Annotations = map[string]struct{}{
+	CacheIgnoreNext: {},
+}
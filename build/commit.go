@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -15,6 +16,27 @@ type containerCommitResponse struct {
 	ID string `json:"Id"`
 }
 
+// SetNoComment sets whether images are committed with an empty comment rather
+// than the commands of each layer, which may reveal details of the build such
+// as the paths of copied files. The commands are still used as the cache key
+// of the layer.
+func (b *Builder) SetNoComment(noComment bool) {
+	b.noComment = noComment
+}
+
+// layerComment returns the commands which create the uncommitted layer, as
+// they are printed in the build output.
+func (b *Builder) layerComment() string {
+	return strings.Join(b.layerCommands, "; ")
+}
+
+// nopCommand returns the command of a container which is only created to be
+// committed. It is not run, but like the container of a RUN command it is
+// shown by `docker history` as the command which created the layer.
+func (b *Builder) nopCommand() []string {
+	return []string{"#(nop) " + b.layerComment()}
+}
+
 func (b *Builder) commit() error {
 	log.Debugf("committing container: %s", b.containerID)
 
@@ -22,18 +44,20 @@ func (b *Builder) commit() error {
 		return fmt.Errorf("no container to commit")
 	}
 
-	// Encode the uncommited commands as a JSON array to use as a comment.
-	comment, err := json.Marshal(b.uncommittedCommands)
-	if err != nil {
-		return fmt.Errorf("unable to encode comment for commit: %s", err)
-	}
-
-	query := make(url.Values, 2)
+	query := make(url.Values, 3)
 	query.Set("container", b.containerID)
 	query.Set("author", b.maintainer)
-	query.Set("comment", string(comment))
 
-	data, err := json.Marshal(b.config.toDocker())
+	if !b.noComment {
+		query.Set("comment", b.layerComment())
+	}
+
+	// ENV never sets a variable twice, but the environment is normalized
+	// anyway so that no image is committed with more than one value for a
+	// variable, which runtimes handle inconsistently.
+	b.config.Env = dedupeEnv(b.config.Env)
+
+	data, err := b.commitConfig()
 	if err != nil {
 		return fmt.Errorf("unable to encode config: %s", err)
 	}
@@ -46,7 +70,7 @@ func (b *Builder) commit() error {
 
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := b.client.HTTPClient.Do(req)
+	resp, err := b.doDaemonRequest(req, false)
 	if err != nil {
 		return fmt.Errorf("unable to make request: %s", err)
 	}
@@ -65,7 +89,7 @@ func (b *Builder) commit() error {
 		return fmt.Errorf("unable to decode commit response: %s", err)
 	}
 
-	if err := b.client.RemoveContainer(b.containerID, true, true); err != nil {
+	if err := b.removeContainer(b.containerID); err != nil {
 		return fmt.Errorf("unable to remove container: %s", err)
 	}
 
@@ -74,8 +98,11 @@ func (b *Builder) commit() error {
 	}
 
 	b.imageID = commitResponse.ID
+	b.committedImages = append(b.committedImages, b.imageID)
+	b.stats.layers++
+	b.recordCache(stepCacheMiss)
 
-	fmt.Fprintf(b.out, " ---> %s\n", b.imageID)
+	b.observe().OnCommit(b.imageID)
 
 	b.uncommitted = false
 	b.uncommittedCommands = nil
@@ -0,0 +1,88 @@
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestNoComment(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{"Dockerfile": "FROM base\nCOPY file /file\n", "file": "content"}
+
+	build := func(noComment bool) *Builder {
+		b := d.newBuilder(t, files, "")
+		b.SetNoComment(noComment)
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b
+	}
+
+	b := build(true)
+	if comment := d.images[b.ImageID()].Comment; comment != "" {
+		t.Fatalf("expected an empty comment, got %q", comment)
+	}
+
+	// The cache key still includes the commands, so the image is found in
+	// the cache by a build with comments.
+	numImages := d.numImages
+	if again := build(false); again.ImageID() != b.ImageID() || d.numImages != numImages {
+		t.Fatalf("expected cached image %s, got %s", b.ImageID(), again.ImageID())
+	}
+
+	files["file"] = "changed"
+	changed := build(false)
+	if comment := d.images[changed.ImageID()].Comment; comment != "COPY file /file" {
+		t.Fatalf("expected the command in the comment, got %q", comment)
+	}
+}
+
+func TestLayerHistory(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	b := d.newBuilder(t, map[string]string{
+		"Dockerfile": "FROM base\nENV a=1\nCOPY file /file\nRUN make\nRUN make install\nCMD [\"sh\"]\nLABEL b=2\n",
+		"file":       "content",
+	}, "")
+	b.SetCompressRuns(true)
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	type entry struct {
+		createdBy, comment string
+	}
+
+	// Each image is created by the command of its layer, not by the
+	// commands before it.
+	expected := []entry{
+		{"#(nop) COPY file /file", "COPY file /file"},
+		{"", "RUN make; RUN make install"},
+		{"#(nop) LABEL b=2", "LABEL b=2"},
+	}
+
+	var history []entry
+	for id := b.ImageID(); id != "base-id"; id = d.images[id].Parent {
+		image := d.images[id]
+		var createdBy string
+		if cmd := image.ContainerConfig.Cmd; len(cmd) == 1 && strings.HasPrefix(cmd[0], "#(nop)") {
+			createdBy = cmd[0]
+		}
+		history = append([]entry{{createdBy, image.Comment}}, history...)
+	}
+
+	if !reflect.DeepEqual(history, expected) {
+		t.Fatalf("expected history %q, got %q", expected, history)
+	}
+}
@@ -0,0 +1,96 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/samalba/dockerclient"
+)
+
+// SetConfigPatch sets a JSON object which is merged into the config of every
+// image committed by the build, as described by RFC 7386. This allows setting
+// config fields which have no Dockerfile command, such as OnBuild or Shell.
+func (b *Builder) SetConfigPatch(patch []byte) error {
+	var patchObj map[string]interface{}
+	if err := json.Unmarshal(patch, &patchObj); err != nil {
+		return fmt.Errorf("invalid config patch: must be a JSON object: %s", err)
+	}
+
+	// Check that the patch results in a valid config.
+	if _, err := applyConfigPatch(&dockerclient.ContainerConfig{}, patchObj); err != nil {
+		return err
+	}
+
+	// Encoding a map sorts its keys, which makes this suitable for the
+	// cache key.
+	canonical, err := json.Marshal(patchObj)
+	if err != nil {
+		return fmt.Errorf("unable to encode config patch: %s", err)
+	}
+
+	b.configPatch = patchObj
+	b.configPatchString = string(canonical)
+
+	return nil
+}
+
+// commitConfig returns the encoded config to commit an image with.
+func (b *Builder) commitConfig() ([]byte, error) {
+	if b.configPatch == nil {
+		return json.Marshal(b.config.toDocker())
+	}
+
+	return applyConfigPatch(b.config.toDocker(), b.configPatch)
+}
+
+// applyConfigPatch returns the encoding of the given config with the given
+// patch merged into it.
+func applyConfigPatch(config *dockerclient.ContainerConfig, patch map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode config: %s", err)
+	}
+
+	var configObj interface{}
+	if err := json.Unmarshal(data, &configObj); err != nil {
+		return nil, fmt.Errorf("unable to decode config: %s", err)
+	}
+
+	patched, err := json.Marshal(mergePatch(configObj, patch))
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode patched config: %s", err)
+	}
+
+	// Fields which are unknown to the client are passed on to the daemon
+	// as is, but known fields must have the right types.
+	if err := json.Unmarshal(patched, &dockerclient.ContainerConfig{}); err != nil {
+		return nil, fmt.Errorf("invalid config patch: %s", err)
+	}
+
+	return patched, nil
+}
+
+// mergePatch merges the given JSON merge patch into the given decoded JSON
+// value: members of a patch object replace those of the target object, except
+// that null members remove them, and objects are merged recursively.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = mergePatch(targetObj[key], value)
+		}
+	}
+
+	return targetObj
+}
@@ -0,0 +1,60 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestConfigPatch(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nWORKDIR /app\nLABEL foo bar\n",
+	}
+
+	b := d.newBuilder(t, files, "")
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+	unpatchedID := b.ImageID()
+
+	b = d.newBuilder(t, files, "")
+	patch := `{"OnBuild": ["RUN echo hello"], "Labels": {"patched": "yes", "foo": null}, "WorkingDir": null}`
+	if err := b.SetConfigPatch([]byte(patch)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	// The patch is part of the cache key.
+	if b.ImageID() == unpatchedID {
+		t.Fatal("expected the patched build to miss the cache")
+	}
+
+	info, err := b.client.InspectImage(b.ImageID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"RUN echo hello"}; !reflect.DeepEqual(info.Config.OnBuild, expected) {
+		t.Fatalf("expected OnBuild %q, got %q", expected, info.Config.OnBuild)
+	}
+	if expected := map[string]string{"patched": "yes"}; !reflect.DeepEqual(info.Config.Labels, expected) {
+		t.Fatalf("expected labels %v, got %v", expected, info.Config.Labels)
+	}
+	if info.Config.WorkingDir != "" {
+		t.Fatalf("expected no working directory, got %q", info.Config.WorkingDir)
+	}
+
+	for _, invalid := range []string{`["OnBuild"]`, `{"Env": "FOO=bar"}`, `not json`} {
+		if err := b.SetConfigPatch([]byte(invalid)); err == nil {
+			t.Fatalf("expected error for config patch %s", invalid)
+		}
+	}
+}
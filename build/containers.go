@@ -0,0 +1,64 @@
+package build
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/samalba/dockerclient"
+)
+
+// createContainerWithConfig creates a container with the given config for the
+// platform of the build, if one is set and the daemon supports it. The
+// container is recorded so that it may be removed at the end of the build if
+// it still exists.
+func (b *Builder) createContainerWithConfig(config *dockerclient.ContainerConfig) (containerID string, err error) {
+	if b.platform != nil && apiVersionAtLeast(b.apiVersion, platformCreateAPIVersion) {
+		containerID, err = b.createContainerForPlatform(config)
+	} else {
+		// An older daemon creates the container for the platform of
+		// its image.
+		containerID, err = b.client.CreateContainer(config, "", nil)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	b.containers = append(b.containers, containerID)
+
+	return containerID, nil
+}
+
+// removeContainer removes the given container, killing it if it is running.
+func (b *Builder) removeContainer(containerID string) error {
+	if err := b.client.RemoveContainer(containerID, true, true); err != nil {
+		return err
+	}
+
+	for i, id := range b.containers {
+		if id == containerID {
+			b.containers = append(b.containers[:i], b.containers[i+1:]...)
+			break
+		}
+	}
+
+	if b.containerID == containerID {
+		b.containerID = ""
+	}
+
+	return nil
+}
+
+// removeContainers removes every container created by the build which still
+// exists.
+func (b *Builder) removeContainers() {
+	// Copy the list as it is modified by removeContainer.
+	for _, containerID := range append([]string(nil), b.containers...) {
+		if err := b.removeContainer(containerID); err != nil {
+			log.Warnf("unable to remove container %s: %s", containerID, err)
+		}
+	}
+}
+
+// SetForceRemove sets whether to remove every container created by the build
+// when it ends, even if it fails and -rm is disabled.
+func (b *Builder) SetForceRemove(forceRm bool) {
+	b.forceRm = forceRm
+}
@@ -0,0 +1,237 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jlhawn/dockramp/archive"
+)
+
+// ContextStdin is the build context source which means a tar archive of the
+// context is read from stdin.
+const ContextStdin = "-"
+
+// PrepareContext returns a build context directory for the given source, which
+// is a local directory, ContextStdin for a tar archive read from stdin, the URL
+// of a git repository, or the URL of a tar archive or a single Dockerfile.
+// Anything other than a local directory is fetched into a temporary directory
+// which is removed by the returned cleanup function.
+func PrepareContext(source string) (contextDirectory string, cleanup func(), err error) {
+	var fetch func(dir string) error
+
+	switch {
+	case source == ContextStdin:
+		fetch = func(dir string) error {
+			return extractContext(os.Stdin, dir)
+		}
+	case isGitURL(source):
+		fetch = func(dir string) error {
+			return cloneContext(source, dir)
+		}
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		fetch = func(dir string) error {
+			return downloadContext(source, dir)
+		}
+	default:
+		return source, func() {}, nil
+	}
+
+	dir, err := ioutil.TempDir("", "dockramp-context")
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to create context directory: %s", err)
+	}
+
+	cleanup = func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("unable to remove context directory %s: %s", dir, err)
+		}
+	}
+
+	if err := fetch(dir); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("unable to prepare build context from %s: %s", source, err)
+	}
+
+	return dir, cleanup, nil
+}
+
+// isGitURL returns whether the given build context source is a git
+// repository, optionally followed by `#ref` or `#ref:subdirectory`.
+func isGitURL(source string) bool {
+	repo := strings.SplitN(source, "#", 2)[0]
+
+	return strings.HasPrefix(repo, "git://") || strings.HasPrefix(repo, "git@") ||
+		strings.HasPrefix(repo, "github.com/") || strings.HasSuffix(repo, ".git")
+}
+
+// cloneContext clones the given git repository into the context directory.
+// The repository may be followed by `#ref` to check out a branch or tag and
+// by `:subdirectory` to use only that subdirectory as the context.
+func cloneContext(source, dir string) error {
+	parts := strings.SplitN(source, "#", 2)
+	repo, ref, subdir := parts[0], "", ""
+	if len(parts) == 2 {
+		refParts := strings.SplitN(parts[1], ":", 2)
+		ref = refParts[0]
+		if len(refParts) == 2 {
+			subdir = refParts[1]
+		}
+	}
+
+	if strings.HasPrefix(repo, "github.com/") {
+		repo = "https://" + repo
+	}
+
+	cloneDir := dir
+	if subdir != "" {
+		cloneDir = filepath.Join(dir, ".clone")
+	}
+
+	args := []string{"clone", "--quiet", "--depth", "1", "--recursive"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, repo, cloneDir)
+
+	if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to clone repository: %s: %s", err, bytes.TrimSpace(out))
+	}
+
+	if subdir == "" {
+		return nil
+	}
+
+	// Move the subdirectory up to be the context directory itself.
+	subdirPath := filepath.Join(cloneDir, filepath.FromSlash(subdir))
+	if !strings.HasPrefix(subdirPath, cloneDir+string(filepath.Separator)) {
+		return fmt.Errorf("invalid subdirectory %q", subdir)
+	}
+
+	entries, err := ioutil.ReadDir(subdirPath)
+	if err != nil {
+		return fmt.Errorf("unable to read subdirectory: %s", err)
+	}
+
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(subdirPath, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(cloneDir)
+}
+
+// downloadContext downloads the given URL into the context directory. The
+// content is either a tar archive of the context, which may be compressed, or
+// a Dockerfile, which is the only file in the context.
+func downloadContext(url, dir string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("request failed with status code %d", resp.StatusCode)
+	}
+
+	content, err := archive.DecompressStream(resp.Body)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	buf := bufio.NewReader(content)
+	if isTar(buf) {
+		return extractContext(buf, dir)
+	}
+
+	dockerfile, err := os.Create(filepath.Join(dir, "Dockerfile"))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dockerfile, buf); err != nil {
+		dockerfile.Close()
+		return err
+	}
+
+	return dockerfile.Close()
+}
+
+// isTar returns whether the content of the given reader begins with the
+// header of a POSIX or GNU tar archive.
+func isTar(buf *bufio.Reader) bool {
+	// The magic field is at offset 257 of the header.
+	header, _ := buf.Peek(262)
+
+	return len(header) == 262 && string(header[257:262]) == "ustar"
+}
+
+// extractContext extracts the tar archive, which may be compressed, read from
+// r into the context directory. Entries may not be written outside of the
+// directory.
+func extractContext(r io.Reader, dir string) error {
+	content, err := archive.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	tarReader := tar.NewReader(content)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read context archive: %s", err)
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path in context archive: %q", header.Name)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(header.Mode) & os.ModePerm
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tarReader); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		default:
+			log.Debugf("skipping context archive entry %q of type %q", header.Name, header.Typeflag)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// contextArchive returns a gzipped tar archive of the given entries. A name
+// ending in "/" is a directory.
+func contextArchive(t *testing.T, entries ...tarEntry) []byte {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.content)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(entry.name, "/") {
+			header.Mode, header.Typeflag = 0755, tar.TypeDir
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func checkContextFiles(t *testing.T, dir string, expected map[string]string) {
+	for name, content := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("unable to read %s from context: %s", name, err)
+		}
+		if string(data) != content {
+			t.Fatalf("expected %s to be %q, got %q", name, content, data)
+		}
+	}
+}
+
+func TestPrepareContextFromURL(t *testing.T) {
+	contextTar := contextArchive(t, tarEntry{"Dockerfile", "FROM base\n"}, tarEntry{"src/", ""}, tarEntry{"src/app.go", "package main"})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/context.tar.gz":
+			w.Write(contextTar)
+		case "/Dockerfile":
+			w.Write([]byte("FROM scratch\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir, cleanup, err := PrepareContext(server.URL + "/context.tar.gz")
+	if err != nil {
+		t.Fatalf("unable to prepare context: %s", err)
+	}
+	checkContextFiles(t, dir, map[string]string{"Dockerfile": "FROM base\n", "src/app.go": "package main"})
+
+	// The temporary context is removed by the cleanup function.
+	cleanup()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected context directory to be removed, got %v", err)
+	}
+
+	// Anything other than an archive is a Dockerfile.
+	dir, cleanup, err = PrepareContext(server.URL + "/Dockerfile")
+	if err != nil {
+		t.Fatalf("unable to prepare context: %s", err)
+	}
+	defer cleanup()
+	checkContextFiles(t, dir, map[string]string{"Dockerfile": "FROM scratch\n"})
+
+	if _, _, err := PrepareContext(server.URL + "/missing"); err == nil || !strings.Contains(err.Error(), "status code 404") {
+		t.Fatalf("expected an error for a missing context, got %v", err)
+	}
+}
+
+func TestPrepareContextFromStdin(t *testing.T) {
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinReader.Close()
+
+	stdin := os.Stdin
+	os.Stdin = stdinReader
+	defer func() { os.Stdin = stdin }()
+
+	go func() {
+		stdinWriter.Write(contextArchive(t, tarEntry{"Dockerfile", "FROM base\n"}, tarEntry{"a", "a"}))
+		stdinWriter.Close()
+	}()
+
+	dir, cleanup, err := PrepareContext(ContextStdin)
+	if err != nil {
+		t.Fatalf("unable to prepare context: %s", err)
+	}
+	defer cleanup()
+
+	checkContextFiles(t, dir, map[string]string{"Dockerfile": "FROM base\n", "a": "a"})
+}
+
+func TestExtractContextBreakout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockramp-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = extractContext(bytes.NewReader(contextArchive(t, tarEntry{"../escape", "x"})), filepath.Join(dir, "context"))
+	if err == nil || !strings.Contains(err.Error(), "invalid path") {
+		t.Fatalf("expected an invalid path error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); !os.IsNotExist(err) {
+		t.Fatal("archive entry was written outside of the context")
+	}
+}
+
+func TestPrepareContextSources(t *testing.T) {
+	for source, git := range map[string]bool{
+		"https://github.com/user/repo.git":        true,
+		"https://github.com/user/repo.git#v1:dir": true,
+		"git@github.com:user/repo.git":            true,
+		"git://example.com/repo":                  true,
+		"github.com/user/repo":                    true,
+		"https://example.com/context.tar.gz":      false,
+		"https://example.com/repo.git/Dockerfile": false,
+		"path/to/context":                         false,
+	} {
+		if isGitURL(source) != git {
+			t.Errorf("expected isGitURL(%q) to be %t", source, git)
+		}
+	}
+
+	// A local directory is used as is.
+	dir, cleanup, err := PrepareContext("path/to/context")
+	if err != nil || dir != "path/to/context" {
+		t.Fatalf("expected the local directory, got %q, %v", dir, err)
+	}
+	cleanup()
+}
+
+func TestPrepareContextFromGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skipf("git is not available: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "dockramp-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo.git")
+	writeContextFile(t, repo, "Dockerfile", "FROM root\n")
+	writeContextFile(t, repo, "sub/Dockerfile", "FROM sub\n")
+
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "initial"},
+		{"tag", "v1"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s failed: %s: %s", args[0], err, out)
+		}
+	}
+
+	for source, dockerfile := range map[string]string{
+		repo:             "FROM root\n",
+		repo + "#v1:sub": "FROM sub\n",
+	} {
+		contextDir, cleanup, err := PrepareContext(source)
+		if err != nil {
+			t.Fatalf("unable to prepare context from %s: %s", source, err)
+		}
+
+		checkContextFiles(t, contextDir, map[string]string{"Dockerfile": dockerfile})
+		cleanup()
+	}
+}
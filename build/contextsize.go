@@ -0,0 +1,66 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
+	"github.com/jlhawn/dockramp/build/commands"
+)
+
+// defaultContextWarnSize is the size of the archive of the whole build context
+// above which a COPY of it is warned about.
+const defaultContextWarnSize = 100 * 1000 * 1000
+
+// SetContextWarnSize sets the size, such as `100MB`, of the archive of the
+// whole build context above which a COPY of it logs a warning. Such a COPY,
+// like `COPY . /app`, is often a mistake which copies files the image does
+// not need, such as the .git directory. A size of 0 disables the warning.
+func (b *Builder) SetContextWarnSize(size string) error {
+	warnSize, err := units.FromHumanSize(size)
+	if err != nil {
+		return fmt.Errorf("invalid context warning size %q: %s", size, err)
+	}
+	if warnSize < 0 {
+		return fmt.Errorf("invalid context warning size %q: must not be negative", size)
+	}
+
+	b.contextWarnSize = warnSize
+
+	return nil
+}
+
+// isWholeContext returns whether the given source path of a COPY is the build
+// context directory itself.
+func (b *Builder) isWholeContext(srcPath string) bool {
+	return filepath.Clean(srcPath) == filepath.Clean(b.contextDirectory)
+}
+
+// warnContextSize logs a warning if the given size of the archive of the
+// whole build context exceeds the context warning size.
+func (b *Builder) warnContextSize(size int64) {
+	if b.contextWarnSize == 0 || size <= b.contextWarnSize {
+		return
+	}
+
+	advice := "create a " + dockerignoreFilename + " file"
+	if len(b.excludePatterns) > 0 {
+		advice = "add patterns to the " + dockerignoreFilename + " file"
+	}
+
+	log.Warnf("%s copies the whole build context, which is %s: %s to leave out files the image does not need, such as .git", commands.Copy, units.HumanSize(float64(size)), advice)
+}
+
+// sizeReader counts the bytes read through it.
+type sizeReader struct {
+	r    io.Reader
+	size int64
+}
+
+func (s *sizeReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.size += int64(n)
+	return n, err
+}
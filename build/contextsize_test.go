@@ -0,0 +1,64 @@
+package build
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/samalba/dockerclient"
+)
+
+func TestContextSizeWarning(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	warned := func(dockerfile, warnSize string) string {
+		b := d.newBuilder(t, map[string]string{
+			"Dockerfile": dockerfile,
+			"big":        strings.Repeat("x", 10000),
+		}, "")
+		if err := b.SetContextWarnSize(warnSize); err != nil {
+			t.Fatal(err)
+		}
+
+		logs.Reset()
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return logs.String()
+	}
+
+	for _, dockerfile := range []string{"FROM base\nCOPY . /app\n", "FROM base\nCOPY ./ /app/\n"} {
+		if output := warned(dockerfile, "5kB"); !strings.Contains(output, "COPY copies the whole build context") || !strings.Contains(output, "create a .dockerignore file") {
+			t.Fatalf("expected a warning for %q, got %q", dockerfile, output)
+		}
+	}
+
+	if output := warned("FROM base\nCOPY big /big\n", "5kB"); strings.Contains(output, "whole build context") {
+		t.Fatalf("expected no warning for a copy of part of the context, got %q", output)
+	}
+
+	if output := warned("FROM base\nCOPY . /app\n", "100kB"); strings.Contains(output, "whole build context") {
+		t.Fatalf("expected no warning for a context under the size, got %q", output)
+	}
+
+	if output := warned("FROM base\nCOPY . /app\n", "0"); strings.Contains(output, "whole build context") {
+		t.Fatalf("expected the warning to be disabled, got %q", output)
+	}
+
+	b := d.builder(t)
+	for _, size := range []string{"", "lots", "-1"} {
+		if err := b.SetContextWarnSize(size); err == nil {
+			t.Errorf("expected an error for context warning size %q", size)
+		}
+	}
+}
@@ -4,82 +4,406 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/jlhawn/dockramp/archive"
 	"github.com/jlhawn/dockramp/build/commands"
-	"github.com/jlhawn/tarsum"
+	"github.com/jlhawn/dockramp/tarsum"
+	"github.com/samalba/dockerclient"
 )
 
 func (b *Builder) handleCopy(args []string, heredoc string) error {
 	log.Debugf("handling %s with args: %#v", commands.Copy, args)
 
-	if len(args) != 2 {
-		return fmt.Errorf("%s requires exactly two arguments", commands.Copy)
+	tarOptions := &archive.TarOptions{
+		ExcludePatterns: b.excludePatterns,
+		ExcludeBaseDir:  b.contextDirectory,
+		RootDir:         b.contextDirectory,
 	}
 
-	if b.checkCopyCache(args[0]) {
+	if chown, ok := b.flags["chown"]; ok {
+		chownOpts, err := parseChown(chown)
+		if err != nil {
+			return err
+		}
+		tarOptions.ChownOpts = chownOpts
+	}
+
+	if chmod, ok := b.flags["chmod"]; ok {
+		mode, err := parseChmod(chmod)
+		if err != nil {
+			return err
+		}
+		tarOptions.ChmodOpts = &mode
+	}
+
+	if heredoc != "" {
+		return b.copyHeredoc(heredoc, args[0])
+	}
+
+	if from, ok := b.flags["from"]; ok {
+		if tarOptions.ChownOpts != nil || tarOptions.ChmodOpts != nil {
+			return fmt.Errorf("%s --from cannot be combined with --chown or --chmod", commands.Copy)
+		}
+
+		return b.copyFrom(from, args[0], args[1])
+	}
+
+	srcPaths, err := b.contextSources(args[0])
+	if err != nil {
+		return err
+	}
+
+	if len(srcPaths) > 1 && !archive.AssertsDirectory(args[1]) {
+		return fmt.Errorf("%s with more than one source requires the destination to be a directory ending with a /", commands.Copy)
+	}
+
+	if err := checkSourcesExist(args[0], srcPaths); err != nil {
+		return err
+	}
+
+	if hit, err := b.checkCopyCache(srcPaths, tarOptions); err != nil || hit {
+		return err
+	}
+
+	if b.dryRun {
 		return nil
 	}
 
-	containerID, err := b.createContainer([]string{"/bin/sh", "-c"}, []string{"#(nop)"}, false)
+	containerID, err := b.createContainer([]string{"/bin/sh", "-c"}, b.nopCommand(), false)
 	if err != nil {
 		return fmt.Errorf("unable to create container: %s", err)
 	}
 
-	if err := b.copyToContainer(args[0], containerID, args[1]); err != nil {
-		return fmt.Errorf("unable to copy to container: %s", err)
+	// The container is removed by Run if the build fails.
+	b.containerID = containerID
+
+	for _, srcPath := range srcPaths {
+		if err := b.copyToContainer(srcPath, tarOptions, containerID, args[1]); err != nil {
+			return fmt.Errorf("unable to copy to container: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// copyFrom copies the resource at srcPath in the given image to dstPath in a
+// new container. The image is either the final image of a build stage,
+// specified by name or index, or any other image, which is pulled if
+// necessary.
+func (b *Builder) copyFrom(from, srcPath, dstPath string) error {
+	imageID, err := b.copySourceImage(from)
+	if err != nil {
+		return fmt.Errorf("invalid --from value: %s", err)
+	}
+
+	// The image ID identifies the contents of the source.
+	b.uncommittedCommands = append(b.uncommittedCommands, fmt.Sprintf("COPY from image: %s", imageID))
+
+	if b.probeCache() || b.dryRun {
+		return nil
+	}
+
+	srcContainer, err := b.createContainerWithConfig(&dockerclient.ContainerConfig{
+		Image:      imageID,
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Cmd:        []string{"#(nop)"},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create source container: %s", err)
+	}
+	defer func() {
+		if err := b.removeContainer(srcContainer); err != nil {
+			log.Warnf("unable to remove source container %s: %s", srcContainer, err)
+		}
+	}()
+
+	containerID, err := b.createContainer([]string{"/bin/sh", "-c"}, b.nopCommand(), false)
+	if err != nil {
+		return fmt.Errorf("unable to create container: %s", err)
 	}
 
+	// The container is removed by Run if the build fails.
 	b.containerID = containerID
 
+	// Source paths are relative to the root of the image's filesystem.
+	srcPath = archive.PreserveTrailingDotOrSeparator(path.Join("/", srcPath), srcPath)
+
+	if err := b.copyFromContainer(srcContainer, srcPath, containerID, dstPath); err != nil {
+		return fmt.Errorf("unable to copy from %q: %s", from, err)
+	}
+
 	return nil
 }
 
-func (b *Builder) checkCopyCache(srcPath string) bool {
-	srcPath = fmt.Sprintf("%s%c%s", b.contextDirectory, filepath.Separator, srcPath)
-	srcArchive, err := archive.TarResource(srcPath)
+// copySourceImage returns the ID of the image to copy from given the value of
+// the --from option to COPY.
+func (b *Builder) copySourceImage(from string) (string, error) {
+	stage, err := b.lookupStage(from)
+	if err == nil {
+		if stage.imageID == "" {
+			return "", fmt.Errorf("build stage %q has no files to copy", from)
+		}
+
+		return stage.imageID, nil
+	}
+
+	// A number may only refer to a build stage.
+	if _, numErr := strconv.Atoi(from); numErr == nil {
+		return "", err
+	}
+
+	log.Debugf("copying from image %q which is not a build stage", from)
+
+	info, err := b.resolveImage(from)
 	if err != nil {
-		log.Debugf("unable to archive source: %s", err)
-		return false
+		return "", err
 	}
-	defer srcArchive.Close()
 
-	digester, err := tarsum.NewDigest(tarsum.Version1)
+	return info.Id, nil
+}
+
+// copyFromContainer copies the resource at srcPath in the source container to
+// dstPath in the destination container.
+func (b *Builder) copyFromContainer(srcContainer, srcPath, dstContainer, dstPath string) error {
+	dstInfo := b.containerCopyInfo(dstContainer, dstPath)
+
+	query := make(url.Values, 1)
+	query.Set("path", srcPath)
+
+	urlPath := fmt.Sprintf("/containers/%s/archive?%s", srcContainer, query.Encode())
+	req, err := http.NewRequest("GET", b.client.URL.String()+urlPath, nil)
 	if err != nil {
-		log.Debugf("unable to get new tarsum digester: %s", err)
-		return false
+		return fmt.Errorf("unable to prepare request: %s", err)
 	}
 
-	if _, err := io.Copy(digester, srcArchive); err != nil {
-		log.Debugf("unable to digest source archive: %s", err)
+	resp, err := b.doDaemonRequest(req, true)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Read the body if possible.
+		buf := bytes.NewBuffer(make([]byte, 0, resp.ContentLength))
+		io.Copy(buf, resp.Body) // It's okay if this fails.
+
+		return fmt.Errorf("request failed with status code %d: %s", resp.StatusCode, buf.String())
+	}
+
+	srcStat, err := decodeContainerPathStat(resp.Header)
+	if err != nil {
+		return err
+	}
+
+	// The response body is streamed directly into the destination.
+	srcInfo := archive.CopyInfo{Path: srcPath, Exists: true, IsDir: srcStat.Mode.IsDir()}
+
+	return b.putArchive(resp.Body, srcInfo, dstContainer, dstInfo)
+}
+
+// parseChown parses the value of the --chown option to COPY, which must be a
+// numeric uid optionally followed by a colon and numeric gid. If no gid is
+// given, it is the same as the uid.
+func parseChown(chown string) (*archive.TarChownOptions, error) {
+	parts := strings.Split(chown, ":")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid --chown value %q: must be uid[:gid]", chown)
+	}
+
+	ids := make([]int, len(parts))
+	for i, part := range parts {
+		id, err := strconv.Atoi(part)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid --chown value %q: only numeric uid and gid are supported", chown)
+		}
+		ids[i] = id
+	}
+
+	chownOpts := &archive.TarChownOptions{UID: ids[0], GID: ids[0]}
+	if len(ids) == 2 {
+		chownOpts.GID = ids[1]
+	}
+
+	return chownOpts, nil
+}
+
+// parseChmod parses the value of the --chmod option to COPY, which must be an
+// octal file mode.
+func parseChmod(chmod string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(chmod, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid --chmod value %q: must be an octal mode such as 0644", chmod)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// contextSources returns the paths of the resources in the build context which
+// are specified by the given source argument. The source may be a glob pattern
+// as accepted by filepath.Match, in which case it is an error if it matches
+// nothing. A source which is not a pattern is returned as is. It is an error
+// for any of the paths to be outside of the build context or for a source
+// which is not a pattern to be excluded by the .dockerignore file. Excluded
+// matches of a pattern are left out.
+func (b *Builder) contextSources(source string) ([]string, error) {
+	srcPath := fmt.Sprintf("%s%c%s", b.contextDirectory, filepath.Separator, source)
+
+	if !strings.ContainsAny(source, "*?[") {
+		// Not a pattern. Leave the path untouched so that any trailing
+		// separator or `.` keeps its meaning.
+		if err := b.checkContextPath(source, srcPath); err != nil {
+			return nil, err
+		}
+
+		excluded, err := b.isExcluded(srcPath)
+		if err != nil {
+			return nil, err
+		}
+		if excluded {
+			return nil, fmt.Errorf("source %q is excluded by %s", source, dockerignoreFilename)
+		}
+
+		return []string{srcPath}, nil
+	}
+
+	matches, err := filepath.Glob(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source pattern %q: %s", source, err)
+	}
+
+	included := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if err := b.checkContextPath(source, match); err != nil {
+			return nil, err
+		}
+
+		excluded, err := b.isExcluded(match)
+		if err != nil {
+			return nil, err
+		}
+		if !excluded {
+			included = append(included, match)
+		}
+	}
+
+	if len(included) == 0 {
+		return nil, fmt.Errorf("no source files match %q", source)
+	}
+
+	return included, nil
+}
+
+// checkContextPath returns an error if the given path, which was specified by
+// the given source argument, is outside of the build context. The path must be
+// within the context both as written and after following any symbolic links.
+func (b *Builder) checkContextPath(source, path string) error {
+	forbidden := fmt.Errorf("forbidden path outside the build context: %s", source)
+
+	if !isWithinDir(b.contextDirectory, path) {
+		return forbidden
+	}
+
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		// Leave it for the instruction to report that the source
+		// does not exist.
+		return nil
+	}
+
+	resolvedContext, err := filepath.EvalSymlinks(b.contextDirectory)
+	if err != nil {
+		return fmt.Errorf("unable to resolve build context directory: %s", err)
+	}
+
+	if !isWithinDir(resolvedContext, resolvedPath) {
+		return forbidden
+	}
+
+	return nil
+}
+
+// isWithinDir returns whether the given path is the given directory or is
+// lexically beneath it.
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
 		return false
 	}
 
-	copyDigest := fmt.Sprintf("%x", digester.Sum(nil))
-	b.uncommittedCommands = append(b.uncommittedCommands, fmt.Sprintf("COPY digest: %s", copyDigest))
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkCopyCache digests each source to probe the cache. A source which can't
+// be archived or digested fails the step rather than leaving its digest out of
+// the cache key.
+func (b *Builder) checkCopyCache(srcPaths []string, tarOptions *archive.TarOptions) (bool, error) {
+	fileSums := make(map[string][]tarsum.FileSum, len(srcPaths))
+
+	// Digest each source separately so that a change to the set of files
+	// matched by a pattern also changes the cache key.
+	for _, srcPath := range srcPaths {
+		srcArchive, err := archive.TarResourceWithOptions(srcPath, tarOptions)
+		if err != nil {
+			return false, fmt.Errorf("unable to archive source: %s", err)
+		}
+
+		// The size of the whole context is measured as it is digested.
+		sized := &sizeReader{r: srcArchive}
+
+		copyDigest, sums, err := digestTar(sized, b.tarsumVersion)
+		srcArchive.Close()
+		if err != nil {
+			return false, fmt.Errorf("unable to digest source %s: %s", srcPath, err)
+		}
+
+		if b.isWholeContext(srcPath) {
+			b.warnContextSize(sized.size)
+		}
+
+		fileSums[srcPath] = sums
+		b.uncommittedCommands = append(b.uncommittedCommands, fmt.Sprintf("COPY digest: %s", copyDigest))
+	}
+
+	if b.probeCache() {
+		return true, nil
+	}
 
-	return b.probeCache()
+	logFileSums(srcPaths, fileSums)
+
+	return false, nil
 }
 
-// containerPathStat is used to encode the response from
-// 	GET /containers/{name:.*}/stat-path
+// containerPathStat is the stat of a path in a container, which the daemon
+// sends in the X-Docker-Container-Path-Stat header of responses from HEAD and
+// GET /containers/{id}/archive, encoded as JSON and then standard base64.
 type containerPathStat struct {
-	Name  string      `json:"name"`
-	Path  string      `json:"path"`
-	Size  int64       `json:"size"`
-	Mode  os.FileMode `json:"mode"`
-	Mtime time.Time   `json:"mtime"`
+	Name       string      `json:"name"`
+	Size       int64       `json:"size"`
+	Mode       os.FileMode `json:"mode"`
+	Mtime      time.Time   `json:"mtime"`
+	LinkTarget string      `json:"linkTarget"`
 }
 
+// errNoPathStat is returned if a response from the archive endpoint does not
+// have the container path stat header.
+var errNoPathStat = errors.New("daemon response has no X-Docker-Container-Path-Stat header")
+
+// errPathNotFound is returned if the daemon responds to a stat of a container
+// path with 404 Not Found.
+var errPathNotFound = errors.New("no such path in container")
+
 func (b *Builder) statContainerPath(container, path string) (*containerPathStat, error) {
 	query := make(url.Values, 1)
 	query.Set("path", filepath.ToSlash(path)) // Normalize the paths used in the API.
@@ -90,49 +414,52 @@ func (b *Builder) statContainerPath(container, path string) (*containerPathStat,
 		return nil, fmt.Errorf("unable to prepare request: %s", err)
 	}
 
-	resp, err := b.client.HTTPClient.Do(req)
+	resp, err := b.doDaemonRequest(req, true)
 	if err != nil {
 		return nil, fmt.Errorf("unable to make request: %s", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errPathNotFound
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("request failed with status code: %d", resp.StatusCode)
 	}
 
-	encodedStat := resp.Header.Get("X-Docker-Container-Path-Stat")
+	return decodeContainerPathStat(resp.Header)
+}
+
+// decodeContainerPathStat decodes the container path stat header of a response
+// from the archive endpoint.
+func decodeContainerPathStat(header http.Header) (*containerPathStat, error) {
+	encodedStat := header.Get("X-Docker-Container-Path-Stat")
+	if encodedStat == "" {
+		return nil, errNoPathStat
+	}
+
 	statDecoder := base64.NewDecoder(base64.StdEncoding, strings.NewReader(encodedStat))
 
 	var stat containerPathStat
-	if err = json.NewDecoder(statDecoder).Decode(&stat); err != nil {
+	if err := json.NewDecoder(statDecoder).Decode(&stat); err != nil {
 		return nil, fmt.Errorf("unable to decode container path stat header: %s", err)
 	}
 
 	return &stat, nil
 }
 
-func (b *Builder) copyToContainer(srcPath, dstContainer, dstPath string) (err error) {
+func (b *Builder) copyToContainer(srcPath string, tarOptions *archive.TarOptions, dstContainer, dstPath string) (err error) {
 	// In order to get the copy behavior right, we need to know information
 	// about both the source and destination. The API is a simple tar
 	// archive/extract API but we can use the stat info header about the
 	// destination to be more informed about exactly what the destination is.
 
-	// Prepare destination copy info by stat-ing the container path.
-	dstInfo := archive.CopyInfo{Path: dstPath}
-	dstStat, err := b.statContainerPath(dstContainer, dstPath)
-	if err == nil {
-		dstInfo.Exists, dstInfo.IsDir = true, dstStat.Mode.IsDir()
-	}
-	// Ignore any other error and assume that the parent directory of the
-	// destination path exists, in which case the copy may still succeed. If
-	// there is any type of conflict (e.g., non-directory overwriting an
-	// existing directory or vice versia) the extraction will fail. If the
-	// destination simply did not exist, but the parent directory does, the
-	// extraction will still succeed.
-
-	srcPath = fmt.Sprintf("%s%c%s", b.contextDirectory, filepath.Separator, srcPath)
+	dstInfo := b.containerCopyInfo(dstContainer, dstPath)
 
-	srcArchive, err := archive.TarResource(srcPath)
+	// The archive is produced lazily through a pipe as it is read by the
+	// request below, so the source is never held in memory. Closing it
+	// stops the archiver if the request fails before reading all of it.
+	srcArchive, err := archive.TarResourceWithOptions(srcPath, tarOptions)
 	if err != nil {
 		return err
 	}
@@ -150,6 +477,34 @@ func (b *Builder) copyToContainer(srcPath, dstContainer, dstPath string) (err er
 		return err
 	}
 
+	return b.putArchive(srcArchive, srcInfo, dstContainer, dstInfo)
+}
+
+// containerCopyInfo returns the info about the destination path of a copy into
+// the given container.
+func (b *Builder) containerCopyInfo(container, path string) archive.CopyInfo {
+	// Prepare destination copy info by stat-ing the container path.
+	info := archive.CopyInfo{Path: path}
+	stat, err := b.statContainerPath(container, path)
+	if err == nil {
+		info.Exists, info.IsDir = true, stat.Mode.IsDir()
+	}
+	if err == errNoPathStat {
+		log.Warnf("unable to stat %s in container: %s: assuming its parent directory exists", path, err)
+	}
+	// Ignore any other error and assume that the parent directory of the
+	// destination path exists, in which case the copy may still succeed. If
+	// there is any type of conflict (e.g., non-directory overwriting an
+	// existing directory or vice versia) the extraction will fail. If the
+	// destination simply did not exist, but the parent directory does, the
+	// extraction will still succeed.
+
+	return info
+}
+
+// putArchive extracts the given source archive, which is described by srcInfo,
+// into the given container at the destination described by dstInfo.
+func (b *Builder) putArchive(srcArchive archive.ArchiveReader, srcInfo archive.CopyInfo, dstContainer string, dstInfo archive.CopyInfo) error {
 	// See comments in the implementation of `archive.PrepareArchiveCopy`
 	// for exactly what goes into deciding how and whether the source
 	// archive needs to be altered for the correct copy behavior when it is
@@ -162,10 +517,8 @@ func (b *Builder) copyToContainer(srcPath, dstContainer, dstPath string) (err er
 	}
 	defer preparedArchive.Close()
 
-	dstPath = dstDir
-
 	query := make(url.Values, 1)
-	query.Set("path", filepath.ToSlash(dstPath)) // Normalize the paths used in the API.
+	query.Set("path", filepath.ToSlash(dstDir)) // Normalize the paths used in the API.
 	// Do not allow for an existing directory to be overwritten by a non-directory and vice versa.
 	query.Set("noOverwriteDirNonDir", "true")
 
@@ -177,7 +530,7 @@ func (b *Builder) copyToContainer(srcPath, dstContainer, dstPath string) (err er
 
 	req.Header.Set("Content-Type", "application/x-tar")
 
-	resp, err := b.client.HTTPClient.Do(req)
+	resp, err := b.doDaemonRequest(req, true)
 	if err != nil {
 		return fmt.Errorf("unable to make request: %s", err)
 	}
@@ -0,0 +1,288 @@
+package build
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jlhawn/dockramp/archive"
+	"github.com/samalba/dockerclient"
+)
+
+// newContextDir creates a temporary build context directory containing the
+// given files.
+func newContextDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "dockramp-context")
+	if err != nil {
+		t.Fatalf("unable to create context directory: %s", err)
+	}
+
+	for name, content := range files {
+		writeContextFile(t, dir, name, content)
+	}
+
+	return dir
+}
+
+func writeContextFile(t *testing.T, dir, name, content string) {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("unable to create directory for %s: %s", name, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write %s: %s", name, err)
+	}
+}
+
+func TestContextSourcesPattern(t *testing.T) {
+	dir := newContextDir(t, map[string]string{
+		"a.conf":   "a",
+		"b.conf":   "b",
+		"c.txt":    "c",
+		"d/e.conf": "e",
+	})
+	defer os.RemoveAll(dir)
+
+	b := &Builder{contextDirectory: dir}
+
+	srcPaths, err := b.contextSources("*.conf")
+	if err != nil {
+		t.Fatalf("unable to expand pattern: %s", err)
+	}
+
+	expected := []string{filepath.Join(dir, "a.conf"), filepath.Join(dir, "b.conf")}
+	if len(srcPaths) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, srcPaths)
+	}
+	for i := range expected {
+		if srcPaths[i] != expected[i] {
+			t.Fatalf("expected %q, got %q", expected, srcPaths)
+		}
+	}
+
+	if _, err := b.contextSources("*.none"); err == nil {
+		t.Fatal("expected an error for a pattern which matches nothing")
+	}
+
+	// A literal source is not expanded, even if it does not exist.
+	srcPaths, err = b.contextSources("d/")
+	if err != nil {
+		t.Fatalf("unable to get literal source: %s", err)
+	}
+	if len(srcPaths) != 1 || srcPaths[0] != dir+string(filepath.Separator)+"d/" {
+		t.Fatalf("unexpected literal source paths: %q", srcPaths)
+	}
+}
+
+func TestCopyCacheKeyIncludesMatchedFiles(t *testing.T) {
+	dir := newContextDir(t, map[string]string{
+		"a.conf": "a",
+	})
+	defer os.RemoveAll(dir)
+
+	b := &Builder{contextDirectory: dir, cache: &fileCache{entries: map[string]string{}}}
+
+	cacheKey := func() string {
+		b.uncommittedCommands = []string{"COPY *.conf /etc/"}
+
+		srcPaths, err := b.contextSources("*.conf")
+		if err != nil {
+			t.Fatalf("unable to expand pattern: %s", err)
+		}
+
+		if hit, err := b.checkCopyCache(srcPaths, &archive.TarOptions{}); err != nil || hit {
+			t.Fatalf("expected a cache miss, got hit %t, error %v", hit, err)
+		}
+
+		return b.getCacheKey()
+	}
+
+	before := cacheKey()
+
+	if after := cacheKey(); after != before {
+		t.Fatalf("cache key changed without any change to the context")
+	}
+
+	writeContextFile(t, dir, "b.conf", "b")
+
+	if after := cacheKey(); after == before {
+		t.Fatalf("cache key did not change when a new file matched the pattern")
+	}
+}
+
+func TestParseChown(t *testing.T) {
+	valid := map[string]archive.TarChownOptions{
+		"1000":      {UID: 1000, GID: 1000},
+		"1000:50":   {UID: 1000, GID: 50},
+		"0:0":       {UID: 0, GID: 0},
+		"65534:100": {UID: 65534, GID: 100},
+	}
+
+	for chown, expected := range valid {
+		chownOpts, err := parseChown(chown)
+		if err != nil {
+			t.Fatalf("unable to parse %q: %s", chown, err)
+		}
+		if *chownOpts != expected {
+			t.Fatalf("parsing %q: expected %+v, got %+v", chown, expected, *chownOpts)
+		}
+	}
+
+	for _, chown := range []string{"", "user", "1000:group", "1:2:3", "-1", "1000:"} {
+		if _, err := parseChown(chown); err == nil {
+			t.Fatalf("expected an error parsing %q", chown)
+		}
+	}
+}
+
+func TestCopyCacheKeyIncludesChown(t *testing.T) {
+	dir := newContextDir(t, map[string]string{
+		"a.conf": "a",
+	})
+	defer os.RemoveAll(dir)
+
+	b := &Builder{contextDirectory: dir, cache: &fileCache{entries: map[string]string{}}}
+
+	cacheKey := func(tarOptions *archive.TarOptions) string {
+		b.uncommittedCommands = nil
+
+		if hit, err := b.checkCopyCache([]string{filepath.Join(dir, "a.conf")}, tarOptions); err != nil || hit {
+			t.Fatalf("expected a cache miss, got hit %t, error %v", hit, err)
+		}
+
+		return b.getCacheKey()
+	}
+
+	plain := cacheKey(&archive.TarOptions{})
+	owned := cacheKey(&archive.TarOptions{ChownOpts: &archive.TarChownOptions{UID: 4321, GID: 4321}})
+
+	if plain == owned {
+		t.Fatal("cache key did not change with a different owner")
+	}
+}
+
+func TestParseChmod(t *testing.T) {
+	valid := map[string]os.FileMode{
+		"0644": 0644,
+		"755":  0755,
+		"4755": 04755,
+		"0":    0,
+	}
+
+	for chmod, expected := range valid {
+		mode, err := parseChmod(chmod)
+		if err != nil {
+			t.Fatalf("unable to parse %q: %s", chmod, err)
+		}
+		if mode != expected {
+			t.Fatalf("parsing %q: expected %#o, got %#o", chmod, expected, mode)
+		}
+	}
+
+	for _, chmod := range []string{"", "rwx", "0800", "17777", "-644", "u+x"} {
+		if _, err := parseChmod(chmod); err == nil {
+			t.Fatalf("expected an error parsing %q", chmod)
+		}
+	}
+}
+
+func TestContextSourcesOutsideContext(t *testing.T) {
+	outside := newContextDir(t, map[string]string{
+		"secret": "secret",
+	})
+	defer os.RemoveAll(outside)
+
+	dir := newContextDir(t, map[string]string{
+		"a.conf":     "a",
+		"sub/b.conf": "b",
+	})
+	defer os.RemoveAll(dir)
+
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dir, "escape")); err != nil {
+		t.Fatalf("unable to create symlink: %s", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "escapedir")); err != nil {
+		t.Fatalf("unable to create symlink: %s", err)
+	}
+	if err := os.Symlink("a.conf", filepath.Join(dir, "inside")); err != nil {
+		t.Fatalf("unable to create symlink: %s", err)
+	}
+
+	b := &Builder{contextDirectory: dir}
+
+	for _, source := range []string{"a.conf", "sub/../a.conf", "/a.conf", ".", "sub/", "inside", "*.conf", "missing"} {
+		if _, err := b.contextSources(source); err != nil {
+			t.Errorf("unexpected error for source %q: %s", source, err)
+		}
+	}
+
+	forbidden := []string{
+		"..",
+		"../../etc/passwd",
+		"sub/../../" + filepath.Base(outside) + "/secret",
+		"../*",
+		"escape",
+		"escapedir/",
+		"escapedir/secret",
+		"escape*",
+	}
+
+	for _, source := range forbidden {
+		if _, err := b.contextSources(source); err == nil || !strings.Contains(err.Error(), "forbidden path outside the build context") {
+			t.Errorf("expected a forbidden path error for source %q, got %v", source, err)
+		}
+	}
+}
+
+func TestDecodeContainerPathStat(t *testing.T) {
+	// The header as sent by the daemon for a symbolic link.
+	header := http.Header{}
+	header.Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString([]byte(
+		`{"name":"localtime","size":25,"mode":134218239,"mtime":"2016-01-02T03:04:05Z","linkTarget":"/usr/share/zoneinfo/UTC"}`,
+	)))
+
+	stat, err := decodeContainerPathStat(header)
+	if err != nil {
+		t.Fatalf("unable to decode stat: %s", err)
+	}
+
+	expected := &containerPathStat{
+		Name:       "localtime",
+		Size:       25,
+		Mode:       os.ModeSymlink | 0777,
+		Mtime:      time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		LinkTarget: "/usr/share/zoneinfo/UTC",
+	}
+	if !reflect.DeepEqual(stat, expected) {
+		t.Fatalf("expected stat %+v, got %+v", expected, stat)
+	}
+
+	if _, err := decodeContainerPathStat(http.Header{}); err != errNoPathStat {
+		t.Fatalf("expected errNoPathStat for a response without the header, got %v", err)
+	}
+}
+
+func TestCopyWithoutPathStat(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.noPathStat = true
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	// Without the stat of the destination, its parent directory is
+	// assumed to exist.
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nCOPY file /etc/file\n", "file": "content"}, "")
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	if content := d.imageFiles[b.ImageID()]["/etc/file"]; content != "content" {
+		t.Fatalf("expected /etc/file to be copied, got %q", content)
+	}
+}
@@ -0,0 +1,783 @@
+package build
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jlhawn/dockramp/tarsum"
+	"github.com/jlhawn/dockramp/util"
+	"github.com/samalba/dockerclient"
+)
+
+// apiVersionPrefix matches the optional version prefix of a Remote API path.
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// fakeContainer is a container known to a fakeDaemon.
+type fakeContainer struct {
+	config *dockerclient.ContainerConfig
+	// files maps paths in the container to the content of files which
+	// have been copied into it.
+	files map[string]string
+	// dirs is the set of paths of directories which have been created in
+	// the container.
+	dirs map[string]struct{}
+	// size is the number of bytes copied into the container.
+	size int64
+	// platform is the platform the container was created for, if any.
+	platform string
+}
+
+// fakeRun is a container which was run by a fakeDaemon.
+type fakeRun struct {
+	// cmd is the entrypoint of the container followed by its command.
+	cmd []string
+	// env is the environment of the container, and workingDir, user, and
+	// platform are those it runs with.
+	env        []string
+	workingDir string
+	user       string
+	platform   string
+	// input is what was sent to the container on stdin.
+	input string
+}
+
+// fakeDaemon is a minimal stand-in for the Docker Remote API which keeps just
+// enough state to exercise the builder.
+type fakeDaemon struct {
+	*httptest.Server
+
+	mu sync.Mutex
+
+	// dir holds the build cache and any build contexts.
+	dir string
+
+	// images maps canonical image names and IDs to images known to the
+	// daemon.
+	images map[string]*dockerclient.ImageInfo
+	// registry maps canonical image names to images which may be pulled.
+	registry map[string]*dockerclient.ImageInfo
+	// tags maps canonical repo:tag names to the ID of the tagged image.
+	tags map[string]string
+	// imageFiles maps image IDs to the content of the files in the image
+	// keyed by path.
+	imageFiles map[string]map[string]string
+	// imageDirs maps image IDs to the set of paths of directories created
+	// in the image.
+	imageDirs map[string]map[string]struct{}
+
+	// numImages is the number of images ever committed.
+	numImages int
+
+	containers map[string]*fakeContainer
+	// numContainers is the number of containers ever created.
+	numContainers int
+
+	// driver is the storage driver reported by the daemon.
+	driver string
+	// infoRequests is the number of requests for the daemon info.
+	infoRequests int
+	// apiVersion is the API version reported by the daemon.
+	apiVersion string
+	// noPathStat is set if the daemon does not send the container path
+	// stat header when a path is stat-ed with a HEAD request.
+	noPathStat bool
+	// statStatus, if set, is the status code of the response to every
+	// HEAD request to stat a container path, which has no stat header.
+	statStatus int
+
+	// extractEndpoints are the endpoints used to extract archives.
+	extractEndpoints []string
+
+	// pullFailures is the number of pull attempts which fail before a
+	// pull may succeed.
+	pullFailures int
+	pulls        int
+	// pullPlatforms are the platforms given with each pull, and
+	// platformRegistry maps a canonical name and a platform, separated by a
+	// space, to the image pulled for that platform instead of the one in
+	// registry.
+	pullPlatforms    []string
+	platformRegistry map[string]*dockerclient.ImageInfo
+	// pullError is the error with which every pull fails in the stream of
+	// progress messages, if any.
+	pullError string
+
+	// pushAuths maps the canonical repo:tag names of pushed images to the
+	// registry auth header of the push, and pushError is the error with
+	// which every push fails, if any.
+	pushAuths map[string]string
+	pushError string
+
+	// unavailable maps a method and the last element of a path, such as
+	// "POST tag", to the number of requests to the endpoint which fail
+	// with 503 Service Unavailable before it may succeed.
+	unavailable map[string]int
+
+	// runs are the containers which have been run, in order, and
+	// runExitCode is the exit code of each of them.
+	runs        []fakeRun
+	runExitCode int
+}
+
+func newFakeDaemon(t *testing.T) *fakeDaemon {
+	dir, err := ioutil.TempDir("", "dockramp-daemon")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+
+	d := &fakeDaemon{
+		dir:        dir,
+		driver:     "aufs",
+		apiVersion: "1.24",
+		images:     map[string]*dockerclient.ImageInfo{},
+		registry:   map[string]*dockerclient.ImageInfo{},
+		tags:       map[string]string{},
+		imageFiles: map[string]map[string]string{},
+		imageDirs:  map[string]map[string]struct{}{},
+		containers: map[string]*fakeContainer{},
+		pushAuths:  map[string]string{},
+
+		platformRegistry: map[string]*dockerclient.ImageInfo{},
+		unavailable:      map[string]int{},
+	}
+
+	d.Server = httptest.NewServer(http.HandlerFunc(d.serveHTTP))
+
+	return d
+}
+
+// Close shuts down the daemon and removes its temporary files.
+func (d *fakeDaemon) Close() {
+	d.Server.Close()
+	os.RemoveAll(d.dir)
+}
+
+// addImage makes the given image available locally under the given name.
+func (d *fakeDaemon) addImage(name string, info *dockerclient.ImageInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.images[canonicalName(name)] = info
+	d.images[info.Id] = info
+}
+
+// addRegistryImage makes the given image available to pull with the given
+// name.
+func (d *fakeDaemon) addRegistryImage(name string, info *dockerclient.ImageInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.registry[canonicalName(name)] = info
+}
+
+// canonicalName normalizes an image name the way the daemon does. Names which
+// are not valid references, such as image IDs, are returned unchanged.
+func canonicalName(name string) string {
+	canonical, err := util.CanonicalString(name)
+	if err != nil {
+		return name
+	}
+
+	return canonical
+}
+
+// lookupImage finds a local image by ID, name, or tag.
+func (d *fakeDaemon) lookupImage(name string) (*dockerclient.ImageInfo, bool) {
+	if info, ok := d.images[name]; ok {
+		return info, true
+	}
+
+	name = canonicalName(name)
+	if id, ok := d.tags[name]; ok {
+		name = id
+	}
+
+	info, ok := d.images[name]
+
+	return info, ok
+}
+
+// builder returns a builder which is connected to this daemon but has no
+// build context.
+func (d *fakeDaemon) builder(t *testing.T) *Builder {
+	client, err := dockerclient.NewDockerClient(d.URL, nil)
+	if err != nil {
+		t.Fatalf("unable to create client: %s", err)
+	}
+
+	return &Builder{
+		daemonURL:     d.URL,
+		client:        client,
+		out:           ioutil.Discard,
+		config:        &config{},
+		tarsumVersion: tarsum.Version1,
+		cache:         &fileCache{path: filepath.Join(d.dir, "cache"), entries: map[string]string{}},
+	}
+}
+
+// newBuilder returns a builder which is connected to this daemon and uses a
+// new build context containing the given files. Builders returned by the same
+// daemon share a build cache.
+func (d *fakeDaemon) newBuilder(t *testing.T, files map[string]string, repoTag string) *Builder {
+	contextDir, err := ioutil.TempDir(d.dir, "context")
+	if err != nil {
+		t.Fatalf("unable to create context directory: %s", err)
+	}
+
+	for name, content := range files {
+		writeContextFile(t, contextDir, name, content)
+	}
+
+	b, err := NewBuilder(d.URL, nil, contextDir, "", repoTag)
+	if err != nil {
+		t.Fatalf("unable to create builder: %s", err)
+	}
+
+	b.out = ioutil.Discard
+	if b.cache, err = newFileCache(filepath.Join(d.dir, "cache")); err != nil {
+		t.Fatalf("unable to load cache: %s", err)
+	}
+
+	return b
+}
+
+func (d *fakeDaemon) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	urlPath := apiVersionPrefix.ReplaceAllString(r.URL.Path, "/")
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+
+	// An attached container reads its input while it is started, so the
+	// daemon must not be locked for the whole attach.
+	if r.Method == "POST" && len(parts) == 3 && parts[0] == "containers" && parts[2] == "attach" {
+		d.attachContainer(w, parts[1])
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if endpoint := r.Method + " " + parts[len(parts)-1]; d.unavailable[endpoint] > 0 {
+		d.unavailable[endpoint]--
+		http.Error(w, "daemon is busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && urlPath == "/info":
+		d.info(w)
+	case r.Method == "GET" && urlPath == "/version":
+		d.version(w)
+	case r.Method == "POST" && urlPath == "/images/create" && r.URL.Query().Get("fromSrc") == "-":
+		d.importImage(w, r)
+	case r.Method == "POST" && urlPath == "/images/create":
+		d.pullImage(w, r)
+	case r.Method == "GET" && len(parts) >= 3 && parts[0] == "images" && parts[len(parts)-1] == "json":
+		d.inspectImage(w, strings.Join(parts[1:len(parts)-1], "/"))
+	case r.Method == "POST" && len(parts) >= 3 && parts[0] == "images" && parts[len(parts)-1] == "tag":
+		d.tagImage(w, r, strings.Join(parts[1:len(parts)-1], "/"))
+	case r.Method == "POST" && len(parts) >= 3 && parts[0] == "images" && parts[len(parts)-1] == "push":
+		d.pushImage(w, r, strings.Join(parts[1:len(parts)-1], "/"))
+	case r.Method == "DELETE" && len(parts) >= 2 && parts[0] == "images":
+		d.removeImage(w, strings.Join(parts[1:], "/"))
+	case r.Method == "POST" && urlPath == "/containers/create":
+		d.createContainer(w, r)
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "containers":
+		d.removeContainer(w, parts[1])
+	case r.Method == "HEAD" && len(parts) == 3 && parts[0] == "containers" && parts[2] == "archive":
+		d.statContainerPath(w, r, parts[1])
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "containers" && parts[2] == "archive":
+		d.archiveContainerPath(w, r, parts[1])
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "containers" && parts[2] == "export":
+		d.exportContainer(w, parts[1])
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "containers" && (parts[2] == "start" || parts[2] == "stop"):
+		d.startOrStopContainer(w, parts[1])
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "containers" && parts[2] == "json":
+		d.inspectContainer(w, parts[1])
+	case r.Method == "PUT" && len(parts) == 3 && parts[0] == "containers" && parts[2] == "archive":
+		d.extractToContainer(w, r, parts[1])
+	case r.Method == "POST" && urlPath == "/commit":
+		d.commit(w, r)
+	default:
+		http.Error(w, "unexpected request: "+r.Method+" "+urlPath, http.StatusInternalServerError)
+	}
+}
+
+func (d *fakeDaemon) version(w http.ResponseWriter) {
+	if d.apiVersion == "" {
+		http.Error(w, "version unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(&dockerclient.Version{ApiVersion: d.apiVersion})
+}
+
+func (d *fakeDaemon) info(w http.ResponseWriter) {
+	d.infoRequests++
+
+	if d.driver == "" {
+		http.Error(w, "info unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(dockerclient.Info{Driver: d.driver})
+}
+
+func (d *fakeDaemon) pullImage(w http.ResponseWriter, r *http.Request) {
+	d.pulls++
+
+	if d.pulls <= d.pullFailures {
+		http.Error(w, "registry unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	name := r.URL.Query().Get("fromImage")
+	if tag := r.URL.Query().Get("tag"); strings.Contains(tag, ":") {
+		name += "@" + tag
+	} else if tag != "" {
+		name += ":" + tag
+	}
+
+	name = canonicalName(name)
+	platform := r.URL.Query().Get("platform")
+	d.pullPlatforms = append(d.pullPlatforms, platform)
+
+	info, ok := d.platformRegistry[name+" "+platform]
+	if !ok {
+		info, ok = d.registry[name]
+	}
+	if !ok {
+		http.Error(w, "not found: "+name, http.StatusNotFound)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	if d.pullError != "" {
+		encoder.Encode(jsonMessage{Error: d.pullError})
+		return
+	}
+
+	d.images[name] = info
+	d.images[info.Id] = info
+
+	encoder.Encode(jsonMessage{ID: "layer1", Status: "Pulling fs layer"})
+	for current := int64(0); current <= 1000; current += 50 {
+		encoder.Encode(jsonMessage{ID: "layer1", Status: "Downloading", ProgressDetail: &progressDetail{Current: current, Total: 1000}})
+	}
+	encoder.Encode(jsonMessage{ID: "layer1", Status: "Pull complete"})
+	encoder.Encode(jsonMessage{Status: "Downloaded newer image for " + name})
+}
+
+func (d *fakeDaemon) importImage(w http.ResponseWriter, r *http.Request) {
+	files := map[string]string{}
+	dirs := map[string]struct{}{}
+
+	var size int64
+	tr := tar.NewReader(r.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		name := path.Join("/", hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			files[name] = string(content)
+			size += int64(len(content))
+		case tar.TypeDir:
+			dirs[name] = struct{}{}
+		}
+	}
+
+	d.numImages++
+	info := &dockerclient.ImageInfo{
+		Id:          fmt.Sprintf("image%d", d.numImages),
+		Config:      &dockerclient.ContainerConfig{},
+		Size:        size,
+		VirtualSize: size,
+	}
+
+	d.images[info.Id] = info
+	d.imageFiles[info.Id] = files
+	d.imageDirs[info.Id] = dirs
+
+	json.NewEncoder(w).Encode(jsonMessage{Status: info.Id})
+}
+
+func (d *fakeDaemon) inspectImage(w http.ResponseWriter, name string) {
+	info, ok := d.lookupImage(name)
+	if !ok {
+		http.Error(w, "No such image: "+name, http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(info)
+}
+
+func (d *fakeDaemon) tagImage(w http.ResponseWriter, r *http.Request, name string) {
+	info, ok := d.lookupImage(name)
+	if !ok {
+		http.Error(w, "No such image: "+name, http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	tag := query.Get("tag")
+	if tag == "" {
+		tag = "latest"
+	}
+
+	d.tags[canonicalName(query.Get("repo")+":"+tag)] = info.Id
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (d *fakeDaemon) pushImage(w http.ResponseWriter, r *http.Request, repo string) {
+	name := canonicalName(repo + ":" + r.URL.Query().Get("tag"))
+	id, ok := d.tags[name]
+	if !ok {
+		http.Error(w, "No such image: "+name, http.StatusNotFound)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(jsonMessage{Status: "The push refers to a repository [" + repo + "]"})
+	encoder.Encode(jsonMessage{ID: id, Status: "Pushing"})
+	encoder.Encode(jsonMessage{ID: id, Status: "Pushing"})
+
+	if d.pushError != "" {
+		encoder.Encode(jsonMessage{Error: d.pushError})
+		return
+	}
+
+	encoder.Encode(jsonMessage{ID: id, Status: "Pushed"})
+
+	d.pushAuths[name] = r.Header.Get("X-Registry-Auth")
+	d.registry[name] = d.images[id]
+}
+
+func (d *fakeDaemon) removeImage(w http.ResponseWriter, name string) {
+	info, ok := d.lookupImage(name)
+	if !ok {
+		http.Error(w, "No such image: "+name, http.StatusNotFound)
+		return
+	}
+
+	for key, image := range d.images {
+		if image == info {
+			delete(d.images, key)
+		}
+	}
+	delete(d.imageFiles, info.Id)
+	delete(d.imageDirs, info.Id)
+
+	json.NewEncoder(w).Encode([]*dockerclient.ImageDelete{{Deleted: info.Id}})
+}
+
+func (d *fakeDaemon) createContainer(w http.ResponseWriter, r *http.Request) {
+	var config dockerclient.ContainerConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A container starts with the files of its image.
+	files := map[string]string{}
+	dirs := map[string]struct{}{}
+	if config.Image != "" {
+		info, ok := d.images[config.Image]
+		if !ok {
+			http.Error(w, "No such image: "+config.Image, http.StatusNotFound)
+			return
+		}
+
+		for name, content := range d.imageFiles[info.Id] {
+			files[name] = content
+		}
+		for name := range d.imageDirs[info.Id] {
+			dirs[name] = struct{}{}
+		}
+	}
+
+	d.numContainers++
+	id := fmt.Sprintf("container%d", d.numContainers)
+	d.containers[id] = &fakeContainer{
+		config:   &config,
+		files:    files,
+		dirs:     dirs,
+		platform: r.URL.Query().Get("platform"),
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(dockerclient.RespContainersCreate{Id: id})
+}
+
+// attachContainer hijacks the connection and reads the input of the given
+// container until it is closed, then records the run of the container. The
+// container has no output.
+func (d *fakeDaemon) attachContainer(w http.ResponseWriter, id string) {
+	d.mu.Lock()
+	container, ok := d.containers[id]
+	d.mu.Unlock()
+	if !ok {
+		http.Error(w, "No such container: "+id, http.StatusNotFound)
+		return
+	}
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprint(rw, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	rw.Flush()
+
+	input, _ := ioutil.ReadAll(rw)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.runs = append(d.runs, fakeRun{
+		cmd:        append(container.config.Entrypoint, container.config.Cmd...),
+		env:        container.config.Env,
+		workingDir: container.config.WorkingDir,
+		user:       container.config.User,
+		platform:   container.platform,
+		input:      string(input),
+	})
+}
+
+func (d *fakeDaemon) startOrStopContainer(w http.ResponseWriter, id string) {
+	if _, ok := d.containers[id]; !ok {
+		http.Error(w, "No such container: "+id, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *fakeDaemon) inspectContainer(w http.ResponseWriter, id string) {
+	container, ok := d.containers[id]
+	if !ok {
+		http.Error(w, "No such container: "+id, http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(&dockerclient.ContainerInfo{
+		Id:     id,
+		Config: container.config,
+		State:  &dockerclient.State{ExitCode: d.runExitCode},
+	})
+}
+
+func (d *fakeDaemon) removeContainer(w http.ResponseWriter, id string) {
+	if _, ok := d.containers[id]; !ok {
+		http.Error(w, "No such container: "+id, http.StatusNotFound)
+		return
+	}
+
+	delete(d.containers, id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *fakeDaemon) statContainerPath(w http.ResponseWriter, r *http.Request, id string) {
+	container, ok := d.containers[id]
+	if !ok {
+		http.Error(w, "No such container: "+id, http.StatusNotFound)
+		return
+	}
+
+	if d.statStatus != 0 {
+		w.WriteHeader(d.statStatus)
+		return
+	}
+
+	// The fake container filesystem only tracks directories which were
+	// created explicitly, so report that every other path does not exist.
+	dirPath := path.Clean(r.URL.Query().Get("path"))
+	if _, ok := container.dirs[dirPath]; !ok {
+		http.Error(w, "no such file or directory", http.StatusNotFound)
+		return
+	}
+
+	encodedStat, err := json.Marshal(containerPathStat{Name: path.Base(dirPath), Mode: os.ModeDir | 0755})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !d.noPathStat {
+		w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(encodedStat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *fakeDaemon) archiveContainerPath(w http.ResponseWriter, r *http.Request, id string) {
+	container, ok := d.containers[id]
+	if !ok {
+		http.Error(w, "No such container: "+id, http.StatusNotFound)
+		return
+	}
+
+	srcPath := path.Clean(r.URL.Query().Get("path"))
+	base := path.Base(srcPath)
+
+	// The path is either a file or a directory containing files. The
+	// archive entries are relative to the parent of the path.
+	stat := containerPathStat{Name: base, Mode: 0644}
+	entries := map[string]string{}
+	for name, content := range container.files {
+		switch {
+		case name == srcPath:
+			entries[base] = content
+		case strings.HasPrefix(name, srcPath+"/"):
+			entries[path.Join(base, strings.TrimPrefix(name, srcPath+"/"))] = content
+			stat.Mode = os.ModeDir | 0755
+		}
+	}
+
+	if len(entries) == 0 {
+		http.Error(w, "no such file or directory: "+srcPath, http.StatusNotFound)
+		return
+	}
+
+	encodedStat, err := json.Marshal(stat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(encodedStat))
+	w.Header().Set("Content-Type", "application/x-tar")
+
+	tw := tar.NewWriter(w)
+	for name, content := range entries {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		io.WriteString(tw, content)
+	}
+	tw.Close()
+}
+
+func (d *fakeDaemon) exportContainer(w http.ResponseWriter, id string) {
+	container, ok := d.containers[id]
+	if !ok {
+		http.Error(w, "No such container: "+id, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+
+	tw := tar.NewWriter(w)
+	for name := range container.dirs {
+		tw.WriteHeader(&tar.Header{Name: strings.TrimPrefix(name, "/") + "/", Mode: 0755, Typeflag: tar.TypeDir})
+	}
+	for name, content := range container.files {
+		tw.WriteHeader(&tar.Header{Name: strings.TrimPrefix(name, "/"), Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		io.WriteString(tw, content)
+	}
+	tw.Close()
+}
+
+func (d *fakeDaemon) extractToContainer(w http.ResponseWriter, r *http.Request, id string) {
+	container, ok := d.containers[id]
+	if !ok {
+		http.Error(w, "No such container: "+id, http.StatusNotFound)
+		return
+	}
+
+	dstDir := r.URL.Query().Get("path")
+	d.extractEndpoints = append(d.extractEndpoints, path.Base(r.URL.Path))
+
+	tr := tar.NewReader(r.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			container.files[path.Join(dstDir, hdr.Name)] = string(content)
+			container.size += int64(len(content))
+		case tar.TypeDir:
+			container.dirs[path.Join(dstDir, hdr.Name)] = struct{}{}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *fakeDaemon) commit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	containerID := query.Get("container")
+	container, ok := d.containers[containerID]
+	if !ok {
+		http.Error(w, "No such container: "+containerID, http.StatusNotFound)
+		return
+	}
+
+	var config dockerclient.ContainerConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d.numImages++
+	info := &dockerclient.ImageInfo{
+		Id:              fmt.Sprintf("image%d", d.numImages),
+		Author:          query.Get("author"),
+		Comment:         query.Get("comment"),
+		Config:          &config,
+		Container:       containerID,
+		ContainerConfig: container.config,
+		Parent:          container.config.Image,
+		Size:            container.size,
+		VirtualSize:     container.size,
+	}
+
+	if parent, ok := d.images[info.Parent]; ok {
+		info.VirtualSize += parent.VirtualSize
+	}
+
+	d.images[info.Id] = info
+	d.imageFiles[info.Id] = container.files
+	d.imageDirs[info.Id] = container.dirs
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(containerCommitResponse{ID: info.Id})
+}
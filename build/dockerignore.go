@@ -0,0 +1,83 @@
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+const dockerignoreFilename = ".dockerignore"
+
+// readDockerignore returns the patterns of files to exclude from the given
+// build context which are listed in its .dockerignore file, if any. Patterns
+// are relative to the context directory. Blank lines and lines beginning with
+// `#` are ignored.
+//
+// The Dockerfile and the .dockerignore file itself are always read by the
+// builder, even if they are excluded, but excluded files are never copied
+// from the context.
+func readDockerignore(contextDirectory string) ([]string, error) {
+	f, err := os.Open(filepath.Join(contextDirectory, dockerignoreFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %s", dockerignoreFilename, err)
+	}
+	defer f.Close()
+
+	var patterns []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		exception := strings.HasPrefix(pattern, "!")
+		if exception {
+			if pattern = strings.TrimSpace(pattern[1:]); pattern == "" {
+				return nil, fmt.Errorf("invalid pattern in %s: %q", dockerignoreFilename, scanner.Text())
+			}
+		}
+
+		// Patterns are always relative to the context directory.
+		pattern = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(pattern)), "/")
+
+		if exception {
+			pattern = "!" + pattern
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %s", dockerignoreFilename, err)
+	}
+
+	if _, _, _, err := fileutils.CleanPatterns(patterns); err != nil {
+		return nil, fmt.Errorf("invalid pattern in %s: %s", dockerignoreFilename, err)
+	}
+
+	return patterns, nil
+}
+
+// isExcluded returns whether the given path in the build context is excluded
+// by the .dockerignore file.
+func (b *Builder) isExcluded(path string) (bool, error) {
+	if len(b.excludePatterns) == 0 {
+		return false, nil
+	}
+
+	rel, err := filepath.Rel(b.contextDirectory, path)
+	if err != nil {
+		return false, err
+	}
+
+	return fileutils.Matches(filepath.ToSlash(rel), b.excludePatterns)
+}
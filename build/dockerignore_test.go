@@ -0,0 +1,116 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestDockerignore(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	for _, testCase := range []struct {
+		dockerignore string
+		dockerfile   string
+		expected     []string
+		err          string
+	}{
+		{
+			// Everything is excluded, but the Dockerfile is still read.
+			dockerignore: "*\n",
+			dockerfile:   "FROM base\nCOPY . /app/\nLABEL foo bar\n",
+			expected:     nil,
+		},
+		{
+			dockerignore: "*\n!app.go\n",
+			dockerfile:   "FROM base\nCOPY . /app/\n",
+			expected:     []string{"/app/app.go"},
+		},
+		{
+			dockerignore: "# Build files\nDockerfile\n/.dockerignore\n\nlogs\n",
+			dockerfile:   "FROM base\nCOPY . /app/\n",
+			expected:     []string{"/app/app.go", "/app/docs/readme"},
+		},
+		{
+			dockerignore: "docs\nlogs\nDockerfile\n.dockerignore\n",
+			dockerfile:   "FROM base\nCOPY * /app/app.go\n",
+			expected:     []string{"/app/app.go"},
+		},
+		{
+			dockerignore: "Dockerfile\n",
+			dockerfile:   "FROM base\nCOPY Dockerfile /app/\n",
+			err:          `source "Dockerfile" is excluded by .dockerignore`,
+		},
+		{
+			dockerignore: "*.go\n",
+			dockerfile:   "FROM base\nCOPY *.go /app/\n",
+			err:          `no source files match "*.go"`,
+		},
+	} {
+		files := map[string]string{
+			"Dockerfile":    testCase.dockerfile,
+			".dockerignore": testCase.dockerignore,
+			"app.go":        "package main",
+			"logs/build":    "log",
+			"docs/readme":   "docs",
+		}
+
+		b := d.newBuilder(t, files, "")
+
+		err := b.Run()
+		if testCase.err != "" {
+			if err == nil || !strings.Contains(err.Error(), testCase.err) {
+				t.Fatalf("expected error containing %q for %q, got %v", testCase.err, testCase.dockerignore, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("build failed with %q: %s", testCase.dockerignore, err)
+		}
+
+		var copied []string
+		for name := range d.imageFiles[b.ImageID()] {
+			copied = append(copied, name)
+		}
+		sort.Strings(copied)
+
+		if !reflect.DeepEqual(copied, testCase.expected) {
+			t.Fatalf("expected files %v with %q, got %v", testCase.expected, testCase.dockerignore, copied)
+		}
+	}
+}
+
+func TestReadDockerignore(t *testing.T) {
+	dir := newContextDir(t, map[string]string{
+		".dockerignore": "# comment\n\n  /logs/  \n! docs/keep\n**/*.tmp\n",
+	})
+	defer os.RemoveAll(dir)
+
+	patterns, err := readDockerignore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"logs", "!docs/keep", "**/*.tmp"}; !reflect.DeepEqual(patterns, expected) {
+		t.Fatalf("expected patterns %q, got %q", expected, patterns)
+	}
+
+	writeContextFile(t, dir, ".dockerignore", "!\n")
+	if _, err := readDockerignore(dir); err == nil {
+		t.Fatal("expected an error for a lone exclamation mark")
+	}
+
+	os.Remove(filepath.Join(dir, ".dockerignore"))
+	if patterns, err := readDockerignore(dir); err != nil || patterns != nil {
+		t.Fatalf("expected no patterns without a .dockerignore file, got %q, %v", patterns, err)
+	}
+}
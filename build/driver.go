@@ -0,0 +1,96 @@
+package build
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// minAPIVersion is the oldest daemon API version which has the archive
+// endpoint, which is used to copy files into and out of containers.
+const minAPIVersion = "1.20"
+
+// detectStorageDriver records the storage driver of the daemon.
+func (b *Builder) detectStorageDriver() {
+	info, err := b.client.Info()
+	if err != nil {
+		log.Warnf("unable to get daemon info: %s", err)
+		return
+	}
+
+	b.storageDriver = info.Driver
+	log.Debugf("daemon storage driver: %s", b.storageDriver)
+}
+
+// StorageDriver returns the storage driver of the daemon, or an empty string if
+// it can't be determined. The driver does not change how anything is built, so
+// it is only asked for when it is first needed, for diagnostics.
+func (b *Builder) StorageDriver() string {
+	if !b.storageDriverDetected {
+		b.detectStorageDriver()
+		b.storageDriverDetected = true
+	}
+
+	return b.storageDriver
+}
+
+// detectAPIVersion records the API version of the daemon and checks that it
+// is new enough to copy files. If the version can't be determined, the daemon
+// is assumed to be new enough.
+func (b *Builder) detectAPIVersion() error {
+	version, err := b.client.Version()
+	if err != nil {
+		log.Warnf("unable to get daemon version, assuming its API version is at least %s: %s", minAPIVersion, err)
+		return nil
+	}
+
+	b.apiVersion = version.ApiVersion
+	log.Debugf("daemon API version: %s", b.apiVersion)
+
+	if !apiVersionAtLeast(b.apiVersion, minAPIVersion) {
+		return fmt.Errorf("daemon API version %s is too old: the archive endpoint used to copy files requires API version %s or newer", b.apiVersion, minAPIVersion)
+	}
+
+	return nil
+}
+
+// APIVersion returns the API version of the daemon, or an empty string if it
+// is not known. The version is detected when the build is run.
+func (b *Builder) APIVersion() string {
+	return b.apiVersion
+}
+
+// apiVersionAtLeast returns whether the API version is the same as or newer
+// than min. A version which can't be parsed is assumed to be newer.
+func apiVersionAtLeast(version, min string) bool {
+	v, ok := parseAPIVersion(version)
+	if !ok {
+		return true
+	}
+
+	m, _ := parseAPIVersion(min)
+
+	return v[0] > m[0] || (v[0] == m[0] && v[1] >= m[1])
+}
+
+// parseAPIVersion parses an API version of the form major.minor.
+func parseAPIVersion(version string) ([2]int, bool) {
+	var parsed [2]int
+
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return parsed, false
+	}
+
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+
+	return parsed, true
+}
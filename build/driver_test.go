@@ -0,0 +1,86 @@
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestStorageDriver(t *testing.T) {
+	for _, driver := range []string{"aufs", "overlay", "windowsfilter", ""} {
+		d := newFakeDaemon(t)
+		d.driver = driver
+		d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+		files := map[string]string{
+			"Dockerfile": "FROM base\nEXTRACT layer.tar /\n",
+			"layer.tar":  string(makeTar(t, tarEntry{"file", "content"})),
+		}
+
+		b := d.newBuilder(t, files, "")
+		if err := b.Run(); err != nil {
+			t.Fatalf("build with driver %q failed: %s", driver, err)
+		}
+
+		// The driver is only asked for when it is needed, and only once.
+		if d.infoRequests != 0 {
+			t.Errorf("driver %q: expected the build not to ask for the daemon info, got %d requests", driver, d.infoRequests)
+		}
+		for i := 0; i < 2; i++ {
+			if b.StorageDriver() != driver {
+				t.Errorf("expected storage driver %q, got %q", driver, b.StorageDriver())
+			}
+		}
+		if d.infoRequests != 1 {
+			t.Errorf("driver %q: expected 1 request for the daemon info, got %d", driver, d.infoRequests)
+		}
+
+		// EXTRACT uses the standard archive endpoint with every driver.
+		if len(d.extractEndpoints) != 1 || d.extractEndpoints[0] != "archive" {
+			t.Errorf("driver %q: expected EXTRACT to use the archive endpoint, got %q", driver, d.extractEndpoints)
+		}
+
+		d.Close()
+	}
+}
+
+func TestAPIVersion(t *testing.T) {
+	for _, test := range []struct {
+		apiVersion string
+		err        string
+	}{
+		{"1.24", ""},
+		{"1.20", ""},
+		{"2.0", ""},
+		// The daemon is assumed to be new enough if its version is
+		// unknown.
+		{"", ""},
+		{"1.19", "daemon API version 1.19 is too old"},
+	} {
+		d := newFakeDaemon(t)
+		d.apiVersion = test.apiVersion
+		d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+		b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nCOPY file /file\n", "file": "content"}, "")
+		err := b.Run()
+		d.Close()
+
+		if test.err == "" {
+			if err != nil {
+				t.Fatalf("build with API version %q failed: %s", test.apiVersion, err)
+			}
+			if b.APIVersion() != test.apiVersion {
+				t.Errorf("expected API version %q, got %q", test.apiVersion, b.APIVersion())
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expected error containing %q for API version %s, got %v", test.err, test.apiVersion, err)
+		}
+		if d.numContainers != 0 {
+			t.Errorf("expected no containers to be created with API version %s", test.apiVersion)
+		}
+	}
+}
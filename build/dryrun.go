@@ -0,0 +1,62 @@
+package build
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// plannedImagePrefix marks the stand-in ID of an image which a dry run plans
+// to commit.
+const plannedImagePrefix = "planned:"
+
+// SetDryRun sets whether to only plan the build. A dry run parses the
+// Dockerfile and validates the arguments of every command, and it reports the
+// steps of the build and the cache key of each layer it would commit, but it
+// never contacts the daemon. As base images are not pulled, their names stand
+// in for their IDs in the cache keys, which therefore differ from those of a
+// real build, and their config is not known.
+func (b *Builder) SetDryRun(dryRun bool) {
+	b.dryRun = dryRun
+}
+
+// planCommit records the layer which would be committed for the uncommitted
+// commands in place of committing a container. The cache key of the commands
+// identifies the planned image, so later keys depend on it as they would on
+// a committed image.
+func (b *Builder) planCommit() {
+	cacheKey := b.getCacheKey()
+	log.Debugf("planned layer with cache key %s", cacheKey)
+
+	b.imageID = plannedImagePrefix + cacheKey
+	b.stats.layers++
+
+	b.emit(&event{Type: eventPlan, CacheKey: cacheKey})
+
+	b.uncommitted = false
+	b.uncommittedCommands = nil
+}
+
+// printPlanSummary emits an event summarizing the planned build.
+func (b *Builder) printPlanSummary() {
+	b.emit(&event{Type: eventPlan, Summary: &summaryStats{
+		Steps:  b.stats.steps,
+		Layers: b.stats.layers,
+		Size:   -1,
+	}})
+}
+
+// checkSourcesExist returns an error if any of the given paths in the build
+// context, which were specified by the given source argument, does not exist.
+// It is checked before the sources are digested, so that a missing source is
+// reported as such rather than as an archive which can't be digested.
+func checkSourcesExist(source string, srcPaths []string) error {
+	for _, srcPath := range srcPaths {
+		if _, err := os.Lstat(srcPath); err != nil {
+			return fmt.Errorf("unable to access source %q: %s", source, err)
+		}
+	}
+
+	return nil
+}
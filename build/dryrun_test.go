@@ -0,0 +1,82 @@
+package build
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	files := map[string]string{
+		"Dockerfile": strings.Join([]string{
+			"FROM golang:1.6 AS builder",
+			"WORKDIR /src",
+			"COPY main.go /src/",
+			"RUN go build",
+			"FROM busybox",
+			"COPY --from=builder /src/app /app",
+			"ENV APP /app",
+			"",
+		}, "\n"),
+		"main.go": "package main",
+	}
+
+	plan := func() string {
+		b := d.newBuilder(t, files, "example/app")
+		b.SetDryRun(true)
+
+		var out bytes.Buffer
+		b.out = &out
+
+		if err := b.Run(); err != nil {
+			t.Fatalf("dry run failed: %s", err)
+		}
+
+		return out.String()
+	}
+
+	// The daemon is never contacted.
+	d.Server.Close()
+
+	output := plan()
+	if count := strings.Count(output, "planned layer with cache key"); count != 4 {
+		t.Fatalf("expected 4 planned layers, got %d in output:\n%s", count, output)
+	}
+	if !strings.HasSuffix(output, "Planned 7 steps and 4 layers; nothing was built\n") {
+		t.Fatalf("expected a summary of the plan, got output:\n%s", output)
+	}
+
+	if again := plan(); again != output {
+		t.Fatalf("expected the same plan, got:\n%s\nthen:\n%s", output, again)
+	}
+
+	// The cache keys depend on the content of the context.
+	files["main.go"] = "package main // changed"
+	if changed := plan(); changed == output {
+		t.Fatalf("expected a different plan after changing a source, got:\n%s", changed)
+	}
+}
+
+func TestDryRunValidates(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+	d.Server.Close()
+
+	for dockerfile, expected := range map[string]string{
+		"FROM Invalid/Name\n":                   "invalid image name",
+		"FROM busybox\nEXPOSE 70000\n":          "invalid port",
+		"FROM busybox\nCOPY missing /\n":        "missing",
+		"FROM busybox\nCOPY --from=1 a /\n":     "invalid --from value",
+		"FROM busybox\nRUN --network=host sh\n": "invalid --network value",
+	} {
+		b := d.newBuilder(t, map[string]string{"Dockerfile": dockerfile}, "")
+		b.SetDryRun(true)
+
+		if err := b.Run(); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %q, got %v", expected, dockerfile, err)
+		}
+	}
+}
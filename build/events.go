@@ -0,0 +1,197 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
+)
+
+// Output formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Types of build events.
+const (
+	eventStep     = "step"
+	eventInput    = "input"
+	eventOutput   = "output"
+	eventPull     = "pull"
+	eventCacheHit = "cache-hit"
+	eventRun      = "run"
+	eventCommit   = "commit"
+	eventImage    = "image"
+	eventPush     = "push"
+	eventPlan     = "plan"
+	eventSummary  = "summary"
+	eventError    = "error"
+)
+
+// event is a record of the progress of a build. In the JSON format, each
+// event is written as a single line JSON object.
+type event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Step is the number of the step during which the event occurred.
+	Step int `json:"step"`
+
+	Command string `json:"command,omitempty"`
+	Image   string `json:"image,omitempty"`
+	ImageID string `json:"imageId,omitempty"`
+	// Stream is the name of the container stream of an output event.
+	Stream  string `json:"stream,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// Duration is the time in seconds taken by the command of a run event,
+	// and ExitCode is its exit code.
+	Duration float64 `json:"duration,omitempty"`
+	ExitCode *int    `json:"exitCode,omitempty"`
+
+	// CacheKey is the cache key of a layer planned by a dry run.
+	CacheKey string `json:"cacheKey,omitempty"`
+
+	Summary *summaryStats `json:"summary,omitempty"`
+}
+
+// summaryStats holds the statistics of a summary event.
+type summaryStats struct {
+	Duration  float64 `json:"duration"`
+	Steps     int     `json:"steps"`
+	CacheHits int     `json:"cacheHits"`
+	Layers    int     `json:"layers"`
+	// Size is the total size of the image in bytes, or -1 if unknown.
+	Size int64 `json:"size"`
+}
+
+// SetFormat sets the format of the build output, which is either FormatText,
+// the default, or FormatJSON.
+func (b *Builder) SetFormat(format string) error {
+	switch format {
+	case FormatText, FormatJSON:
+		b.format = format
+	case "":
+		b.format = FormatText
+	default:
+		return fmt.Errorf("unknown output format %q: must be %q or %q", format, FormatText, FormatJSON)
+	}
+
+	return nil
+}
+
+// SetOutput sets the writer which receives the build output, which is
+// os.Stdout by default.
+func (b *Builder) SetOutput(out io.Writer) {
+	b.out = out
+}
+
+// emit writes the given event to the build output in the configured format.
+// In quiet mode, only the ID of the built image is written.
+func (b *Builder) emit(e *event) {
+	if b.quiet && e.Type != eventImage {
+		return
+	}
+
+	e.Time = time.Now().UTC()
+	e.Step = b.step
+	e.Command = b.maskSecrets(e.Command)
+	e.Message = b.maskSecrets(e.Message)
+
+	if b.format == FormatJSON {
+		if err := json.NewEncoder(b.out).Encode(e); err != nil {
+			log.Debugf("unable to encode build event: %s", err)
+		}
+		return
+	}
+
+	switch e.Type {
+	case eventStep:
+		fmt.Fprintf(b.out, "Step %d: %s\n", e.Step, e.Command)
+	case eventInput:
+		fmt.Fprintf(b.out, "Input:\n%s\n", e.Message)
+	case eventOutput:
+		fmt.Fprint(b.out, e.Message)
+	case eventPull:
+		if e.Message == "" {
+			fmt.Fprintf(b.out, "pulling %s ...\n", e.Image)
+		} else {
+			fmt.Fprintln(b.out, e.Message)
+		}
+	case eventRun:
+		if *e.ExitCode == 0 {
+			fmt.Fprintf(b.out, " ---> Ran in %.1fs\n", e.Duration)
+		} else {
+			fmt.Fprintf(b.out, " ---> Failed with exit code %d in %.1fs\n", *e.ExitCode, e.Duration)
+		}
+	case eventCacheHit:
+		fmt.Fprintf(b.out, " cache hit ---> %s\n", e.ImageID)
+	case eventCommit:
+		fmt.Fprintf(b.out, " ---> %s\n", e.ImageID)
+	case eventImage:
+		if b.quiet {
+			fmt.Fprintln(b.out, e.ImageID)
+		} else {
+			fmt.Fprintf(b.out, "Successfully built %s\n", e.Image)
+		}
+	case eventPush:
+		if e.Message == "" {
+			fmt.Fprintf(b.out, "pushing %s ...\n", e.Image)
+		} else {
+			fmt.Fprintln(b.out, e.Message)
+		}
+	case eventPlan:
+		if e.Summary != nil {
+			fmt.Fprintf(b.out, "Planned %d steps and %d layers; nothing was built\n", e.Summary.Steps, e.Summary.Layers)
+		} else {
+			fmt.Fprintf(b.out, " ---> planned layer with cache key %s\n", e.CacheKey)
+		}
+	case eventSummary:
+		size := "unknown"
+		if e.Summary.Size >= 0 {
+			size = units.HumanSize(float64(e.Summary.Size))
+		}
+
+		fmt.Fprintf(
+			b.out, "Built %s in %.1fs; %d steps, %d cache hits, %d layers, total size %s\n",
+			e.Image, e.Summary.Duration, e.Summary.Steps, e.Summary.CacheHits, e.Summary.Layers, size,
+		)
+	case eventError:
+		// Errors are reported by the caller of Run.
+	}
+}
+
+// outputWriter emits everything written to it as output events from the named
+// container stream. The end of what is written which may be the start of a
+// secret value is held back until the next write, so that a value split
+// between writes is still masked. Flush emits what is held back.
+type outputWriter struct {
+	b       *Builder
+	stream  string
+	pending string
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	secrets := w.b.secretValues()
+
+	output := w.b.maskSecrets(w.pending + string(p))
+	held := secretPrefixLen(output, secrets)
+	w.pending = output[len(output)-held:]
+
+	if output = output[:len(output)-held]; output != "" {
+		w.b.emit(&event{Type: eventOutput, Stream: w.stream, Message: output})
+	}
+
+	return len(p), nil
+}
+
+// Flush emits the output held back by the writer.
+func (w *outputWriter) Flush() {
+	if w.pending != "" {
+		w.b.emit(&event{Type: eventOutput, Stream: w.stream, Message: w.pending})
+		w.pending = ""
+	}
+}
@@ -0,0 +1,137 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+// decodeEvents decodes the stream of JSON events from a build.
+func decodeEvents(t *testing.T, out *bytes.Buffer) []event {
+	var events []event
+
+	decoder := json.NewDecoder(out)
+	for {
+		var e event
+		if err := decoder.Decode(&e); err == io.EOF {
+			return events
+		} else if err != nil {
+			t.Fatalf("unable to decode build event: %s", err)
+		}
+
+		events = append(events, e)
+	}
+}
+
+func TestJSONEvents(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nCOPY a /a\nLABEL foo bar\n",
+		"a":          "aaaa",
+	}
+
+	build := func() (*Builder, []event) {
+		b := d.newBuilder(t, files, "app:latest")
+		if err := b.SetFormat(FormatJSON); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		b.out = &out
+
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b, decodeEvents(t, &out)
+	}
+
+	expectEvents := func(events []event, expected ...event) {
+		if len(events) != len(expected) {
+			t.Fatalf("expected %d events, got %d: %+v", len(expected), len(events), events)
+		}
+
+		for i, e := range events {
+			want := expected[i]
+			if e.Type != want.Type || e.Step != want.Step || e.Command != want.Command || e.ImageID != want.ImageID {
+				t.Fatalf("event %d: expected %+v, got %+v", i, want, e)
+			}
+			if e.Time.IsZero() {
+				t.Fatalf("event %d has no time", i)
+			}
+		}
+	}
+
+	b, events := build()
+	expectEvents(events,
+		event{Type: eventStep, Step: 0, Command: "FROM base"},
+		event{Type: eventStep, Step: 1, Command: "COPY a /a"},
+		event{Type: eventCommit, Step: 1, ImageID: "image1"},
+		event{Type: eventStep, Step: 2, Command: "LABEL foo bar"},
+		event{Type: eventCommit, Step: 2, ImageID: "image2"},
+		event{Type: eventImage, Step: 2, ImageID: b.ImageID()},
+		event{Type: eventSummary, Step: 2, ImageID: b.ImageID()},
+	)
+
+	if summary := events[len(events)-1].Summary; summary == nil || summary.Steps != 3 || summary.Layers != 2 || summary.Size != 4 {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+
+	_, events = build()
+	expectEvents(events,
+		event{Type: eventStep, Step: 0, Command: "FROM base"},
+		event{Type: eventStep, Step: 1, Command: "COPY a /a"},
+		event{Type: eventCacheHit, Step: 1, ImageID: "image1"},
+		event{Type: eventStep, Step: 2, Command: "LABEL foo bar"},
+		event{Type: eventCacheHit, Step: 2, ImageID: "image2"},
+		event{Type: eventImage, Step: 2, ImageID: "image2"},
+		event{Type: eventSummary, Step: 2, ImageID: "image2"},
+	)
+}
+
+func TestJSONErrorEvent(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	b := d.newBuilder(t, map[string]string{
+		"Dockerfile": "FROM scratch\nFROB foo\n",
+	}, "")
+	if err := b.SetFormat(FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	b.out = &out
+
+	err := b.Run()
+	if err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	events := decodeEvents(t, &out)
+	last := events[len(events)-1]
+	if last.Type != eventError || last.Message != err.Error() {
+		t.Fatalf("expected an error event for %q, got %+v", err, last)
+	}
+}
+
+func TestSetFormat(t *testing.T) {
+	b := &Builder{}
+
+	for _, format := range []string{FormatText, FormatJSON, ""} {
+		if err := b.SetFormat(format); err != nil {
+			t.Errorf("unexpected error for format %q: %s", format, err)
+		}
+	}
+
+	if err := b.SetFormat("yaml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
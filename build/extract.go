@@ -4,71 +4,114 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/jlhawn/dockramp/archive"
 	"github.com/jlhawn/dockramp/build/commands"
-	"github.com/jlhawn/tarsum"
+	"github.com/jlhawn/dockramp/tarsum"
 )
 
 func (b *Builder) handleExtract(args []string, heredoc string) error {
 	log.Debugf("handling %s with args: %#v", commands.Extract, args)
 
-	if len(args) != 2 {
-		return fmt.Errorf("%s requires exactly two arguments", commands.Extract)
+	srcPaths, err := b.contextSources(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := checkSourcesExist(args[0], srcPaths); err != nil {
+		return err
 	}
 
-	if b.checkExtractCache(args[0]) {
+	if hit, err := b.checkExtractCache(srcPaths); err != nil || hit {
+		return err
+	}
+
+	if b.dryRun {
 		return nil
 	}
 
-	containerID, err := b.createContainer([]string{"/bin/sh", "-c"}, []string{"#(nop)"}, false)
+	containerID, err := b.createContainer([]string{"/bin/sh", "-c"}, b.nopCommand(), false)
 	if err != nil {
 		return fmt.Errorf("unable to create container: %s", err)
 	}
 
-	if err := b.extractToContainer(args[0], containerID, args[1]); err != nil {
-		return fmt.Errorf("unable to copy to container: %s", err)
-	}
-
+	// The container is removed by Run if the build fails.
 	b.containerID = containerID
 
+	for _, srcPath := range srcPaths {
+		if err := b.extractToContainer(srcPath, containerID, args[1]); err != nil {
+			return fmt.Errorf("unable to copy to container: %s", err)
+		}
+	}
+
 	return nil
 }
 
-func (b *Builder) checkExtractCache(srcPath string) bool {
-	srcPath = fmt.Sprintf("%s%c%s", b.contextDirectory, filepath.Separator, srcPath)
-
-	srcArchive, err := os.Open(srcPath)
-	if err != nil {
-		log.Debugf("unable to open source archive: %s", err)
-		return false
+// checkExtractCache digests the content of each source archive to probe the
+// cache. Compressed archives are decompressed first so that archives with the
+// same content hit the cache no matter how they were compressed. An archive
+// which can't be digested, such as a truncated one, fails the step rather than
+// leaving its digest out of the cache key.
+func (b *Builder) checkExtractCache(srcPaths []string) (bool, error) {
+	for _, srcPath := range srcPaths {
+		extractDigest, err := tarsum.DigestFile(srcPath, b.tarsumVersion)
+		if err != nil {
+			return false, fmt.Errorf("unable to digest source archive %s: %s", srcPath, err)
+		}
+
+		b.uncommittedCommands = append(b.uncommittedCommands, fmt.Sprintf("EXTRACT digest: %s", extractDigest))
 	}
-	defer srcArchive.Close()
 
-	digester, err := tarsum.NewDigest(tarsum.Version1)
-	if err != nil {
-		log.Debugf("unable to get new tarsum digester: %s", err)
-		return false
+	if b.probeCache() {
+		return true, nil
 	}
 
-	if _, err := io.Copy(digester, srcArchive); err != nil {
-		log.Debugf("unable to digest source archive: %s", err)
-		return false
+	logArchiveFileSums(srcPaths, b.tarsumVersion)
+
+	return false, nil
+}
+
+// logArchiveFileSums logs the checksum of each file in the given source
+// archives after a cache miss. The checksums are only needed in debug mode, so
+// the archives are only digested again for them then.
+func logArchiveFileSums(srcPaths []string, version tarsum.Version) {
+	if log.GetLevel() < log.DebugLevel {
+		return
 	}
 
-	copyDigest := fmt.Sprintf("%x", digester.Sum(nil))
-	b.uncommittedCommands = append(b.uncommittedCommands, fmt.Sprintf("EXTRACT digest: %s", copyDigest))
+	fileSums := make(map[string][]tarsum.FileSum, len(srcPaths))
+	for _, srcPath := range srcPaths {
+		srcArchive, err := os.Open(srcPath)
+		if err != nil {
+			log.Debugf("unable to open source archive: %s", err)
+			continue
+		}
+
+		content, err := archive.DecompressStream(srcArchive)
+		if err == nil {
+			_, fileSums[srcPath], err = digestTar(content, version)
+			content.Close()
+		}
+		srcArchive.Close()
+
+		if err != nil {
+			log.Debugf("unable to digest source archive %s: %s", srcPath, err)
+		}
+	}
 
-	return b.probeCache()
+	logFileSums(srcPaths, fileSums)
 }
 
-func (b *Builder) extractToContainer(srcPath, dstContainer, dstDir string) (err error) {
-	srcPath = fmt.Sprintf("%s%c%s", b.contextDirectory, filepath.Separator, srcPath)
-
+// extractToContainer extracts the archive at srcPath to the existing directory
+// dstDir in the given container using the standard archive endpoint, which
+// decompresses the archive if necessary.
+func (b *Builder) extractToContainer(srcPath, dstContainer, dstDir string) error {
 	srcArchive, err := os.Open(srcPath)
 	if err != nil {
 		return fmt.Errorf("unable to open source archive: %s", err)
@@ -78,7 +121,7 @@ func (b *Builder) extractToContainer(srcPath, dstContainer, dstDir string) (err
 	query := make(url.Values, 1)
 	query.Set("path", filepath.ToSlash(dstDir)) // Normalize the paths used in the API.
 
-	urlPath := fmt.Sprintf("/containers/%s/extract-to-dir?%s", dstContainer, query.Encode())
+	urlPath := fmt.Sprintf("/containers/%s/archive?%s", dstContainer, query.Encode())
 	req, err := http.NewRequest("PUT", b.client.URL.String()+urlPath, srcArchive)
 	if err != nil {
 		return fmt.Errorf("unable to prepare request: %s", err)
@@ -86,7 +129,15 @@ func (b *Builder) extractToContainer(srcPath, dstContainer, dstDir string) (err
 
 	req.Header.Set("Content-Type", "application/x-tar")
 
-	resp, err := b.client.HTTPClient.Do(req)
+	// The archive is read again from the start if the request is retried.
+	req.GetBody = func() (io.ReadCloser, error) {
+		if _, err := srcArchive.Seek(0, os.SEEK_SET); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(srcArchive), nil
+	}
+
+	resp, err := b.doDaemonRequest(req, true)
 	if err != nil {
 		return fmt.Errorf("unable to make request: %s", err)
 	}
@@ -0,0 +1,194 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jlhawn/dockramp/archive"
+	"github.com/jlhawn/dockramp/tarsum"
+	"github.com/samalba/dockerclient"
+)
+
+type tarEntry struct {
+	name, content string
+}
+
+// makeTar returns a tar archive of the given entries in the given order.
+func makeTar(t *testing.T, entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:    entry.name,
+			Mode:    0644,
+			Size:    int64(len(entry.content)),
+			ModTime: time.Unix(1234567890, 0),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte, level int) []byte {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDigestArchiveIgnoresCompressionAndOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockramp-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, b := tarEntry{"a", "first"}, tarEntry{"b", "second"}
+	plain := makeTar(t, a, b)
+
+	archives := map[string][]byte{
+		"plain.tar":     plain,
+		"reordered.tar": makeTar(t, b, a),
+		"fast.tar.gz":   gzipBytes(t, plain, gzip.BestSpeed),
+		"best.tar.gz":   gzipBytes(t, plain, gzip.BestCompression),
+	}
+
+	digests := map[string]string{}
+	for name, data := range archives {
+		srcPath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(srcPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		digest, err := tarsum.DigestFile(srcPath, tarsum.Version1)
+		if err != nil {
+			t.Fatalf("unable to digest %s: %s", name, err)
+		}
+		digests[name] = digest
+	}
+
+	for name, digest := range digests {
+		if digest != digests["plain.tar"] {
+			t.Errorf("digest of %s (%s) differs from plain.tar (%s)", name, digest, digests["plain.tar"])
+		}
+	}
+
+	changed := filepath.Join(dir, "changed.tar.gz")
+	if err := ioutil.WriteFile(changed, gzipBytes(t, makeTar(t, a, tarEntry{"b", "changed"}), gzip.DefaultCompression), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := tarsum.DigestFile(changed, tarsum.Version1)
+	if err != nil {
+		t.Fatalf("unable to digest changed.tar.gz: %s", err)
+	}
+	if digest == digests["plain.tar"] {
+		t.Error("digest did not change with the content of the archive")
+	}
+
+	// A truncated archive cannot be digested.
+	truncated := filepath.Join(dir, "truncated.tar")
+	if err := ioutil.WriteFile(truncated, plain[:len(plain)-1024], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tarsum.DigestFile(truncated, tarsum.Version1); err == nil || !strings.Contains(err.Error(), "incomplete archive") {
+		t.Fatalf("expected an incomplete archive error for truncated.tar, got %v", err)
+	}
+}
+
+func TestDigestCacheLinesAreLabeled(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	dir, err := ioutil.TempDir("", "dockramp-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcPath := filepath.Join(dir, "src.tar")
+	if err := ioutil.WriteFile(srcPath, makeTar(t, tarEntry{"a", "first"}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same content digested with each version gives a different line in
+	// the cache key.
+	lines := map[string]bool{}
+	for version, label := range map[tarsum.Version]string{
+		tarsum.Version1: "tarsum.v1+sha256:",
+		tarsum.Version2: "tarsum.v2+sha512:",
+	} {
+		b := d.builder(t)
+		b.tarsumVersion = version
+
+		if _, err := b.checkExtractCache([]string{srcPath}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.checkCopyCache([]string{srcPath}, &archive.TarOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, prefix := range []string{"EXTRACT digest: ", "COPY digest: "} {
+			if line := b.uncommittedCommands[i]; !strings.HasPrefix(line, prefix+label) {
+				t.Errorf("expected a line starting with %q, got %q", prefix+label, line)
+			}
+		}
+
+		for _, line := range b.uncommittedCommands {
+			lines[line] = true
+		}
+	}
+
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 distinct cache key lines, got %d", len(lines))
+	}
+}
+
+func TestExtractTruncatedArchive(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	// Cut the archive off in the middle of the content of its first entry.
+	archived := makeTar(t, tarEntry{"a", strings.Repeat("a", 1000)}, tarEntry{"b", "second"})
+	truncated := string(archived[:700])
+
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nEXTRACT src.tar /dst/\n", "src.tar": truncated}, "")
+	err := b.Run()
+	if err == nil || !strings.Contains(err.Error(), "unable to digest source archive") {
+		t.Fatalf("expected the truncated archive to fail the build, got %v", err)
+	}
+
+	if len(d.extractEndpoints) != 0 {
+		t.Fatalf("expected nothing to be extracted, got %q", d.extractEndpoints)
+	}
+}
@@ -0,0 +1,45 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+)
+
+// instructionFlags holds the `--name=value` options given to an instruction
+// keyed by name. An option given without a value has the value "true".
+type instructionFlags map[string]string
+
+// parseFlags separates the leading options of an instruction from its
+// positional arguments. Options must be in the allowed set for the command.
+// An argument of `--` ends the options. The returned flagArgs are the raw
+// arguments which specified the options, including any `--`.
+func parseFlags(cmd string, args []string, allowed map[string]struct{}) (flags instructionFlags, flagArgs, rest []string, err error) {
+	flags = instructionFlags{}
+
+	for i, arg := range args {
+		if arg == "--" {
+			return flags, args[:i+1], args[i+1:], nil
+		}
+
+		if !strings.HasPrefix(arg, "--") {
+			return flags, args[:i], args[i:], nil
+		}
+
+		name, value := arg[2:], "true"
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value = name[:j], name[j+1:]
+		}
+
+		if _, ok := allowed[name]; !ok {
+			return nil, nil, nil, fmt.Errorf("unknown flag for %s: --%s", cmd, name)
+		}
+
+		if _, ok := flags[name]; ok {
+			return nil, nil, nil, fmt.Errorf("duplicate flag for %s: --%s", cmd, name)
+		}
+
+		flags[name] = value
+	}
+
+	return flags, args, nil, nil
+}
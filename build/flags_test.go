@@ -0,0 +1,62 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	allowed := map[string]struct{}{"chown": {}, "check": {}}
+
+	testCases := []struct {
+		args     []string
+		flags    instructionFlags
+		flagArgs []string
+		rest     []string
+	}{
+		{
+			args:     []string{"src", "dst"},
+			flags:    instructionFlags{},
+			flagArgs: []string{},
+			rest:     []string{"src", "dst"},
+		},
+		{
+			args:     []string{"--chown=1:2", "--check", "src", "--dst"},
+			flags:    instructionFlags{"chown": "1:2", "check": "true"},
+			flagArgs: []string{"--chown=1:2", "--check"},
+			rest:     []string{"src", "--dst"},
+		},
+		{
+			args:     []string{"--chown=1", "--", "--src", "dst"},
+			flags:    instructionFlags{"chown": "1"},
+			flagArgs: []string{"--chown=1", "--"},
+			rest:     []string{"--src", "dst"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		flags, flagArgs, rest, err := parseFlags("COPY", testCase.args, allowed)
+		if err != nil {
+			t.Fatalf("unable to parse %q: %s", testCase.args, err)
+		}
+
+		if !reflect.DeepEqual(flags, testCase.flags) {
+			t.Fatalf("parsing %q: expected flags %v, got %v", testCase.args, testCase.flags, flags)
+		}
+		if len(flagArgs) != len(testCase.flagArgs) || (len(flagArgs) > 0 && !reflect.DeepEqual(flagArgs, testCase.flagArgs)) {
+			t.Fatalf("parsing %q: expected flag args %q, got %q", testCase.args, testCase.flagArgs, flagArgs)
+		}
+		if !reflect.DeepEqual(rest, testCase.rest) {
+			t.Fatalf("parsing %q: expected args %q, got %q", testCase.args, testCase.rest, rest)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"--unknown=1", "src", "dst"},
+		{"--chown=1", "--chown=2", "src", "dst"},
+	} {
+		if _, _, _, err := parseFlags("COPY", args, allowed); err == nil {
+			t.Fatalf("expected an error parsing %q", args)
+		}
+	}
+}
@@ -2,9 +2,12 @@ package build
 
 import (
 	"fmt"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
 	"github.com/jlhawn/dockramp/build/commands"
+	"github.com/jlhawn/dockramp/util"
 	"github.com/samalba/dockerclient"
 )
 
@@ -16,11 +19,36 @@ const (
 func (b *Builder) handleFrom(args []string, heredoc string) error {
 	log.Debugf("handling %s with args: %#v", commands.From, args)
 
-	if len(args) != 1 {
-		return fmt.Errorf("%s requires exactly one argument", commands.From)
+	imageName, stageName, err := parseFromArgs(args)
+	if err != nil {
+		return err
+	}
+
+	if err := b.startStage(stageName); err != nil {
+		return err
 	}
 
-	imageName := args[0]
+	if stage, ok := b.lookupStageName(imageName); ok {
+		log.Debugf("building from stage %q: %s", stage.name, stage.imageID)
+
+		if stage.imageID == "" || b.dryRun {
+			// The stage did not add anything to an empty image, or
+			// its image is only planned.
+			b.imageID = stage.imageID
+			b.mergeConfig(nil)
+			return nil
+		}
+
+		info, err := b.client.InspectImage(stage.imageID)
+		if err != nil {
+			return fmt.Errorf("unable to inspect image of stage %q: %s", stage.name, err)
+		}
+
+		b.imageID = info.Id
+		b.mergeConfig(info.Config)
+
+		return nil
+	}
 
 	if imageName == fromScratch {
 		log.Debugf("building image from scratch")
@@ -31,44 +59,119 @@ func (b *Builder) handleFrom(args []string, heredoc string) error {
 		return nil
 	}
 
-	// See if it already exists.
-	info, err := b.client.InspectImage(imageName)
-	if err == nil {
-		b.imageID = info.Id
-		b.mergeConfig(info.Config)
+	info, err := b.resolveImage(imageName)
+	if err != nil {
+		return err
+	}
 
-		log.Debugf("got image ID: %s", b.imageID)
+	b.imageID = info.Id
+	b.mergeConfig(info.Config)
 
-		return nil
+	log.Debugf("got image ID: %s", b.imageID)
+
+	return nil
+}
+
+// resolveImage returns the local image with the given name, pulling it first
+// if it does not exist, if it is for another platform than that of the build,
+// or if every image is pulled. The ID of the image is the start of the cache
+// key of every step built on it.
+func (b *Builder) resolveImage(imageName string) (*dockerclient.ImageInfo, error) {
+	if err := validateImageDigest(imageName); err != nil {
+		return nil, err
 	}
 
-	if err != dockerclient.ErrNotFound {
-		fmt.Errorf("unable to inspect image: %s", err)
+	imageName, err := canonicalImageName(b.mirrorImageName(imageName))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image name: %s", err)
+	}
+
+	if b.dryRun {
+		// The name stands in for the ID of the image, and its config is
+		// not known.
+		return &dockerclient.ImageInfo{Id: imageName}, nil
+	}
+
+	if !b.pull {
+		// See if it already exists. An image for another platform is
+		// pulled again for the platform of the build.
+		info, err := b.client.InspectImage(imageName)
+		if err == nil && (b.platform == nil || b.platform.matches(info)) {
+			return info, nil
+		}
+
+		if err != nil && !isImageNotFound(err) {
+			return nil, fmt.Errorf("unable to inspect image: %s", err)
+		}
 	}
 
 	// Need to pull the image.
-	fmt.Fprintln(b.out, "pulling image ...")
-	if err := b.client.PullImage(imageName, nil); err != nil {
-		return fmt.Errorf("unable to pull image: %s", err)
+	b.emit(&event{Type: eventPull, Image: imageName})
+	if err := b.pullImage(imageName); err != nil {
+		return nil, pullError(imageName, err)
 	}
 
 	// Inspect to get the ID.
-	info, err = b.client.InspectImage(imageName)
+	info, err := b.client.InspectImage(imageName)
 	if err != nil {
-		return fmt.Errorf("unable to inspect image: %s", err)
+		return nil, fmt.Errorf("unable to inspect image: %s", err)
 	}
 
-	b.imageID = info.Id
-	b.mergeConfig(info.Config)
+	if b.platform != nil && !b.platform.matches(info) {
+		return nil, fmt.Errorf("image %s is not available for platform %s: pulled an image for %s/%s", imageName, b.platform, info.Os, info.Architecture)
+	}
+
+	log.Debugf("resolved %s to image %s", imageName, info.Id)
+
+	return info, nil
+}
+
+// canonicalImageName returns the fully qualified form of the given image
+// reference with either its tag or, if it has one, its digest. An image
+// referenced by digest is pulled and inspected by that digest alone, so any
+// tag given with it is dropped.
+func canonicalImageName(imageName string) (string, error) {
+	repo, tag, digest, err := util.Canonicalize(imageName)
+	if err != nil {
+		return "", err
+	}
+
+	if digest != "" {
+		return repo + "@" + digest, nil
+	}
+
+	return repo + ":" + tag, nil
+}
+
+// validateImageDigest returns an error if the given image reference has a
+// digest which is not well-formed. A reference which is built from variables
+// is not checked until they have been substituted.
+func validateImageDigest(imageName string) error {
+	i := strings.Index(imageName, "@")
+	if i < 0 || strings.Contains(imageName, "$") {
+		return nil
+	}
+
+	if _, err := digest.ParseDigest(imageName[i+1:]); err != nil {
+		return fmt.Errorf("invalid digest in image reference %q: %s: expected an algorithm and hex digits such as sha256:<64 hex digits>", imageName, err)
+	}
 
 	return nil
 }
 
+// isImageNotFound returns whether the given error from the client means that
+// an image does not exist.
+func isImageNotFound(err error) bool {
+	return err == dockerclient.ErrNotFound || err == dockerclient.ErrImageNotFound
+}
+
 func (b *Builder) mergeConfig(config *dockerclient.ContainerConfig) {
 	if config != nil {
 		b.config.User = config.User
 		b.config.ExposedPorts = config.ExposedPorts
-		b.config.Env = config.Env
+		// The environment is copied so that ENV does not modify the
+		// config of the base image.
+		b.config.Env = dedupeEnv(config.Env)
 		b.config.Cmd = config.Cmd
 		b.config.Volumes = config.Volumes
 		b.config.WorkingDir = config.WorkingDir
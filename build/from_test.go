@@ -0,0 +1,103 @@
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestFromCanonicalizesImageName(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addRegistryImage("docker.io/library/busybox:latest", &dockerclient.ImageInfo{Id: "busybox-id"})
+
+	b := d.builder(t)
+
+	for _, imageName := range []string{"busybox", "library/busybox:latest", "docker.io/busybox"} {
+		if err := b.handleFrom([]string{imageName}, ""); err != nil {
+			t.Fatalf("unable to handle FROM %s: %s", imageName, err)
+		}
+
+		if b.imageID != "busybox-id" {
+			t.Fatalf("FROM %s: expected image ID %q, got %q", imageName, "busybox-id", b.imageID)
+		}
+	}
+
+	// Only the first FROM needs to pull the image.
+	if d.pulls != 1 {
+		t.Fatalf("expected 1 pull, got %d", d.pulls)
+	}
+
+	if err := b.handleFrom([]string{"BusyBox"}, ""); err == nil {
+		t.Fatal("expected an error for an invalid image name")
+	}
+
+	if d.pulls != 1 {
+		t.Fatalf("expected no pull for an invalid image name, got %d", d.pulls-1)
+	}
+}
+
+func TestFromInspectError(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+	d.addRegistryImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	// The daemon fails to inspect the image for a reason other than it
+	// not existing.
+	d.unavailable["GET json"] = 1
+
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nCOPY file /file\n", "file": "content"}, "")
+	if err := b.Run(); err == nil || !strings.Contains(err.Error(), "unable to inspect image") {
+		t.Fatalf("expected the build to fail to inspect the image, got %v", err)
+	}
+
+	// The error is not masked by pulling the image instead.
+	if d.pulls != 0 {
+		t.Fatalf("expected no pulls, got %d", d.pulls)
+	}
+	if d.numContainers != 0 {
+		t.Fatalf("expected no containers to be created, got %d", d.numContainers)
+	}
+}
+
+func TestFromDigest(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	const digest = "sha256:4bf9cc1a1e5b4e3f8ebc4fb9e2bcf9a4e5f0ba3ae0e7cc8dbd1f3a1e5d1b3c2a"
+
+	d.addRegistryImage("alpine:3.4", &dockerclient.ImageInfo{Id: "tagged-id"})
+	d.addRegistryImage("alpine@"+digest, &dockerclient.ImageInfo{Id: "pinned-id"})
+
+	// An image referenced by digest is pulled by the digest alone, even if
+	// a tag is also given.
+	for _, imageName := range []string{"alpine@" + digest, "alpine:3.4@" + digest} {
+		b := d.builder(t)
+		if err := b.handleFrom([]string{imageName}, ""); err != nil {
+			t.Fatalf("unable to handle FROM %s: %s", imageName, err)
+		}
+
+		if b.imageID != "pinned-id" {
+			t.Fatalf("FROM %s: expected image ID %q, got %q", imageName, "pinned-id", b.imageID)
+		}
+	}
+
+	if d.pulls != 1 {
+		t.Fatalf("expected 1 pull, got %d", d.pulls)
+	}
+
+	for _, imageName := range []string{"alpine@sha256:4bf9", "alpine@md5:d41d8cd98f00b204e9800998ecf8427e", "alpine@" + strings.ToUpper(digest)} {
+		err := d.builder(t).handleFrom([]string{imageName}, "")
+		if err == nil || !strings.Contains(err.Error(), "invalid digest in image reference") {
+			t.Errorf("expected an invalid digest error for %s, got %v", imageName, err)
+		}
+	}
+
+	if d.pulls != 1 {
+		t.Fatalf("expected no pulls of invalid digests, got %d", d.pulls-1)
+	}
+}
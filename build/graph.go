@@ -0,0 +1,230 @@
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jlhawn/dockramp/build/commands"
+	"github.com/jlhawn/dockramp/build/parser"
+)
+
+// stageGraph is the dependency graph of the stages of a build.
+type stageGraph struct {
+	stages []graphStage
+	// images are the external base images, in the order they are first
+	// used.
+	images []string
+	edges  []graphEdge
+}
+
+// graphStage is a stage of a build as written in the Dockerfile.
+type graphStage struct {
+	name string
+	// used is set if the target stage depends on this stage.
+	used bool
+}
+
+// graphEdge is a dependency of a stage on a stage or external image.
+type graphEdge struct {
+	from, to string
+	label    string
+}
+
+// WriteGraph writes the dependency graph of the stages in the Dockerfile to the
+// given writer in the Graphviz DOT format, without building anything. The
+// target stage, which is the last, and stages it does not depend on are
+// marked as such.
+func (b *Builder) WriteGraph(w io.Writer) error {
+	commandList, err := b.parseDockerfile()
+	if err != nil {
+		return err
+	}
+
+	graph, err := newStageGraph(commandList)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	graph.writeDOT(bw)
+
+	return bw.Flush()
+}
+
+// newStageGraph analyzes the FROM and COPY --from commands of a parsed
+// Dockerfile to determine the dependencies between its stages.
+func newStageGraph(commandList []*parser.Command) (*stageGraph, error) {
+	if err := checkHasFrom(commandList); err != nil {
+		return nil, err
+	}
+
+	graph := &stageGraph{}
+	// deps holds the indexes of the stages which each stage depends on.
+	var deps [][]int
+
+	// lookupStage returns the index of the earlier stage with the given
+	// name or index.
+	lookupStage := func(ref string) (int, error) {
+		if index, err := strconv.Atoi(ref); err == nil {
+			if index < 0 || index >= len(graph.stages)-1 {
+				return 0, fmt.Errorf("no completed build stage with index %d", index)
+			}
+
+			return index, nil
+		}
+
+		name := strings.ToLower(ref)
+		for i, stage := range graph.stages[:len(graph.stages)-1] {
+			if stage.name == name {
+				return i, nil
+			}
+		}
+
+		return 0, fmt.Errorf("no completed build stage named %q", ref)
+	}
+
+	addEdge := func(from, to, label string) {
+		edge := graphEdge{from: from, to: to, label: label}
+		for _, existing := range graph.edges {
+			if existing == edge {
+				return
+			}
+		}
+
+		graph.edges = append(graph.edges, edge)
+	}
+
+	for i, command := range commandList {
+		cmd, args := strings.ToUpper(command.Args[0]), command.Args[1:]
+
+		if i == 0 && cmd != commands.From {
+			return nil, fmt.Errorf("FROM must be the first Dockerfile command")
+		}
+
+		current := len(graph.stages) - 1
+
+		switch cmd {
+		case commands.From:
+			imageName, stageName, err := parseFromArgs(args)
+			if err != nil {
+				return nil, err
+			}
+
+			graph.stages = append(graph.stages, graphStage{name: stageName})
+			deps = append(deps, nil)
+			current++
+
+			stageID := graphStageID(current)
+
+			// A stage may build on an earlier stage by name.
+			if _, err := strconv.Atoi(imageName); err != nil {
+				if index, err := lookupStage(imageName); err == nil {
+					deps[current] = append(deps[current], index)
+					addEdge(graphStageID(index), stageID, commands.From)
+					continue
+				}
+			}
+
+			if imageName != fromScratch {
+				addEdge(graph.imageID(imageName), stageID, commands.From)
+			}
+		case commands.Copy:
+			flags, _, _, err := parseFlags(cmd, args, commands.Flags[cmd])
+			if err != nil {
+				return nil, err
+			}
+
+			from, ok := flags["from"]
+			if !ok {
+				continue
+			}
+
+			index, err := lookupStage(from)
+			if err == nil {
+				deps[current] = append(deps[current], index)
+				addEdge(graphStageID(index), graphStageID(current), commands.Copy+" --from")
+				continue
+			}
+
+			// Any other name is an external image.
+			if _, numErr := strconv.Atoi(from); numErr == nil {
+				return nil, fmt.Errorf("invalid --from value: %s", err)
+			}
+
+			addEdge(graph.imageID(from), graphStageID(current), commands.Copy+" --from")
+		}
+	}
+
+	// Mark the stages which the target depends on.
+	var mark func(index int)
+	mark = func(index int) {
+		if graph.stages[index].used {
+			return
+		}
+
+		graph.stages[index].used = true
+		for _, dep := range deps[index] {
+			mark(dep)
+		}
+	}
+	mark(len(graph.stages) - 1)
+
+	return graph, nil
+}
+
+// imageID returns the ID of the node for the given external image, adding it
+// to the graph if necessary.
+func (g *stageGraph) imageID(imageName string) string {
+	for i, name := range g.images {
+		if name == imageName {
+			return fmt.Sprintf("image%d", i)
+		}
+	}
+
+	g.images = append(g.images, imageName)
+
+	return fmt.Sprintf("image%d", len(g.images)-1)
+}
+
+// graphStageID returns the ID of the node for the stage with the given index.
+func graphStageID(index int) string {
+	return fmt.Sprintf("stage%d", index)
+}
+
+// writeDOT writes the graph in the Graphviz DOT format.
+func (g *stageGraph) writeDOT(w io.Writer) {
+	fmt.Fprintln(w, "digraph build {")
+
+	for i, name := range g.images {
+		fmt.Fprintf(w, "\timage%d [label=%q, shape=box];\n", i, name)
+	}
+
+	target := len(g.stages) - 1
+	for i, stage := range g.stages {
+		label := strconv.Itoa(i)
+		if stage.name != "" {
+			label += ": " + stage.name
+		}
+
+		style := "solid"
+		switch {
+		case i == target:
+			label += " (target)"
+			style = "bold"
+		case !stage.used:
+			label += " (unused)"
+			style = "dashed"
+		}
+
+		fmt.Fprintf(w, "\t%s [label=%q, style=%s];\n", graphStageID(i), label, style)
+	}
+
+	for _, edge := range g.edges {
+		fmt.Fprintf(w, "\t%s -> %s [label=%q];\n", edge.from, edge.to, edge.label)
+	}
+
+	fmt.Fprintln(w, "}")
+}
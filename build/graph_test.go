@@ -0,0 +1,56 @@
+package build
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteGraph(t *testing.T) {
+	contextDir, err := ioutil.TempDir("", "dockramp-graph")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(contextDir)
+
+	writeContextFile(t, contextDir, "Dockerfile", strings.Join([]string{
+		"FROM golang AS builder",
+		"COPY . /src",
+		"RUN go build",
+		"FROM builder AS tester",
+		"RUN go test",
+		"FROM alpine",
+		"COPY --from=builder /go/bin/app /bin/app",
+		"COPY --from=0 /go/bin/tool /bin/tool",
+		"COPY --from=alpine /etc/ssl/certs /certs",
+		"",
+	}, "\n"))
+
+	b := &Builder{dockerfilePath: filepath.Join(contextDir, "Dockerfile")}
+
+	var out bytes.Buffer
+	if err := b.WriteGraph(&out); err != nil {
+		t.Fatalf("unable to write graph: %s", err)
+	}
+
+	expected := `digraph build {
+	image0 [label="golang", shape=box];
+	image1 [label="alpine", shape=box];
+	stage0 [label="0: builder", style=solid];
+	stage1 [label="1: tester (unused)", style=dashed];
+	stage2 [label="2 (target)", style=bold];
+	image0 -> stage0 [label="FROM"];
+	stage0 -> stage1 [label="FROM"];
+	image1 -> stage2 [label="FROM"];
+	stage0 -> stage2 [label="COPY --from"];
+	image1 -> stage2 [label="COPY --from"];
+}
+`
+
+	if out.String() != expected {
+		t.Fatalf("expected graph:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
@@ -3,7 +3,9 @@ package build
 import (
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"unicode"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/jlhawn/dockramp/build/commands"
@@ -44,11 +46,105 @@ func (b *Builder) handleEntrypoint(args []string, heredoc string) error {
 func (b *Builder) handleEnv(args []string, heredoc string) error {
 	log.Debugf("handling %s with args: %#v", commands.Env, args)
 
-	if len(args) != 2 {
-		return fmt.Errorf("%s requires exactly two arguments", commands.Env)
+	// The original form sets a single variable: `ENV key value`.
+	if len(args) > 0 && !strings.Contains(args[0], "=") {
+		if len(args) != 2 {
+			return fmt.Errorf("%s requires exactly two arguments, or one or more key=value pairs", commands.Env)
+		}
+
+		if err := validateKey(commands.Env, args[0]); err != nil {
+			return err
+		}
+
+		b.config.setEnv(args[0], args[1])
+
+		return nil
+	}
+
+	pairs, err := parseKeyValuePairs(commands.Env, args)
+	if err != nil {
+		return err
+	}
+
+	for _, pair := range pairs {
+		b.config.setEnv(pair[0], pair[1])
+	}
+
+	return nil
+}
+
+// setEnv sets the environment variable with the given name. A variable which
+// is already set is replaced in place rather than set again at the end, so
+// the environment never has more than one value for a variable.
+func (c *config) setEnv(name, value string) {
+	env := fmt.Sprintf("%s=%s", name, value)
+	for i, existing := range c.Env {
+		if strings.SplitN(existing, "=", 2)[0] == name {
+			c.Env[i] = env
+			return
+		}
+	}
+
+	c.Env = append(c.Env, env)
+}
+
+// dedupeEnv returns a copy of the given environment with only one entry for
+// each variable, in the position of its first entry but with the value of its
+// last, which is the value a container sees.
+func dedupeEnv(env []string) []string {
+	deduped := make([]string, 0, len(env))
+	index := make(map[string]int, len(env))
+	for _, entry := range env {
+		name := strings.SplitN(entry, "=", 2)[0]
+		if i, ok := index[name]; ok {
+			deduped[i] = entry
+			continue
+		}
+
+		index[name] = len(deduped)
+		deduped = append(deduped, entry)
+	}
+
+	return deduped
+}
+
+// parseKeyValuePairs parses the `key=value` arguments of the given command
+// into key and value pairs, in order. Quotes around a value have already been
+// removed by the parser.
+func parseKeyValuePairs(cmd string, args []string) ([][2]string, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s requires at least one key=value pair", cmd)
+	}
+
+	pairs := make([][2]string, len(args))
+	for i, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s requires key=value pairs, got %q", cmd, arg)
+		}
+
+		if err := validateKey(cmd, parts[0]); err != nil {
+			return nil, err
+		}
+
+		pairs[i] = [2]string{parts[0], parts[1]}
 	}
 
-	b.config.Env = append(b.config.Env, fmt.Sprintf("%s=%s", args[0], args[1]))
+	return pairs, nil
+}
+
+// validateKey returns an error if the given key of an ENV, ARG, or LABEL is
+// empty or contains whitespace or '=', which the daemon accepts but which makes
+// a broken image. Keys are checked once they have been interpolated.
+func validateKey(cmd, key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("%s requires a non-empty key", cmd)
+	case strings.Contains(key, "="):
+		return fmt.Errorf("invalid %s key %q: must not contain '='", cmd, key)
+	case strings.IndexFunc(key, unicode.IsSpace) >= 0:
+		return fmt.Errorf("invalid %s key %q: must not contain whitespace", cmd, key)
+	}
 
 	return nil
 }
@@ -56,23 +152,73 @@ func (b *Builder) handleEnv(args []string, heredoc string) error {
 func (b *Builder) handleExpose(args []string, heredoc string) error {
 	log.Debugf("handling %s with args: %#v", commands.Expose, args)
 
-	if len(args) != 1 {
-		return fmt.Errorf("%s requires exactly one argument", commands.Expose)
+	ports := make([]string, len(args))
+	for i, arg := range args {
+		port, err := parsePortSpec(arg)
+		if err != nil {
+			return err
+		}
+
+		ports[i] = port
 	}
 
-	b.config.ExposedPorts[args[0]] = struct{}{}
+	for _, port := range ports {
+		b.config.ExposedPorts[port] = struct{}{}
+	}
 
 	return nil
 }
 
+// parsePortSpec normalizes a port given as `port` or `port/protocol` to
+// `port/protocol`. The protocol defaults to tcp.
+func parsePortSpec(spec string) (string, error) {
+	parts := strings.SplitN(spec, "/", 2)
+
+	proto := "tcp"
+	if len(parts) == 2 {
+		proto = strings.ToLower(parts[1])
+	}
+
+	switch proto {
+	case "tcp", "udp", "sctp":
+	default:
+		return "", fmt.Errorf("invalid port %q: protocol must be tcp, udp, or sctp", spec)
+	}
+
+	port, err := strconv.Atoi(parts[0])
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid port %q: must be a number from 1 to 65535", spec)
+	}
+
+	return fmt.Sprintf("%d/%s", port, proto), nil
+}
+
 func (b *Builder) handleLabel(args []string, heredoc string) error {
 	log.Debugf("handling %s with args: %#v", commands.Label, args)
 
-	if len(args) != 2 {
-		return fmt.Errorf("%s requires exactly two arguments", commands.Label)
+	// The original form sets a single label: `LABEL key value`.
+	if len(args) > 0 && !strings.Contains(args[0], "=") {
+		if len(args) != 2 {
+			return fmt.Errorf("%s requires exactly two arguments, or one or more key=value pairs", commands.Label)
+		}
+
+		if err := validateKey(commands.Label, args[0]); err != nil {
+			return err
+		}
+
+		b.config.Labels[args[0]] = args[1]
+
+		return nil
 	}
 
-	b.config.Labels[args[0]] = args[1]
+	pairs, err := parseKeyValuePairs(commands.Label, args)
+	if err != nil {
+		return err
+	}
+
+	for _, pair := range pairs {
+		b.config.Labels[pair[0]] = pair[1]
+	}
 
 	return nil
 }
@@ -80,10 +226,6 @@ func (b *Builder) handleLabel(args []string, heredoc string) error {
 func (b *Builder) handleMaintainer(args []string, heredoc string) error {
 	log.Debugf("handling %s with args: %#v", commands.Maintainer, args)
 
-	if len(args) < 1 {
-		return fmt.Errorf("%s requires at least one argument", commands.Maintainer)
-	}
-
 	b.maintainer = strings.Join(args, " ")
 
 	return nil
@@ -92,8 +234,8 @@ func (b *Builder) handleMaintainer(args []string, heredoc string) error {
 func (b *Builder) handleUser(args []string, heredoc string) error {
 	log.Debugf("handling %s with args: %#v", commands.User, args)
 
-	if len(args) != 1 {
-		return fmt.Errorf("%s requires exactly one argument", commands.User)
+	if err := validateUser(args[0]); err != nil {
+		return err
 	}
 
 	b.config.User = args[0]
@@ -101,6 +243,44 @@ func (b *Builder) handleUser(args []string, heredoc string) error {
 	return nil
 }
 
+// validateUser returns an error if the given USER is not of the form user,
+// uid, user:group, or uid:gid. Names are resolved by the runtime when a
+// container starts, so only their syntax is checked.
+func validateUser(userspec string) error {
+	if userspec == "" {
+		return fmt.Errorf("%s requires a user, e.g., name, uid, name:group, or uid:gid", commands.User)
+	}
+
+	parts := strings.Split(userspec, ":")
+	if len(parts) > 2 {
+		return fmt.Errorf("invalid %s %q: must be user or user:group", commands.User, userspec)
+	}
+
+	for i, part := range parts {
+		what := "user"
+		if i == 1 {
+			what = "group"
+		}
+
+		if part == "" {
+			return fmt.Errorf("invalid %s %q: empty %s", commands.User, userspec, what)
+		}
+
+		if strings.IndexFunc(part, unicode.IsSpace) >= 0 {
+			return fmt.Errorf("invalid %s %q: %s must not contain whitespace", commands.User, userspec, what)
+		}
+
+		// A numeric ID must fit in 32 bits.
+		if strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' }) < 0 {
+			if _, err := strconv.ParseUint(part, 10, 32); err != nil {
+				return fmt.Errorf("invalid %s %q: %s ID out of range", commands.User, userspec, what)
+			}
+		}
+	}
+
+	return nil
+}
+
 func (b *Builder) handleVolume(args []string, heredoc string) error {
 	log.Debugf("handling %s with args: %#v", commands.Volume, args)
 
@@ -108,12 +288,21 @@ func (b *Builder) handleVolume(args []string, heredoc string) error {
 		return fmt.Errorf("%s requires at least one argument", commands.Volume)
 	}
 
-	for _, arg := range args {
+	volumes := make([]string, len(args))
+	for i, arg := range args {
 		vol := strings.TrimSpace(arg)
 		if vol == "" {
 			return fmt.Errorf("volume specified can not be an empty string")
 		}
 
+		if !filepath.IsAbs(vol) {
+			return fmt.Errorf("invalid %s %q: must be an absolute path", commands.Volume, vol)
+		}
+
+		volumes[i] = filepath.ToSlash(filepath.Clean(vol))
+	}
+
+	for _, vol := range volumes {
 		b.config.Volumes[vol] = struct{}{}
 	}
 
@@ -123,16 +312,19 @@ func (b *Builder) handleVolume(args []string, heredoc string) error {
 func (b *Builder) handleWorkdir(args []string, heredoc string) error {
 	log.Debugf("handling %s with args: %#v", commands.Workdir, args)
 
-	if len(args) != 1 {
-		return fmt.Errorf("%s requires exactly one argument", commands.Workdir)
+	// The argument may be empty after interpolation.
+	workdir := args[0]
+	if workdir == "" {
+		return fmt.Errorf("%s requires a non-empty directory", commands.Workdir)
 	}
 
-	workdir := args[0]
+	// A relative directory is relative to the previous working directory.
 	if !filepath.IsAbs(workdir) {
 		workdir = filepath.Join("/", b.config.WorkingDir, workdir)
 	}
+	workdir = filepath.ToSlash(filepath.Clean(workdir))
 
 	b.config.WorkingDir = workdir
 
-	return nil
+	return b.createWorkdir()
 }
@@ -0,0 +1,277 @@
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+// buildConfig builds the given Dockerfile on an empty base image and returns
+// the config of the built image.
+func buildConfig(t *testing.T, dockerfile string) *dockerclient.ContainerConfig {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	b := d.newBuilder(t, map[string]string{"Dockerfile": dockerfile}, "")
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	return d.images[b.ImageID()].Config
+}
+
+// buildError builds the given Dockerfile on an empty base image and returns
+// the error, which must not be nil.
+func buildError(t *testing.T, dockerfile string) error {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	err := d.newBuilder(t, map[string]string{"Dockerfile": dockerfile}, "").Run()
+	if err == nil {
+		t.Fatalf("expected the build of %q to fail", dockerfile)
+	}
+
+	return err
+}
+
+func TestEnv(t *testing.T) {
+	config := buildConfig(t, "FROM base\nENV ONE 1\nENV TWO=2 GREETING=\"hello world\" EMPTY=\nENV THREE a=b\n")
+
+	expected := []string{"ONE=1", "TWO=2", "GREETING=hello world", "EMPTY=", "THREE=a=b"}
+	env := config.Env[len(config.Env)-len(expected):]
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected environment to end with %q, got %q", expected, config.Env)
+	}
+
+	for _, invalid := range []string{"ENV ONE", "ENV ONE 1 2", "ENV A=1 B", "ENV A=1 =2"} {
+		buildError(t, "FROM base\n"+invalid+"\n")
+	}
+}
+
+func TestRepeatedEnv(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{
+		Env: []string{"PATH=/bin", "HOME=/root", "PATH=/usr/bin:/bin"},
+	}})
+
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nENV A=1 PATH=/app:$PATH\nENV A 2\nENV B=3 HOME=/home\n"}, "")
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	// Each variable keeps its position but has its last value, and the
+	// duplicate PATH of the base image is dropped.
+	expected := []string{"PATH=/app:/usr/bin:/bin", "HOME=/home", "A=2", "B=3"}
+	if env := d.images[b.ImageID()].Config.Env; !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected environment %q, got %q", expected, env)
+	}
+}
+
+func TestDedupeEnv(t *testing.T) {
+	for _, test := range []struct {
+		env, expected []string
+	}{
+		{nil, []string{}},
+		{[]string{"A=1", "B=2"}, []string{"A=1", "B=2"}},
+		{[]string{"A=1", "B=2", "A=3", "A=4"}, []string{"A=4", "B=2"}},
+		{[]string{"A=1", "A", "B=", "B=x=y"}, []string{"A", "B=x=y"}},
+	} {
+		if deduped := dedupeEnv(test.env); !reflect.DeepEqual(deduped, test.expected) {
+			t.Errorf("expected %q to be deduplicated to %q, got %q", test.env, test.expected, deduped)
+		}
+	}
+
+	config := buildConfig(t, "FROM base\nENV A=1\nENV B 2\nENV A=3\nENV A 4\n")
+	if expected := []string{"PATH=" + defaultPathEnv, "A=4", "B=2"}; !reflect.DeepEqual(config.Env, expected) {
+		t.Fatalf("expected environment %q, got %q", expected, config.Env)
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	for dockerfile, expected := range map[string]string{
+		"FROM base\nENV \"MY VAR\"=1\n":              `invalid ENV key "MY VAR": must not contain whitespace`,
+		"FROM base\nENV \"MY\tVAR\" 1\n":             `invalid ENV key "MY\tVAR": must not contain whitespace`,
+		"FROM base\nENV $EMPTY 1\n":                  "ENV requires a non-empty key",
+		"FROM base\nARG NAME=\"A B\"\nENV $NAME=1\n": `invalid ENV key "A B": must not contain whitespace`,
+		"FROM base\nLABEL \"my label\"=1\n":          `invalid LABEL key "my label": must not contain whitespace`,
+		"FROM base\nLABEL \"my label\" 1\n":          `invalid LABEL key "my label": must not contain whitespace`,
+		"FROM base\nARG \"MY ARG\"=1\n":              `invalid ARG key "MY ARG": must not contain whitespace`,
+	} {
+		if err := buildError(t, dockerfile); !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %q, got %v", expected, dockerfile, err)
+		}
+	}
+}
+
+func TestLabel(t *testing.T) {
+	config := buildConfig(t, "FROM base\nLABEL one 1\nLABEL a=1 b=2 c=\"three four\"\nLABEL a=5\n")
+
+	expected := map[string]string{"one": "1", "a": "5", "b": "2", "c": "three four"}
+	if !reflect.DeepEqual(config.Labels, expected) {
+		t.Fatalf("expected labels %v, got %v", expected, config.Labels)
+	}
+
+	for _, invalid := range []string{"LABEL one", "LABEL a=1 b", "LABEL =1"} {
+		buildError(t, "FROM base\n"+invalid+"\n")
+	}
+}
+
+func TestLiteralDollar(t *testing.T) {
+	config := buildConfig(t, "FROM base\nARG PRICE=10\nENV PRICE \\$5\nENV TOTAL=$$6 SUM=\"\\$$PRICE\"\nLABEL cost=$$5 note='$PRICE'\n")
+
+	expected := []string{"PRICE=$5", "TOTAL=$6", "SUM=$$5"}
+	env := config.Env[len(config.Env)-len(expected):]
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected environment to end with %q, got %q", expected, config.Env)
+	}
+
+	if expected := map[string]string{"cost": "$5", "note": "$5"}; !reflect.DeepEqual(config.Labels, expected) {
+		t.Fatalf("expected labels %v, got %v", expected, config.Labels)
+	}
+
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"Dockerfile":  "FROM base\nCOPY price\\$5.txt /price$$5.txt\n",
+		"price$5.txt": "five",
+	}
+	b := d.newBuilder(t, files, "")
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	if content := d.imageFiles[b.ImageID()]["/price$5.txt"]; content != "five" {
+		t.Fatalf("expected price$5.txt to be copied to /price$5.txt, got files %v", d.imageFiles[b.ImageID()])
+	}
+}
+
+func TestExpose(t *testing.T) {
+	config := buildConfig(t, "FROM base\nEXPOSE 80 443/tcp 53/UDP\nEXPOSE 9000/sctp\n")
+
+	expected := map[string]struct{}{"80/tcp": {}, "443/tcp": {}, "53/udp": {}, "9000/sctp": {}}
+	if !reflect.DeepEqual(config.ExposedPorts, expected) {
+		t.Fatalf("expected exposed ports %v, got %v", expected, config.ExposedPorts)
+	}
+
+	for _, invalid := range []string{"EXPOSE", "EXPOSE 99999", "EXPOSE 0", "EXPOSE http", "EXPOSE 80/icmp", "EXPOSE 80 -1"} {
+		buildError(t, "FROM base\n"+invalid+"\n")
+	}
+}
+
+func TestWorkdir(t *testing.T) {
+	for dockerfile, expected := range map[string]string{
+		"WORKDIR /a\nWORKDIR b\nWORKDIR c\n":              "/a/b/c",
+		"WORKDIR a/\nWORKDIR ./b/../c/\n":                 "/a/c",
+		"WORKDIR /a\nWORKDIR b\nWORKDIR /x/\nWORKDIR y\n": "/x/y",
+		"ENV BASE /srv\nWORKDIR $BASE\nWORKDIR ${BASE}\n": "/srv",
+		"ENV DIR app\nWORKDIR /home\nWORKDIR $DIR/src\n":  "/home/app/src",
+		"ARG DIR=/opt\nWORKDIR $DIR\nWORKDIR tools\n":     "/opt/tools",
+	} {
+		if config := buildConfig(t, "FROM base\n"+dockerfile); config.WorkingDir != expected {
+			t.Fatalf("expected working directory %q for %q, got %q", expected, dockerfile, config.WorkingDir)
+		}
+	}
+
+	buildError(t, "FROM base\nWORKDIR $UNSET\n")
+}
+
+func TestWorkdirCreated(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+	d.imageDirs["base-id"] = map[string]struct{}{"/srv": {}}
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nWORKDIR /srv\nWORKDIR app/src\nENV FOO bar\n",
+	}
+
+	b := d.newBuilder(t, files, "")
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	// The existing directory is not created again, so only the new
+	// directory and the trailing ENV are committed.
+	if d.numImages != 2 {
+		t.Fatalf("expected 2 committed images, got %d", d.numImages)
+	}
+
+	if _, ok := d.imageDirs[b.ImageID()]["/srv/app/src"]; !ok {
+		t.Fatalf("expected the working directory to be created, got directories %v", d.imageDirs[b.ImageID()])
+	}
+
+	again := d.newBuilder(t, files, "")
+	if err := again.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	if again.ImageID() != b.ImageID() || d.numImages != 2 {
+		t.Fatalf("expected cached image %s, got %s after %d commits", b.ImageID(), again.ImageID(), d.numImages)
+	}
+}
+
+func TestUser(t *testing.T) {
+	for _, user := range []string{"nobody", "1000", "app:staff", "1000:1000", "app:1000", "1000:staff", "www-data"} {
+		if config := buildConfig(t, "FROM base\nUSER "+user+"\n"); config.User != user {
+			t.Errorf("expected user %q, got %q", user, config.User)
+		}
+	}
+
+	for dockerfile, expected := range map[string]string{
+		"FROM base\nUSER $EMPTY\n":        "USER requires a user",
+		"FROM base\nUSER a:b:c\n":         `invalid USER "a:b:c": must be user or user:group`,
+		"FROM base\nUSER :staff\n":        `invalid USER ":staff": empty user`,
+		"FROM base\nUSER app:\n":          `invalid USER "app:": empty group`,
+		"FROM base\nUSER \"my app\"\n":    `invalid USER "my app": user must not contain whitespace`,
+		"FROM base\nUSER 4294967296:0\n":  `invalid USER "4294967296:0": user ID out of range`,
+		"FROM base\nUSER 0:99999999999\n": `invalid USER "0:99999999999": group ID out of range`,
+	} {
+		if err := buildError(t, dockerfile); !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %q, got %v", expected, dockerfile, err)
+		}
+	}
+}
+
+func TestVolume(t *testing.T) {
+	for dockerfile, expected := range map[string][]string{
+		"FROM base\nVOLUME /data\n":                       {"/data"},
+		"FROM base\nVOLUME /data/ /log//app/../other\n":   {"/data", "/log/other"},
+		"FROM base\nVOLUME [\"/data\",\"/log\"]\n":        {"/data", "/log"},
+		"FROM base\nVOLUME [ \"/data/\", \"/my log\" ]\n": {"/data", "/my log"},
+		"FROM base\nVOLUME [\"/a,b\"]\n":                  {"/a,b"},
+		"FROM base\nVOLUME [\"/caf\\u00e9\"]\n":           {"/caf\u00e9"},
+	} {
+		config := buildConfig(t, dockerfile)
+
+		volumes := make(map[string]struct{}, len(expected))
+		for _, vol := range expected {
+			volumes[vol] = struct{}{}
+		}
+		if !reflect.DeepEqual(config.Volumes, volumes) {
+			t.Errorf("expected volumes %q for %q, got %v", expected, dockerfile, config.Volumes)
+		}
+	}
+
+	for dockerfile, expected := range map[string]string{
+		"FROM base\nVOLUME data\n":                 `invalid VOLUME "data": must be an absolute path`,
+		"FROM base\nVOLUME [\"/data\", \"log\"]\n": `invalid VOLUME "log": must be an absolute path`,
+		"FROM base\nVOLUME []\n":                   "VOLUME requires at least one argument",
+		"FROM base\nVOLUME [\"/data\", \"\"]\n":    "volume specified can not be an empty string",
+	} {
+		if err := buildError(t, dockerfile); !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %q, got %v", expected, dockerfile, err)
+		}
+	}
+}
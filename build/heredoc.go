@@ -0,0 +1,107 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jlhawn/dockramp/archive"
+	"github.com/jlhawn/dockramp/build/commands"
+)
+
+// heredocFileDir is the directory in the container which holds the heredocs of
+// a RUN command after the first, which is its input.
+const heredocFileDir = "/.dockramp-heredocs"
+
+// heredocFilePath returns the path in the container of the file holding the
+// heredoc of a RUN command with the given index.
+func heredocFilePath(index int) string {
+	return path.Join(heredocFileDir, strconv.Itoa(index))
+}
+
+// copyHeredoc writes the given heredoc as the content of the file at the given
+// destination in a new container, so that small files need not be in the
+// build context. The file is named by the base name of the destination, and
+// its mode may be set with the --chmod option.
+func (b *Builder) copyHeredoc(heredoc, dstPath string) error {
+	mode := os.FileMode(0644)
+	for name, value := range b.flags {
+		if name != "chmod" {
+			return fmt.Errorf("%s with a heredoc does not accept --%s", commands.Copy, name)
+		}
+
+		var err error
+		if mode, err = parseChmod(value); err != nil {
+			return err
+		}
+	}
+
+	if archive.AssertsDirectory(dstPath) {
+		return fmt.Errorf("%s with a heredoc requires the destination to be a file, not a directory ending with a /: %s", commands.Copy, dstPath)
+	}
+
+	b.emit(&event{Type: eventInput, Message: heredoc})
+	b.uncommittedCommands = append(b.uncommittedCommands, fmt.Sprintf("COPY input: %q", heredoc))
+
+	if b.probeCache() || b.dryRun {
+		return nil
+	}
+
+	containerID, err := b.createContainer([]string{"/bin/sh", "-c"}, b.nopCommand(), false)
+	if err != nil {
+		return fmt.Errorf("unable to create container: %s", err)
+	}
+
+	// The container is removed by Run if the build fails.
+	b.containerID = containerID
+
+	dstInfo := b.containerCopyInfo(containerID, dstPath)
+	if dstInfo.IsDir {
+		return fmt.Errorf("%s with a heredoc requires the destination to be a file, but %s is a directory", commands.Copy, dstPath)
+	}
+
+	name := path.Base(filepath.ToSlash(dstPath))
+	content, err := heredocArchive(name, heredoc, mode)
+	if err != nil {
+		return fmt.Errorf("unable to archive heredoc: %s", err)
+	}
+
+	srcInfo := archive.CopyInfo{Path: name, Exists: true}
+
+	if err := b.putArchive(content, srcInfo, containerID, dstInfo); err != nil {
+		return fmt.Errorf("unable to copy to container: %s", err)
+	}
+
+	return nil
+}
+
+// heredocArchive returns a tar archive of a single file with the given name,
+// content and mode.
+func heredocArchive(name, content string, mode os.FileMode) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	header := &tar.Header{
+		Name:     name,
+		Mode:     int64(mode),
+		Size:     int64(len(content)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
@@ -0,0 +1,74 @@
+package build
+
+import (
+	"archive/tar"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestCopyHeredoc(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	build := func(content string) *Builder {
+		b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nCOPY /motd <<EOF\n" + content + "EOF\n"}, "")
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b
+	}
+
+	b := build("hello\n")
+	if content := d.imageFiles[b.ImageID()]["/motd"]; content != "hello\n" {
+		t.Fatalf("expected the heredoc to be copied, got %q", content)
+	}
+
+	numImages := d.numImages
+	if again := build("hello\n"); again.ImageID() != b.ImageID() || d.numImages != numImages {
+		t.Fatalf("expected cached image %s, got %s", b.ImageID(), again.ImageID())
+	}
+
+	if changed := build("goodbye\n"); changed.ImageID() == b.ImageID() {
+		t.Fatal("expected a new image when the heredoc changes")
+	}
+
+	d.imageDirs["base-id"] = map[string]struct{}{"/etc": {}}
+	err := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nCOPY /etc <<EOF\nhello\nEOF\n"}, "").Run()
+	if err == nil || !strings.Contains(err.Error(), "/etc is a directory") {
+		t.Fatalf("expected an error for a directory destination, got %v", err)
+	}
+}
+
+func TestHeredocArchive(t *testing.T) {
+	buf, err := heredocArchive("run.sh", "echo hi\n", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := tar.NewReader(buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Name != "run.sh" || hdr.Mode != 0755 || hdr.Size != int64(len("echo hi\n")) {
+		t.Fatalf("expected an executable run.sh, got %s with mode %o and size %d", hdr.Name, hdr.Mode, hdr.Size)
+	}
+}
+
+func TestCopyHeredocErrors(t *testing.T) {
+	for dockerfile, expected := range map[string]string{
+		"FROM base\nCOPY a /motd <<EOF\nhello\nEOF\n":           "COPY with a heredoc requires exactly one argument",
+		"FROM base\nCOPY --from=base /motd <<EOF\nhello\nEOF\n": "COPY with a heredoc does not accept --from",
+		"FROM base\nCOPY /etc/ <<EOF\nhello\nEOF\n":             "requires the destination to be a file",
+		"FROM base\nCOPY --chmod=9 /run.sh <<EOF\nhello\nEOF\n": "invalid --chmod value",
+	} {
+		if err := buildError(t, dockerfile); !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %q, got %v", expected, dockerfile, err)
+		}
+	}
+}
@@ -72,6 +72,18 @@ func (b *Builder) hijack(method, path string, in io.Reader, out io.Writer, start
 
 	started <- 1
 
+	// Close the connection if the build is cancelled, which ends both of
+	// the copies below.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-b.ctx.Done():
+			rwc.Close()
+		case <-done:
+		}
+	}()
+
 	outputErr := make(chan error, 1)
 	inputErr := make(chan error, 1)
 
@@ -0,0 +1,25 @@
+package build
+
+import (
+	"fmt"
+	"os"
+)
+
+// SetIIDFile sets the path of a file to which the ID of the built image is
+// written after a successful build, like `docker build --iidfile`.
+func (b *Builder) SetIIDFile(path string) {
+	b.iidFile = path
+}
+
+// writeIIDFile writes the ID of the built image to the image ID file.
+func (b *Builder) writeIIDFile() error {
+	if b.iidFile == "" {
+		return nil
+	}
+
+	if err := writeOutputFile(b.iidFile, []byte(b.imageID), os.FileMode(0644)); err != nil {
+		return fmt.Errorf("unable to write image ID file: %s", err)
+	}
+
+	return nil
+}
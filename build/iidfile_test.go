@@ -0,0 +1,51 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestIIDFile(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	dir, err := ioutil.TempDir("", "dockramp-iidfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The directory of the file is created.
+	iidFile := filepath.Join(dir, "out", "iid")
+
+	build := func(dockerfile string) (*Builder, error) {
+		b := d.newBuilder(t, map[string]string{"Dockerfile": dockerfile, "file": "content"}, "")
+		b.SetIIDFile(iidFile)
+
+		return b, b.Run()
+	}
+
+	b, err := build("FROM base\nCOPY file /file\n")
+	if err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	if iid, err := ioutil.ReadFile(iidFile); err != nil || string(iid) != b.ImageID() {
+		t.Fatalf("expected image ID %s in the file, got %q, %v", b.ImageID(), iid, err)
+	}
+
+	// The file of the previous build does not remain after a failed build.
+	if _, err := build("FROM base\nCOPY missing /missing\n"); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	if _, err := os.Stat(iidFile); !os.IsNotExist(err) {
+		t.Fatalf("expected the image ID file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// SetInterpolateRun sets whether the values of environment variables and
+// build args are substituted into the arguments of RUN commands before they
+// are run. Otherwise, any substitution is left to a shell run by the command.
+func (b *Builder) SetInterpolateRun(interpolateRun bool) {
+	b.interpolateRun = interpolateRun
+}
+
+// interpolateRunWord substitutes the value of each variable in the given
+// environment which is referenced in the given argument of a RUN command, in
+// the forms `$name`, `${name}`, and `${name:-word}` or `${name:+word}`. A
+// reference to any other variable is left as it is for a shell run by the
+// command to expand, and a substituted value is not expanded again. `$$` is a
+// literal `$`. Unlike other commands, quotes and backslashes are left as they
+// are for the shell.
+func interpolateRunWord(word string, env []string) (string, error) {
+	sw := &shellWord{word: word, envs: env}
+
+	var result bytes.Buffer
+	for sw.pos < len(word) {
+		if word[sw.pos] != '$' {
+			result.WriteByte(word[sw.pos])
+			sw.pos++
+			continue
+		}
+
+		start := sw.pos
+		sw.pos++
+
+		switch sw.peek() {
+		case '$':
+			sw.pos++
+			result.WriteByte('$')
+			continue
+		case '{':
+			sw.pos++
+		}
+
+		name := sw.processName()
+		if _, ok := sw.lookupEnv(name); !ok {
+			// Leave the whole reference for the shell.
+			sw.pos = start + 1
+			if sw.peek() == '{' {
+				sw.pos = closingBrace(word, sw.pos)
+			} else {
+				sw.processName()
+			}
+			result.WriteString(word[start:sw.pos])
+			continue
+		}
+
+		sw.pos = start
+		value, err := sw.processDollar()
+		if err != nil {
+			return "", fmt.Errorf("unable to interpolate %q: %s", word, err)
+		}
+		result.WriteString(value)
+	}
+
+	return result.String(), nil
+}
+
+// closingBrace returns the position after the brace which closes the one at
+// the given position of the given word, or the length of the word if it is
+// not closed.
+func closingBrace(word string, pos int) int {
+	depth := 0
+	for ; pos < len(word); pos++ {
+		switch word[pos] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return pos + 1
+			}
+		}
+	}
+
+	return len(word)
+}
@@ -0,0 +1,71 @@
+package build
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestInterpolateRunWord(t *testing.T) {
+	env := []string{"NAME=world", "EMPTY=", "PRICE=$5"}
+
+	for word, expected := range map[string]string{
+		"hello $NAME":                  "hello world",
+		"hello ${NAME}!":               "hello world!",
+		"${EMPTY:-default} ${NAME:+x}": "default x",
+		// Variables which are not set are left for the shell.
+		"echo $HOME ${USER:-root} $1 $(pwd) $?": "echo $HOME ${USER:-root} $1 $(pwd) $?",
+		"${UNSET:-${NAME}} done":                "${UNSET:-${NAME}} done",
+		// Quotes and backslashes are left for the shell.
+		`echo "$NAME" '$NAME' \n`: `echo "world" 'world' \n`,
+		// $$ is a literal $, and values are not expanded again.
+		"echo $$NAME $$$$": "echo $NAME $$",
+		"echo $PRICE":      "echo $5",
+		"$":                "$",
+	} {
+		interpolated, err := interpolateRunWord(word, env)
+		if err != nil {
+			t.Fatalf("unable to interpolate %q: %s", word, err)
+		}
+		if interpolated != expected {
+			t.Errorf("expected %q to be interpolated to %q, got %q", word, expected, interpolated)
+		}
+	}
+
+	if _, err := interpolateRunWord("${NAME:?unset}", env); err == nil {
+		t.Fatalf("expected an error for an unsupported modifier")
+	}
+}
+
+func TestInterpolateRun(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	files := map[string]string{
+		"Dockerfile": "FROM busybox\nARG VERSION=1.0\nENV DIR /opt\nRUN tar -C $DIR -xf app-${VERSION}.tar $HOME\n",
+	}
+
+	plan := func(interpolateRun bool) string {
+		b := d.newBuilder(t, files, "example/app")
+		b.SetDryRun(true)
+		b.SetInterpolateRun(interpolateRun)
+
+		var out bytes.Buffer
+		b.out = &out
+
+		if err := b.Run(); err != nil {
+			t.Fatalf("dry run failed: %s", err)
+		}
+
+		return out.String()
+	}
+
+	d.Server.Close()
+
+	if output, expected := plan(true), "RUN tar -C /opt -xf app-1.0.tar $HOME"; !strings.Contains(output, expected) {
+		t.Fatalf("expected output containing %q, got:\n%s", expected, output)
+	}
+	if output, expected := plan(false), "RUN tar -C $DIR -xf app-${VERSION}.tar $HOME"; !strings.Contains(output, expected) {
+		t.Fatalf("expected output containing %q, got:\n%s", expected, output)
+	}
+}
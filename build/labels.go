@@ -0,0 +1,56 @@
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jlhawn/dockramp/build/commands"
+)
+
+// SetLabels sets labels, given as `key=value` strings, to add to the built
+// image in addition to those set by LABEL instructions in the Dockerfile. They
+// take precedence over a LABEL with the same key.
+func (b *Builder) SetLabels(labels []string) error {
+	parsed := make(map[string]string, len(labels))
+
+	for _, label := range labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid label %q: must be key=value", label)
+		}
+
+		if err := validateKey(commands.Label, parts[0]); err != nil {
+			return err
+		}
+
+		parsed[parts[0]] = parts[1]
+	}
+
+	b.labels = parsed
+
+	return nil
+}
+
+// applyLabels merges the labels given for the build into the config of the
+// final stage, which must then be committed.
+func (b *Builder) applyLabels() {
+	if len(b.labels) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(b.labels))
+	for key := range b.labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		b.config.Labels[key] = b.labels[key]
+		args = append(args, key, b.labels[key])
+	}
+
+	b.uncommitted = true
+	b.uncommittedCommands = append(b.uncommittedCommands, makeCommandString(commands.Label, args...))
+}
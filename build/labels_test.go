@@ -0,0 +1,79 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestLabelsOnFinalImage(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{
+		Labels: map[string]string{"from-base": "base"},
+	}})
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nLABEL version 1.0\nLABEL team builders\nCOPY a /a\n",
+		"a":          "a",
+	}
+
+	build := func(labels ...string) *Builder {
+		b := d.newBuilder(t, files, "")
+		if err := b.SetLabels(labels); err != nil {
+			t.Fatalf("unable to set labels: %s", err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b
+	}
+
+	unlabeled := build()
+
+	b := build("version=1.1", "commit=abc123")
+
+	expected := map[string]string{
+		"from-base": "base",
+		"team":      "builders",
+		"version":   "1.1",
+		"commit":    "abc123",
+	}
+
+	labels := d.images[b.ImageID()].Config.Labels
+	if len(labels) != len(expected) {
+		t.Fatalf("expected labels %v, got %v", expected, labels)
+	}
+	for key, value := range expected {
+		if labels[key] != value {
+			t.Fatalf("expected labels %v, got %v", expected, labels)
+		}
+	}
+
+	// The labels are added on top of the cached image of the Dockerfile.
+	if parent := d.images[b.ImageID()].Parent; parent != unlabeled.ImageID() {
+		t.Fatalf("expected the labeled image to be a child of %s, got %s", unlabeled.ImageID(), parent)
+	}
+
+	// The same labels hit the cache.
+	if again := build("commit=abc123", "version=1.1"); again.ImageID() != b.ImageID() {
+		t.Fatalf("expected cached image %s, got %s", b.ImageID(), again.ImageID())
+	}
+
+	if other := build("version=1.2"); other.ImageID() == b.ImageID() {
+		t.Fatal("expected a different image for different labels")
+	}
+}
+
+func TestSetLabelsValidation(t *testing.T) {
+	b := &Builder{config: &config{}}
+
+	for _, label := range []string{"novalue", "=value"} {
+		if err := b.SetLabels([]string{label}); err == nil {
+			t.Fatalf("expected an error for label %q", label)
+		}
+	}
+}
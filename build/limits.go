@@ -0,0 +1,94 @@
+package build
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/docker/go-units"
+	"github.com/samalba/dockerclient"
+)
+
+// resourceLimits are the limits on the resources used by the containers of
+// RUN commands. A zero value is no limit.
+type resourceLimits struct {
+	memory     int64
+	cpuShares  int64
+	cpusetCpus string
+}
+
+// cpusetPattern matches a list of CPUs such as `0-3,5`.
+var cpusetPattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+
+// SetResourceLimits limits the resources used by the containers of RUN
+// commands. The memory limit is a size such as `512m` or `2g`, the CPU shares
+// are the relative weight of the containers, and the cpuset is the list of
+// CPUs on which they may run, such as `0-3,5`. An empty or zero value leaves
+// the resource unlimited.
+func (b *Builder) SetResourceLimits(memory string, cpuShares int64, cpusetCpus string) error {
+	var limits resourceLimits
+
+	if memory != "" {
+		size, err := units.RAMInBytes(memory)
+		if err != nil {
+			return fmt.Errorf("invalid memory limit %q: %s", memory, err)
+		}
+		if size <= 0 {
+			return fmt.Errorf("invalid memory limit %q: must be positive", memory)
+		}
+		limits.memory = size
+	}
+
+	if cpuShares < 0 {
+		return fmt.Errorf("invalid CPU shares %d: must not be negative", cpuShares)
+	}
+	limits.cpuShares = cpuShares
+
+	if cpusetCpus != "" && !cpusetPattern.MatchString(cpusetCpus) {
+		return fmt.Errorf("invalid cpuset %q: must be a list of CPUs such as 0-3,5", cpusetCpus)
+	}
+	limits.cpusetCpus = cpusetCpus
+
+	b.limits = limits
+
+	return nil
+}
+
+// apply sets the limits in the given host config.
+func (l resourceLimits) apply(hostConfig *dockerclient.HostConfig) {
+	hostConfig.Memory = l.memory
+	hostConfig.CpuShares = l.cpuShares
+	hostConfig.CpusetCpus = l.cpusetCpus
+}
+
+// SetUlimits sets the ulimits of the containers of RUN commands, each given
+// as `name=soft[:hard]`, such as `nofile=1024:4096`. The hard limit defaults
+// to the soft limit.
+func (b *Builder) SetUlimits(specs []string) error {
+	ulimits := make([]dockerclient.Ulimit, 0, len(specs))
+	seen := make(map[string]struct{}, len(specs))
+
+	for _, spec := range specs {
+		ulimit, err := units.ParseUlimit(spec)
+		if err != nil {
+			return fmt.Errorf("invalid ulimit %q: %s", spec, err)
+		}
+		if ulimit.Soft < 0 {
+			return fmt.Errorf("invalid ulimit %q: limits must not be negative", spec)
+		}
+
+		if _, ok := seen[ulimit.Name]; ok {
+			return fmt.Errorf("duplicate ulimit %q", ulimit.Name)
+		}
+		seen[ulimit.Name] = struct{}{}
+
+		ulimits = append(ulimits, dockerclient.Ulimit{
+			Name: ulimit.Name,
+			Soft: uint64(ulimit.Soft),
+			Hard: uint64(ulimit.Hard),
+		})
+	}
+
+	b.ulimits = ulimits
+
+	return nil
+}
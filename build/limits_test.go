@@ -0,0 +1,74 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestSetResourceLimits(t *testing.T) {
+	for _, test := range []struct {
+		memory     string
+		cpuShares  int64
+		cpusetCpus string
+		expected   resourceLimits
+		valid      bool
+	}{
+		{"", 0, "", resourceLimits{}, true},
+		{"512m", 512, "0-3,5", resourceLimits{memory: 512 * 1024 * 1024, cpuShares: 512, cpusetCpus: "0-3,5"}, true},
+		{"2g", 0, "1", resourceLimits{memory: 2 * 1024 * 1024 * 1024, cpusetCpus: "1"}, true},
+		{"lots", 0, "", resourceLimits{}, false},
+		{"0", 0, "", resourceLimits{}, false},
+		{"", -1, "", resourceLimits{}, false},
+		{"", 0, "0-", resourceLimits{}, false},
+		{"", 0, "a,b", resourceLimits{}, false},
+	} {
+		b := &Builder{}
+		err := b.SetResourceLimits(test.memory, test.cpuShares, test.cpusetCpus)
+		if test.valid != (err == nil) {
+			t.Fatalf("expected valid %t for %q %d %q, got error %v", test.valid, test.memory, test.cpuShares, test.cpusetCpus, err)
+		}
+
+		if test.valid && b.limits != test.expected {
+			t.Fatalf("expected limits %+v, got %+v", test.expected, b.limits)
+		}
+	}
+}
+
+func TestResourceLimitsApply(t *testing.T) {
+	var hostConfig dockerclient.HostConfig
+	resourceLimits{memory: 1024, cpuShares: 2, cpusetCpus: "0"}.apply(&hostConfig)
+
+	if hostConfig.Memory != 1024 || hostConfig.CpuShares != 2 || hostConfig.CpusetCpus != "0" {
+		t.Fatalf("expected limits to be set, got %+v", hostConfig)
+	}
+}
+
+func TestSetUlimits(t *testing.T) {
+	b := &Builder{}
+	if err := b.SetUlimits([]string{"nofile=1024:4096", "nproc=512"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []dockerclient.Ulimit{
+		{Name: "nofile", Soft: 1024, Hard: 4096},
+		{Name: "nproc", Soft: 512, Hard: 512},
+	}
+	if !reflect.DeepEqual(b.ulimits, expected) {
+		t.Fatalf("expected ulimits %+v, got %+v", expected, b.ulimits)
+	}
+
+	for _, specs := range [][]string{
+		{"nofile"},
+		{"files=1024"},
+		{"nofile=4096:1024"},
+		{"nofile=1:2:3"},
+		{"nofile=-1"},
+		{"nofile=1024", "nofile=2048"},
+	} {
+		if err := b.SetUlimits(specs); err == nil {
+			t.Fatalf("expected error for %q", specs)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Cache results of the steps in the build metadata.
+const (
+	stepCacheHit  = "hit"
+	stepCacheMiss = "miss"
+)
+
+// buildMetadata describes the result of a successful build. It is written as
+// JSON to the metadata file.
+type buildMetadata struct {
+	ImageID string   `json:"imageId"`
+	Tags    []string `json:"tags"`
+	// Duration is the time in seconds taken by the build.
+	Duration float64         `json:"duration"`
+	Steps    []*stepMetadata `json:"steps"`
+}
+
+// stepMetadata describes a step of the build.
+type stepMetadata struct {
+	Step    int    `json:"step"`
+	Command string `json:"command"`
+	// Cache is stepCacheHit if the layer of the step was found in the build
+	// cache, stepCacheMiss if it was committed, or empty if the step did not
+	// create a layer of its own, such as an ENV, a RUN command which is not
+	// the last of a batch, or a WORKDIR whose directory already exists.
+	Cache string `json:"cache,omitempty"`
+}
+
+// SetMetadataFile sets the path of a file to which a JSON description of the
+// build is written after a successful build: the ID of the built image, its
+// tags, the duration of the build, and whether the layer of each step was
+// found in the build cache.
+func (b *Builder) SetMetadataFile(path string) {
+	b.metadataFile = path
+}
+
+// recordStep adds the current step to the build metadata.
+func (b *Builder) recordStep(command string) {
+	b.currentStep = &stepMetadata{Step: b.step, Command: command}
+	b.metadata.Steps = append(b.metadata.Steps, b.currentStep)
+}
+
+// recordCache sets the cache result of the current step, if any. The layers
+// committed after the last step, such as that of a squashed image, are not
+// recorded.
+func (b *Builder) recordCache(result string) {
+	if b.currentStep != nil {
+		b.currentStep.Cache = result
+	}
+}
+
+// writeMetadataFile writes the build metadata to the metadata file.
+func (b *Builder) writeMetadataFile() error {
+	if b.metadataFile == "" {
+		return nil
+	}
+
+	b.metadata.ImageID = b.imageID
+	b.metadata.Tags = make([]string, len(b.tags))
+	for i, tag := range b.tags {
+		b.metadata.Tags[i] = tag.name
+	}
+	b.metadata.Duration = time.Since(b.stats.start).Seconds()
+
+	data, err := json.MarshalIndent(&b.metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode build metadata: %s", err)
+	}
+
+	if err := writeOutputFile(b.metadataFile, append(data, '\n'), os.FileMode(0644)); err != nil {
+		return fmt.Errorf("unable to write metadata file: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package build
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestMetadataFile(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	dir, err := ioutil.TempDir("", "dockramp-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	metadataFile := filepath.Join(dir, "metadata.json")
+
+	build := func(dockerfile string) (*Builder, error) {
+		b := d.newBuilder(t, map[string]string{"Dockerfile": dockerfile, "file": "content"}, "example/app")
+		b.SetMetadataFile(metadataFile)
+
+		return b, b.Run()
+	}
+
+	if _, err := build("FROM base\nCOPY file /file\n"); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	b, err := build("FROM base\nCOPY file /file\nENV a=1\nCOPY file /other\n")
+	if err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(metadataFile)
+	if err != nil {
+		t.Fatalf("unable to read metadata file: %s", err)
+	}
+
+	var metadata buildMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		t.Fatalf("unable to decode metadata file: %s", err)
+	}
+
+	if metadata.ImageID != b.ImageID() || !reflect.DeepEqual(metadata.Tags, []string{"example/app"}) || metadata.Duration <= 0 {
+		t.Fatalf("unexpected metadata: %s", data)
+	}
+
+	expected := []*stepMetadata{
+		{Step: 0, Command: "FROM base"},
+		{Step: 1, Command: "COPY file /file", Cache: stepCacheHit},
+		{Step: 2, Command: "ENV a=1"},
+		{Step: 3, Command: "COPY file /other", Cache: stepCacheMiss},
+	}
+	if !reflect.DeepEqual(metadata.Steps, expected) {
+		t.Fatalf("unexpected steps in metadata: %s", data)
+	}
+
+	// The file of the previous build does not remain after a failed build.
+	if _, err := build("FROM base\nCOPY missing /missing\n"); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	if _, err := os.Stat(metadataFile); !os.IsNotExist(err) {
+		t.Fatalf("expected the metadata file to be removed, got %v", err)
+	}
+}
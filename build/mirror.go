@@ -0,0 +1,72 @@
+package build
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+	"github.com/jlhawn/dockramp/util"
+)
+
+// SetRegistryMirror sets a registry from which to pull images which would
+// otherwise be pulled from Docker Hub. The mirror is given as a URL or as a
+// host with an optional port. An empty mirror disables the rewriting of image
+// names, in which case any mirror configured on the daemon still applies.
+func (b *Builder) SetRegistryMirror(mirror string) error {
+	if mirror == "" {
+		b.registryMirror = ""
+		return nil
+	}
+
+	if !strings.Contains(mirror, "://") {
+		mirror = "https://" + mirror
+	}
+
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return fmt.Errorf("invalid registry mirror: %s", err)
+	}
+
+	if u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return fmt.Errorf("invalid registry mirror %q: must be a registry host with an optional scheme and port", mirror)
+	}
+
+	b.registryMirror = u.Host
+
+	return nil
+}
+
+// mirrorImageName returns the name of the given image on the registry mirror
+// if one is set and the image is implicitly from Docker Hub. Otherwise, the
+// image name is returned unchanged.
+func (b *Builder) mirrorImageName(imageName string) string {
+	if b.registryMirror == "" {
+		return imageName
+	}
+
+	named, err := reference.ParseNamed(imageName)
+	if err != nil {
+		// Leave it for the daemon to report.
+		return imageName
+	}
+
+	name := named.Name()
+	registry, remoteName := util.SplitReposName(name)
+	if registry != "" {
+		return imageName
+	}
+
+	if !strings.Contains(remoteName, "/") {
+		// Official images are in the library namespace.
+		remoteName = "library/" + remoteName
+	}
+
+	// Keep any tag or digest which follows the name.
+	mirrored := fmt.Sprintf("%s/%s%s", b.registryMirror, remoteName, imageName[len(name):])
+
+	log.Debugf("using %s from registry mirror for %s", mirrored, imageName)
+
+	return mirrored
+}
@@ -0,0 +1,79 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestMirrorImageName(t *testing.T) {
+	b := &Builder{}
+	if err := b.SetRegistryMirror("https://mirror.example.com:5000/"); err != nil {
+		t.Fatalf("unable to set registry mirror: %s", err)
+	}
+
+	testCases := map[string]string{
+		"ubuntu":                     "mirror.example.com:5000/library/ubuntu",
+		"ubuntu:14.04":               "mirror.example.com:5000/library/ubuntu:14.04",
+		"jlhawn/dockramp":            "mirror.example.com:5000/jlhawn/dockramp",
+		"jlhawn/dockramp:latest":     "mirror.example.com:5000/jlhawn/dockramp:latest",
+		"gcr.io/foo/bar":             "gcr.io/foo/bar",
+		"localhost/foo":              "localhost/foo",
+		"registry:5000/foo:1.0":      "registry:5000/foo:1.0",
+		"docker.io/library/ubuntu":   "docker.io/library/ubuntu",
+		"INVALID-because-uppercase":  "INVALID-because-uppercase",
+		"localhost:5000/foo/bar:tag": "localhost:5000/foo/bar:tag",
+	}
+
+	for imageName, expected := range testCases {
+		if mirrored := b.mirrorImageName(imageName); mirrored != expected {
+			t.Errorf("mirroring %q: expected %q, got %q", imageName, expected, mirrored)
+		}
+	}
+}
+
+func TestSetRegistryMirrorValidation(t *testing.T) {
+	b := &Builder{}
+
+	for _, mirror := range []string{"mirror.example.com", "http://10.0.0.1:5000", ""} {
+		if err := b.SetRegistryMirror(mirror); err != nil {
+			t.Errorf("unexpected error setting mirror %q: %s", mirror, err)
+		}
+	}
+
+	for _, mirror := range []string{"https://", "https://mirror.example.com/v2/path", "mirror.example.com?x=y"} {
+		if err := b.SetRegistryMirror(mirror); err == nil {
+			t.Errorf("expected an error setting mirror %q", mirror)
+		}
+	}
+}
+
+func TestFromPullsHubImagesFromMirror(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addRegistryImage("mirror.example.com/library/ubuntu", &dockerclient.ImageInfo{Id: "mirrored-ubuntu"})
+	d.addRegistryImage("gcr.io/foo/bar", &dockerclient.ImageInfo{Id: "gcr-bar"})
+
+	b := d.builder(t)
+	if err := b.SetRegistryMirror("mirror.example.com"); err != nil {
+		t.Fatalf("unable to set registry mirror: %s", err)
+	}
+
+	for imageName, expectedID := range map[string]string{
+		"ubuntu":         "mirrored-ubuntu",
+		"gcr.io/foo/bar": "gcr-bar",
+	} {
+		if err := b.handleFrom([]string{imageName}, ""); err != nil {
+			t.Fatalf("unable to handle FROM %s: %s", imageName, err)
+		}
+
+		if b.imageID != expectedID {
+			t.Fatalf("FROM %s: expected image ID %q, got %q", imageName, expectedID, b.imageID)
+		}
+	}
+
+	if d.pulls != 2 {
+		t.Fatalf("expected 2 pulls, got %d", d.pulls)
+	}
+}
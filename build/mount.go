@@ -0,0 +1,131 @@
+package build
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/jlhawn/dockramp/archive"
+	"github.com/jlhawn/dockramp/build/commands"
+)
+
+// runMount is a file or directory in the build context which is made available
+// to a RUN command but is not committed to the image.
+type runMount struct {
+	// source is the path of the file or directory in the build context.
+	source string
+	// target is the absolute path in the container.
+	target string
+}
+
+// parseMount parses the value of the --mount option to RUN, which is a comma
+// separated list of `key=value` fields. Only bind mounts from the build context
+// are supported.
+func parseMount(spec string) (*runMount, error) {
+	mount := &runMount{source: "."}
+
+	for _, field := range strings.Split(spec, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --mount field %q: must be key=value", field)
+		}
+
+		key, value := parts[0], parts[1]
+		switch key {
+		case "type":
+			if value != "bind" {
+				return nil, fmt.Errorf("unsupported --mount type %q: only bind is supported", value)
+			}
+		case "source", "src":
+			mount.source = value
+		case "target", "dst", "destination":
+			mount.target = value
+		default:
+			return nil, fmt.Errorf("unknown --mount field %q", key)
+		}
+	}
+
+	if mount.target == "" {
+		return nil, fmt.Errorf("--mount requires a target")
+	}
+	if !path.IsAbs(mount.target) {
+		return nil, fmt.Errorf("invalid --mount target %q: must be an absolute path", mount.target)
+	}
+
+	mount.target = path.Clean(mount.target)
+	if mount.target == "/" {
+		return nil, fmt.Errorf("invalid --mount target %q: cannot be the root directory", mount.target)
+	}
+
+	return mount, nil
+}
+
+// mountSource returns the path of the source of the given mount in the build
+// context and the options used to archive it.
+func (b *Builder) mountSource(mount *runMount) (string, *archive.TarOptions, error) {
+	srcPaths, err := b.contextSources(mount.source)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(srcPaths) != 1 {
+		return "", nil, fmt.Errorf("%s --mount source %q must match exactly one file or directory", commands.Run, mount.source)
+	}
+
+	tarOptions := &archive.TarOptions{
+		ExcludePatterns: b.excludePatterns,
+		ExcludeBaseDir:  b.contextDirectory,
+		RootDir:         b.contextDirectory,
+	}
+
+	return srcPaths[0], tarOptions, nil
+}
+
+// checkMountCache adds the digest of the source of the given mount to the cache
+// key of the current command, as its content may affect the result.
+func (b *Builder) checkMountCache(mount *runMount) error {
+	srcPath, tarOptions, err := b.mountSource(mount)
+	if err != nil {
+		return err
+	}
+
+	srcArchive, err := archive.TarResourceWithOptions(srcPath, tarOptions)
+	if err != nil {
+		return fmt.Errorf("unable to archive --mount source: %s", err)
+	}
+	defer srcArchive.Close()
+
+	mountDigest, _, err := digestTar(srcArchive, b.tarsumVersion)
+	if err != nil {
+		return fmt.Errorf("unable to digest --mount source: %s", err)
+	}
+
+	b.uncommittedCommands = append(b.uncommittedCommands, fmt.Sprintf("RUN mount digest: %s", mountDigest))
+
+	return nil
+}
+
+// mountIntoContainer copies the source of the given mount into the container
+// at its target, which must not already exist so that removing it afterward
+// does not remove anything from the image. Only a 404 from the daemon shows
+// that the target does not exist, so any other error refuses the mount.
+func (b *Builder) mountIntoContainer(container string, mount *runMount) error {
+	_, err := b.statContainerPath(container, mount.target)
+	if err == nil {
+		return fmt.Errorf("%s --mount target %s already exists in the image", commands.Run, mount.target)
+	}
+	if err != errPathNotFound {
+		return fmt.Errorf("unable to check that %s --mount target %s does not exist in the image: %s", commands.Run, mount.target, err)
+	}
+
+	srcPath, tarOptions, err := b.mountSource(mount)
+	if err != nil {
+		return err
+	}
+
+	if err := b.copyToContainer(srcPath, tarOptions, container, mount.target); err != nil {
+		return fmt.Errorf("unable to copy --mount source to container: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package build
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestParseMount(t *testing.T) {
+	for spec, expected := range map[string]runMount{
+		"type=bind,source=secrets,target=/run/secrets": {source: "secrets", target: "/run/secrets"},
+		"src=data/,dst=/tmp/data/":                     {source: "data/", target: "/tmp/data"},
+		"target=/ctx":                                  {source: ".", target: "/ctx"},
+	} {
+		mount, err := parseMount(spec)
+		if err != nil {
+			t.Fatalf("unable to parse %q: %s", spec, err)
+		}
+
+		if *mount != expected {
+			t.Fatalf("expected %+v for %q, got %+v", expected, spec, *mount)
+		}
+	}
+
+	for _, invalid := range []string{
+		"type=cache,target=/cache",
+		"source=a",
+		"source=a,target=relative",
+		"source=a,target=/",
+		"source=a,target=/b,readonly",
+		"source=a,target=/b,mode=0600",
+	} {
+		if _, err := parseMount(invalid); err == nil {
+			t.Fatalf("expected an error for --mount=%s", invalid)
+		}
+	}
+}
+
+func TestMountEntrypointRemovesTarget(t *testing.T) {
+	if _, err := exec.LookPath("/bin/sh"); err != nil {
+		t.Skip(err)
+	}
+
+	dir, err := ioutil.TempDir("", "dockramp-mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "it's mounted")
+
+	for _, test := range []struct {
+		command []string
+		err     string
+	}{
+		// The command sees the mount.
+		{[]string{"test", "-f", filepath.Join(target, "file")}, ""},
+		{[]string{"sh", "-c", "exit 3"}, "exit status 3"},
+	} {
+		writeContextFile(t, target, "file", "content")
+
+		args := append(cleanupEntrypoint(target), test.command...)
+		err := exec.Command(args[0], args[1:]...).Run()
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Fatalf("expected error %q for %q, got %v", test.err, test.command, err)
+		}
+
+		if _, err := os.Stat(target); !os.IsNotExist(err) {
+			t.Fatalf("expected the mount target to be removed, got %v", err)
+		}
+	}
+}
+
+func TestMountTargetStatFailure(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	// Neither a response without the stat header nor a server error shows
+	// that the target does not exist, so the mount, which removes its target
+	// afterward, is refused.
+	for _, status := range []int{http.StatusOK, http.StatusInternalServerError} {
+		d.statStatus = status
+
+		b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nRUN --mount=target=/etc true\n", "a": "a"}, "")
+		err := b.Run()
+		if err == nil || !strings.Contains(err.Error(), "unable to check that RUN --mount target /etc does not exist") {
+			t.Fatalf("expected the mount to be refused when the stat responds with %d, got %v", status, err)
+		}
+	}
+
+	// A 404 shows that the target does not exist.
+	d.statStatus = 0
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nRUN --mount=target=/src true\n", "a": "a"}, "")
+	if err := b.Run(); err != nil {
+		t.Fatalf("expected a mount at a missing target to succeed, got %s", err)
+	}
+}
@@ -0,0 +1,56 @@
+package build
+
+// Observer is notified of the progress of a build, such as by the progress UI
+// of a program which uses the builder as a library. It is notified from the
+// goroutine which called Run. The default observer writes each notification
+// to the build output, so an observer which is set instead takes over their
+// presentation, and is notified even in quiet mode.
+type Observer interface {
+	// OnStepStart is called when the step with the given number and
+	// command, as printed in the build output, begins.
+	OnStepStart(step int, command string)
+	// OnCacheHit is called when the layer of a step is found in the build
+	// cache, with the ID of the cached image.
+	OnCacheHit(imageID string)
+	// OnCommit is called with the ID of each committed image.
+	OnCommit(imageID string)
+	// OnError is called with the error of a failed build.
+	OnError(err error)
+}
+
+// SetObserver sets the observer of the build, or restores the default, which
+// writes to the build output, if observer is nil.
+func (b *Builder) SetObserver(observer Observer) {
+	b.observer = observer
+}
+
+// observe returns the observer of the build.
+func (b *Builder) observe() Observer {
+	if b.observer == nil {
+		return outputObserver{b}
+	}
+
+	return b.observer
+}
+
+// outputObserver is the default Observer, which writes each notification to
+// the build output in the configured format.
+type outputObserver struct {
+	b *Builder
+}
+
+func (o outputObserver) OnStepStart(step int, command string) {
+	o.b.emit(&event{Type: eventStep, Command: command})
+}
+
+func (o outputObserver) OnCacheHit(imageID string) {
+	o.b.emit(&event{Type: eventCacheHit, ImageID: imageID})
+}
+
+func (o outputObserver) OnCommit(imageID string) {
+	o.b.emit(&event{Type: eventCommit, ImageID: imageID})
+}
+
+func (o outputObserver) OnError(err error) {
+	o.b.emit(&event{Type: eventError, Message: err.Error()})
+}
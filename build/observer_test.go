@@ -0,0 +1,101 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+// recordingObserver records each notification as a string.
+type recordingObserver struct {
+	calls []string
+}
+
+func (o *recordingObserver) OnStepStart(step int, command string) {
+	o.calls = append(o.calls, fmt.Sprintf("step %d: %s", step, command))
+}
+
+func (o *recordingObserver) OnCacheHit(imageID string) {
+	o.calls = append(o.calls, "cache hit: "+imageID)
+}
+
+func (o *recordingObserver) OnCommit(imageID string) {
+	o.calls = append(o.calls, "commit: "+imageID)
+}
+
+func (o *recordingObserver) OnError(err error) {
+	o.calls = append(o.calls, "error: "+err.Error())
+}
+
+func TestObserver(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	build := func(dockerfile string) (*recordingObserver, error) {
+		observer := &recordingObserver{}
+		b := d.newBuilder(t, map[string]string{"Dockerfile": dockerfile, "a": "a"}, "")
+		b.SetObserver(observer)
+		// The observer is notified even in quiet mode.
+		b.SetQuiet(true)
+
+		return observer, b.Run()
+	}
+
+	observer, err := build("FROM base\nCOPY a /a\nENV A 1\n")
+	if err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	expected := []string{"step 0: FROM base", "step 1: COPY a /a", "commit: image1", "step 2: ENV A 1", "commit: image2"}
+	if !reflect.DeepEqual(observer.calls, expected) {
+		t.Fatalf("expected notifications %q, got %q", expected, observer.calls)
+	}
+
+	observer, err = build("FROM base\nCOPY a /a\nCOPY missing /missing\n")
+	if err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	expected = []string{"step 0: FROM base", "step 1: COPY a /a", "cache hit: image1", "step 2: COPY missing /missing", "error: " + err.Error()}
+	if !reflect.DeepEqual(observer.calls, expected) {
+		t.Fatalf("expected notifications %q, got %q", expected, observer.calls)
+	}
+
+	if !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expected an error for the missing file, got %v", err)
+	}
+}
+
+func TestObserverReplacesOutput(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	build := func(observer Observer) string {
+		var out bytes.Buffer
+		b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nENV A 1\n"}, "")
+		b.SetObserver(observer)
+		b.SetOutput(&out)
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return out.String()
+	}
+
+	// By default, steps and commits are written to the build output.
+	if out := build(nil); !strings.Contains(out, "Step 1: ENV A 1") || !strings.Contains(out, "image1") {
+		t.Fatalf("expected the step and commit in the build output, got %q", out)
+	}
+
+	if out := build(&recordingObserver{}); strings.Contains(out, "Step 1") {
+		t.Fatalf("expected an observer to replace the printing of steps, got %q", out)
+	}
+}
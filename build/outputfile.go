@@ -0,0 +1,52 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// removeOutputFile removes a file written by a previous build, if any, so that
+// it does not remain if this build fails.
+func removeOutputFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// writeOutputFile writes the given data to the file at the given path with the
+// given mode, creating its directory if necessary. The data is written to a
+// temporary file which is renamed into place so that the file is never read
+// partially written.
+func writeOutputFile(path string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmpFile.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
@@ -2,14 +2,17 @@ package parser
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"regexp"
+	"strings"
 )
 
 type unevaluatedToken int
 
 const (
 	unevaluatedTokenWhitespace unevaluatedToken = iota
+	unevaluatedTokenAnnotation
 	unevaluatedTokenComment
 	unevaluatedTokenNewline
 	unevaluatedTokenDoubleQuotedString
@@ -47,9 +50,14 @@ func unquotedEscapeFunc(esc string) string {
 	return esc[1:]
 }
 
+// An annotation is a comment which begins with `dockramp:` followed by the
+// name of the annotation. Anything after the name is ignored.
+var annotationPattern = regexp.MustCompile(`^#[ \f\r\t\v]*dockramp:([^ \f\r\t\v\n]*)`)
+
 // eval evaluates this unevaluated token and returns an evaluated token.
-// Whitespace matches are evaluated to a whitespace token. Both Newline and
-// Comment matches are evaluated to Newline token. Quoted tokens (backtick,
+// Whitespace matches are evaluated to a whitespace token. Annotation matches
+// are evaluated to an annotation token with the name of the annotation. Both
+// Newline and Comment matches are evaluated to Newline token. Quoted tokens (backtick,
 // single, or double quotes) are evaluated according to their escape rules. A
 // raw arg token also goes through escape processing. If a token of unknown
 // kind is processed, eval() panics.
@@ -58,6 +66,8 @@ func (t unevaluatedToken) eval(match string) token {
 	case unevaluatedTokenWhitespace:
 		// Whitespace yields whitespace.
 		return whitespaceToken{}
+	case unevaluatedTokenAnnotation:
+		return annotationToken(annotationPattern.FindStringSubmatch(match)[1])
 	case unevaluatedTokenComment, unevaluatedTokenNewline:
 		// Treat comments and newlines both as newlines.
 		return newlineToken{}
@@ -93,6 +103,10 @@ var allPatterns = []pattern{
 		unevaluatedToken: unevaluatedTokenWhitespace,
 		re:               regexp.MustCompile(`^([ \f\r\t\v]|\\\n)+`),
 	},
+	{
+		unevaluatedToken: unevaluatedTokenAnnotation,
+		re:               regexp.MustCompile(`^#[ \f\r\t\v]*dockramp:[^\n]*\n`),
+	},
 	{
 		unevaluatedToken: unevaluatedTokenComment,
 		re:               regexp.MustCompile(`^#[^\n]*\n`),
@@ -115,6 +129,12 @@ var allPatterns = []pattern{
 		unevaluatedToken: unevaluatedTokenSingleQuotedString,
 		re:               regexp.MustCompile(`^'[^']*'`),
 	},
+	{
+		// The here-string operator is the only raw arg which may contain
+		// `<`, which otherwise begins a heredoc.
+		unevaluatedToken: unevaluatedTokenRawArg,
+		re:               regexp.MustCompile(`^<<<`),
+	},
 	{
 		unevaluatedToken: unevaluatedTokenRawArg,
 		re:               regexp.MustCompile(`^([^<#'" \f\n\r\t\v\\]|\\.)+`),
@@ -125,28 +145,95 @@ type unevaluatedHeredoc struct {
 	ignoreLeadingTabs bool
 	delimitingTerm    string
 	matchPattern      *regexp.Regexp
+	// line is the number of the line on which the heredoc was started.
+	line int
 }
 
+// A line may start more than one heredoc, as in `<<A <<B`, in which case the
+// body of each follows the line in order.
 var (
-	heredocStartPattern = regexp.MustCompile(`^<<(-)?(?:[ \f\r\t\v])*([a-zA-Z0-9_]+)\n`)
+	heredocStartPattern = regexp.MustCompile(`^<<-?[ \f\r\t\v]*[a-zA-Z0-9_]+(?:[ \f\r\t\v]*<<-?[ \f\r\t\v]*[a-zA-Z0-9_]+)*[ \f\r\t\v]*\n`)
+	heredocTermPattern  = regexp.MustCompile(`<<(-)?[ \f\r\t\v]*([a-zA-Z0-9_]+)`)
+	validTermPattern    = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
 	leadingTabsPattern  = regexp.MustCompile(`(?m)^\t+`)
 )
 
-func (h *unevaluatedHeredoc) eval(match string) token {
+func newUnevaluatedHeredoc(ignoreLeadingTabs bool, delimitingTerm string, line int) *unevaluatedHeredoc {
+	return &unevaluatedHeredoc{
+		ignoreLeadingTabs: ignoreLeadingTabs,
+		delimitingTerm:    delimitingTerm,
+		matchPattern:      regexp.MustCompile(`^((?:.|\n)+?\n)?` + regexp.QuoteMeta(delimitingTerm) + `(\n|\z)`),
+		line:              line,
+	}
+}
+
+func (h *unevaluatedHeredoc) unterminatedError() error {
+	return fmt.Errorf("unterminated heredoc started on line %d: no line with the delimiting term %q before the end of input", h.line, h.delimitingTerm)
+}
+
+// heredocStartError returns the reason the given line, which begins with
+// `<<`, does not start one or more heredocs.
+func heredocStartError(line string, lineNum int) error {
+	for _, start := range strings.Split(line, "<<")[1:] {
+		term := strings.Trim(strings.TrimPrefix(start, "-"), " \f\r\t\v")
+
+		switch {
+		case term == "":
+			return fmt.Errorf("invalid heredoc on line %d: empty delimiting term", lineNum)
+		case strings.ContainsAny(term, " \f\r\t\v"):
+			return fmt.Errorf("invalid heredoc on line %d: delimiting term %q contains whitespace", lineNum, term)
+		case !validTermPattern.MatchString(term):
+			return fmt.Errorf("invalid heredoc on line %d: delimiting term %q must contain only letters, digits, and underscores", lineNum, term)
+		}
+	}
+
+	// The terms are valid, so the line is the last of the input.
+	matches := heredocTermPattern.FindStringSubmatch(line)
+
+	return newUnevaluatedHeredoc(matches[1] == "-", matches[2], lineNum).unterminatedError()
+}
+
+func (h *unevaluatedHeredoc) eval(match string) string {
 	if h.ignoreLeadingTabs {
 		match = leadingTabsPattern.ReplaceAllString(match, "")
 	}
 
-	return heredocToken(match)
+	return match
 }
 
 func tokenize(currentToken *token) bufio.SplitFunc {
-	var heredoc *unevaluatedHeredoc
+	// line is the number of the line at the start of the remaining input.
+	line := 1
+
+	// The heredocs started on the current line which have not yet been
+	// matched, and the bodies of those which have.
+	var heredocs []*unevaluatedHeredoc
+	var bodies []string
+
+	// foundHeredoc records the body of the first remaining heredoc. Once
+	// every heredoc started on the line has been found, the heredoc token is
+	// returned with all of their bodies.
+	foundHeredoc := func(body string, fullMatchBytes []byte) (advance int, token []byte, err error) {
+		bodies = append(bodies, heredocs[0].eval(body))
+		heredocs = heredocs[1:]
+
+		if len(heredocs) > 0 {
+			// Consume this heredoc but keep looking for the next.
+			return len(fullMatchBytes), nil, nil
+		}
+
+		*currentToken = heredocToken(bodies)
+		bodies = nil
+
+		return len(fullMatchBytes), fullMatchBytes, nil
+	}
 
 	findHeredoc := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		heredoc := heredocs[0]
+
 		if len(data) == 0 && atEOF {
 			// No more data to parse from stream.
-			return 0, nil, fmt.Errorf("invalid heredoc at end of input: term %q", heredoc.delimitingTerm)
+			return 0, nil, heredoc.unterminatedError()
 		}
 
 		inputStr := string(data)
@@ -157,7 +244,7 @@ func tokenize(currentToken *token) bufio.SplitFunc {
 			// No heredoc match found. If we're at EOF, then it's an invalid
 			// heredoc.
 			if atEOF {
-				return 0, nil, fmt.Errorf("invalid heredoc at end of input: term %q", heredoc.delimitingTerm)
+				return 0, nil, heredoc.unterminatedError()
 			}
 
 			// Try to read more data so that we have more to match.
@@ -165,7 +252,6 @@ func tokenize(currentToken *token) bufio.SplitFunc {
 		}
 
 		fullMatch := matches[0]
-		*currentToken = heredoc.eval(matches[1])
 
 		// Trim the input.
 		fullMatchBytes := []byte(fullMatch)
@@ -178,9 +264,7 @@ func tokenize(currentToken *token) bufio.SplitFunc {
 		if len(fullMatch) == len(inputStr) {
 			if atEOF || matches[2] == "\n" {
 				// We've found the full heredoc.
-				heredoc = nil
-
-				return len(fullMatchBytes), fullMatchBytes, nil
+				return foundHeredoc(matches[1], fullMatchBytes)
 			}
 
 			// The match did not end with a newline and there's more data
@@ -197,14 +281,12 @@ func tokenize(currentToken *token) bufio.SplitFunc {
 		}
 
 		// We've found the full heredoc.
-		heredoc = nil
-
-		return len(fullMatchBytes), fullMatchBytes, nil
+		return foundHeredoc(matches[1], fullMatchBytes)
 	}
 
-	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	split := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		// If we are in a heredoc, look for the end.
-		if heredoc != nil {
+		if len(heredocs) > 0 {
 			return findHeredoc(data, atEOF)
 		}
 
@@ -215,21 +297,34 @@ func tokenize(currentToken *token) bufio.SplitFunc {
 
 		inputStr := string(data)
 
-		// Check if the input matches the beginning of a heredoc.
-		if matches := heredocStartPattern.FindStringSubmatch(inputStr); matches != nil {
-			heredoc = &unevaluatedHeredoc{
-				ignoreLeadingTabs: matches[1] == "-",
-				delimitingTerm:    matches[2],
-				matchPattern:      regexp.MustCompile(`^((?:.|\n)+?\n)?` + regexp.QuoteMeta(matches[2]) + `(\n|\z)`),
+		// Check if the input matches the beginning of one or more heredocs.
+		if match := heredocStartPattern.FindString(inputStr); match != "" {
+			for _, term := range heredocTermPattern.FindAllStringSubmatch(match, -1) {
+				heredocs = append(heredocs, newUnevaluatedHeredoc(term[1] == "-", term[2], line))
 			}
 
-			matchBytes := []byte(matches[0])
+			matchBytes := []byte(match)
 
 			advance, token, err = findHeredoc(data[len(matchBytes):], atEOF)
 
 			return advance + len(matchBytes), token, err
 		}
 
+		// A here-string, as in `<<<"$x"`, is left to the shell as a raw arg.
+		if strings.HasPrefix(inputStr, "<<") && !strings.HasPrefix(inputStr, "<<<") {
+			// Not a valid heredoc start. Find out why once the whole line
+			// has been read.
+			end := strings.IndexByte(inputStr, '\n')
+			if end < 0 && !atEOF {
+				return 0, nil, nil
+			}
+			if end < 0 {
+				end = len(inputStr)
+			}
+
+			return 0, nil, heredocStartError(inputStr[:end], line)
+		}
+
 		var match string
 		for _, pattern := range allPatterns {
 			if match = pattern.re.FindString(inputStr); match == "" {
@@ -258,4 +353,11 @@ func tokenize(currentToken *token) bufio.SplitFunc {
 
 		return len(matchBytes), matchBytes, nil
 	}
+
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		advance, token, err = split(data, atEOF)
+		line += bytes.Count(data[:advance], []byte("\n"))
+
+		return advance, token, err
+	}
 }
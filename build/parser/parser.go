@@ -2,14 +2,32 @@ package parser
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"io"
+	"strings"
 )
 
-// Command has arguments and an input literal from a heredoc.
+// Command has arguments and input literals from any heredocs, in the order
+// they were started. Annotations are the names of any `# dockramp:name`
+// comments which preceded the command. JSONArgs are the arguments after the
+// instruction decoded from their source text if it is a JSON array of
+// strings, as in `VOLUME ["/data", "/log"]`, and are otherwise nil.
 type Command struct {
-	Args    []string
-	Heredoc string
+	Args        []string
+	JSONArgs    []string
+	Heredocs    []string
+	Annotations []string
+}
+
+// Heredoc returns the body of the first heredoc of the command, or an empty
+// string if it has none.
+func (c *Command) Heredoc() string {
+	if len(c.Heredocs) == 0 {
+		return ""
+	}
+
+	return c.Heredocs[0]
 }
 
 // Parse parses the given input as a line-separated list of arguments.
@@ -20,15 +38,21 @@ func Parse(input io.Reader) (commands []*Command, err error) {
 	var currentToken token
 	scanner.Split(tokenize(&currentToken))
 
+	// The source text of each arg token is kept, as evaluating it removes
+	// any quotes.
 	var tokens []token
+	var sources []string
 	for scanner.Scan() {
 		tokens = append(tokens, currentToken)
+		sources = append(sources, scanner.Text())
 
 		if numTokens := len(tokens); numTokens > 1 {
 			prevToken := tokens[numTokens-2]
 			if mergedToken := prevToken.Merge(currentToken); mergedToken != nil {
 				tokens[numTokens-2] = mergedToken
 				tokens = tokens[:numTokens-1]
+				sources[numTokens-2] += sources[numTokens-1]
+				sources = sources[:numTokens-1]
 			}
 		}
 	}
@@ -39,7 +63,17 @@ func Parse(input io.Reader) (commands []*Command, err error) {
 
 	beginning := true
 	var currentCommand *Command
-	for _, token := range tokens {
+	var annotations []string
+	var argSources []string
+
+	endCommand := func() {
+		currentCommand.JSONArgs = parseJSONArray(strings.Join(argSources, " "))
+		commands = append(commands, currentCommand)
+		currentCommand = nil
+		argSources = nil
+	}
+
+	for i, token := range tokens {
 		if token.Type() == tokenTypeWhitespace {
 			continue // Ignore whitespace tokens.
 		}
@@ -47,22 +81,32 @@ func Parse(input io.Reader) (commands []*Command, err error) {
 		if token.Type() == tokenTypeNewline {
 			if !beginning { // handle leading newlines.
 				// Newline signals the end of a command.
-				commands = append(commands, currentCommand)
-				currentCommand = nil
+				endCommand()
 			}
 			continue
 		}
 
+		if token.Type() == tokenTypeAnnotation {
+			if currentCommand != nil {
+				// Annotation also signals the end of a command.
+				endCommand()
+			}
+
+			// Save the annotation for the next command.
+			annotations = append(annotations, token.Value())
+
+			continue
+		}
+
 		if token.Type() == tokenTypeHeredoc {
 			if currentCommand == nil {
 				return nil, errors.New("unexpected heredoc")
 			}
 
-			currentCommand.Heredoc = token.Value()
+			currentCommand.Heredocs = []string(token.(heredocToken))
 
 			// Heredoc also signals the end of a command.
-			commands = append(commands, currentCommand)
-			currentCommand = nil
+			endCommand()
 
 			continue
 		}
@@ -74,15 +118,33 @@ func Parse(input io.Reader) (commands []*Command, err error) {
 		beginning = false
 		// Append arg to current command.
 		if currentCommand == nil {
-			currentCommand = &Command{}
+			currentCommand = &Command{Annotations: annotations}
+			annotations = nil
+		} else {
+			argSources = append(argSources, sources[i])
 		}
 		currentCommand.Args = append(currentCommand.Args, token.Value())
 	}
 
 	if currentCommand != nil {
 		// Handles case with no trailing newline.
-		commands = append(commands, currentCommand)
+		endCommand()
 	}
 
 	return commands, nil
 }
+
+// parseJSONArray returns the strings of the given JSON array, or nil if it is
+// not a JSON array of strings.
+func parseJSONArray(source string) []string {
+	if !strings.HasPrefix(source, "[") || !strings.HasSuffix(source, "]") {
+		return nil
+	}
+
+	elements := []string{}
+	if err := json.Unmarshal([]byte(source), &elements); err != nil {
+		return nil
+	}
+
+	return elements
+}
@@ -0,0 +1,158 @@
+package parser
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	input := `FROM base
+# dockramp:cache-ignore-next
+COPY a /a
+# an ordinary comment
+#dockramp:first and some words
+  # dockramp:second
+RUN sh <<EOF
+echo hi
+EOF
+LABEL foo=bar # dockramp:trailing
+CMD sh
+`
+
+	commands, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unable to parse input: %s", err)
+	}
+
+	expected := []*Command{
+		{Args: []string{"FROM", "base"}},
+		{Args: []string{"COPY", "a", "/a"}, Annotations: []string{"cache-ignore-next"}},
+		{Args: []string{"RUN", "sh"}, Heredocs: []string{"echo hi\n"}, Annotations: []string{"first", "second"}},
+		{Args: []string{"LABEL", "foo=bar"}},
+		{Args: []string{"CMD", "sh"}, Annotations: []string{"trailing"}},
+	}
+
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("expected commands:\n%s\ngot:\n%s", formatCommands(expected), formatCommands(commands))
+	}
+}
+
+func formatCommands(commands []*Command) string {
+	lines := make([]string, len(commands))
+	for i, command := range commands {
+		lines[i] = fmt.Sprintf("%#v", *command)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func TestParseLeadingComments(t *testing.T) {
+	for _, input := range []string{
+		"# A comment.\n# Another comment.\nFROM base\nRUN make\n",
+		"\n\n   \n# A comment after blank lines.\n\nFROM base\nRUN make\n",
+		"# syntax=docker/dockerfile:1\n# escape=\\\n\nFROM base\nRUN make\n",
+		"\t# An indented comment.\r\n\r\nFROM base\r\nRUN make\r\n",
+	} {
+		commands, err := Parse(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("unable to parse %q: %s", input, err)
+		}
+
+		expected := []*Command{
+			{Args: []string{"FROM", "base"}},
+			{Args: []string{"RUN", "make"}},
+		}
+
+		if !reflect.DeepEqual(commands, expected) {
+			t.Fatalf("expected commands for %q:\n%s\ngot:\n%s", input, formatCommands(expected), formatCommands(commands))
+		}
+	}
+}
+
+func TestParseJSONArgs(t *testing.T) {
+	input := "VOLUME [\"/a,b\", \\\n \"/c d\"]\nVOLUME /data\nVOLUME [\"/data\",]\nVOLUME []\n"
+
+	commands, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unable to parse input: %s", err)
+	}
+
+	expected := []*Command{
+		{Args: []string{"VOLUME", "[/a,b,", "/c d]"}, JSONArgs: []string{"/a,b", "/c d"}},
+		{Args: []string{"VOLUME", "/data"}},
+		{Args: []string{"VOLUME", "[/data,]"}},
+		{Args: []string{"VOLUME", "[]"}, JSONArgs: []string{}},
+	}
+
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("expected commands:\n%s\ngot:\n%s", formatCommands(expected), formatCommands(commands))
+	}
+}
+
+func TestParseMultipleHeredocs(t *testing.T) {
+	input := "FROM base\nRUN python3 /.dockramp-heredocs/1 <<SCRIPT <<-DATA\nimport sys\nSCRIPT\n\tone\n\ttwo\nDATA\nRUN sh <<EOF\necho hi\nEOF\n"
+
+	commands, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unable to parse input: %s", err)
+	}
+
+	expected := []*Command{
+		{Args: []string{"FROM", "base"}},
+		{Args: []string{"RUN", "python3", "/.dockramp-heredocs/1"}, Heredocs: []string{"import sys\n", "one\ntwo\n"}},
+		{Args: []string{"RUN", "sh"}, Heredocs: []string{"echo hi\n"}},
+	}
+
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("expected commands:\n%s\ngot:\n%s", formatCommands(expected), formatCommands(commands))
+	}
+
+	if _, err := Parse(strings.NewReader("RUN sh <<A <<B\na\nA\n")); err == nil || !strings.Contains(err.Error(), `term "B"`) {
+		t.Fatalf("expected an error for the unterminated second heredoc, got %v", err)
+	}
+}
+
+func TestParseHereString(t *testing.T) {
+	input := "RUN cat <<<\"$x\"\nRUN cat <<< word\n"
+
+	commands, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unable to parse input: %s", err)
+	}
+
+	expected := []*Command{
+		{Args: []string{"RUN", "cat", "<<<$x"}},
+		{Args: []string{"RUN", "cat", "<<<", "word"}},
+	}
+
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("expected commands:\n%s\ngot:\n%s", formatCommands(expected), formatCommands(commands))
+	}
+}
+
+func TestParseHeredocErrors(t *testing.T) {
+	for input, expected := range map[string]string{
+		"FROM base\nRUN sh <<EOF\necho hi\n":          `unterminated heredoc started on line 2: no line with the delimiting term "EOF"`,
+		"FROM base\n\nRUN sh <<EOF":                   `unterminated heredoc started on line 3: no line with the delimiting term "EOF"`,
+		"FROM base\nRUN sh <<A <<B\na\nA\nb\n":        `unterminated heredoc started on line 2: no line with the delimiting term "B"`,
+		"FROM base\nRUN sh <<\necho hi\n":             "invalid heredoc on line 2: empty delimiting term",
+		"FROM base\nRUN sh <<- \necho hi\n":           "invalid heredoc on line 2: empty delimiting term",
+		"FROM base\nRUN sh <<END OF\necho hi\n":       `invalid heredoc on line 2: delimiting term "END OF" contains whitespace`,
+		"FROM base\nRUN sh <<\"EOF\"\necho hi\nEOF\n": `invalid heredoc on line 2: delimiting term "\"EOF\"" must contain only letters, digits, and underscores`,
+	} {
+		if _, err := Parse(strings.NewReader(input)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %q, got %v", expected, input, err)
+		}
+	}
+
+	// Trailing whitespace after the delimiting term is ignored.
+	commands, err := Parse(strings.NewReader("RUN sh <<EOF \t\necho hi\nEOF\n"))
+	if err != nil {
+		t.Fatalf("unable to parse heredoc with trailing whitespace: %s", err)
+	}
+	if expected := []string{"echo hi\n"}; !reflect.DeepEqual(commands[0].Heredocs, expected) {
+		t.Fatalf("expected heredocs %q, got %q", expected, commands[0].Heredocs)
+	}
+}
@@ -1,5 +1,7 @@
 package parser
 
+import "strings"
+
 type tokenType int
 
 const (
@@ -7,6 +9,7 @@ const (
 	tokenTypeWhitespace
 	tokenTypeHeredoc
 	tokenTypeNewline
+	tokenTypeAnnotation
 )
 
 type token interface {
@@ -76,14 +79,15 @@ func (t newlineToken) Merge(next token) token {
 	}
 }
 
-type heredocToken string
+// heredocToken has the bodies of each heredoc started on a line, in order.
+type heredocToken []string
 
 func (t heredocToken) Type() tokenType {
 	return tokenTypeHeredoc
 }
 
 func (t heredocToken) Value() string {
-	return string(t)
+	return strings.Join(t, "")
 }
 
 func (t heredocToken) Merge(next token) token {
@@ -94,3 +98,24 @@ func (t heredocToken) Merge(next token) token {
 		return nil
 	}
 }
+
+// annotationToken is the name of an annotation. Like a comment, an annotation
+// also ends the current line.
+type annotationToken string
+
+func (t annotationToken) Type() tokenType {
+	return tokenTypeAnnotation
+}
+
+func (t annotationToken) Value() string {
+	return string(t)
+}
+
+func (t annotationToken) Merge(next token) token {
+	switch next.Type() {
+	case tokenTypeWhitespace, tokenTypeNewline:
+		return t
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,142 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	// platformPullAPIVersion is the oldest daemon API version which pulls
+	// the variant of an image for a given platform.
+	platformPullAPIVersion = "1.32"
+	// platformCreateAPIVersion is the oldest daemon API version which
+	// creates containers for a given platform, running them under
+	// emulation if it differs from that of the daemon.
+	platformCreateAPIVersion = "1.41"
+)
+
+// platformComponent matches each component of a platform: an operating
+// system, an architecture, or a variant of the architecture.
+var platformComponent = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// platform is the operating system and architecture, with an optional
+// variant, of the images used and built by a build.
+type platform struct {
+	os, arch, variant string
+}
+
+// parsePlatform parses a platform of the form os/arch[/variant], such as
+// linux/arm64 or linux/arm/v7.
+func parsePlatform(spec string) (*platform, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid platform %q: expected os/arch or os/arch/variant, such as linux/arm64", spec)
+	}
+
+	for _, part := range parts {
+		if !platformComponent.MatchString(part) {
+			return nil, fmt.Errorf("invalid platform %q: each component must contain only lowercase letters, digits, and underscores", spec)
+		}
+	}
+
+	p := &platform{os: parts[0], arch: parts[1]}
+	if len(parts) == 3 {
+		p.variant = parts[2]
+	}
+
+	return p, nil
+}
+
+func (p *platform) String() string {
+	if p.variant != "" {
+		return p.os + "/" + p.arch + "/" + p.variant
+	}
+
+	return p.os + "/" + p.arch
+}
+
+// matches returns whether the given image is for the operating system and
+// architecture of the platform. The variant is not recorded by every daemon,
+// so it is not compared.
+func (p *platform) matches(info *dockerclient.ImageInfo) bool {
+	return info.Os == p.os && info.Architecture == p.arch
+}
+
+// SetPlatform sets the platform, of the form os/arch[/variant], of the images
+// pulled by FROM and COPY --from and of the containers which run the RUN
+// commands. A platform which differs from that of the daemon requires the
+// daemon to emulate it. An empty platform uses that of the daemon.
+func (b *Builder) SetPlatform(spec string) error {
+	if spec == "" {
+		b.platform = nil
+		return nil
+	}
+
+	p, err := parsePlatform(spec)
+	if err != nil {
+		return err
+	}
+
+	b.platform = p
+
+	return nil
+}
+
+// checkPlatformSupport returns an error if a platform is set and the daemon
+// is too old to pull images for it.
+func (b *Builder) checkPlatformSupport() error {
+	if b.platform == nil || apiVersionAtLeast(b.apiVersion, platformPullAPIVersion) {
+		return nil
+	}
+
+	return fmt.Errorf("daemon API version %s is too old: pulling images for platform %s requires API version %s or newer", b.apiVersion, b.platform, platformPullAPIVersion)
+}
+
+// createContainerForPlatform creates a container with the given config for
+// the platform of the build.
+func (b *Builder) createContainerForPlatform(config *dockerclient.ContainerConfig) (string, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode config: %s", err)
+	}
+
+	query := make(url.Values, 1)
+	query.Set("platform", b.platform.String())
+
+	path := fmt.Sprintf("/containers/create?%s", query.Encode())
+	req, err := http.NewRequest("POST", b.client.URL.String()+path, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("unable to prepare request: %s", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.doDaemonRequest(req, false)
+	if err != nil {
+		return "", fmt.Errorf("unable to make request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		// Read the body if possible.
+		buf := bytes.NewBuffer(make([]byte, 0, resp.ContentLength))
+		io.Copy(buf, resp.Body) // It's okay if this fails.
+
+		return "", fmt.Errorf("request failed with status code %d: %s", resp.StatusCode, buf.String())
+	}
+
+	var createResponse dockerclient.RespContainersCreate
+	if err := json.NewDecoder(resp.Body).Decode(&createResponse); err != nil {
+		return "", fmt.Errorf("unable to decode create response: %s", err)
+	}
+
+	return createResponse.Id, nil
+}
@@ -0,0 +1,112 @@
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"linux/arm64":     "",
+		"linux/arm/v7":    "",
+		"windows/amd64":   "",
+		"linux":           "expected os/arch or os/arch/variant",
+		"linux/arm/v7/x":  "expected os/arch or os/arch/variant",
+		"linux/":          "must contain only lowercase letters",
+		"Linux/ARM64":     "must contain only lowercase letters",
+		"linux/arm 64":    "must contain only lowercase letters",
+		"linux/arm64:foo": "must contain only lowercase letters",
+	} {
+		p, err := parsePlatform(spec)
+		if expected == "" {
+			if err != nil {
+				t.Errorf("unable to parse %q: %s", spec, err)
+			} else if p.String() != spec {
+				t.Errorf("expected %q to be formatted as itself, got %q", spec, p)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %q, got %v", expected, spec, err)
+		}
+	}
+}
+
+func TestPlatform(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.apiVersion = "1.41"
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-amd64", Os: "linux", Architecture: "amd64", Config: &dockerclient.ContainerConfig{}})
+	d.platformRegistry[canonicalName("base")+" linux/arm64"] = &dockerclient.ImageInfo{Id: "base-arm64", Os: "linux", Architecture: "arm64", Config: &dockerclient.ContainerConfig{}}
+
+	build := func() {
+		b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nRUN make\n"}, "")
+		if err := b.SetPlatform("linux/arm64"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+	}
+
+	// The local image is for another platform, so the image for the
+	// platform of the build is pulled.
+	build()
+
+	if expected := []string{"linux/arm64"}; !reflect.DeepEqual(d.pullPlatforms, expected) {
+		t.Fatalf("expected pulls for platforms %q, got %q", expected, d.pullPlatforms)
+	}
+	if len(d.runs) != 1 || d.runs[0].platform != "linux/arm64" {
+		t.Fatalf("expected RUN to be run for linux/arm64, got %+v", d.runs)
+	}
+
+	// Once pulled, the image for the platform is used without pulling.
+	build()
+
+	if len(d.pullPlatforms) != 1 {
+		t.Fatalf("expected the pulled image to be used, got pulls for %q", d.pullPlatforms)
+	}
+
+	// A daemon which is too old to run commands for a platform runs them
+	// for the platform of the image.
+	d.apiVersion = "1.40"
+	d.runs = nil
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nRUN make test\n"}, "")
+	b.SetPlatform("linux/arm64")
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+	if len(d.runs) != 1 || d.runs[0].platform != "" {
+		t.Fatalf("expected RUN to be run without a platform, got %+v", d.runs)
+	}
+
+	// A daemon which is too old to pull for a platform fails the build.
+	d.apiVersion = "1.31"
+	b = d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\n"}, "")
+	b.SetPlatform("linux/arm64")
+	if err := b.Run(); err == nil || !strings.Contains(err.Error(), "requires API version 1.32") {
+		t.Fatalf("expected an error for an old daemon, got %v", err)
+	}
+}
+
+func TestPlatformNotAvailable(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.apiVersion = "1.41"
+	d.addRegistryImage("base", &dockerclient.ImageInfo{Id: "base-amd64", Os: "linux", Architecture: "amd64", Config: &dockerclient.ContainerConfig{}})
+
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\n"}, "")
+	if err := b.SetPlatform("linux/arm64"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err == nil || !strings.Contains(err.Error(), "not available for platform linux/arm64") {
+		t.Fatalf("expected an error for an image without the platform, got %v", err)
+	}
+}
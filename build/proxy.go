@@ -0,0 +1,44 @@
+package build
+
+import (
+	"fmt"
+	"os"
+)
+
+// proxyEnvNames are the names of the environment variables which configure
+// proxies for package managers and other tools.
+var proxyEnvNames = []string{
+	"HTTP_PROXY", "http_proxy",
+	"HTTPS_PROXY", "https_proxy",
+	"FTP_PROXY", "ftp_proxy",
+	"NO_PROXY", "no_proxy",
+}
+
+// SetNoProxyInherit sets whether to stop passing the proxy variables in the
+// environment of this process, such as HTTP_PROXY, to RUN commands.
+func (b *Builder) SetNoProxyInherit(noProxyInherit bool) {
+	b.noProxyInherit = noProxyInherit
+}
+
+// proxyEnv returns the proxy variables in the environment of this process as
+// `name=value` strings to set in the environment of a RUN container. They are
+// not committed to the image or part of the build cache key, and a variable
+// set by ENV or ARG takes precedence.
+func (b *Builder) proxyEnv() []string {
+	if b.noProxyInherit {
+		return nil
+	}
+
+	var env []string
+	for _, name := range proxyEnvNames {
+		if _, ok := b.args[name]; ok || b.config.hasEnv(name) {
+			continue
+		}
+
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+
+	return env
+}
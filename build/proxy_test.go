@@ -0,0 +1,46 @@
+package build
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestProxyEnv(t *testing.T) {
+	for _, name := range proxyEnvNames {
+		if value, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			defer os.Setenv(name, value)
+		}
+	}
+
+	os.Setenv("HTTP_PROXY", "http://proxy:3128")
+	os.Setenv("no_proxy", "localhost")
+	os.Setenv("HTTPS_PROXY", "http://proxy:3129")
+	defer os.Unsetenv("HTTP_PROXY")
+	defer os.Unsetenv("no_proxy")
+	defer os.Unsetenv("HTTPS_PROXY")
+
+	b := &Builder{
+		config: &config{Env: []string{"PATH=/bin", "HTTPS_PROXY=http://other:8080"}},
+		args:   map[string]string{},
+	}
+
+	// A variable set with ENV takes precedence.
+	expected := []string{"HTTP_PROXY=http://proxy:3128", "no_proxy=localhost"}
+	if env := b.proxyEnv(); !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected proxy environment %q, got %q", expected, env)
+	}
+
+	// So does a build arg.
+	b.args["no_proxy"] = "example.com"
+	expected = []string{"HTTP_PROXY=http://proxy:3128"}
+	if env := b.proxyEnv(); !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected proxy environment %q, got %q", expected, env)
+	}
+
+	b.SetNoProxyInherit(true)
+	if env := b.proxyEnv(); len(env) != 0 {
+		t.Fatalf("expected no proxy environment, got %q", env)
+	}
+}
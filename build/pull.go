@@ -0,0 +1,258 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
+	"github.com/jlhawn/dockramp/util"
+)
+
+// networkRetryDelay is how long to wait before the first retry of a failed
+// network operation. Each subsequent retry waits twice as long as the last.
+var networkRetryDelay = time.Second
+
+// SetNetworkRetry configures how network operations performed on behalf of
+// the build, such as image pulls, are retried. A failed attempt is retried up
+// to retries more times. If timeout is non-zero, any attempt which takes
+// longer is abandoned and counted as a failure.
+func (b *Builder) SetNetworkRetry(retries int, timeout time.Duration) error {
+	if retries < 0 {
+		return fmt.Errorf("invalid network retry count: %d", retries)
+	}
+	if timeout < 0 {
+		return fmt.Errorf("invalid network timeout: %s", timeout)
+	}
+
+	b.networkRetries = retries
+	b.networkTimeout = timeout
+
+	return nil
+}
+
+// SetPull sets whether the images named by FROM and COPY --from are always
+// pulled so that the build uses their latest version, even if they exist
+// locally. A changed image misses the cache of every step which uses it.
+func (b *Builder) SetPull(pull bool) {
+	b.pull = pull
+}
+
+// jsonMessage is used to decode the stream of progress messages from an
+// image pull or push.
+type jsonMessage struct {
+	ID             string          `json:"id,omitempty"`
+	Status         string          `json:"status"`
+	ProgressDetail *progressDetail `json:"progressDetail,omitempty"`
+	Error          string          `json:"error"`
+}
+
+// progressDetail is the progress of downloading or extracting a layer.
+type progressDetail struct {
+	Current int64 `json:"current"`
+	Total   int64 `json:"total"`
+}
+
+// progressMessage returns the message to emit for the given progress
+// message, or an empty string if it repeats the last message emitted for the
+// same layer, which is recorded in lastStatus. The progress of a download or
+// extraction is only emitted in steps of 10% so that large layers show
+// progress without flooding the output.
+func progressMessage(msg *jsonMessage, lastStatus map[string]string) string {
+	status := msg.Status
+	if detail := msg.ProgressDetail; detail != nil && detail.Total > 0 && detail.Current <= detail.Total {
+		percent := detail.Current * 100 / detail.Total / 10 * 10
+		status = fmt.Sprintf("%s %d%% of %s", msg.Status, percent, units.HumanSize(float64(detail.Total)))
+	}
+
+	if status == "" || lastStatus[msg.ID] == status {
+		return ""
+	}
+	lastStatus[msg.ID] = status
+
+	if msg.ID != "" {
+		return msg.ID + ": " + status
+	}
+
+	return status
+}
+
+// pullImage pulls the given image, retrying if an attempt fails.
+func (b *Builder) pullImage(imageName string) (err error) {
+	delay := networkRetryDelay
+
+	for attempt := 0; attempt <= b.networkRetries; attempt++ {
+		if attempt > 0 {
+			log.Debugf("pull attempt %d of %s failed: %s", attempt, imageName, err)
+			if sleepErr := b.sleep(delay); sleepErr != nil {
+				return sleepErr
+			}
+			delay *= 2
+		}
+
+		if err = b.tryPullImage(imageName); err == nil {
+			return nil
+		}
+		if _, ok := err.(*registryError); ok {
+			// Retrying will not help if the image does not exist or
+			// access to it is denied.
+			return err
+		}
+	}
+
+	return err
+}
+
+func (b *Builder) tryPullImage(imageName string) error {
+	// The tag or digest is given separately, as the docker CLI does, so
+	// that the daemon does not pull every tag of the repository.
+	repo, tagOrDigest := util.ParseRepositoryTag(imageName)
+
+	query := make(url.Values, 3)
+	query.Set("fromImage", repo)
+	query.Set("tag", tagOrDigest)
+	if b.platform != nil {
+		query.Set("platform", b.platform.String())
+	}
+
+	urlPath := fmt.Sprintf("/images/create?%s", query.Encode())
+	req, err := http.NewRequest("POST", b.client.URL.String()+urlPath, nil)
+	if err != nil {
+		return fmt.Errorf("unable to prepare request: %s", err)
+	}
+
+	// The pull is abandoned if the build is cancelled.
+	req = req.WithContext(b.context())
+	req.Header.Set("X-Registry-Auth", b.registryAuth(imageName))
+
+	// The timeout covers reading the whole response body, which is not
+	// complete until the pull has finished.
+	client := &http.Client{
+		Transport: b.client.HTTPClient.Transport,
+		Timeout:   b.networkTimeout,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Read the body if possible.
+		buf := bytes.NewBuffer(make([]byte, 0, resp.ContentLength))
+		io.Copy(buf, resp.Body) // It's okay if this fails.
+
+		message := strings.TrimSpace(buf.String())
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return &registryError{notFound: true, message: message}
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return &registryError{unauthorized: true, message: message}
+		}
+
+		if err := classifyRegistryError(message); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("request failed with status code %d: %s", resp.StatusCode, message)
+	}
+
+	// The pull is not complete until the daemon ends the stream of progress
+	// messages. An error during the pull is reported as the last message.
+	lastStatus := map[string]string{}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg jsonMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to decode pull progress: %s", err)
+		}
+
+		if msg.Error != "" {
+			if err := classifyRegistryError(msg.Error); err != nil {
+				return err
+			}
+			return errors.New(msg.Error)
+		}
+
+		if message := progressMessage(&msg, lastStatus); message != "" {
+			b.emit(&event{Type: eventPull, Image: imageName, Message: message})
+		}
+	}
+}
+
+// registryError is an error from a pull which retrying will not fix: the
+// image does not exist in its registry, access to it is denied, or the
+// registry does not say which of the two.
+type registryError struct {
+	notFound, unauthorized bool
+	message                string
+}
+
+func (e *registryError) Error() string {
+	return e.message
+}
+
+// classifyRegistryError returns a registryError if the given error message
+// from a pull says that the image does not exist or that access to it is
+// denied, or nil otherwise. Registries and daemon versions word these errors
+// differently.
+func classifyRegistryError(message string) error {
+	lower := strings.ToLower(message)
+
+	notFound := containsAny(lower, "not found", "manifest unknown", "does not exist", "name unknown")
+	unauthorized := containsAny(lower, "unauthorized", "authentication required", "access denied", "denied:")
+	if !notFound && !unauthorized {
+		return nil
+	}
+
+	return &registryError{notFound: notFound, unauthorized: unauthorized, message: message}
+}
+
+// isRegistryNetworkError returns whether the given error message from a pull
+// says that the daemon was unable to reach the registry.
+func isRegistryNetworkError(message string) bool {
+	lower := strings.ToLower(message)
+
+	return containsAny(lower, "dial tcp", "no such host", "i/o timeout", "connection refused", "connection reset", "tls handshake timeout", "network is unreachable", "client.timeout exceeded")
+}
+
+func containsAny(s string, substrs ...string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pullError returns an error which explains why the given image could not be
+// pulled and what to do about it.
+func pullError(imageName string, err error) error {
+	if regErr, ok := err.(*registryError); ok {
+		switch {
+		case regErr.notFound && regErr.unauthorized:
+			return fmt.Errorf("image %s was not found or pulling it requires authentication: check the repository name and tag, and run docker login for its registry if it is private (%s)", imageName, regErr.message)
+		case regErr.notFound:
+			return fmt.Errorf("image %s was not found in its registry: check the repository name and tag (%s)", imageName, regErr.message)
+		default:
+			return fmt.Errorf("not authorized to pull image %s: run docker login for its registry or check its credentials in the Docker config file (%s)", imageName, regErr.message)
+		}
+	}
+
+	if isRegistryNetworkError(err.Error()) {
+		return fmt.Errorf("unable to reach the registry of image %s: check the network connection and any registry mirror (%s)", imageName, err)
+	}
+
+	return fmt.Errorf("unable to pull image: %s", err)
+}
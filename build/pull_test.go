@@ -0,0 +1,236 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samalba/dockerclient"
+)
+
+func init() {
+	// Don't make tests wait between retries.
+	networkRetryDelay = time.Millisecond
+}
+
+func TestPullImageRetry(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addRegistryImage("busybox", &dockerclient.ImageInfo{Id: "busybox-id"})
+	d.pullFailures = 2
+
+	b := d.builder(t)
+	if err := b.SetNetworkRetry(2, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.handleFrom([]string{"busybox"}, ""); err != nil {
+		t.Fatalf("unable to handle FROM: %s", err)
+	}
+
+	if d.pulls != 3 {
+		t.Fatalf("expected 3 pull attempts, got %d", d.pulls)
+	}
+
+	if b.imageID != "busybox-id" {
+		t.Fatalf("expected image ID %q, got %q", "busybox-id", b.imageID)
+	}
+}
+
+func TestPullImageRetryExhausted(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addRegistryImage("busybox", &dockerclient.ImageInfo{Id: "busybox-id"})
+	d.pullFailures = 2
+
+	b := d.builder(t)
+	if err := b.SetNetworkRetry(1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.handleFrom([]string{"busybox"}, ""); err == nil {
+		t.Fatal("expected FROM to fail after retries are exhausted")
+	}
+
+	if d.pulls != 2 {
+		t.Fatalf("expected 2 pull attempts, got %d", d.pulls)
+	}
+}
+
+func TestPullImageNotFoundIsNotRetried(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	b := d.builder(t)
+	if err := b.SetNetworkRetry(3, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.handleFrom([]string{"missing"}, ""); err == nil {
+		t.Fatal("expected FROM of a missing image to fail")
+	}
+
+	if d.pulls != 1 {
+		t.Fatalf("expected 1 pull attempt, got %d", d.pulls)
+	}
+}
+
+func TestSetNetworkRetryValidation(t *testing.T) {
+	b := &Builder{}
+
+	if err := b.SetNetworkRetry(-1, 0); err == nil {
+		t.Fatal("expected negative retry count to be rejected")
+	}
+
+	if err := b.SetNetworkRetry(0, -time.Second); err == nil {
+		t.Fatal("expected negative timeout to be rejected")
+	}
+}
+
+func TestPullProgress(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addRegistryImage("busybox", &dockerclient.ImageInfo{Id: "busybox-id"})
+
+	var out bytes.Buffer
+	b := d.builder(t)
+	b.out = &out
+
+	if err := b.handleFrom([]string{"busybox"}, ""); err != nil {
+		t.Fatalf("unable to handle FROM: %s", err)
+	}
+
+	// The progress of the download is shown every 10%.
+	expected := []string{"pulling docker.io/library/busybox:latest ...", "layer1: Pulling fs layer"}
+	for percent := 0; percent <= 100; percent += 10 {
+		expected = append(expected, fmt.Sprintf("layer1: Downloading %d%% of 1 kB", percent))
+	}
+	expected = append(expected, "layer1: Pull complete", "Downloaded newer image for docker.io/library/busybox:latest")
+
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("expected output:\n%s\ngot:\n%s", strings.Join(expected, "\n"), out.String())
+	}
+
+	// Nothing is shown in quiet mode.
+	out.Reset()
+	b.SetQuiet(true)
+	b.SetPull(true)
+	if err := b.handleFrom([]string{"busybox"}, ""); err != nil {
+		t.Fatalf("unable to handle FROM: %s", err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("expected no output in quiet mode, got %q", out.String())
+	}
+}
+
+func TestPullErrors(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected string
+	}{
+		{&registryError{notFound: true, message: "not found"}, "image busybox was not found in its registry: check the repository name and tag (not found)"},
+		{classifyRegistryError("manifest for busybox:missing not found: manifest unknown: manifest unknown"), "image busybox was not found in its registry"},
+		{classifyRegistryError("Tag missing not found in repository docker.io/library/busybox"), "image busybox was not found in its registry"},
+		{&registryError{unauthorized: true, message: "unauthorized"}, "not authorized to pull image busybox: run docker login"},
+		{classifyRegistryError("unauthorized: authentication required"), "not authorized to pull image busybox"},
+		{classifyRegistryError("pull access denied for private/app, repository does not exist or may require 'docker login'"), "image busybox was not found or pulling it requires authentication"},
+		{errors.New(`Get https://registry-1.docker.io/v2/: dial tcp: lookup registry-1.docker.io: no such host`), "unable to reach the registry of image busybox: check the network connection"},
+		{errors.New("request failed with status code 500: disk full"), "unable to pull image: request failed with status code 500: disk full"},
+	} {
+		if err := pullError("busybox", test.err); !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("expected error containing %q for %q, got %q", test.expected, test.err, err)
+		}
+	}
+
+	if err := classifyRegistryError("received unexpected HTTP status: 500 Internal Server Error"); err != nil {
+		t.Fatalf("expected a server error not to be a registry error, got %#v", err)
+	}
+}
+
+func TestPullImageUnauthorizedIsNotRetried(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addRegistryImage("private/app", &dockerclient.ImageInfo{Id: "app-id"})
+	d.pullError = "unauthorized: authentication required"
+
+	b := d.builder(t)
+	if err := b.SetNetworkRetry(3, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	err := b.handleFrom([]string{"private/app"}, "")
+	if err == nil || !strings.Contains(err.Error(), "not authorized to pull image docker.io/private/app:latest") {
+		t.Fatalf("expected an authorization error, got %v", err)
+	}
+
+	if d.pulls != 1 {
+		t.Fatalf("expected 1 pull attempt, got %d", d.pulls)
+	}
+}
+
+func TestPullCancelled(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addRegistryImage("busybox", &dockerclient.ImageInfo{Id: "busybox-id"})
+	d.pullFailures = 10
+
+	defer func(delay time.Duration) { networkRetryDelay = delay }(networkRetryDelay)
+	networkRetryDelay = time.Hour
+
+	b := d.builder(t)
+	if err := b.SetNetworkRetry(5, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	b.SetContext(ctx)
+
+	// The build is cancelled while waiting to retry the pull.
+	if err := b.handleFrom([]string{"busybox"}, ""); err == nil || !strings.Contains(err.Error(), "build cancelled") {
+		t.Fatalf("expected the pull to be cancelled, got %v", err)
+	}
+	if d.pulls != 1 {
+		t.Fatalf("expected 1 pull attempt, got %d", d.pulls)
+	}
+
+	// A pull which hangs is abandoned when the build is cancelled.
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+
+	client, err := dockerclient.NewDockerClient(hung.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.client = client
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	b.SetContext(ctx)
+
+	errC := make(chan error, 1)
+	go func() { errC <- b.tryPullImage("busybox:latest") }()
+
+	select {
+	case err := <-errC:
+		if err == nil {
+			t.Fatal("expected the hung pull to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the hung pull to be abandoned when the build is cancelled")
+	}
+}
@@ -0,0 +1,71 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// SetPush sets whether to push each tag of the built image to its registry
+// after a successful build.
+func (b *Builder) SetPush(push bool) {
+	b.push = push
+}
+
+// pushImage pushes the built image with the given tag to its registry,
+// emitting the progress of the push.
+func (b *Builder) pushImage(tag imageTag) error {
+	b.emit(&event{Type: eventPush, Image: tag.name})
+
+	query := make(url.Values, 1)
+	query.Set("tag", tag.tag)
+
+	urlPath := fmt.Sprintf("/images/%s/push?%s", tag.repo, query.Encode())
+	req, err := http.NewRequest("POST", b.client.URL.String()+urlPath, nil)
+	if err != nil {
+		return fmt.Errorf("unable to prepare request: %s", err)
+	}
+
+	// The push is abandoned if the build is cancelled.
+	req = req.WithContext(b.context())
+	req.Header.Set("X-Registry-Auth", b.registryAuth(tag.repo))
+
+	resp, err := b.client.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Read the body if possible.
+		buf := bytes.NewBuffer(make([]byte, 0, resp.ContentLength))
+		io.Copy(buf, resp.Body) // It's okay if this fails.
+
+		return fmt.Errorf("request failed with status code %d: %s", resp.StatusCode, buf.String())
+	}
+
+	// The push is not complete until the daemon ends the stream of progress
+	// messages. An error during the push is reported as the last message.
+	lastStatus := map[string]string{}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg jsonMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to decode push progress: %s", err)
+		}
+
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+
+		if message := progressMessage(&msg, lastStatus); message != "" {
+			b.emit(&event{Type: eventPush, Image: tag.name, Message: message})
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package build
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestPush(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nCOPY a /a\n", "a": "a"}, "example/app")
+	if err := b.AddTag("registry.example.com:5000/app:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeContextFile(t, d.dir, "config.json", `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("user:secret"))+`"},
+		"registry.example.com:5000": {"username": "other", "password": "pass"}
+	}}`)
+	if err := b.LoadAuthConfig(filepath.Join(d.dir, "config.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	b.out = &out
+	b.SetPush(true)
+
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	for name, expected := range map[string]authConfig{
+		"example/app":                      {Username: "user", Password: "secret", ServerAddress: "https://index.docker.io/v1/"},
+		"registry.example.com:5000/app:v1": {Username: "other", Password: "pass", ServerAddress: "registry.example.com:5000"},
+	} {
+		header, ok := d.pushAuths[canonicalName(name)]
+		if !ok {
+			t.Fatalf("expected %s to be pushed", name)
+		}
+
+		var auth authConfig
+		decoded, err := base64.URLEncoding.DecodeString(header)
+		if err != nil {
+			t.Fatalf("unable to decode auth header for %s: %s", name, err)
+		}
+		if err := json.Unmarshal(decoded, &auth); err != nil {
+			t.Fatalf("unable to decode auth header for %s: %s", name, err)
+		}
+
+		if auth != expected {
+			t.Fatalf("expected auth %+v for %s, got %+v", expected, name, auth)
+		}
+	}
+
+	// Repeated progress is only written once.
+	if count := strings.Count(out.String(), b.ImageID()+": Pushing\n"); count != 2 {
+		t.Fatalf("expected progress of each push once, got %d times in output:\n%s", count, out.String())
+	}
+}
+
+func TestPushFailureKeepsImage(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+	d.pushError = "denied: requested access to the resource is denied"
+
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nCOPY a /a\n", "a": "a"}, "example/app")
+	b.SetPush(true)
+
+	err := b.Run()
+	if err == nil || !strings.Contains(err.Error(), "unable to push example/app: denied") {
+		t.Fatalf("expected push to fail, got %v", err)
+	}
+
+	if _, ok := d.images[b.ImageID()]; !ok {
+		t.Fatalf("expected the built image %s to be kept", b.ImageID())
+	}
+
+	if tagged := d.tags[canonicalName("example/app")]; tagged != b.ImageID() {
+		t.Fatalf("expected the built image %s to be tagged, got %s", b.ImageID(), tagged)
+	}
+}
@@ -0,0 +1,106 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SetDaemonRetry configures how requests made directly to the daemon, such as
+// to commit a container, tag an image, or copy files into a container, are
+// retried if the daemon cannot be reached or is briefly unavailable. A failed
+// request is retried up to retries more times, waiting delay before the first
+// retry and twice as long before each one after.
+func (b *Builder) SetDaemonRetry(retries int, delay time.Duration) error {
+	if retries < 0 {
+		return fmt.Errorf("invalid daemon retry count: %d", retries)
+	}
+	if delay < 0 {
+		return fmt.Errorf("invalid daemon retry delay: %s", delay)
+	}
+
+	b.daemonRetries = retries
+	b.daemonRetryDelay = delay
+
+	return nil
+}
+
+// doDaemonRequest makes the given request to the daemon, retrying it as set
+// by SetDaemonRetry. A request which failed to connect to the daemon was
+// never sent, so it is always retried. Other failures, such as a dropped
+// connection or a response from an overloaded daemon or proxy, are only
+// retried if the request is idempotent and its body, if any, can be sent
+// again.
+func (b *Builder) doDaemonRequest(req *http.Request, idempotent bool) (resp *http.Response, err error) {
+	replayable := req.Body == nil || req.GetBody != nil
+	req = req.WithContext(b.context())
+	if req.Body != nil && req.GetBody == nil {
+		// The client closes the body of a request which fails, but
+		// one which failed to connect has not read any of it and can
+		// still be sent. The caller closes the body when it is done.
+		req.Body = ioutil.NopCloser(req.Body)
+	}
+
+	delay := b.daemonRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err = b.client.HTTPClient.Do(req)
+
+		var retry bool
+		switch {
+		case err != nil:
+			retry = isDialError(err) || (idempotent && replayable)
+		case idempotent && replayable && isUnavailableStatus(resp.StatusCode):
+			retry = true
+		}
+
+		if !retry || attempt == b.daemonRetries {
+			return resp, err
+		}
+
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("request failed with status code %d", resp.StatusCode)
+		}
+
+		log.Debugf("daemon request %s %s failed, retrying in %s: %s", req.Method, req.URL.Path, delay, err)
+		if err := b.sleep(delay); err != nil {
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// isDialError returns whether the given error from an HTTP client is due to a
+// failure to connect.
+func isDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	opErr, ok := err.(*net.OpError)
+
+	return ok && opErr.Op == "dial"
+}
+
+// isUnavailableStatus returns whether the given status code of a response
+// means the request may succeed if it is made again.
+func isUnavailableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,133 @@
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestDaemonRetry(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	build := func(retries int, unavailable map[string]int) error {
+		b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nCOPY file /file\n", "file": "content"}, "test:latest")
+		b.cache = &fileCache{path: d.dir + "/nocache", entries: map[string]string{}}
+		if err := b.SetDaemonRetry(retries, time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+
+		d.unavailable = unavailable
+		return b.Run()
+	}
+
+	if err := build(2, map[string]int{"POST tag": 2, "HEAD archive": 1}); err != nil {
+		t.Fatalf("expected the build to succeed after retries, got %s", err)
+	}
+	if d.tags[canonicalName("test:latest")] == "" {
+		t.Fatal("expected the image to be tagged")
+	}
+
+	if err := build(1, map[string]int{"POST tag": 2}); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected the build to fail once retries are exhausted, got %v", err)
+	}
+
+	// A commit may have happened even if the daemon reports an error, so
+	// it is not retried.
+	if err := build(3, map[string]int{"POST commit": 1}); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected the commit not to be retried, got %v", err)
+	}
+}
+
+// dialFailingTransport fails the given number of requests as if the daemon
+// could not be reached before making requests with the default transport.
+type dialFailingTransport struct {
+	failures int
+	attempts int
+}
+
+func (t *dialFailingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.attempts++
+	if t.attempts <= t.failures {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errConnectionRefused}
+	}
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+var errConnectionRefused = &net.AddrError{Err: "connection refused"}
+
+func TestDaemonRetryCancelled(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+	d.unavailable = map[string]int{"POST tag": 10}
+
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nCOPY file /file\n", "file": "content"}, "test:latest")
+	if err := b.SetDaemonRetry(5, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	b.SetContext(ctx)
+
+	// The build is cancelled while waiting to retry the tag.
+	start := time.Now()
+	if err := b.Run(); err == nil || !strings.Contains(err.Error(), "build cancelled") {
+		t.Fatalf("expected the build to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the build to stop at its deadline, took %s", elapsed)
+	}
+}
+
+func TestDaemonRetryDialError(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+	}))
+	defer server.Close()
+
+	b := &Builder{client: &dockerclient.DockerClient{HTTPClient: &http.Client{}}}
+	if err := b.SetDaemonRetry(2, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, idempotent := range []bool{false, true} {
+		transport := &dialFailingTransport{failures: 2}
+		b.client.HTTPClient.Transport = transport
+
+		// The body is a stream which cannot be read again, but none
+		// of it is read by a request which fails to connect.
+		body := ioutil.NopCloser(strings.NewReader("archive"))
+		req, err := http.NewRequest("POST", server.URL, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := b.doDaemonRequest(req, idempotent)
+		if err != nil {
+			t.Fatalf("expected the request to succeed after retries, got %s", err)
+		}
+		resp.Body.Close()
+
+		if transport.attempts != 3 || received != "archive" {
+			t.Fatalf("expected the whole body after 3 attempts, got %q after %d", received, transport.attempts)
+		}
+	}
+}
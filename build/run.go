@@ -4,35 +4,162 @@ import (
 	"fmt"
 	"io"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/jlhawn/dockramp/build/commands"
+	"github.com/samalba/dockerclient"
 )
 
 func (b *Builder) handleRun(args []string, heredoc string) error {
 	log.Debugf("handling %s with args: %#v", commands.Run, args)
 
-	if len(args) < 1 {
-		return fmt.Errorf("%s requires at least one argument", commands.Run)
+	// The input to the container, which differs from the heredoc if checked.
+	input := heredoc
+
+	if check, ok := b.flags["check"]; ok {
+		enabled, err := strconv.ParseBool(check)
+		if err != nil {
+			return fmt.Errorf("invalid --check value %q: must be a boolean", check)
+		}
+
+		if enabled {
+			if heredoc == "" {
+				return fmt.Errorf("%s --check requires a heredoc", commands.Run)
+			}
+
+			if input, err = checkedScript(args[0], heredoc); err != nil {
+				return err
+			}
+		}
+	}
+
+	networkMode, err := parseNetwork(b.flags["network"])
+	if err != nil {
+		return err
+	}
+
+	var mount *runMount
+	if spec, ok := b.flags["mount"]; ok {
+		if mount, err = parseMount(spec); err != nil {
+			return err
+		}
+
+		if err := b.checkMountCache(mount); err != nil {
+			return err
+		}
 	}
 
 	if heredoc != "" {
-		fmt.Fprintf(b.out, "Input:\n%s\n", heredoc)
-		b.uncommittedCommands = append(b.uncommittedCommands, fmt.Sprintf("RUN input: %q", heredoc))
+		b.emit(&event{Type: eventInput, Message: heredoc})
+		cacheInput := heredoc
+		if b.normalizeCache {
+			cacheInput = normalizeHeredoc(heredoc)
+		}
+		b.uncommittedCommands = append(b.uncommittedCommands, fmt.Sprintf("RUN input: %q", cacheInput))
 	}
 
-	if b.probeCache() {
+	// Any other heredocs are written to files for the command to read.
+	for i, file := range b.heredocFiles {
+		b.emit(&event{Type: eventInput, Message: file})
+		cacheInput := file
+		if b.normalizeCache {
+			cacheInput = normalizeHeredoc(file)
+		}
+		b.uncommittedCommands = append(b.uncommittedCommands, fmt.Sprintf("RUN input %s: %q", heredocFilePath(i+1), cacheInput))
+	}
+
+	// A RUN command followed by another in a batch is run later in the same
+	// container as the last command of the batch.
+	if b.batchNext {
+		b.pendingRuns = append(b.pendingRuns, pendingRun{args: args, input: input})
+		return nil
+	}
+
+	batch := b.pendingRuns
+	b.pendingRuns = nil
+
+	if b.probeCache() || b.dryRun {
 		return nil
 	}
 
-	containerID, err := b.createContainer(args[:1], args[1:], true)
+	start := time.Now()
+
+	// The mount and heredoc files are removed when the command exits so that
+	// they are not committed to the image.
+	var cleanup []string
+	if mount != nil {
+		cleanup = append(cleanup, mount.target)
+	}
+	if len(b.heredocFiles) > 0 {
+		cleanup = append(cleanup, heredocFileDir)
+	}
+
+	entrypoint, cmd := args[:1], args[1:]
+	switch {
+	case len(cleanup) > 0:
+		entrypoint, cmd = cleanupEntrypoint(cleanup...), args
+	case len(batch) > 0:
+		// Each command in the batch reads its input from a file instead.
+		batch = append(batch, pendingRun{args: args, input: input})
+		entrypoint, cmd, input = batchEntrypoint(batchInputDir, batch), nil, ""
+	}
+
+	config := b.containerConfig(entrypoint, cmd, true)
+	config.HostConfig.NetworkMode = networkMode
+	b.limits.apply(&config.HostConfig)
+	config.HostConfig.Ulimits = b.ulimits
+	// Proxy variables are only set for the command, not in the image.
+	config.Env = append(config.Env, b.proxyEnv()...)
+
+	containerID, err := b.createContainerWithConfig(config)
 	if err != nil {
 		return fmt.Errorf("unable to create container: %s", err)
 	}
 
-	errC, err := b.attachContainer(containerID, strings.NewReader(heredoc))
+	// The container is removed by Run if the build fails.
+	b.containerID = containerID
+
+	if mount != nil {
+		if err := b.mountIntoContainer(containerID, mount); err != nil {
+			return err
+		}
+	}
+
+	if len(b.heredocFiles) > 0 {
+		filesArchive, err := inputDirArchive(heredocFileDir, b.heredocFiles, 1)
+		if err != nil {
+			return fmt.Errorf("unable to archive %s heredocs: %s", commands.Run, err)
+		}
+
+		if err := b.extractAtRoot(containerID, filesArchive); err != nil {
+			return fmt.Errorf("unable to copy %s heredocs to container: %s", commands.Run, err)
+		}
+	}
+
+	if len(batch) > 0 {
+		inputs := make([]string, len(batch))
+		for i, run := range batch {
+			inputs[i] = run.input
+		}
+
+		inputArchive, err := inputDirArchive(batchInputDir, inputs, 0)
+		if err != nil {
+			return fmt.Errorf("unable to archive %s input: %s", commands.Run, err)
+		}
+
+		if err := b.extractAtRoot(containerID, inputArchive); err != nil {
+			return fmt.Errorf("unable to copy %s input to container: %s", commands.Run, err)
+		}
+	}
+
+	tail := &outputTail{lines: outputTailLines}
+	errC, err := b.attachContainer(containerID, strings.NewReader(input), tail)
 	if err != nil {
 		return fmt.Errorf("unable to attach to container: %s", err)
 	}
@@ -41,8 +168,17 @@ func (b *Builder) handleRun(args []string, heredoc string) error {
 		return fmt.Errorf("unable to start container: %s", err)
 	}
 
-	// Wait for the container hijack to end.
-	if err := <-errC; err != nil {
+	// Wait for the container hijack to end, or for the build to be
+	// cancelled, in which case the container is killed.
+	err = <-errC
+	if ctxErr := b.ctx.Err(); ctxErr != nil {
+		if err := b.removeContainer(containerID); err != nil {
+			log.Warnf("unable to remove container %s: %s", containerID, err)
+		}
+
+		return fmt.Errorf("%s cancelled: %s", commands.Run, ctxErr)
+	}
+	if err != nil {
 		return fmt.Errorf("unable to end hijack stream: %s", err)
 	}
 
@@ -55,27 +191,93 @@ func (b *Builder) handleRun(args []string, heredoc string) error {
 		return fmt.Errorf("unable to inspect container: %s", err)
 	}
 
-	if info.State.ExitCode != 0 {
-		return fmt.Errorf("non-zero exit code: %d", info.State.ExitCode)
-	}
+	exitCode := info.State.ExitCode
+	b.emit(&event{Type: eventRun, Duration: time.Since(start).Seconds(), ExitCode: &exitCode})
 
-	b.containerID = containerID
+	if exitCode != 0 {
+		if output := tail.String(); output != "" {
+			return fmt.Errorf("non-zero exit code: %d; last lines of output:\n%s", exitCode, output)
+		}
+
+		return fmt.Errorf("non-zero exit code: %d", exitCode)
+	}
 
 	return nil
 }
 
+// parseNetwork returns the network mode of a RUN container given the value of
+// the --network option. An empty mode uses the default network of the daemon.
+func parseNetwork(network string) (string, error) {
+	switch network {
+	case "", "default":
+		return "", nil
+	case "none":
+		return "none", nil
+	default:
+		return "", fmt.Errorf("invalid --network value %q: must be none or default", network)
+	}
+}
+
+// cleanupEntrypoint returns the entrypoint of a RUN container which runs the
+// command given as its arguments and then removes the given paths, exiting
+// with the status of the command.
+func cleanupEntrypoint(paths ...string) []string {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = shellQuote(p)
+	}
+
+	script := fmt.Sprintf(`"$@"; status=$?; rm -rf -- %s; exit $status`, strings.Join(quoted, " "))
+
+	return []string{"/bin/sh", "-c", script, "sh"}
+}
+
+// strictShellOptions maps shells to the options which make a script exit as
+// soon as any command in it fails.
+var strictShellOptions = map[string]string{
+	"bash": "set -euo pipefail",
+	"ksh":  "set -euo pipefail",
+	"zsh":  "set -euo pipefail",
+	"sh":   "set -eu",
+	"ash":  "set -eu",
+	"dash": "set -eu",
+}
+
+// checkedScript returns the given script prefixed with the options for the
+// given shell which make the script exit as soon as any command fails.
+func checkedScript(shell, script string) (string, error) {
+	options, ok := strictShellOptions[path.Base(shell)]
+	if !ok {
+		return "", fmt.Errorf("%s --check is not supported for %q: must be a shell such as sh or bash", commands.Run, shell)
+	}
+
+	return options + "\n" + script, nil
+}
+
 func (b *Builder) createContainer(entryPoint, cmd []string, openStdin bool) (containerID string, err error) {
+	return b.createContainerWithConfig(b.containerConfig(entryPoint, cmd, openStdin))
+}
+
+// containerConfig returns the config of a container to create from the current
+// image with the given entrypoint and command.
+func (b *Builder) containerConfig(entryPoint, cmd []string, openStdin bool) *dockerclient.ContainerConfig {
 	config := b.config.toDocker()
 	config.Entrypoint = entryPoint
 	config.Cmd = cmd
 	config.Image = b.imageID
+	// Build arguments are set in the environment of the container but not
+	// in the config of the committed image.
+	config.Env = append(config.Env[:len(config.Env):len(config.Env)], b.argEnv()...)
 	config.OpenStdin = openStdin
 	config.StdinOnce = openStdin
 
-	return b.client.CreateContainer(config, "", nil)
+	return config
 }
 
-func (b *Builder) attachContainer(container string, input io.Reader) (chan error, error) {
+// attachContainer attaches to the given container, sending it the given input
+// and emitting its output, which is also written to tail. The returned channel
+// receives the result of the attach once all of the output has been emitted.
+func (b *Builder) attachContainer(container string, input io.Reader, tail io.Writer) (chan error, error) {
 	query := make(url.Values, 4)
 	query.Set("stream", "true")
 	query.Set("stdin", "true")
@@ -91,13 +293,25 @@ func (b *Builder) attachContainer(container string, input io.Reader) (chan error
 	// stderr. We need to use a pipe to copy this output into a stdcopy
 	// de-multiplexer and into the build output.
 	pipeReader, pipeWriter := io.Pipe()
+	copied := make(chan struct{})
 	go func() {
+		defer close(copied)
 		defer pipeReader.Close()
-		stdcopy.StdCopy(b.out, b.out, pipeReader)
+		stdout := &outputWriter{b: b, stream: "stdout"}
+		stderr := &outputWriter{b: b, stream: "stderr"}
+		stdcopy.StdCopy(io.MultiWriter(stdout, tail), io.MultiWriter(stderr, tail), pipeReader)
+		stdout.Flush()
+		stderr.Flush()
 	}()
 
 	go func() {
-		hijackErr <- b.hijack("POST", urlPath, input, pipeWriter, hijackStarted)
+		err := b.hijack("POST", urlPath, input, pipeWriter, hijackStarted)
+
+		// Wait for the rest of the output to be de-multiplexed.
+		pipeWriter.Close()
+		<-copied
+
+		hijackErr <- err
 	}()
 
 	// Wait for the hijack to succeeed or fail.
@@ -108,3 +322,51 @@ func (b *Builder) attachContainer(container string, input io.Reader) (chan error
 		return nil, fmt.Errorf("unable to hijack attach tcp stream: %s", err)
 	}
 }
+
+// outputTailLines is the number of lines of the output of a failed RUN command
+// which are included in the error.
+const outputTailLines = 10
+
+// maxOutputTailSize limits the size of the tail of the output kept in case
+// the output has very long lines.
+const maxOutputTailSize = 4096
+
+// outputTail keeps the last lines written to it.
+type outputTail struct {
+	lines int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *outputTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = append(t.buf, p...)
+
+	// Find the start of the last lines, not counting a trailing newline.
+	newlines := 0
+	for i := len(t.buf) - 2; i >= 0; i-- {
+		if t.buf[i] == '\n' {
+			if newlines++; newlines == t.lines {
+				t.buf = t.buf[i+1:]
+				break
+			}
+		}
+	}
+
+	if len(t.buf) > maxOutputTailSize {
+		t.buf = t.buf[len(t.buf)-maxOutputTailSize:]
+	}
+
+	return len(p), nil
+}
+
+// String returns the last lines written without a trailing newline.
+func (t *outputTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return strings.TrimRight(string(t.buf), "\n")
+}
@@ -0,0 +1,147 @@
+package build
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestCheckedScriptAbortsOnFailure(t *testing.T) {
+	const script = "echo before\nfalse\necho after\n"
+
+	for _, shell := range []string{"sh", "bash"} {
+		shellPath, err := exec.LookPath(shell)
+		if err != nil {
+			t.Logf("skipping %s: %s", shell, err)
+			continue
+		}
+
+		run := func(input string) (string, error) {
+			cmd := exec.Command(shellPath)
+			cmd.Stdin = strings.NewReader(input)
+			out, err := cmd.Output()
+			return string(out), err
+		}
+
+		// Without --check, the script carries on after the failure.
+		out, err := run(script)
+		if err != nil || out != "before\nafter\n" {
+			t.Fatalf("%s: unchecked script: expected success with both lines, got %q, %v", shell, out, err)
+		}
+
+		checked, err := checkedScript(shellPath, script)
+		if err != nil {
+			t.Fatalf("%s: unable to check script: %s", shell, err)
+		}
+
+		// With --check, the failure aborts the script.
+		out, err = run(checked)
+		if err == nil || out != "before\n" {
+			t.Fatalf("%s: checked script: expected failure after the first line, got %q, %v", shell, out, err)
+		}
+	}
+}
+
+func TestCheckedScriptPipefail(t *testing.T) {
+	checked, err := checkedScript("/bin/bash", "false | true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(checked, "set -euo pipefail\n") {
+		t.Fatalf("expected bash script to set pipefail, got %q", checked)
+	}
+
+	if _, err := checkedScript("python", "import sys\n"); err == nil {
+		t.Fatal("expected an error for a program which is not a known shell")
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	for network, expected := range map[string]string{"": "", "default": "", "none": "none"} {
+		mode, err := parseNetwork(network)
+		if err != nil || mode != expected {
+			t.Fatalf("expected network mode %q for %q, got %q, %v", expected, network, mode, err)
+		}
+	}
+
+	for _, invalid := range []string{"host", "bridge", "true"} {
+		if _, err := parseNetwork(invalid); err == nil {
+			t.Fatalf("expected an error for --network=%s", invalid)
+		}
+	}
+}
+
+func TestOutputTail(t *testing.T) {
+	tail := &outputTail{lines: 3}
+
+	for _, p := range []string{"one\ntwo\n", "thr", "ee\nfour\n", "five\n"} {
+		tail.Write([]byte(p))
+	}
+
+	if expected := "three\nfour\nfive"; tail.String() != expected {
+		t.Fatalf("expected tail %q, got %q", expected, tail.String())
+	}
+
+	// A long line is truncated.
+	tail.Write([]byte(strings.Repeat("x", 2*maxOutputTailSize)))
+	if len(tail.String()) != maxOutputTailSize {
+		t.Fatalf("expected the tail to be limited to %d bytes, got %d", maxOutputTailSize, len(tail.String()))
+	}
+}
+
+func TestRunEventText(t *testing.T) {
+	var out bytes.Buffer
+	b := &Builder{out: &out}
+
+	success, failure := 0, 3
+	b.emit(&event{Type: eventRun, Duration: 3.21, ExitCode: &success})
+	b.emit(&event{Type: eventRun, Duration: 0.5, ExitCode: &failure})
+
+	if expected := " ---> Ran in 3.2s\n ---> Failed with exit code 3 in 0.5s\n"; out.String() != expected {
+		t.Fatalf("expected output %q, got %q", expected, out.String())
+	}
+}
+
+func TestRunContainerConfig(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	b := d.newBuilder(t, map[string]string{
+		"Dockerfile": "FROM base\nWORKDIR /app\nUSER nobody\nENV GREETING=hello\nRUN pwd\nWORKDIR src\nUSER 1000:1000\nENV GREETING=bye\nRUN id\n",
+	}, "")
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	if len(d.runs) != 2 {
+		t.Fatalf("expected 2 runs, got %d", len(d.runs))
+	}
+
+	// Each RUN container has the working directory, user, and environment
+	// set by the instructions before it.
+	for i, expected := range []struct {
+		workingDir, user, env string
+	}{
+		{"/app", "nobody", "GREETING=hello"},
+		{"/app/src", "1000:1000", "GREETING=bye"},
+	} {
+		run := d.runs[i]
+		if run.workingDir != expected.workingDir || run.user != expected.user {
+			t.Errorf("expected run %d in %s as %s, got %s as %s", i, expected.workingDir, expected.user, run.workingDir, run.user)
+		}
+
+		var found bool
+		for _, env := range run.env {
+			found = found || env == expected.env
+		}
+		if !found {
+			t.Errorf("expected %s in the environment of run %d, got %q", expected.env, i, run.env)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package build
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// secretMask replaces the values of secret build args in the build output.
+const secretMask = "***"
+
+// SetSecretArgs registers the names of build args whose values are secret.
+// Their values are replaced with `***` in the build output, the comments of
+// committed images, and errors, and only a hash of each value is used in the
+// build cache.
+func (b *Builder) SetSecretArgs(names []string) error {
+	secretArgs := make(map[string]struct{}, len(names))
+
+	for _, name := range names {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("invalid secret arg %q: must be the name of a build arg", name)
+		}
+
+		secretArgs[name] = struct{}{}
+	}
+
+	b.secretArgs = secretArgs
+
+	return nil
+}
+
+// isSecretArg returns whether the build arg with the given name is secret.
+func (b *Builder) isSecretArg(name string) bool {
+	_, ok := b.secretArgs[name]
+	return ok
+}
+
+// secretValues returns the non-empty values of secret build args, longest
+// first so that a value which contains another is masked entirely.
+func (b *Builder) secretValues() []string {
+	var values []string
+	for name := range b.secretArgs {
+		for _, args := range []map[string]string{b.buildArgs, b.args} {
+			if value := args[name]; value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+
+	sort.Sort(longestFirst(values))
+
+	return values
+}
+
+// longestFirst sorts strings by decreasing length.
+type longestFirst []string
+
+func (s longestFirst) Len() int           { return len(s) }
+func (s longestFirst) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s longestFirst) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+
+// maskSecrets returns the given string with the values of secret build args
+// replaced with `***`.
+func (b *Builder) maskSecrets(s string) string {
+	for _, value := range b.secretValues() {
+		s = strings.Replace(s, value, secretMask, -1)
+	}
+
+	return s
+}
+
+// secretPrefixLen returns the length of the longest end of s which is the start
+// of one of the given secret values, but not the whole value.
+func secretPrefixLen(s string, secrets []string) int {
+	longest := 0
+	for _, secret := range secrets {
+		for n := len(secret) - 1; n > longest; n-- {
+			if strings.HasSuffix(s, secret[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+
+	return longest
+}
+
+// maskError returns the given error with the values of secret build args
+// masked in its message.
+func (b *Builder) maskError(err error) error {
+	if masked := b.maskSecrets(err.Error()); masked != err.Error() {
+		return errors.New(masked)
+	}
+
+	return err
+}
+
+// hashSecret returns a hash of a secret value for use in the build cache.
+func hashSecret(value string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(value)))
+}
@@ -0,0 +1,126 @@
+package build
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestSecretArgsMasked(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	const secret = "s3cr3t-t0k3n"
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nARG TOKEN\nWORKDIR /$TOKEN\nCOPY a /a\n",
+		"a":          "a",
+	}
+
+	build := func(dockerfile, token string) (*Builder, string, error) {
+		files["Dockerfile"] = dockerfile
+		b := d.newBuilder(t, files, "")
+		if err := b.SetBuildArgs([]string{"TOKEN=" + token}); err != nil {
+			t.Fatalf("unable to set build args: %s", err)
+		}
+		if err := b.SetSecretArgs([]string{"TOKEN"}); err != nil {
+			t.Fatalf("unable to set secret args: %s", err)
+		}
+
+		var out bytes.Buffer
+		b.out = &out
+
+		err := b.Run()
+
+		return b, out.String(), err
+	}
+
+	b, out, err := build(files["Dockerfile"], secret)
+	if err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	// The secret is used in the build.
+	if workdir := d.images[b.ImageID()].Config.WorkingDir; workdir != "/"+secret {
+		t.Fatalf("expected working directory /%s, got %q", secret, workdir)
+	}
+
+	// But masked in the step output and commit comments.
+	if strings.Contains(out, secret) || !strings.Contains(out, "WORKDIR /***") {
+		t.Fatalf("expected secret to be masked in the build output:\n%s", out)
+	}
+
+	for id, image := range d.images {
+		if strings.Contains(image.Comment, secret) {
+			t.Fatalf("secret found in comment of image %s: %s", id, image.Comment)
+		}
+	}
+
+	// A different secret still misses the cache.
+	if other, _, err := build(files["Dockerfile"], "other-token"); err != nil || other.ImageID() == b.ImageID() {
+		t.Fatalf("expected a different image for a different secret, got %s, %v", other.ImageID(), err)
+	}
+
+	// The same secret hits the cache.
+	if again, _, err := build(files["Dockerfile"], secret); err != nil || again.ImageID() != b.ImageID() {
+		t.Fatalf("expected cached image %s, got %s, %v", b.ImageID(), again.ImageID(), err)
+	}
+
+	// The secret is masked in errors.
+	_, out, err = build("FROM base\nARG TOKEN\nCOPY missing-$TOKEN /a\n", secret)
+	if err == nil {
+		t.Fatal("expected copy of a missing file to fail")
+	}
+	if strings.Contains(err.Error(), secret) || !strings.Contains(err.Error(), "missing-***") {
+		t.Fatalf("expected secret to be masked in the error: %s", err)
+	}
+	if strings.Contains(out, secret) {
+		t.Fatalf("expected secret to be masked in the build output:\n%s", out)
+	}
+}
+
+func TestSetSecretArgsValidation(t *testing.T) {
+	b := &Builder{config: &config{}}
+
+	for _, name := range []string{"", "TOKEN=value"} {
+		if err := b.SetSecretArgs([]string{name}); err == nil {
+			t.Fatalf("expected an error for secret arg %q", name)
+		}
+	}
+}
+
+func TestSecretMaskedAcrossWrites(t *testing.T) {
+	const secret = "s3cr3t-t0k3n"
+
+	b := &Builder{config: &config{}, buildArgs: map[string]string{"TOKEN": secret}}
+	if err := b.SetSecretArgs([]string{"TOKEN"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunks := range [][]string{
+		{"token: s3cr", "3t-t0k3n\n"},
+		{"token: s", "3cr3t", "-t0k3", "n and s3cr3t-t0k3n\n"},
+		{"token: s3cr3t-t0k3n", "\n"},
+		// The start of a secret which is not followed by the rest of
+		// it is printed once the output ends.
+		{"token: s3cr3t", "\n", "end s3cr"},
+	} {
+		var out bytes.Buffer
+		b.out = &out
+
+		w := &outputWriter{b: b, stream: "stdout"}
+		for _, chunk := range chunks {
+			w.Write([]byte(chunk))
+		}
+		w.Flush()
+
+		expected := b.maskSecrets(strings.Join(chunks, ""))
+		if out.String() != expected || strings.Contains(out.String(), secret) {
+			t.Errorf("expected output %q for chunks %q, got %q", expected, chunks, out.String())
+		}
+	}
+}
@@ -3,13 +3,15 @@ package build
 // This will take a single word and an array of env variables and
 // process all quotes (" and ') as well as $xxx and ${xxx} env variable
 // tokens.  Tries to mimic bash shell process.
-// It doesn't support all flavors of ${xx:...} formats but new ones can
+// It supports the ${xx:-...} and ${xx:+...} formats, and ${xx-...} and
+// ${xx+...} which only check whether the variable is set. New ones can
 // be added by adding code to the "special ${} format processing" section
 
 import (
 	"fmt"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type shellWord struct {
@@ -75,15 +77,16 @@ func (sw *shellWord) peek() rune {
 	if sw.pos == len(sw.word) {
 		return '\000'
 	}
-	return rune(sw.word[sw.pos])
+	ch, _ := utf8.DecodeRuneInString(sw.word[sw.pos:])
+	return ch
 }
 
 func (sw *shellWord) next() rune {
 	if sw.pos == len(sw.word) {
 		return '\000'
 	}
-	ch := rune(sw.word[sw.pos])
-	sw.pos++
+	ch, size := utf8.DecodeRuneInString(sw.word[sw.pos:])
+	sw.pos += size
 	return ch
 }
 
@@ -148,6 +151,11 @@ func (sw *shellWord) processDoubleQuote() (string, error) {
 func (sw *shellWord) processDollar() (string, error) {
 	sw.next()
 	ch := sw.peek()
+	if ch == '$' {
+		// $$ is a literal $, like \$
+		sw.next()
+		return "$", nil
+	}
 	if ch == '{' {
 		sw.next()
 		name := sw.processName()
@@ -190,6 +198,28 @@ func (sw *shellWord) processDollar() (string, error) {
 				return "", fmt.Errorf("unsupported modifier (%c) in substitution: %s", modifier, sw.word)
 			}
 		}
+		if ch == '-' || ch == '+' {
+			// ${xx-...} and ${xx+...} only check whether the variable
+			// is set, even if it is empty
+			modifier := sw.next()
+
+			word, err := sw.processStopOn('}')
+			if err != nil {
+				return "", err
+			}
+
+			value, set := sw.lookupEnv(name)
+			if modifier == '+' {
+				if set {
+					return word, nil
+				}
+				return "", nil
+			}
+			if !set {
+				return word, nil
+			}
+			return value, nil
+		}
 		return "", fmt.Errorf("missing ':' in substitution: %s", sw.word)
 	}
 	// $xxx case
@@ -222,20 +252,29 @@ func (sw *shellWord) processName() string {
 }
 
 func (sw *shellWord) getEnv(name string) string {
-	for _, env := range sw.envs {
+	value, _ := sw.lookupEnv(name)
+	return value
+}
+
+// lookupEnv returns the value of the variable with the given name and whether
+// it is set. A variable which is set more than once has its last value, as
+// in the environment of a container.
+func (sw *shellWord) lookupEnv(name string) (string, bool) {
+	for i := len(sw.envs) - 1; i >= 0; i-- {
+		env := sw.envs[i]
 		i := strings.Index(env, "=")
 		if i < 0 {
 			if name == env {
 				// Should probably never get here, but just in case treat
 				// it like "var" and "var=" are the same
-				return ""
+				return "", true
 			}
 			continue
 		}
 		if name != env[:i] {
 			continue
 		}
-		return env[i+1:]
+		return env[i+1:], true
 	}
-	return ""
+	return "", false
 }
@@ -15,7 +15,7 @@ func TestShellParser(t *testing.T) {
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
-	envs := []string{"PWD=/home", "SHELL=bash"}
+	envs := []string{"PWD=/home", "SHELL=bash", "EMPTY="}
 	for scanner.Scan() {
 		line := scanner.Text()
 
@@ -38,7 +38,7 @@ func TestShellParser(t *testing.T) {
 		words[0] = strings.TrimSpace(words[0])
 		words[1] = strings.TrimSpace(words[1])
 
-		newWord, err := ProcessWord(words[0], envs)
+		newWord, err := processShellWord(words[0], envs)
 
 		if err != nil {
 			newWord = "error"
@@ -49,3 +49,15 @@ func TestShellParser(t *testing.T) {
 		}
 	}
 }
+
+func TestShellParserLastValue(t *testing.T) {
+	// A variable set more than once, such as by a later ENV, has its last
+	// value.
+	word, err := processShellWord("$A ${A}", []string{"A=first", "B=b", "A=last"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "last last"; word != expected {
+		t.Fatalf("expected %q, got %q", expected, word)
+	}
+}
@@ -0,0 +1,148 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// squashCommand is the command recorded in the build cache and the comment of
+// a squashed image.
+const squashCommand = "SQUASH"
+
+// SetSquash sets whether to squash the filesystem of the built image into a
+// single layer.
+func (b *Builder) SetSquash(squash bool) {
+	b.squash = squash
+}
+
+// squashImage replaces the built image with one which has the same config but
+// only a single layer with the complete filesystem of the image. The
+// filesystem is exported from a container and imported as a new image, which
+// is then committed with the config of the build. The unsquashed image is
+// kept so that it remains in the build cache.
+func (b *Builder) squashImage() error {
+	if b.imageID == "" {
+		// There is nothing to squash in an empty image.
+		return nil
+	}
+
+	unsquashedID := b.imageID
+	b.uncommittedCommands = []string{squashCommand}
+	b.layerCommands = []string{squashCommand}
+	cacheKey := b.getCacheKey()
+
+	if b.probeCache() {
+		return nil
+	}
+
+	log.Debugf("squashing image %s", unsquashedID)
+
+	exportContainer, err := b.createContainer([]string{"/bin/sh", "-c"}, []string{"#(nop)"}, false)
+	if err != nil {
+		return fmt.Errorf("unable to create container: %s", err)
+	}
+
+	importedID, err := b.importContainer(exportContainer)
+	if err != nil {
+		return err
+	}
+	b.committedImages = append(b.committedImages, importedID)
+
+	if err := b.removeContainer(exportContainer); err != nil {
+		log.Warnf("unable to remove container %s: %s", exportContainer, err)
+	}
+
+	// Commit the imported filesystem with the config of the build, which
+	// adds no files.
+	b.imageID = importedID
+	containerID, err := b.createContainer([]string{"/bin/sh", "-c"}, b.nopCommand(), false)
+	if err != nil {
+		return fmt.Errorf("unable to create container: %s", err)
+	}
+
+	b.containerID = containerID
+	b.uncommitted = true
+
+	if err := b.commit(); err != nil {
+		return fmt.Errorf("unable to commit container image: %s", err)
+	}
+
+	// The squashed image is found in the cache by the unsquashed image.
+	return b.cache.Set(cacheKey, b.imageID)
+}
+
+// importContainer exports the filesystem of the given container and imports
+// it as a new image, returning the ID of the image.
+func (b *Builder) importContainer(container string) (string, error) {
+	exportPath := fmt.Sprintf("/containers/%s/export", container)
+	exportResp, err := b.client.HTTPClient.Get(b.client.URL.String() + exportPath)
+	if err != nil {
+		return "", fmt.Errorf("unable to make export request: %s", err)
+	}
+	defer exportResp.Body.Close()
+
+	if exportResp.StatusCode != http.StatusOK {
+		// Read the body if possible.
+		buf := bytes.NewBuffer(make([]byte, 0, exportResp.ContentLength))
+		io.Copy(buf, exportResp.Body) // It's okay if this fails.
+
+		return "", fmt.Errorf("export request failed with status code %d: %s", exportResp.StatusCode, buf.String())
+	}
+
+	query := make(url.Values, 1)
+	query.Set("fromSrc", "-")
+
+	// The exported filesystem is streamed directly into the import.
+	importPath := fmt.Sprintf("/images/create?%s", query.Encode())
+	req, err := http.NewRequest("POST", b.client.URL.String()+importPath, exportResp.Body)
+	if err != nil {
+		return "", fmt.Errorf("unable to prepare request: %s", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	resp, err := b.client.HTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to make import request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Read the body if possible.
+		buf := bytes.NewBuffer(make([]byte, 0, resp.ContentLength))
+		io.Copy(buf, resp.Body) // It's okay if this fails.
+
+		return "", fmt.Errorf("import request failed with status code %d: %s", resp.StatusCode, buf.String())
+	}
+
+	// The last progress message of the import is the ID of the new image.
+	var imageID string
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg jsonMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("unable to decode import progress: %s", err)
+		}
+
+		if msg.Error != "" {
+			return "", errors.New(msg.Error)
+		}
+
+		imageID = msg.Status
+	}
+
+	if imageID == "" {
+		return "", fmt.Errorf("import did not report an image ID")
+	}
+
+	return imageID, nil
+}
@@ -0,0 +1,73 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestSquash(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+	d.imageFiles["base-id"] = map[string]string{"/etc/base": "base"}
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nCOPY a /a\nCOPY b /b\nENV FOO bar\n",
+		"a":          "a",
+		"b":          "b",
+	}
+
+	unsquashed := d.newBuilder(t, files, "")
+	if err := unsquashed.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	build := func() *Builder {
+		b := d.newBuilder(t, files, "example/squashed")
+		b.SetSquash(true)
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		return b
+	}
+
+	b := build()
+
+	image := d.images[b.ImageID()]
+	if image.Parent == "" {
+		t.Fatal("expected the squashed image to have the imported image as its parent")
+	}
+
+	// The imported image is the only layer with files.
+	imported := d.images[image.Parent]
+	if imported.Parent != "" {
+		t.Fatalf("expected the imported image to have no parent, got %s", imported.Parent)
+	}
+
+	expectedFiles := map[string]string{"/etc/base": "base", "/a": "a", "/b": "b"}
+	if !reflect.DeepEqual(d.imageFiles[imported.Id], expectedFiles) {
+		t.Fatalf("expected files %v in the squashed layer, got %v", expectedFiles, d.imageFiles[imported.Id])
+	}
+
+	if env := image.Config.Env; env[len(env)-1] != "FOO=bar" {
+		t.Fatalf("expected the config of the build to be kept, got environment %q", env)
+	}
+
+	if tagged := d.tags[canonicalName("example/squashed")]; tagged != b.ImageID() {
+		t.Fatalf("expected the squashed image %s to be tagged, got %s", b.ImageID(), tagged)
+	}
+
+	// The unsquashed image is kept in the cache.
+	if _, ok := d.images[unsquashed.ImageID()]; !ok {
+		t.Fatal("expected the unsquashed image to be kept")
+	}
+
+	numImages := d.numImages
+	if again := build(); again.ImageID() != b.ImageID() || d.numImages != numImages {
+		t.Fatalf("expected cached squashed image %s, got %s", b.ImageID(), again.ImageID())
+	}
+}
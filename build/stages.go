@@ -0,0 +1,112 @@
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jlhawn/dockramp/build/commands"
+)
+
+// stageNamePattern matches valid names of build stages.
+var stageNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_.-]*$`)
+
+// buildStage is a completed stage of a multi-stage build. Each stage begins
+// with a FROM command, optionally naming the stage with `FROM image AS name`.
+type buildStage struct {
+	name    string
+	imageID string
+}
+
+// parseFromArgs returns the base image and the stage name, if any, from the
+// arguments to a FROM command.
+func parseFromArgs(args []string) (imageName, stageName string, err error) {
+	switch {
+	case len(args) == 1:
+		return args[0], "", nil
+	case len(args) == 3 && strings.EqualFold(args[1], "AS"):
+		stageName = strings.ToLower(args[2])
+		if !stageNamePattern.MatchString(stageName) {
+			return "", "", fmt.Errorf("invalid stage name %q: must start with a letter and contain only letters, digits, '_', '.' and '-'", args[2])
+		}
+
+		return args[0], stageName, nil
+	default:
+		return "", "", fmt.Errorf("%s requires either one argument or three arguments in the form `image AS name`", commands.From)
+	}
+}
+
+// endStage completes the current build stage, committing any trailing metadata
+// commands, and remembers its final image.
+func (b *Builder) endStage() error {
+	// Create a container and commit if we need to (because of trailing
+	// metadata directives).
+	if b.uncommitted && b.dryRun {
+		b.planCommit()
+	} else if b.uncommitted && !b.probeCache() {
+		containerID, err := b.createContainer([]string{"/bin/sh", "-c"}, b.nopCommand(), false)
+		if err != nil {
+			return fmt.Errorf("unable to create container: %s", err)
+		}
+
+		b.containerID = containerID
+
+		if err := b.commit(); err != nil {
+			return fmt.Errorf("unable to commit container image: %s", err)
+		}
+	}
+
+	b.stages = append(b.stages, buildStage{name: b.stageName, imageID: b.imageID})
+
+	return nil
+}
+
+// startStage resets the state of the build for a new stage with the given
+// name, which may be empty.
+func (b *Builder) startStage(name string) error {
+	if name != "" {
+		if _, ok := b.lookupStageName(name); ok {
+			return fmt.Errorf("duplicate stage name %q", name)
+		}
+	}
+
+	b.stageName = name
+	b.imageID = ""
+	b.maintainer = ""
+	b.containerID = ""
+	b.args = map[string]string{}
+	// Annotations apply to every stage.
+	b.config = &config{Annotations: b.config.Annotations}
+
+	return nil
+}
+
+// lookupStage returns the completed build stage with the given name or index.
+func (b *Builder) lookupStage(ref string) (*buildStage, error) {
+	if index, err := strconv.Atoi(ref); err == nil {
+		if index < 0 || index >= len(b.stages) {
+			return nil, fmt.Errorf("no completed build stage with index %d", index)
+		}
+
+		return &b.stages[index], nil
+	}
+
+	if stage, ok := b.lookupStageName(ref); ok {
+		return stage, nil
+	}
+
+	return nil, fmt.Errorf("no completed build stage named %q", ref)
+}
+
+// lookupStageName returns the completed build stage with the given name.
+func (b *Builder) lookupStageName(name string) (*buildStage, bool) {
+	name = strings.ToLower(name)
+	for i := range b.stages {
+		if b.stages[i].name == name {
+			return &b.stages[i], true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,167 @@
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestMultiStageBuild(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"Dockerfile": strings.Join([]string{
+			"FROM base AS builder",
+			"COPY app /out/app",
+			"COPY lib /out/lib/lib",
+			"FROM builder AS tested",
+			"COPY test /out/test",
+			"FROM base",
+			"COPY --from=tested /out/app /bin/app",
+			"COPY --from=0 out/lib /lib",
+			"",
+		}, "\n"),
+		"app":  "app binary",
+		"lib":  "library",
+		"test": "test results",
+	}
+
+	b := d.newBuilder(t, files, "app:latest")
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	if len(b.stages) != 3 {
+		t.Fatalf("expected 3 stages, got %d", len(b.stages))
+	}
+
+	// The second stage builds on the first.
+	if tested := d.imageFiles[b.stages[1].imageID]; tested["/out/app"] != "app binary" || tested["/out/test"] != "test results" {
+		t.Fatalf("unexpected files in second stage: %v", tested)
+	}
+
+	// Only the copied files are in the final image.
+	expected := map[string]string{
+		"/bin/app": "app binary",
+		"/lib/lib": "library",
+	}
+
+	final := d.imageFiles[b.ImageID()]
+	if len(final) != len(expected) {
+		t.Fatalf("expected files %v, got %v", expected, final)
+	}
+	for name, content := range expected {
+		if final[name] != content {
+			t.Fatalf("expected files %v, got %v", expected, final)
+		}
+	}
+
+	if id := d.tags[canonicalName("app:latest")]; id != b.ImageID() {
+		t.Fatalf("expected app:latest to be the final stage %s, got %s", b.ImageID(), id)
+	}
+
+	// Temporary source containers are removed.
+	if len(d.containers) != 0 {
+		t.Fatalf("expected no remaining containers, got %d", len(d.containers))
+	}
+
+	// A rebuild uses the cache for every stage.
+	imageID := b.ImageID()
+	numImages := d.numImages
+
+	b = d.newBuilder(t, files, "app:latest")
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	if b.ImageID() != imageID || d.numImages != numImages {
+		t.Fatalf("expected cached image %s, got %s with %d new images", imageID, b.ImageID(), d.numImages-numImages)
+	}
+
+	// A change to an earlier stage invalidates copies from it.
+	files["app"] = "new app binary"
+
+	b = d.newBuilder(t, files, "app:latest")
+	if err := b.Run(); err != nil {
+		t.Fatalf("build failed: %s", err)
+	}
+
+	if content := d.imageFiles[b.ImageID()]["/bin/app"]; content != "new app binary" {
+		t.Fatalf("expected the new app binary, got %q", content)
+	}
+}
+
+func TestMultiStageBuildErrors(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	for _, testCase := range []struct {
+		dockerfile string
+		err        string
+	}{
+		{"FROM base AS a\nFROM base AS a\n", `duplicate stage name "a"`},
+		{"FROM base AS 1a\n", `invalid stage name "1a"`},
+		{"FROM base a\n", "FROM requires either one argument or three arguments"},
+		{"FROM base AS a\nCOPY --from=b /x /x\n", "invalid --from value: image docker.io/library/b:latest was not found in its registry"},
+		{"FROM base AS a\nCOPY --from=0 /x /x\n", "no completed build stage with index 0"},
+		{"FROM base AS a\nFROM base\nCOPY --from=a --chmod=0644 /x /x\n", "--from cannot be combined"},
+	} {
+		b := d.newBuilder(t, map[string]string{"Dockerfile": testCase.dockerfile}, "")
+
+		err := b.Run()
+		if err == nil || !strings.Contains(err.Error(), testCase.err) {
+			t.Fatalf("expected error containing %q for Dockerfile %q, got %v", testCase.err, testCase.dockerfile, err)
+		}
+	}
+}
+
+func TestCopyFromExternalImage(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+	d.addRegistryImage("alpine:3.4", &dockerclient.ImageInfo{Id: "alpine-id", Config: &dockerclient.ContainerConfig{}})
+	d.imageFiles["alpine-id"] = map[string]string{
+		"/etc/ssl/certs/ca.pem": "certificate",
+		"/etc/hostname":         "alpine",
+	}
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nCOPY --from=alpine:3.4 /etc/ssl/certs /certs\n",
+	}
+
+	for i := 0; i < 2; i++ {
+		b := d.newBuilder(t, files, "")
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		final := d.imageFiles[b.ImageID()]
+		if len(final) != 1 || final["/certs/ca.pem"] != "certificate" {
+			t.Fatalf("unexpected files in image: %v", final)
+		}
+
+		// The image is pulled only once.
+		if d.pulls != 1 {
+			t.Fatalf("expected 1 pull, got %d", d.pulls)
+		}
+	}
+
+	// The source container is removed even if the copy fails.
+	b := d.newBuilder(t, map[string]string{"Dockerfile": "FROM base\nCOPY --from=alpine:3.4 /missing /missing\n"}, "")
+	if err := b.Run(); err == nil {
+		t.Fatal("expected copy of a missing path to fail")
+	}
+
+	for id, container := range d.containers {
+		if container.config.Image == "alpine-id" {
+			t.Fatalf("source container %s was not removed", id)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/jlhawn/dockramp/archive"
+	"github.com/samalba/dockerclient"
+)
+
+// countingReader counts the bytes read through it and records the peak heap
+// usage seen every sampleInterval bytes.
+type countingReader struct {
+	r              io.Reader
+	n              int64
+	nextSample     int64
+	sampleInterval int64
+	peakHeap       uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	if c.n >= c.nextSample {
+		c.nextSample += c.sampleInterval
+
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		if stats.HeapInuse > c.peakHeap {
+			c.peakHeap = stats.HeapInuse
+		}
+	}
+
+	return n, err
+}
+
+func TestCopyToContainerStreams(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large copy in short mode")
+	}
+
+	const (
+		fileSize  = 64 << 20
+		numFiles  = 4
+		maxGrowth = 32 << 20
+	)
+
+	dir := newContextDir(t, nil)
+	defer os.RemoveAll(dir)
+
+	treeDir := filepath.Join(dir, "tree")
+	if err := os.Mkdir(treeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sparse files make for a large tree which is cheap to create.
+	for i := 0; i < numFiles; i++ {
+		f, err := os.Create(filepath.Join(treeDir, fmt.Sprintf("file%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Truncate(fileSize)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var body *countingReader
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			http.Error(w, "no such file or directory", http.StatusNotFound)
+			return
+		}
+
+		body = &countingReader{r: r.Body, sampleInterval: 4 << 20}
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client, err := dockerclient.NewDockerClient(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Builder{client: client, contextDirectory: dir}
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapInuse
+
+	if err := b.copyToContainer(treeDir, &archive.TarOptions{RootDir: dir}, "container", "/tree"); err != nil {
+		t.Fatalf("unable to copy to container: %s", err)
+	}
+
+	if body == nil || body.n < fileSize*numFiles {
+		t.Fatalf("expected at least %d bytes to be copied", fileSize*numFiles)
+	}
+
+	if growth := int64(body.peakHeap) - int64(baseline); growth > maxGrowth {
+		t.Fatalf("heap grew by %d bytes while copying %d bytes", growth, body.n)
+	}
+}
@@ -0,0 +1,35 @@
+package build
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// buildStats holds counts collected over the course of a build.
+type buildStats struct {
+	start     time.Time
+	steps     int
+	cacheHits int
+	layers    int
+}
+
+// printSummary emits an event summarizing a successful build of the named
+// image.
+func (b *Builder) printSummary(imageName string) {
+	summary := &summaryStats{
+		Duration:  time.Since(b.stats.start).Seconds(),
+		Steps:     b.stats.steps,
+		CacheHits: b.stats.cacheHits,
+		Layers:    b.stats.layers,
+		Size:      -1,
+	}
+
+	if info, err := b.client.InspectImage(b.imageID); err != nil {
+		log.Debugf("unable to inspect built image: %s", err)
+	} else {
+		summary.Size = info.VirtualSize
+	}
+
+	b.emit(&event{Type: eventSummary, Image: imageName, ImageID: b.imageID, Summary: summary})
+}
@@ -0,0 +1,90 @@
+package build
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestBuildSummary(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nCOPY a /a\nCOPY b /b\nENV FOO bar\n",
+		"a":          "aaaa",
+		"b":          "bbbbbbbb",
+	}
+
+	summaryPattern := regexp.MustCompile(`Built app:latest in [0-9.]+s; (\d+) steps, (\d+) cache hits, (\d+) layers, total size (.+)\n`)
+
+	build := func() []string {
+		b := d.newBuilder(t, files, "app:latest")
+
+		var out bytes.Buffer
+		b.out = &out
+
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		matches := summaryPattern.FindStringSubmatch(out.String())
+		if matches == nil {
+			t.Fatalf("no build summary in output:\n%s", out.String())
+		}
+
+		return matches[1:]
+	}
+
+	expectSummary := func(summary []string, steps, cacheHits, layers, size string) {
+		expected := []string{steps, cacheHits, layers, size}
+		for i := range expected {
+			if summary[i] != expected[i] {
+				t.Fatalf("expected summary %q, got %q", expected, summary)
+			}
+		}
+	}
+
+	// The first build misses the cache for every step.
+	expectSummary(build(), "4", "0", "3", "12 B")
+
+	// Changing the second copied file misses the cache from that step on.
+	files["b"] = "bbbbbbbbbbbb"
+	expectSummary(build(), "4", "1", "2", "16 B")
+
+	// Nothing changes the second time.
+	expectSummary(build(), "4", "3", "0", "16 B")
+}
+
+func TestQuietBuildPrintsOnlyImageID(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	files := map[string]string{
+		"Dockerfile": "FROM base\nCOPY a /a\nLABEL foo bar\n",
+		"a":          "a",
+	}
+
+	for i := 0; i < 2; i++ {
+		b := d.newBuilder(t, files, "app:latest")
+		b.SetQuiet(true)
+
+		var out bytes.Buffer
+		b.out = &out
+
+		if err := b.Run(); err != nil {
+			t.Fatalf("build failed: %s", err)
+		}
+
+		// The output is the same whether or not the cache is hit.
+		if expected := b.ImageID() + "\n"; out.String() != expected {
+			t.Fatalf("expected output %q, got %q", expected, out.String())
+		}
+	}
+}
@@ -6,8 +6,50 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+
+	"github.com/jlhawn/dockramp/util"
 )
 
+// imageTag is a name to give the built image.
+type imageTag struct {
+	// name is the name as it was specified, and repo and tag are its
+	// canonical parts.
+	name      string
+	repo, tag string
+}
+
+// parseTag validates the given name for the built image.
+func parseTag(repoTag string) (imageTag, error) {
+	repo, tag, digest, err := util.Canonicalize(repoTag)
+	if err != nil {
+		return imageTag{}, fmt.Errorf("invalid tag: %s", err)
+	}
+	if digest != "" {
+		return imageTag{}, fmt.Errorf("invalid tag %q: built images cannot be given a digest", repoTag)
+	}
+
+	return imageTag{name: repoTag, repo: repo, tag: tag}, nil
+}
+
+// AddTag adds another name to give the built image. The first name is the one
+// reported at the end of the build.
+func (b *Builder) AddTag(repoTag string) error {
+	tag, err := parseTag(repoTag)
+	if err != nil {
+		return err
+	}
+
+	for _, existing := range b.tags {
+		if existing.repo == tag.repo && existing.tag == tag.tag {
+			return nil
+		}
+	}
+
+	b.tags = append(b.tags, tag)
+
+	return nil
+}
+
 func (b *Builder) setTag(imgID, repo, tag string) error {
 	query := make(url.Values, 3)
 	query.Set("repo", repo)
@@ -20,7 +62,7 @@ func (b *Builder) setTag(imgID, repo, tag string) error {
 		return fmt.Errorf("unable to prepare request: %s", err)
 	}
 
-	resp, err := b.client.HTTPClient.Do(req)
+	resp, err := b.doDaemonRequest(req, true)
 	if err != nil {
 		return fmt.Errorf("unable to make request: %s", err)
 	}
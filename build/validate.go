@@ -0,0 +1,154 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jlhawn/dockramp/build/commands"
+	"github.com/jlhawn/dockramp/build/parser"
+)
+
+// argValidator checks the number and form of the arguments of a command. A
+// validator depends only on the arguments, and interpolation does not change
+// their number, so every command in the Dockerfile is checked before the build
+// begins. The handlers rely on this and do not check the arguments again.
+type argValidator func(args []string, heredoc string) error
+
+// argValidators maps commands to the validators of their arguments. Commands
+// which are not listed here accept any arguments.
+var argValidators = map[string]argValidator{
+	commands.Add:        unsupportedCommand(commands.Add),
+	commands.Arg:        exactArgs(commands.Arg, 1, "one argument"),
+	commands.Copy:       validateCopyArgs,
+	commands.Env:        atLeastOneArg(commands.Env, "key=value pair"),
+	commands.Expose:     atLeastOneArg(commands.Expose, "argument"),
+	commands.Extract:    exactArgs(commands.Extract, 2, "two arguments"),
+	commands.From:       validateFromArgs,
+	commands.Label:      atLeastOneArg(commands.Label, "key=value pair"),
+	commands.Maintainer: atLeastOneArg(commands.Maintainer, "argument"),
+	commands.Onbuild:    unsupportedCommand(commands.Onbuild),
+	commands.Run:        atLeastOneArg(commands.Run, "argument"),
+	commands.User:       exactArgs(commands.User, 1, "one argument"),
+	commands.Volume:     atLeastOneArg(commands.Volume, "argument"),
+	commands.Workdir:    exactArgs(commands.Workdir, 1, "one argument"),
+}
+
+// exactArgs returns a validator which requires the given number of arguments,
+// described by count.
+func exactArgs(cmd string, n int, count string) argValidator {
+	return func(args []string, heredoc string) error {
+		if len(args) != n {
+			return fmt.Errorf("%s requires exactly %s", cmd, count)
+		}
+
+		return nil
+	}
+}
+
+// atLeastOneArg returns a validator which requires at least one argument,
+// described by what.
+func atLeastOneArg(cmd, what string) argValidator {
+	return func(args []string, heredoc string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("%s requires at least one %s", cmd, what)
+		}
+
+		return nil
+	}
+}
+
+// unsupportedCommand returns a validator which rejects the command.
+func unsupportedCommand(cmd string) argValidator {
+	return func(args []string, heredoc string) error {
+		return fmt.Errorf("%s not yet supported", cmd)
+	}
+}
+
+func validateFromArgs(args []string, heredoc string) error {
+	imageName, _, err := parseFromArgs(args)
+	if err != nil {
+		return err
+	}
+
+	return validateImageDigest(imageName)
+}
+
+// validateCopyArgs requires a source and a destination, or only a destination
+// if the content of the file is given as a heredoc.
+func validateCopyArgs(args []string, heredoc string) error {
+	if heredoc != "" {
+		if len(args) != 1 {
+			return fmt.Errorf("%s with a heredoc requires exactly one argument, the destination", commands.Copy)
+		}
+
+		return nil
+	}
+
+	return exactArgs(commands.Copy, 2, "two arguments")(args, heredoc)
+}
+
+// validateDockerfile checks every command of the parsed Dockerfile so that a
+// mistake is reported before any step of the build is run.
+func validateDockerfile(commandList []*parser.Command) error {
+	if err := checkHasFrom(commandList); err != nil {
+		return err
+	}
+
+	for i, command := range commandList {
+		if err := validateCommand(i, command); err != nil {
+			return fmt.Errorf("invalid Dockerfile step %d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+// checkHasFrom returns an error if the parsed Dockerfile has no FROM command,
+// which would otherwise only be reported as the first command not being FROM.
+func checkHasFrom(commandList []*parser.Command) error {
+	for _, command := range commandList {
+		if strings.ToUpper(command.Args[0]) == commands.From {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no FROM instruction found")
+}
+
+// validateCommand checks that the given command is known, that its annotations
+// and options are known, and that its arguments are valid. FROM must be the
+// first command.
+func validateCommand(stepNum int, command *parser.Command) error {
+	cmd, args := strings.ToUpper(command.Args[0]), command.Args[1:]
+
+	if _, ok := commands.Commands[cmd]; !ok {
+		return fmt.Errorf("unknown command: %q", cmd)
+	}
+
+	if stepNum == 0 && cmd != commands.From {
+		return fmt.Errorf("FROM must be the first Dockerfile command")
+	}
+
+	for _, annotation := range command.Annotations {
+		if _, ok := commands.Annotations[annotation]; !ok {
+			return fmt.Errorf("unknown annotation: %q", "dockramp:"+annotation)
+		}
+	}
+
+	if len(command.Heredocs) > 1 && cmd != commands.Run {
+		return fmt.Errorf("%s accepts at most one heredoc", cmd)
+	}
+
+	if allowed, ok := commands.Flags[cmd]; ok {
+		var err error
+		if _, _, args, err = parseFlags(cmd, args, allowed); err != nil {
+			return err
+		}
+	}
+
+	if validate, ok := argValidators[cmd]; ok {
+		return validate(args, command.Heredoc())
+	}
+
+	return nil
+}
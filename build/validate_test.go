@@ -0,0 +1,57 @@
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jlhawn/dockramp/build/parser"
+	"github.com/samalba/dockerclient"
+)
+
+func TestValidateDockerfile(t *testing.T) {
+	for dockerfile, expected := range map[string]string{
+		"FROM base\nCOPY a\n":                       "step 1: COPY requires exactly two arguments",
+		"COPY a /a\nFROM base\n":                    "step 0: FROM must be the first Dockerfile command",
+		"COPY a /a\nRUN make\n":                     "no FROM instruction found",
+		"FROM base\nFETCH a\n":                      `step 1: unknown command: "FETCH"`,
+		"FROM base\nRUN --privileged make\n":        "step 1: unknown flag for RUN: --privileged",
+		"FROM base\nRUN --network=none\n":           "step 1: RUN requires at least one argument",
+		"FROM base\n# dockramp:unknown\nRUN make\n": `step 1: unknown annotation: "dockramp:unknown"`,
+		"FROM base AS 1st\n":                        "step 0: invalid stage name",
+		"FROM base\nENV\n":                          "step 1: ENV requires at least one key=value pair",
+		"FROM base\nUSER a b\n":                     "step 1: USER requires exactly one argument",
+		"FROM base\nADD a /a\n":                     "step 1: ADD not yet supported",
+		"FROM base\nCMD\nENTRYPOINT\nWORKDIR a b\n": "step 3: WORKDIR requires exactly one argument",
+		"FROM base\nCOPY /a <<A <<B\na\nA\nb\nB\n":  "step 1: COPY accepts at most one heredoc",
+		"FROM alpine@sha256:123\n":                  "step 0: invalid digest in image reference",
+	} {
+		commandList, err := parser.Parse(strings.NewReader(dockerfile))
+		if err != nil {
+			t.Fatalf("unable to parse %q: %s", dockerfile, err)
+		}
+
+		if err := validateDockerfile(commandList); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %q, got %v", expected, dockerfile, err)
+		}
+	}
+}
+
+func TestValidateBeforeBuild(t *testing.T) {
+	d := newFakeDaemon(t)
+	defer d.Close()
+
+	d.addImage("base", &dockerclient.ImageInfo{Id: "base-id", Config: &dockerclient.ContainerConfig{}})
+
+	b := d.newBuilder(t, map[string]string{
+		"Dockerfile": "FROM base\nCOPY a /a\nEXTRACT a.tar\n",
+		"a":          "a",
+	}, "")
+
+	if err := b.Run(); err == nil || !strings.Contains(err.Error(), "EXTRACT requires exactly two arguments") {
+		t.Fatalf("expected the Dockerfile to be invalid, got %v", err)
+	}
+
+	if d.numContainers != 0 {
+		t.Fatalf("expected no containers to be created, got %d", d.numContainers)
+	}
+}
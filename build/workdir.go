@@ -0,0 +1,119 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jlhawn/dockramp/build/commands"
+)
+
+// createWorkdir ensures that the current working directory exists in the
+// container filesystem so that later commands may use it. If the directory
+// already exists, WORKDIR only changes the config and nothing is committed.
+func (b *Builder) createWorkdir() error {
+	workdir := b.config.WorkingDir
+	if workdir == "/" {
+		return nil
+	}
+
+	// A previous build may have already created the directory.
+	if b.probeCache() || b.dryRun {
+		return nil
+	}
+
+	containerID, err := b.createContainer([]string{"/bin/sh", "-c"}, b.nopCommand(), false)
+	if err != nil {
+		return fmt.Errorf("unable to create container: %s", err)
+	}
+
+	stat, err := b.statContainerPath(containerID, workdir)
+	if err == nil {
+		if err := b.removeContainer(containerID); err != nil {
+			log.Warnf("unable to remove container %s: %s", containerID, err)
+		}
+
+		if !stat.Mode.IsDir() {
+			return fmt.Errorf("%s %s exists but is not a directory", commands.Workdir, workdir)
+		}
+
+		log.Debugf("working directory %s already exists", workdir)
+
+		return nil
+	}
+
+	log.Debugf("creating working directory %s", workdir)
+
+	// The container is removed by Run if the build fails.
+	b.containerID = containerID
+
+	if err := b.mkdirInContainer(containerID, workdir); err != nil {
+		return fmt.Errorf("unable to create working directory: %s", err)
+	}
+
+	if err := b.commit(); err != nil {
+		return fmt.Errorf("unable to commit container image: %s", err)
+	}
+
+	return nil
+}
+
+// mkdirInContainer creates the directory at the given absolute path in the
+// container, along with any missing parent directories, by extracting an
+// archive which contains only that directory.
+func (b *Builder) mkdirInContainer(container, dir string) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	header := &tar.Header{
+		Name:     strings.TrimPrefix(dir, "/") + "/",
+		Mode:     0755,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeDir,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return b.extractAtRoot(container, &buf)
+}
+
+// extractAtRoot extracts the given tar archive at the root of the container
+// filesystem.
+func (b *Builder) extractAtRoot(container string, tarball io.Reader) error {
+	query := make(url.Values, 1)
+	query.Set("path", "/")
+
+	urlPath := fmt.Sprintf("/containers/%s/archive?%s", container, query.Encode())
+	req, err := http.NewRequest("PUT", b.client.URL.String()+urlPath, tarball)
+	if err != nil {
+		return fmt.Errorf("unable to prepare request: %s", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	resp, err := b.doDaemonRequest(req, true)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Read the body if possible.
+		errBuf := bytes.NewBuffer(make([]byte, 0, resp.ContentLength))
+		io.Copy(errBuf, resp.Body) // It's okay if this fails.
+
+		return fmt.Errorf("request failed with status code %d: %s", resp.StatusCode, errBuf.String())
+	}
+
+	return nil
+}
@@ -1,44 +1,111 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/jlhawn/dockramp/build"
+	"github.com/jlhawn/dockramp/util"
 )
 
-const (
-	defaultDockerSocket       = "unix:///var/run/docker.sock"
-	defaultCertDir            = "$HOME/.docker"
-	defaultCACertFilename     = "ca.pem"
-	defaultClientCertFilename = "cert.pem"
-	defaultClientKeyFilename  = "key.pem"
-)
+const defaultAuthConfigFilename = "config.json"
+
+// listOpts is a flag which may be given more than once.
+type listOpts []string
+
+func (l *listOpts) String() string {
+	return fmt.Sprintf("%v", []string(*l))
+}
+
+func (l *listOpts) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
 func main() {
 	// Set Docker connection flags.
 	var (
-		daemonURL      = flag.String("H", "", "Docker daemon socket/host to connect to")
-		useTLS         = flag.Bool("-tls", false, "Use TLS client cert/key (implied by --tlsverify)")
-		verifyTLS      = flag.Bool("-tlsverify", true, "Use TLS and verify the remote server certificate")
-		caCertFile     = flag.String("-cacert", "", "Trust certs signed only by this CA")
-		clientCertFile = flag.String("-cert", "", "TLS client certificate")
-		clientKeyFile  = flag.String("-key", "", "TLS client key")
+		host           = flag.String("H", "", "Docker daemon socket/host to connect to")
+		useTLS         = flag.Bool("tls", false, "Use TLS client cert/key (implied by -tlsverify)")
+		verifyTLS      = flag.Bool("tlsverify", false, "Use TLS and verify the remote server certificate")
+		caCertFile     = flag.String("cacert", "", "Trust certs signed only by this CA")
+		clientCertFile = flag.String("cert", "", "TLS client certificate")
+		clientKeyFile  = flag.String("key", "", "TLS client key")
 	)
 
 	// Build context flags.
 	var (
 		contextDirectory = flag.String("C", ".", "Build context directory")
-		dockerfilePath   = flag.String("f", "", "Path to Dockerfile")
-		repoTag          = flag.String("t", "", "Repository name (and optionally a tag) for the image")
+		dockerfilePath   = flag.String("f", "", "Path to Dockerfile, or - to read it from stdin")
+		repoTags         listOpts
+		lockPath         = flag.String("lock", "", "Hold an exclusive lock on this file for the duration of the build or of -prune-cache")
+		graphPath        = flag.String("graph", "", "Write the build stage graph in DOT format to this file instead of building")
+		iidFile          = flag.String("iidfile", "", "Write the ID of the built image to this file")
+		metadataFile     = flag.String("metadata-file", "", "Write a JSON description of the build to this file")
+		cacheBackend     = flag.String("cache-backend", "", "Build cache to use: file:path, dir:path, or an http(s) URL (default ~/.dockrampcache)")
+		pruneCache       = flag.Bool("prune-cache", false, "Remove the build cache entries whose images no longer exist instead of building")
+		dryRun           = flag.Bool("dry-run", false, "Validate the Dockerfile and print the planned steps without contacting the daemon")
+		maxSteps         = flag.Int("max-steps", 0, "Fail if the Dockerfile has more than this many steps (0 for no limit)")
+		buildArgs        listOpts
+		secretArgs       listOpts
+		forceRm          = flag.Bool("force-rm", false, "Always remove the containers created by the build, even if -rm=false")
+		contextWarnSize  = flag.String("context-warn-size", "100MB", "Warn when COPY copies the whole build context and its archive is larger than this (0 to never warn)")
+		tarsumVersion    = flag.String("tarsum-version", "v1", "Version of tarsum used to digest files for the build cache: v1 (SHA-256) or v2 (SHA-512)")
+		noComment        = flag.Bool("no-comment", false, "Commit images with an empty comment instead of the commands of each layer")
+		squash           = flag.Bool("squash", false, "Squash the filesystem of the built image into a single layer")
+		push             = flag.Bool("push", false, "Push each tag of the built image to its registry after the build")
+		compressRuns     = flag.Bool("compress-runs", false, "Run consecutive RUN commands in the same container and commit them as one layer")
+		interpolateRun   = flag.Bool("interpolate-run", false, "Substitute ENV and ARG values into the arguments of RUN commands; $$ is a literal $")
+		rm               = flag.Bool("rm", true, "Remove the containers and images created by a build which fails")
+		timeout          = flag.Duration("timeout", 0, "Cancel the build if it takes longer than this (0 for no limit)")
+		noProxyInherit   = flag.Bool("no-proxy-inherit", false, "Do not pass HTTP_PROXY and the other proxy variables in the environment to RUN commands")
+	)
+	flag.Var(&repoTags, "t", "Repository name (and optionally a tag) for the image (may be repeated)")
+	flag.Var(&buildArgs, "build-arg", "Set the build arg name=value, or name to use its value from the environment (may be repeated)")
+	flag.Var(&secretArgs, "secret-arg", "Mask the value of the named build arg in the build output (may be repeated)")
+
+	// Image metadata flags.
+	var (
+		configPatchPath   = flag.String("config-patch", "", "Merge the JSON object in this file into the config of committed images")
+		annotations       listOpts
+		labels            listOpts
+		strictAnnotations = flag.Bool("strict-annotations", false, "Require annotation keys in reverse domain notation")
 	)
+	flag.Var(&annotations, "annotation", "Set metadata key=value on the image (may be repeated)")
+	flag.Var(&labels, "label", "Set the label key=value on the image (may be repeated)")
+
+	// Network resilience flags.
+	var (
+		networkRetries = flag.Int("network-retries", 0, "Number of times to retry a failed image pull")
+		networkTimeout = flag.Duration("network-timeout", 0, "Time limit for each image pull attempt (0 for no limit)")
+		daemonRetries  = flag.Int("daemon-retries", 0, "Number of times to retry a request to the daemon which fails because it cannot be reached or is unavailable")
+		daemonDelay    = flag.Duration("daemon-retry-delay", time.Second, "Time to wait before the first retry of a failed daemon request, doubling with each retry")
+		registryMirror = flag.String("registry-mirror", "", "Registry to pull Docker Hub images from instead")
+		pull           = flag.Bool("pull", false, "Always pull the images named by FROM and COPY --from, even if they exist locally")
+		platform       = flag.String("platform", "", "Platform of the pulled images and RUN containers, such as linux/arm64")
+	)
+
+	// RUN container resource flags.
+	var (
+		memory     = flag.String("memory", "", "Memory limit of RUN containers, such as 512m or 2g")
+		cpuShares  = flag.Int64("cpu-shares", 0, "CPU shares (relative weight) of RUN containers")
+		cpusetCpus = flag.String("cpuset-cpus", "", "CPUs on which RUN containers may run, such as 0-3,5")
+		ulimits    listOpts
+	)
+	flag.Var(&ulimits, "ulimit", "Set the ulimit name=soft[:hard] of RUN containers (may be repeated)")
 
 	debug := flag.Bool("d", false, "enable debug output")
+	quiet := flag.Bool("q", false, "Suppress the build output and print only the image ID")
+	format := flag.String("format", build.FormatText, "Format of the build output: text or json")
 
 	flag.Parse()
 
@@ -50,96 +117,249 @@ func main() {
 	 * Get Docker client connection *
 	 ********************************/
 
-	// Command line option takes preference, then fallback to environment var,
-	// then fallback to default.
-	if *daemonURL == "" {
-		if *daemonURL = os.Getenv("DOCKER_HOST"); *daemonURL == "" {
-			*daemonURL = defaultDockerSocket
+	tlsConfig, daemonURL, err := build.ClientConfigFromEnv(*host, build.TLSOptions{
+		UseTLS:         *useTLS,
+		VerifyTLS:      *verifyTLS,
+		CACertFile:     *caCertFile,
+		ClientCertFile: *clientCertFile,
+		ClientKeyFile:  *clientKeyFile,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// An interrupt cancels the build, so that Run stops its RUN command and
+	// removes its containers before any lock is released. A second
+	// interrupt exits immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-interrupts
+		signal.Stop(interrupts)
+		log.Warnf("build interrupted: %s: cancelling the build", sig)
+		cancel()
+	}()
+
+	// The lock is held while pruning too, as another build which uses the
+	// lock may be saving the same cache.
+	if *lockPath != "" {
+		lock, err := util.LockFile(*lockPath, func() {
+			fmt.Fprintf(os.Stderr, "waiting for lock on %s ...\n", *lockPath)
+		})
+		if err != nil {
+			log.Fatal(err)
 		}
+
+		// Release the lock once the build is done, even if it fails
+		// with a fatal error which skips deferred calls.
+		var once sync.Once
+		unlockOnce := func() { once.Do(func() { lock.Unlock() }) }
+		log.AddHook(fatalHook(unlockOnce))
+		defer unlockOnce()
 	}
 
-	// Setup TLS config.
-	var tlsConfig *tls.Config
-	if *useTLS || *verifyTLS || os.Getenv("DOCKER_TLS_VERIFY") != "" {
-		tlsConfig = &tls.Config{
-			InsecureSkipVerify: !*verifyTLS,
+	if *pruneCache {
+		removed, err := build.PruneCache(daemonURL, tlsConfig, *cacheBackend)
+		if err != nil {
+			log.Fatalf("unable to prune build cache: %s", err)
 		}
 
-		// Get the cert path specified by environment variable or default.
-		certDir := os.Getenv("DOCKER_CERT_PATH")
-		if certDir == "" {
-			certDir = defaultCertDir
+		fmt.Printf("Removed %d stale build cache entries\n", removed)
+		return
+	}
+
+	/***************
+	 * Begin Build *
+	 ***************/
+
+	// A context given as an argument may need to be fetched.
+	if flag.NArg() > 1 {
+		log.Fatalf("too many arguments: %v", flag.Args())
+	}
+
+	if source := flag.Arg(0); source != "" {
+		if flagIsSet("C") {
+			log.Fatal("the build context may be given with -C or as an argument, but not both")
 		}
-		certDir = os.ExpandEnv(certDir)
-
-		// Get CA cert bundle.
-		if *caCertFile == "" { // Not set on command line.
-			*caCertFile = filepath.Join(certDir, defaultCACertFilename)
-			if _, err := os.Stat(*caCertFile); os.IsNotExist(err) {
-				// CA cert bundle does not exist in default location.
-				// We'll use the system default root CAs instead.
-				*caCertFile = ""
-			}
+		if source == build.ContextStdin && *dockerfilePath == build.DockerfileStdin {
+			log.Fatal("the build context and the Dockerfile cannot both be read from stdin")
 		}
 
-		if *caCertFile != "" {
-			certBytes, err := ioutil.ReadFile(*caCertFile)
-			if err != nil {
-				log.Fatalf("unable to read ca cert file: %s", err)
-			}
-
-			tlsConfig.RootCAs = x509.NewCertPool()
-			if !tlsConfig.RootCAs.AppendCertsFromPEM(certBytes) {
-				log.Fatal("unable to load ca cert file")
-			}
+		dir, cleanup, err := build.PrepareContext(source)
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		// Get client cert.
-		if *clientCertFile == "" { // Not set on command line.
-			*clientCertFile = filepath.Join(certDir, defaultClientCertFilename)
-			if _, err := os.Stat(*clientCertFile); os.IsNotExist(err) {
-				// Client cert does not exist in default location.
-				*clientCertFile = ""
-			}
+		// Remove a fetched context even if the build fails.
+		var once sync.Once
+		cleanupOnce := func() { once.Do(cleanup) }
+		log.AddHook(fatalHook(cleanupOnce))
+		defer cleanupOnce()
+
+		*contextDirectory = dir
+	}
+
+	// Every tag is validated before building.
+	builder, err := build.NewBuilderWithOptions(build.BuilderOptions{
+		DaemonURL:        daemonURL,
+		TLSConfig:        tlsConfig,
+		ContextDirectory: *contextDirectory,
+		DockerfilePath:   *dockerfilePath,
+		Tags:             repoTags,
+		CacheBackend:     *cacheBackend,
+		BuildArgs:        buildArgs,
+	})
+	if err != nil {
+		log.Fatalf("unable to initialize builder: %s", err)
+	}
+
+	if *graphPath != "" {
+		if err := writeGraph(builder, *graphPath); err != nil {
+			log.Fatalf("unable to write build graph: %s", err)
 		}
+		return
+	}
+
+	if *push && len(repoTags) == 0 {
+		log.Fatal("-push requires a tag given with -t")
+	}
+
+	authConfigPath := filepath.Join(build.DockerConfigDir(), defaultAuthConfigFilename)
+	if err := builder.LoadAuthConfig(authConfigPath); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := builder.SetNetworkRetry(*networkRetries, *networkTimeout); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := builder.SetDaemonRetry(*daemonRetries, *daemonDelay); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := builder.SetRegistryMirror(*registryMirror); err != nil {
+		log.Fatal(err)
+	}
+
+	builder.SetPull(*pull)
 
-		// Get client key.
-		if *clientKeyFile == "" { // Not set on commadn line.
-			*clientKeyFile = filepath.Join(certDir, defaultClientKeyFilename)
-			if _, err := os.Stat(*clientKeyFile); os.IsNotExist(err) {
-				// Client key does not exist in default location.
-				*clientKeyFile = ""
-			}
+	if err := builder.SetPlatform(*platform); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := builder.SetTarsumVersion(*tarsumVersion); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := builder.SetContextWarnSize(*contextWarnSize); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := builder.SetMaxSteps(*maxSteps); err != nil {
+		log.Fatal(err)
+	}
+
+	if *timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, *timeout)
+		defer cancelTimeout()
+	}
+	builder.SetContext(ctx)
+
+	if err := builder.SetResourceLimits(*memory, *cpuShares, *cpusetCpus); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := builder.SetUlimits(ulimits); err != nil {
+		log.Fatal(err)
+	}
+
+	builder.SetRemoveIntermediates(*rm)
+	builder.SetForceRemove(*forceRm)
+	builder.SetSquash(*squash)
+	builder.SetNoComment(*noComment)
+	builder.SetCompressRuns(*compressRuns)
+	builder.SetInterpolateRun(*interpolateRun)
+	builder.SetPush(*push)
+	builder.SetDryRun(*dryRun)
+	builder.SetQuiet(*quiet)
+	builder.SetIIDFile(*iidFile)
+	builder.SetMetadataFile(*metadataFile)
+
+	if err := builder.SetFormat(*format); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := builder.SetSecretArgs(secretArgs); err != nil {
+		log.Fatal(err)
+	}
+
+	builder.SetNoProxyInherit(*noProxyInherit)
+
+	if err := builder.SetLabels(labels); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := builder.SetAnnotations(annotations, *strictAnnotations); err != nil {
+		log.Fatal(err)
+	}
+
+	if *configPatchPath != "" {
+		configPatch, err := ioutil.ReadFile(*configPatchPath)
+		if err != nil {
+			log.Fatalf("unable to read config patch: %s", err)
 		}
 
-		// If one of client cert/key is specified then both must be.
-		certSpecified := *clientCertFile != ""
-		keySpecified := *clientKeyFile != ""
-		if certSpecified != keySpecified {
-			log.Fatal("must specify both client certificate and key")
+		if err := builder.SetConfigPatch(configPatch); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		// If both are specified, load them into the tls config.
-		if certSpecified && keySpecified {
-			tlsClientCert, err := tls.LoadX509KeyPair(*clientCertFile, *clientKeyFile)
-			if err != nil {
-				log.Fatalf("unable to load client cert/key pair: %s", err)
-			}
+	if err := builder.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
 
-			tlsConfig.Certificates = append(tlsConfig.Certificates, tlsClientCert)
+// flagIsSet returns whether the flag with the given name was given on the
+// command line.
+func flagIsSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-	}
+	})
 
-	/***************
-	 * Begin Build *
-	 ***************/
+	return set
+}
+
+// fatalHook is a log hook which is called before the process exits on a fatal
+// error.
+type fatalHook func()
+
+func (h fatalHook) Levels() []log.Level {
+	return []log.Level{log.FatalLevel}
+}
 
-	builder, err := build.NewBuilder(*daemonURL, tlsConfig, *contextDirectory, *dockerfilePath, *repoTag)
+func (h fatalHook) Fire(*log.Entry) error {
+	h()
+	return nil
+}
+
+// writeGraph writes the stage graph of the build to the file at the given path.
+func writeGraph(builder *build.Builder, path string) error {
+	f, err := os.Create(path)
 	if err != nil {
-		log.Fatalf("unable to initialize builder: %s", err)
+		return err
 	}
 
-	if err := builder.Run(); err != nil {
-		log.Fatal(err)
+	if err := builder.WriteGraph(f); err != nil {
+		f.Close()
+		return err
 	}
+
+	return f.Close()
 }
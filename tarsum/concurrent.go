@@ -0,0 +1,244 @@
+package tarsum
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/jlhawn/tarsum/archive/tar"
+)
+
+const (
+	// concurrentChunkSize is the size of the chunks of entry content which
+	// are passed to the workers of a ConcurrentDigest.
+	concurrentChunkSize = 32 * 1024
+	// concurrentChunkQueue is the number of chunks which may be queued for
+	// each worker.
+	concurrentChunkQueue = 8
+)
+
+// ConcurrentDigest computes the same TarSum as a Digest, but hashes the
+// entries of the archive on a pool of workers while the archive continues to
+// be read. Unlike a Digest, its state cannot be saved and restored. The
+// archive is written to it and then it must be closed before its sum is
+// read.
+type ConcurrentDigest struct {
+	version        Version
+	hashName       string
+	headerSelector tarHeaderSelector
+	workers        int
+
+	pipeWriter *io.PipeWriter
+	done       chan struct{}
+	closed     bool
+
+	// The following are set by the scanner before done is closed.
+	err  error
+	sums fileInfoSums
+}
+
+// NewConcurrentDigest returns a digest of the given version which uses the
+// given number of workers to hash archive entries.
+func NewConcurrentDigest(version Version, workers int) (*ConcurrentDigest, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("invalid number of workers: %d", workers)
+	}
+
+	headerSelector, err := getTarHeaderSelector(version)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+
+	cd := &ConcurrentDigest{
+		version:        version,
+		hashName:       getHashName(version),
+		headerSelector: headerSelector,
+		workers:        workers,
+		pipeWriter:     pipeWriter,
+		done:           make(chan struct{}),
+	}
+
+	go cd.scan(pipeReader)
+
+	return cd, nil
+}
+
+// Write writes more of the archive to the digest. It returns an error if the
+// archive is invalid.
+func (cd *ConcurrentDigest) Write(p []byte) (int, error) {
+	return cd.pipeWriter.Write(p)
+}
+
+// Close waits for all of the entries of the archive to be hashed. It returns
+// an error if the archive is invalid or ended before its end-of-archive
+// marker.
+func (cd *ConcurrentDigest) Close() error {
+	if !cd.closed {
+		cd.pipeWriter.Close()
+		cd.closed = true
+	}
+
+	<-cd.done
+
+	return cd.err
+}
+
+func (cd *ConcurrentDigest) Label() string {
+	return fmt.Sprintf("%s+%s", cd.version.String(), cd.hashName)
+}
+
+// Sum appends the TarSum of the archive to the given slice. It must only be
+// called after Close.
+func (cd *ConcurrentDigest) Sum(extra []byte) []byte {
+	h, err := newResumableHash(cd.hashName)
+	if err != nil {
+		panic(err)
+	}
+
+	return sumFileInfoSums(h, cd.sums, extra)
+}
+
+// SumString returns the TarSum of the archive with its label. It must only be
+// called after Close.
+func (cd *ConcurrentDigest) SumString(extra []byte) string {
+	return fmt.Sprintf("%s:%x", cd.Label(), cd.Sum(extra))
+}
+
+// FileSums returns the checksums of the archive entries in the order they
+// appear in the archive. It must only be called after Close.
+func (cd *ConcurrentDigest) FileSums() []FileSum {
+	return fileSumsByPos(cd.sums)
+}
+
+// scan reads the archive, handing the selected headers and content of each
+// entry to a worker to be hashed.
+func (cd *ConcurrentDigest) scan(r *io.PipeReader) {
+	defer close(cd.done)
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		workers = make(chan struct{}, cd.workers)
+		sums    fileInfoSums
+	)
+
+	hashEntry := func(name string, pos int64, chunks <-chan []byte) {
+		defer func() {
+			<-workers
+			wg.Done()
+		}()
+
+		h, _ := newResumableHash(cd.hashName) // The name is always valid.
+		for chunk := range chunks {
+			h.Write(chunk)
+		}
+
+		mu.Lock()
+		sums = append(sums, fileInfoSum{name: name, sum: hex.EncodeToString(h.Sum(nil)), pos: pos})
+		mu.Unlock()
+	}
+
+	counter := &countingReader{r: r}
+	err := cd.readEntries(tar.NewReader(counter), counter, func(header *tar.Header, pos int64) chan<- []byte {
+		chunks := make(chan []byte, concurrentChunkQueue)
+
+		workers <- struct{}{}
+		wg.Add(1)
+		go hashEntry(strings.TrimSuffix(strings.TrimPrefix(header.Name, "./"), "/"), pos, chunks)
+
+		return chunks
+	})
+
+	wg.Wait()
+
+	if err != nil {
+		r.CloseWithError(err)
+	} else {
+		// Like a Digest, ignore anything written after the end of the
+		// archive.
+		io.Copy(ioutil.Discard, r)
+	}
+
+	// Sum in the same order as a Digest.
+	sums.SortByPos()
+	cd.err, cd.sums = err, sums
+}
+
+// readEntries reads the entries of the archive, passing the selected headers
+// and then the content of each to a channel returned by the given function.
+func (cd *ConcurrentDigest) readEntries(tarReader *tar.Reader, counter *countingReader, newEntry func(*tar.Header, int64) chan<- []byte) error {
+	// headerStart is the offset of the next header in the archive.
+	var headerStart int64
+
+	for pos := int64(0); ; pos++ {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			// The tar reader also returns io.EOF if the archive ends
+			// exactly at a header without the end-of-archive marker,
+			// in which case fewer bytes have been read.
+			if counter.n != headerStart+int64(len(archiveEndBlock)) {
+				return ErrIncompleteArchive
+			}
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return ErrIncompleteArchive
+		}
+		if err != nil {
+			return err
+		}
+
+		chunks := newEntry(header, pos)
+
+		var selected []byte
+		for _, elem := range cd.headerSelector.selectHeaders(header) {
+			selected = append(selected, elem[0]+elem[1]...)
+		}
+		chunks <- selected
+
+		for remaining := header.Size; remaining > 0; {
+			size := remaining
+			if size > concurrentChunkSize {
+				size = concurrentChunkSize
+			}
+
+			chunk := make([]byte, size)
+			n, err := io.ReadFull(tarReader, chunk)
+			if n > 0 {
+				chunks <- chunk[:n]
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				close(chunks)
+				return err
+			}
+
+			remaining -= int64(n)
+		}
+		close(chunks)
+
+		// The tar reader also returns io.EOF if the archive is truncated
+		// within the entry, in which case nothing more is read and the
+		// archive is found to be incomplete at the next header.
+		headerStart = counter.n + int64(computeBlockPadding(header.Size))
+	}
+}
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
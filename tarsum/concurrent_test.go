@@ -0,0 +1,184 @@
+package tarsum
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jlhawn/tarsum/archive/tar"
+)
+
+// testTarWriter writes entries with the given content to a tar archive.
+type testTarWriter struct {
+	t  *testing.T
+	tw *tar.Writer
+}
+
+func newTestTarWriter(t *testing.T, w io.Writer) *testTarWriter {
+	return &testTarWriter{t, tar.NewWriter(w)}
+}
+
+func (w *testTarWriter) add(name, content string) {
+	if err := w.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+		w.t.Fatal(err)
+	}
+	if _, err := w.tw.Write([]byte(content)); err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+func (w *testTarWriter) close() {
+	if err := w.tw.Close(); err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+// TestConcurrentDigest tests that a concurrent digest computes the same sums
+// as a serial digest.
+func TestConcurrentDigest(t *testing.T) {
+	archives := map[string][]byte{}
+	for name, opts := range map[string]sizedOptions{
+		"many small files":  {200, 1024, true, false, true},
+		"few large files":   {3, 200 * 1024, true, false, true},
+		"identical content": {20, 1024, false, false, false},
+	} {
+		data, err := ioutil.ReadAll(sizedTar(opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives[name] = data
+	}
+
+	// Entries with the same path are summed in archive order.
+	dups := new(bytes.Buffer)
+	tw := newTestTarWriter(t, dups)
+	for _, content := range []string{"first", "second", "third"} {
+		tw.add("file", content)
+		tw.add("other", content)
+	}
+	tw.close()
+	archives["duplicate paths"] = dups.Bytes()
+
+	for name, archive := range archives {
+		for _, version := range []Version{Version0, Version1, Version2} {
+			serial, err := NewDigest(version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := serial.Write(archive); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, workers := range []int{1, 4} {
+				concurrent, err := NewConcurrentDigest(version, workers)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// Trailing data after the archive is ignored.
+				if _, err := io.Copy(concurrent, io.MultiReader(bytes.NewReader(archive), bytes.NewReader(make([]byte, 10240)))); err != nil {
+					t.Fatalf("%s: unable to write archive: %s", name, err)
+				}
+				if err := concurrent.Close(); err != nil {
+					t.Fatalf("%s: unable to close digest: %s", name, err)
+				}
+
+				if expected, sum := serial.SumString(nil), concurrent.SumString(nil); sum != expected {
+					t.Fatalf("%s: version %s with %d workers: expected %s, got %s", name, version, workers, expected, sum)
+				}
+
+				expectedFiles, files := serial.FileSums(), concurrent.FileSums()
+				if len(files) != len(expectedFiles) {
+					t.Fatalf("%s: expected %d file sums, got %d", name, len(expectedFiles), len(files))
+				}
+				for i := range files {
+					if files[i] != expectedFiles[i] {
+						t.Fatalf("%s: expected file sum %v, got %v", name, expectedFiles[i], files[i])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestConcurrentDigestErrors(t *testing.T) {
+	if _, err := NewConcurrentDigest(Version1, 0); err == nil {
+		t.Fatal("expected an error for zero workers")
+	}
+
+	buf := new(bytes.Buffer)
+	tw := newTestTarWriter(t, buf)
+	tw.add("a", string(bytes.Repeat([]byte("a"), 1000)))
+	tw.add("b", "")
+	tw.close()
+	archive := buf.Bytes()
+
+	// Truncated within a header, within content, at a header, and within
+	// the end-of-archive marker.
+	for _, length := range []int{100, blockSize + 10, 3 * blockSize, len(archive) - blockSize} {
+		cd, err := NewConcurrentDigest(Version1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cd.Write(archive[:length])
+		if err := cd.Close(); err != ErrIncompleteArchive {
+			t.Fatalf("expected an incomplete archive error for %d bytes, got %v", length, err)
+		}
+	}
+
+	// A corrupt header fails the write.
+	corrupt := append([]byte{}, archive...)
+	corrupt[0] ^= 0xff
+
+	cd, err := NewConcurrentDigest(Version1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cd.Write(corrupt); err == nil {
+		t.Fatal("expected an error writing a corrupt archive")
+	}
+	if err := cd.Close(); err == nil {
+		t.Fatal("expected an error closing the digest of a corrupt archive")
+	}
+}
+
+// this is 1024 1k files in the tar archive
+func Benchmark1kFilesConcurrentTarDigest(b *testing.B) {
+	opts := sizedOptions{1024, 1024, true, true, false}
+
+	tarReader, ok := sizedTar(opts).(io.ReadSeeker)
+	if !ok {
+		b.Fatal("sizedTar did not return an io.ReadSeeker")
+	}
+
+	if f, ok := tarReader.(*os.File); ok {
+		defer os.Remove(f.Name())
+		defer f.Close()
+	}
+
+	// The archive is written to the end of the file.
+	tarReader.Seek(0, 0)
+
+	b.SetBytes(opts.size * opts.num)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		cd, err := NewConcurrentDigest(Version1, 4)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := io.Copy(cd, tarReader); err != nil {
+			b.Fatal(err)
+		}
+		if err := cd.Close(); err != nil {
+			b.Fatal(err)
+		}
+
+		cd.Sum(nil)
+		tarReader.Seek(0, 0)
+	}
+}
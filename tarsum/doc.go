@@ -0,0 +1,7 @@
+// Package tarsum computes resumable TarSum digests of tar archives.
+//
+// It is a copy of github.com/jlhawn/tarsum at revision d07f381, extended with
+// what the builder needs, such as Version2 using SHA-512. The tar reader and
+// the resumable SHA-256 implementation are still vendored from
+// github.com/jlhawn/tarsum.
+package tarsum
@@ -0,0 +1,188 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sha512 implements the SHA512 hash algorithm as defined in FIPS
+// 180-4 with a digest whose state may be saved and restored.
+package sha512
+
+import (
+	"bytes"
+	"encoding/gob"
+	"hash"
+)
+
+// The size of a SHA512 checksum in bytes.
+const Size = 64
+
+// The blocksize of SHA512 in bytes.
+const BlockSize = 128
+
+const (
+	chunk = 128
+	init0 = 0x6a09e667f3bcc908
+	init1 = 0xbb67ae8584caa73b
+	init2 = 0x3c6ef372fe94f82b
+	init3 = 0xa54ff53a5f1d36f1
+	init4 = 0x510e527fade682d1
+	init5 = 0x9b05688c2b3e6c1f
+	init6 = 0x1f83d9abfb41bd6b
+	init7 = 0x5be0cd19137e2179
+)
+
+type Resumable interface {
+	hash.Hash
+	Len() uint64
+	State() ([]byte, error)
+	Restore(state []byte) error
+}
+
+// digest represents the partial evaluation of a checksum.
+type digest struct {
+	h   [8]uint64
+	x   [chunk]byte
+	nx  int
+	len uint64
+}
+
+// Len returns the number of bytes which
+// have been written to the digest.
+func (d *digest) Len() uint64 {
+	return d.len
+}
+
+func (d *digest) State() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	encoder := gob.NewEncoder(buf)
+
+	// We encode this way so that we do not have
+	// to export these fields of the digest struct.
+	vals := []interface{}{
+		d.h, d.x, d.nx, d.len,
+	}
+
+	for _, val := range vals {
+		if err := encoder.Encode(val); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (d *digest) Restore(state []byte) error {
+	decoder := gob.NewDecoder(bytes.NewReader(state))
+
+	// We decode this way so that we do not have
+	// to export these fields of the digest struct.
+	vals := []interface{}{
+		&d.h, &d.x, &d.nx, &d.len,
+	}
+
+	for _, val := range vals {
+		if err := decoder.Decode(val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *digest) Reset() {
+	d.h[0] = init0
+	d.h[1] = init1
+	d.h[2] = init2
+	d.h[3] = init3
+	d.h[4] = init4
+	d.h[5] = init5
+	d.h[6] = init6
+	d.h[7] = init7
+	d.nx = 0
+	d.len = 0
+}
+
+// New returns a new Resumable computing the SHA512 checksum.
+func New() Resumable {
+	d := new(digest)
+	d.Reset()
+	return d
+}
+
+func (d *digest) Size() int { return Size }
+
+func (d *digest) BlockSize() int { return BlockSize }
+
+func (d *digest) Write(p []byte) (nn int, err error) {
+	nn = len(p)
+	d.len += uint64(nn)
+	if d.nx > 0 {
+		n := copy(d.x[d.nx:], p)
+		d.nx += n
+		if d.nx == chunk {
+			block(d, d.x[:])
+			d.nx = 0
+		}
+		p = p[n:]
+	}
+	if len(p) >= chunk {
+		n := len(p) &^ (chunk - 1)
+		block(d, p[:n])
+		p = p[n:]
+	}
+	if len(p) > 0 {
+		d.nx = copy(d.x[:], p)
+	}
+	return
+}
+
+func (d0 *digest) Sum(in []byte) []byte {
+	// Make a copy of d0 so that caller can keep writing and summing.
+	d := *d0
+	hash := d.checkSum()
+	return append(in, hash[:]...)
+}
+
+func (d *digest) checkSum() [Size]byte {
+	len := d.len
+	// Padding.  Add a 1 bit and 0 bits until 112 bytes mod 128.
+	var tmp [128]byte
+	tmp[0] = 0x80
+	if len%128 < 112 {
+		d.Write(tmp[0 : 112-len%128])
+	} else {
+		d.Write(tmp[0 : 128+112-len%128])
+	}
+
+	// Length in bits.
+	len <<= 3
+	for i := uint(0); i < 16; i++ {
+		tmp[i] = byte(len >> (120 - 8*i))
+	}
+	d.Write(tmp[0:16])
+
+	if d.nx != 0 {
+		panic("d.nx != 0")
+	}
+
+	var digest [Size]byte
+	for i, s := range d.h {
+		digest[i*8] = byte(s >> 56)
+		digest[i*8+1] = byte(s >> 48)
+		digest[i*8+2] = byte(s >> 40)
+		digest[i*8+3] = byte(s >> 32)
+		digest[i*8+4] = byte(s >> 24)
+		digest[i*8+5] = byte(s >> 16)
+		digest[i*8+6] = byte(s >> 8)
+		digest[i*8+7] = byte(s)
+	}
+
+	return digest
+}
+
+// Sum512 returns the SHA512 checksum of the data.
+func Sum512(data []byte) [Size]byte {
+	var d digest
+	d.Reset()
+	d.Write(data)
+	return d.checkSum()
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"hash"
 	"io"
@@ -27,7 +28,12 @@ const (
 // including the byte payload of the image's json metadata as well, and for
 // calculating the checksums for buildcache.
 func newTarSum(r io.Reader, dc bool, v Version) (*tarSum, error) {
-	return newTarSumHash(r, dc, v, defaultTHash)
+	th := defaultTHash
+	if getHashName(v) == "sha512" {
+		th = newTHash("sha512", sha512.New)
+	}
+
+	return newTarSumHash(r, dc, v, th)
 }
 
 // Create a new TarSum, providing a THash to use rather than the DefaultTHash
@@ -5,9 +5,11 @@ import (
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"strings"
 
+	"github.com/jlhawn/dockramp/tarsum/sha512"
 	"github.com/jlhawn/tarsum/archive/tar"
 	"github.com/jlhawn/tarsum/sha256"
 )
@@ -16,6 +18,26 @@ const blockSize = 1 << 9
 
 var archiveEndBlock = make([]byte, blockSize*2) // 2 blocks of zeroed bytes.
 
+// resumableHash is a hash whose state may be saved and restored.
+type resumableHash interface {
+	hash.Hash
+	Len() uint64
+	State() ([]byte, error)
+	Restore(state []byte) error
+}
+
+// newResumableHash returns a new resumable hash using the named algorithm.
+func newResumableHash(name string) (resumableHash, error) {
+	switch name {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported TarSum hash algorithm: %q", name)
+	}
+}
+
 func computeBlockPadding(size int64) int {
 	// since blockSize is a power of 2, we can do this instead of:
 	// 		blocksize - (size % blocksize)
@@ -27,10 +49,11 @@ func computeBlockPadding(size int64) int {
 type Digest struct {
 	// Critical State/Fields
 	version         Version
+	hashName        string
 	digestStage     string
 	headerBuffer    bytes.Buffer
 	tarReader       *tar.Reader
-	entryHash       sha256.Resumable
+	entryHash       resumableHash
 	sums            fileInfoSums
 	fileCounter     int64
 	bytesWritten    int64
@@ -63,6 +86,7 @@ func NewDigest(version Version) (*Digest, error) {
 	tsd := &Digest{
 		headerSelector: headerSelector,
 		version:        version,
+		hashName:       getHashName(version),
 	}
 
 	tsd.Reset()
@@ -82,11 +106,23 @@ func (tsd *Digest) logDebug(format string, args ...interface{}) {
 }
 
 func (tsd *Digest) Size() int {
-	return sha256.New().Size()
+	return tsd.newHash().Size()
 }
 
 func (tsd *Digest) BlockSize() int {
-	return sha256.New().BlockSize()
+	return tsd.newHash().BlockSize()
+}
+
+// newHash returns a new hash using the algorithm of this digest's version.
+func (tsd *Digest) newHash() resumableHash {
+	h, err := newResumableHash(tsd.hashName)
+	if err != nil {
+		// The hash name always comes from a known version or a
+		// state which was checked when restored.
+		panic(err)
+	}
+
+	return h
 }
 
 func (tsd *Digest) Reset() {
@@ -95,7 +131,7 @@ func (tsd *Digest) Reset() {
 
 	tsd.digestStage = stageReadHeader
 	tsd.tarReader = new(tar.Reader)
-	tsd.entryHash = sha256.New()
+	tsd.entryHash = tsd.newHash()
 	tsd.sums = fileInfoSums{}
 	tsd.fileCounter = 0
 	tsd.bytesWritten = 0
@@ -305,19 +341,73 @@ func (tsd *Digest) copyWithBuf(dst io.Writer, src io.Reader) (written int64, err
 
 func (tsd *Digest) Finished() bool { return tsd.digestStage == stageFinished }
 
+// Close returns an error if the digest failed or if the archive written to it
+// ended before its end-of-archive marker, in which case the sum would be that
+// of a partial archive.
+func (tsd *Digest) Close() error {
+	if tsd.err != nil {
+		return tsd.err
+	}
+
+	if tsd.Finished() {
+		return nil
+	}
+
+	pending := tsd.currentBuffer.Len()
+	if tsd.digestStage == stageReadHeader {
+		pending = tsd.headerBuffer.Len()
+	}
+
+	return fmt.Errorf("incomplete archive: %d bytes pending in stage %s", pending, tsd.digestStage)
+}
+
+// FileSum is the checksum of a single entry in a tar archive and its headers.
+type FileSum struct {
+	Name string
+	Sum  string
+	Pos  int64
+}
+
+// FileSums returns the checksums of the archive entries which have been
+// completely digested so far, in the order they appear in the archive.
+func (tsd *Digest) FileSums() []FileSum {
+	return fileSumsByPos(tsd.sums)
+}
+
+// fileSumsByPos returns the given checksums in the order of their entries in
+// the archive.
+func fileSumsByPos(fis fileInfoSums) []FileSum {
+	sums := make(fileInfoSums, len(fis))
+	copy(sums, fis)
+	sums.SortByPos()
+
+	fileSums := make([]FileSum, len(sums))
+	for i, fis := range sums {
+		fileSums[i] = FileSum{Name: fis.Name(), Sum: fis.Sum(), Pos: fis.Pos()}
+	}
+
+	return fileSums
+}
+
 func (tsd *Digest) Label() string {
-	return fmt.Sprintf("%s+%s", tsd.version.String(), "sha256")
+	return fmt.Sprintf("%s+%s", tsd.version.String(), tsd.hashName)
 }
 
 func (tsd *Digest) Sum(extra []byte) []byte {
-	tsd.sums.SortBySums()
-	hasher := sha256.New()
+	return sumFileInfoSums(tsd.newHash(), tsd.sums, extra)
+}
+
+// sumFileInfoSums returns the combined checksum of the given file checksums,
+// which must be in the order of their entries in the archive, using the given
+// hash.
+func sumFileInfoSums(hasher hash.Hash, sums fileInfoSums, extra []byte) []byte {
+	sums.SortBySums()
 
 	if extra != nil {
 		hasher.Write(extra)
 	}
 
-	for _, fis := range tsd.sums {
+	for _, fis := range sums {
 		hasher.Write([]byte(fis.Sum()))
 	}
 
@@ -339,7 +429,7 @@ func (tsd *Digest) State() ([]byte, error) {
 	// 		pad             int
 	// 		headerBuffer    bytes.Buffer
 	// 		tarReader       *tar.Reader
-	// 		entryHash       sha256.Resumable
+	// 		entryHash       resumableHash
 	// 		sums            FileInfoSums
 	if tsd.err != nil {
 		return nil, tsd.err
@@ -351,7 +441,7 @@ func (tsd *Digest) State() ([]byte, error) {
 	// Encode the simple stuff first.
 	isFinished := tsd.Finished()
 	vals := []interface{}{
-		tsd.version, "sha256", isFinished,
+		tsd.version, tsd.hashName, isFinished,
 		tsd.bytesWritten, tsd.fileCounter,
 	}
 
@@ -437,6 +527,21 @@ func (tsd *Digest) Restore(state []byte) error {
 		}
 	}
 
+	// The restored state determines the header selector and hash.
+	headerSelector, err := getTarHeaderSelector(tsd.version)
+	if err != nil {
+		return err
+	}
+
+	entryHash, err := newResumableHash(hashType)
+	if err != nil {
+		return err
+	}
+
+	tsd.headerSelector = headerSelector
+	tsd.hashName = hashType
+	tsd.entryHash = entryHash
+
 	if isFinished {
 		tsd.digestStage = stageFinished
 	} else {
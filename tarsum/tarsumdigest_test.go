@@ -3,6 +3,7 @@ package tarsum
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/sha512"
 	"errors"
 	"fmt"
 	"hash"
@@ -10,8 +11,10 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 
+	resumableSHA512 "github.com/jlhawn/dockramp/tarsum/sha512"
 	"github.com/jlhawn/tarsum/archive/tar"
 )
 
@@ -359,6 +362,101 @@ func TestDigestStateRestore(t *testing.T) {
 	}
 }
 
+func TestDigestVersion2(t *testing.T) {
+	tarBuf := new(bytes.Buffer)
+	n, err := io.Copy(tarBuf, sizedTar(sizedOptions{16, 64 * 1024, true, false, true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Treat the original read-through TarSum as the 'golden' sum value.
+	tarSumReader, err := newTarSum(bytes.NewReader(tarBuf.Bytes()), true, Version2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, tarSumReader); err != nil {
+		t.Fatal(err)
+	}
+	goldenSum := tarSumReader.Sum(nil)
+
+	digest, err := NewDigest(Version2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if label := digest.Label(); label != "tarsum.v2+sha512" {
+		t.Fatalf("expected label tarsum.v2+sha512, got %s", label)
+	}
+	if size := digest.Size(); size != sha512.Size {
+		t.Fatalf("expected size %d, got %d", sha512.Size, size)
+	}
+
+	// Restoring the state into a digest of another version must switch to
+	// the hash algorithm of the saved state.
+	var m int64
+	for m < n {
+		nn, err := digest.Write(tarBuf.Next(5 * blockSize))
+		if err != nil {
+			t.Fatalf("error after %d bytes: %s", digest.Len(), err)
+		}
+		m += int64(nn)
+
+		state, err := digest.State()
+		if err != nil {
+			t.Fatalf("unable to save digest state: %s", err)
+		}
+
+		if digest, err = NewDigest(Version1); err != nil {
+			t.Fatal(err)
+		}
+		if err = digest.Restore(state); err != nil {
+			t.Fatalf("unable to restore digest state: %s", err)
+		}
+	}
+
+	if !digest.Finished() {
+		t.Fatal("digest not finished when it should be")
+	}
+
+	if sum := digest.SumString(nil); sum != goldenSum {
+		t.Fatalf("expected sum %s, got %s", goldenSum, sum)
+	}
+	if len(digest.Sum(nil)) != sha512.Size {
+		t.Fatalf("expected a %d byte sum, got %d bytes", sha512.Size, len(digest.Sum(nil)))
+	}
+}
+
+func TestResumableSHA512(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	for _, size := range []int{0, 1, 111, 112, 127, 128, 129, 500, 1000} {
+		h := resumableSHA512.New()
+		for i := 0; i < size; i += 7 {
+			end := i + 7
+			if end > size {
+				end = size
+			}
+			h.Write(data[i:end])
+
+			// Save and restore the state along the way.
+			state, err := h.State()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h = resumableSHA512.New()
+			if err := h.Restore(state); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected := sha512.Sum512(data[:size])
+		if sum := h.Sum(nil); !bytes.Equal(sum, expected[:]) {
+			t.Fatalf("size %d: expected %x, got %x", size, expected, sum)
+		}
+	}
+}
+
 func Benchmark9kTarDigest(b *testing.B) {
 	buf := bytes.NewBuffer([]byte{})
 	fh, err := os.Open("testdata/46af0962ab5afeb5ce6740d4d91652e69206fc991fd5328c1a94d364ad00e457/layer.tar")
@@ -439,3 +537,109 @@ func benchmarkTarDigest(b *testing.B, opts sizedOptions) {
 		tarReader.Seek(0, 0)
 	}
 }
+
+// TestDigestFileSums tests that the checksums of individual files are reported
+// in archive order and that a change to one file changes only its checksum.
+func TestDigestFileSums(t *testing.T) {
+	makeArchive := func(contents map[string]string, names ...string) []byte {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		for _, name := range names {
+			content := contents[name]
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	fileSums := func(archive []byte) []FileSum {
+		tsd, err := NewDigest(Version1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tsd.Write(archive); err != nil {
+			t.Fatal(err)
+		}
+		if !tsd.Finished() {
+			t.Fatal("digest should be finished")
+		}
+		// Summing the digest must not affect the order of the file sums.
+		tsd.Sum(nil)
+		return tsd.FileSums()
+	}
+
+	names := []string{"./zebra", "apple", "dir/mango/"}
+	contents := map[string]string{"./zebra": "stripes", "apple": "red", "dir/mango/": ""}
+
+	before := fileSums(makeArchive(contents, names...))
+	if len(before) != len(names) {
+		t.Fatalf("expected %d file sums, got %d", len(names), len(before))
+	}
+
+	expectedNames := []string{"zebra", "apple", "dir/mango"}
+	for i, fileSum := range before {
+		if fileSum.Name != expectedNames[i] || fileSum.Pos != int64(i) {
+			t.Fatalf("expected file %q at position %d, got %q at %d", expectedNames[i], i, fileSum.Name, fileSum.Pos)
+		}
+	}
+
+	contents["apple"] = "green"
+	after := fileSums(makeArchive(contents, names...))
+
+	for i := range before {
+		changed := before[i].Sum != after[i].Sum
+		if changed != (before[i].Name == "apple") {
+			t.Fatalf("unexpected change of sum for %q: %s -> %s", before[i].Name, before[i].Sum, after[i].Sum)
+		}
+	}
+}
+
+// TestDigestClose tests that closing a digest reports a truncated archive.
+func TestDigestClose(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	content := bytes.Repeat([]byte("a"), 1000)
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	for _, testCase := range []struct {
+		length int
+		err    string
+	}{
+		{len(archive), ""},
+		{100, "incomplete archive: 100 bytes pending in stage readHeader"},
+		{2*blockSize + 10, "stage readEntry"},
+		{len(archive) - blockSize, "stage readHeader"},
+	} {
+		tsd, err := NewDigest(Version1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tsd.Write(archive[:testCase.length]); err != nil {
+			t.Fatal(err)
+		}
+
+		err = tsd.Close()
+		switch {
+		case testCase.err == "" && err != nil:
+			t.Fatalf("unexpected error closing digest of %d bytes: %s", testCase.length, err)
+		case testCase.err != "" && (err == nil || !strings.Contains(err.Error(), testCase.err)):
+			t.Fatalf("expected error containing %q closing digest of %d bytes, got %v", testCase.err, testCase.length, err)
+		}
+	}
+}
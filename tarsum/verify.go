@@ -0,0 +1,96 @@
+package tarsum
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrIncompleteArchive is returned by Verify and ConcurrentDigest.Close if the
+// archive ends before its end-of-archive marker.
+var ErrIncompleteArchive = errors.New("incomplete tar archive")
+
+// Verify reads a complete tar archive from r and returns whether its TarSum is
+// the expected one, such as "tarsum.v1+sha256:<hex>". The TarSum is computed
+// using the version given by the label of the expected sum.
+func Verify(r io.Reader, expected string) (bool, error) {
+	version, err := GetVersionFromTarsum(expected)
+	if err != nil {
+		return false, err
+	}
+
+	digest, err := NewDigest(version)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := io.Copy(digest, r); err != nil {
+		return false, err
+	}
+
+	if !digest.Finished() {
+		return false, ErrIncompleteArchive
+	}
+
+	return digest.SumString(nil) == expected, nil
+}
+
+var (
+	gzipMagic  = []byte{0x1F, 0x8B, 0x08}
+	bzip2Magic = []byte{0x42, 0x5A, 0x68}
+)
+
+// DigestFile returns the TarSum, such as "tarsum.v1+sha256:<hex>", of the tar
+// archive in the file at the given path. An archive compressed with gzip or
+// bzip2 is decompressed first, so that its TarSum is that of its content.
+func DigestFile(path string, version Version) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	digest, err := NewDigest(version)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := decompress(f)
+	if err != nil {
+		return "", fmt.Errorf("unable to decompress %s: %s", path, err)
+	}
+
+	if _, err := io.Copy(digest, content); err != nil {
+		return "", fmt.Errorf("unable to digest %s: %s", path, err)
+	}
+
+	if err := digest.Close(); err != nil {
+		return "", fmt.Errorf("unable to digest %s: %s", path, err)
+	}
+
+	return digest.SumString(nil), nil
+}
+
+// decompress returns a reader of the decompressed content of the given archive
+// if it is compressed with gzip or bzip2, or of the archive as is otherwise.
+func decompress(archive io.Reader) (io.Reader, error) {
+	buf := bufio.NewReader(archive)
+
+	// An archive too short to be compressed is left for the tar reader
+	// to reject.
+	magic, _ := buf.Peek(3)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buf)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return bzip2.NewReader(buf), nil
+	default:
+		return buf, nil
+	}
+}
@@ -0,0 +1,115 @@
+package tarsum
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	tarBuf := new(bytes.Buffer)
+	if _, err := io.Copy(tarBuf, sizedTar(sizedOptions{4, 1024, true, false, false})); err != nil {
+		t.Fatal(err)
+	}
+	archive := tarBuf.Bytes()
+
+	for _, version := range []Version{Version0, Version1, Version2} {
+		digest, err := NewDigest(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := digest.Write(archive); err != nil {
+			t.Fatal(err)
+		}
+		expected := digest.SumString(nil)
+
+		ok, err := Verify(bytes.NewReader(archive), expected)
+		if err != nil || !ok {
+			t.Fatalf("expected %s to verify, got %t, %v", expected, ok, err)
+		}
+
+		// A different archive does not verify.
+		other := append([]byte{}, archive...)
+		other[blockSize+1] ^= 0xff
+		if ok, err := Verify(bytes.NewReader(other), expected); err != nil || ok {
+			t.Fatalf("expected modified archive not to verify with %s, got %t, %v", expected, ok, err)
+		}
+	}
+
+	digest, err := NewDigest(Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest.Write(archive)
+	expected := digest.SumString(nil)
+
+	// An archive without its end-of-archive marker is incomplete.
+	truncated := archive[:len(archive)-2*blockSize]
+	if _, err := Verify(bytes.NewReader(truncated), expected); err != ErrIncompleteArchive {
+		t.Fatalf("expected %v, got %v", ErrIncompleteArchive, err)
+	}
+
+	if _, err := Verify(bytes.NewReader(archive), "tarsum.v9+sha256:deadbeef"); err != ErrNotVersion {
+		t.Fatalf("expected %v, got %v", ErrNotVersion, err)
+	}
+}
+
+func TestDigestFile(t *testing.T) {
+	tarBuf := new(bytes.Buffer)
+	if _, err := io.Copy(tarBuf, sizedTar(sizedOptions{4, 1024, true, false, false})); err != nil {
+		t.Fatal(err)
+	}
+	archive := tarBuf.Bytes()
+
+	dir, err := ioutil.TempDir("", "tarsum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	complete := filepath.Join(dir, "complete.tar")
+	truncated := filepath.Join(dir, "truncated.tar")
+	if err := ioutil.WriteFile(complete, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(truncated, archive[:len(archive)-2*blockSize], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gzipBuf := new(bytes.Buffer)
+	gz := gzip.NewWriter(gzipBuf)
+	gz.Write(archive)
+	gz.Close()
+
+	compressed := filepath.Join(dir, "complete.tar.gz")
+	if err := ioutil.WriteFile(compressed, gzipBuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []Version{Version0, Version1, Version2} {
+		sum, err := DigestFile(complete, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, err := Verify(bytes.NewReader(archive), sum); err != nil || !ok {
+			t.Fatalf("expected %s to verify, got %t, %v", sum, ok, err)
+		}
+
+		// A compressed archive has the TarSum of its content.
+		if compressedSum, err := DigestFile(compressed, version); err != nil || compressedSum != sum {
+			t.Fatalf("expected the compressed archive to have TarSum %s, got %s, %v", sum, compressedSum, err)
+		}
+	}
+
+	for _, path := range []string{truncated, filepath.Join(dir, "missing.tar")} {
+		if _, err := DigestFile(path, Version1); err == nil || !strings.Contains(err.Error(), path) {
+			t.Fatalf("expected an error naming %s, got %v", path, err)
+		}
+	}
+}
@@ -20,6 +20,10 @@ const (
 	Version1
 	// NOTE: this variable will be either the latest or an unsettled next-version of the TarSum calculation
 	VersionDev
+	// Version2 uses SHA-512 rather than SHA-256. It follows VersionDev so
+	// that the values of the earlier versions, which are recorded in saved
+	// digest states, do not change.
+	Version2
 )
 
 // Get a list of all known tarsum Version
@@ -35,6 +39,7 @@ var tarSumVersions = map[Version]string{
 	Version0:   "tarsum",
 	Version1:   "tarsum.v1",
 	VersionDev: "tarsum.dev",
+	Version2:   "tarsum.v2",
 }
 
 func (tsv Version) String() string {
@@ -120,6 +125,7 @@ var registeredHeaderSelectors = map[Version]tarHeaderSelectFunc{
 	Version0:   v0TarHeaderSelect,
 	Version1:   v1TarHeaderSelect,
 	VersionDev: v1TarHeaderSelect,
+	Version2:   v1TarHeaderSelect,
 }
 
 func getTarHeaderSelector(v Version) (tarHeaderSelector, error) {
@@ -130,3 +136,17 @@ func getTarHeaderSelector(v Version) (tarHeaderSelector, error) {
 
 	return headerSelector, nil
 }
+
+// versionHashNames are the names of the hash algorithms used by each version.
+// Versions which are not listed use sha256.
+var versionHashNames = map[Version]string{
+	Version2: "sha512",
+}
+
+func getHashName(v Version) string {
+	if name, ok := versionHashNames[v]; ok {
+		return name
+	}
+
+	return "sha256"
+}
@@ -22,6 +22,12 @@ func TestVersion(t *testing.T) {
 	if v.String() != expected {
 		t.Errorf("expected %q, got %q", expected, v.String())
 	}
+
+	expected = "tarsum.v2"
+	v = Version2
+	if v.String() != expected {
+		t.Errorf("expected %q, got %q", expected, v.String())
+	}
 }
 
 func TestGetVersion(t *testing.T) {
@@ -34,6 +40,7 @@ func TestGetVersion(t *testing.T) {
 		{"tarsum", Version0},
 		{"tarsum.dev", VersionDev},
 		{"tarsum.dev+sha256:deadbeef", VersionDev},
+		{"tarsum.v2+sha512:deadbeef", Version2},
 	}
 
 	for _, ts := range testSet {
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"fmt"
+	"os"
+)
+
+// FileLock is an exclusive lock on a file which is held until it is unlocked
+// or the process exits.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile acquires an exclusive lock on the file at the given path, creating
+// it if necessary, and blocks until the lock is available. If the lock is
+// held by another process, waiting is called before blocking.
+func LockFile(path string, waiting func()) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, os.FileMode(0600))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file: %s", err)
+	}
+
+	acquired, err := tryLock(file)
+	if err == nil && !acquired {
+		if waiting != nil {
+			waiting()
+		}
+		err = lock(file)
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to lock %s: %s", path, err)
+	}
+
+	return &FileLock{file: file}, nil
+}
+
+// Unlock releases the lock. The lock file is left in place so that any other
+// process waiting for the lock still refers to the same file.
+func (l *FileLock) Unlock() error {
+	if err := unlock(l.file); err != nil {
+		l.file.Close()
+		return fmt.Errorf("unable to unlock %s: %s", l.file.Name(), err)
+	}
+
+	return l.file.Close()
+}
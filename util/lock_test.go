@@ -0,0 +1,104 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockFileSerializes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockramp-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lockPath := filepath.Join(dir, "build.lock")
+
+	var (
+		mu      sync.Mutex
+		events  []string
+		waited  = make(chan struct{})
+		wg      sync.WaitGroup
+		holding int
+	)
+
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	// Each build holds the lock for a while and checks that no other
+	// build holds it at the same time.
+	runBuild := func(name string, waiting func()) {
+		defer wg.Done()
+
+		lock, err := LockFile(lockPath, waiting)
+		if err != nil {
+			t.Errorf("%s: unable to acquire lock: %s", name, err)
+			return
+		}
+
+		mu.Lock()
+		holding++
+		if holding != 1 {
+			t.Errorf("%s: %d builds hold the lock", name, holding)
+		}
+		mu.Unlock()
+
+		record(name + " start")
+		time.Sleep(50 * time.Millisecond)
+		record(name + " end")
+
+		mu.Lock()
+		holding--
+		mu.Unlock()
+
+		if err := lock.Unlock(); err != nil {
+			t.Errorf("%s: unable to release lock: %s", name, err)
+		}
+	}
+
+	first, err := LockFile(lockPath, nil)
+	if err != nil {
+		t.Fatalf("unable to acquire lock: %s", err)
+	}
+
+	wg.Add(1)
+	go runBuild("second", func() { close(waited) })
+
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second build did not wait for the lock")
+	}
+
+	record("first end")
+	if err := first.Unlock(); err != nil {
+		t.Fatalf("unable to release lock: %s", err)
+	}
+
+	wg.Add(2)
+	go runBuild("third", nil)
+	go runBuild("fourth", nil)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(events) != 7 || events[0] != "first end" {
+		t.Fatalf("unexpected events: %q", events)
+	}
+
+	// Every build must end before the next one starts.
+	for i := 1; i < len(events); i += 2 {
+		start, end := events[i], events[i+1]
+		if start[:len(start)-len(" start")] != end[:len(end)-len(" end")] {
+			t.Fatalf("builds overlapped: %q", events)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package util
+
+import (
+	"errors"
+	"os"
+)
+
+var errLockNotSupported = errors.New("file locking is not supported on windows")
+
+func tryLock(file *os.File) (bool, error) {
+	return false, errLockNotSupported
+}
+
+func lock(file *os.File) error {
+	return errLockNotSupported
+}
+
+func unlock(file *os.File) error {
+	return errLockNotSupported
+}
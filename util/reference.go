@@ -0,0 +1,113 @@
+// Package util provides helpers shared by the dockramp packages.
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+const (
+	// DefaultRegistry is the registry host of images which do not name
+	// one explicitly.
+	DefaultRegistry = "docker.io"
+	// DefaultTag is the tag of image references which have neither a tag
+	// nor a digest.
+	DefaultTag = "latest"
+
+	legacyDefaultRegistry = "index.docker.io"
+	officialRepoPrefix    = "library/"
+)
+
+// ParseRepositoryTag splits a reference into a repository and a tag or
+// digest. A colon is only treated as the start of a tag if no slash follows
+// it, so the port of a registry host such as `localhost:5000/foo` is kept in
+// the repository. A digest is returned without its leading `@`. The reference
+// is not otherwise validated.
+func ParseRepositoryTag(repos string) (repo, tagOrDigest string) {
+	if i := strings.Index(repos, "@"); i >= 0 {
+		return repos[:i], repos[i+1:]
+	}
+
+	i := strings.LastIndex(repos, ":")
+	if i < 0 {
+		return repos, ""
+	}
+
+	if tag := repos[i+1:]; !strings.Contains(tag, "/") {
+		return repos[:i], tag
+	}
+
+	return repos, ""
+}
+
+// SplitReposName splits a repository name into the registry host and the
+// name of the repository on that registry. The first component of the name is
+// only considered a registry host if it contains a `.` or `:` or is
+// `localhost`. Otherwise, the repository is implicitly on Docker Hub and the
+// returned registry host is empty.
+func SplitReposName(reposName string) (registry, remoteName string) {
+	parts := strings.SplitN(reposName, "/", 2)
+	if len(parts) == 1 || (!strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost") {
+		return "", reposName
+	}
+
+	return parts[0], parts[1]
+}
+
+// Canonicalize validates the given image reference and returns it in its
+// fully qualified form. The returned repository always includes a registry
+// host, which defaults to Docker Hub, and official Docker Hub images are
+// expanded to the `library/` namespace. If the reference has neither a tag nor
+// a digest, the default tag is returned.
+func Canonicalize(ref string) (repo, tag, digest string, err error) {
+	named, err := reference.ParseNamed(ref)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid reference %q: %s", ref, err)
+	}
+
+	registry, remoteName := SplitReposName(named.Name())
+	if registry == "" || registry == legacyDefaultRegistry {
+		registry = DefaultRegistry
+	}
+
+	if registry == DefaultRegistry && !strings.Contains(remoteName, "/") {
+		remoteName = officialRepoPrefix + remoteName
+	}
+
+	repo = registry + "/" + remoteName
+
+	if tagged, isTagged := named.(reference.Tagged); isTagged {
+		tag = tagged.Tag()
+	}
+
+	if digested, isDigested := named.(reference.Digested); isDigested {
+		digest = digested.Digest().String()
+	}
+
+	if tag == "" && digest == "" {
+		tag = DefaultTag
+	}
+
+	return repo, tag, digest, nil
+}
+
+// CanonicalString returns the fully qualified form of the given image
+// reference, as returned by Canonicalize, as a single string.
+func CanonicalString(ref string) (string, error) {
+	repo, tag, digest, err := Canonicalize(ref)
+	if err != nil {
+		return "", err
+	}
+
+	if tag != "" {
+		repo += ":" + tag
+	}
+
+	if digest != "" {
+		repo += "@" + digest
+	}
+
+	return repo, nil
+}
@@ -0,0 +1,113 @@
+package util
+
+import "testing"
+
+func TestParseRepositoryTag(t *testing.T) {
+	testCases := []struct {
+		ref, repo, tagOrDigest string
+	}{
+		{"ubuntu", "ubuntu", ""},
+		{"ubuntu:14.04", "ubuntu", "14.04"},
+		{"localhost:5000/foo", "localhost:5000/foo", ""},
+		{"localhost:5000/foo:bar", "localhost:5000/foo", "bar"},
+		{"foo@sha256:abcd", "foo", "sha256:abcd"},
+		{"localhost:5000/foo@sha256:abcd", "localhost:5000/foo", "sha256:abcd"},
+	}
+
+	for _, tc := range testCases {
+		repo, tagOrDigest := ParseRepositoryTag(tc.ref)
+		if repo != tc.repo || tagOrDigest != tc.tagOrDigest {
+			t.Errorf("parsing %q: expected (%q, %q), got (%q, %q)", tc.ref, tc.repo, tc.tagOrDigest, repo, tagOrDigest)
+		}
+	}
+}
+
+func TestSplitReposName(t *testing.T) {
+	testCases := []struct {
+		name, registry, remoteName string
+	}{
+		{"ubuntu", "", "ubuntu"},
+		{"jlhawn/dockramp", "", "jlhawn/dockramp"},
+		{"gcr.io/foo/bar", "gcr.io", "foo/bar"},
+		{"localhost/foo", "localhost", "foo"},
+		{"registry:5000/foo", "registry:5000", "foo"},
+		{"a/b/c", "", "a/b/c"},
+	}
+
+	for _, tc := range testCases {
+		registry, remoteName := SplitReposName(tc.name)
+		if registry != tc.registry || remoteName != tc.remoteName {
+			t.Errorf("splitting %q: expected (%q, %q), got (%q, %q)", tc.name, tc.registry, tc.remoteName, registry, remoteName)
+		}
+	}
+}
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestCanonicalize(t *testing.T) {
+	testCases := []struct {
+		ref, repo, tag, digest string
+	}{
+		// Official images.
+		{"ubuntu", "docker.io/library/ubuntu", "latest", ""},
+		{"ubuntu:14.04", "docker.io/library/ubuntu", "14.04", ""},
+		{"library/ubuntu", "docker.io/library/ubuntu", "latest", ""},
+		{"docker.io/ubuntu", "docker.io/library/ubuntu", "latest", ""},
+		{"index.docker.io/ubuntu", "docker.io/library/ubuntu", "latest", ""},
+		// Implicit registry.
+		{"jlhawn/dockramp", "docker.io/jlhawn/dockramp", "latest", ""},
+		{"jlhawn/dockramp:v1", "docker.io/jlhawn/dockramp", "v1", ""},
+		{"docker.io/jlhawn/dockramp", "docker.io/jlhawn/dockramp", "latest", ""},
+		// Explicit registry, with and without ports.
+		{"gcr.io/foo/bar", "gcr.io/foo/bar", "latest", ""},
+		{"gcr.io/bar", "gcr.io/bar", "latest", ""},
+		{"localhost/foo", "localhost/foo", "latest", ""},
+		{"localhost:5000/foo", "localhost:5000/foo", "latest", ""},
+		{"localhost:5000/foo:5000", "localhost:5000/foo", "5000", ""},
+		{"registry.example.com:443/a/b/c:tag", "registry.example.com:443/a/b/c", "tag", ""},
+		// Digests.
+		{"ubuntu@" + testDigest, "docker.io/library/ubuntu", "", testDigest},
+		{"localhost:5000/foo@" + testDigest, "localhost:5000/foo", "", testDigest},
+		{"ubuntu:14.04@" + testDigest, "docker.io/library/ubuntu", "14.04", testDigest},
+	}
+
+	for _, tc := range testCases {
+		repo, tag, digest, err := Canonicalize(tc.ref)
+		if err != nil {
+			t.Errorf("unable to canonicalize %q: %s", tc.ref, err)
+			continue
+		}
+
+		if repo != tc.repo || tag != tc.tag || digest != tc.digest {
+			t.Errorf("canonicalizing %q: expected (%q, %q, %q), got (%q, %q, %q)", tc.ref, tc.repo, tc.tag, tc.digest, repo, tag, digest)
+		}
+	}
+
+	for _, ref := range []string{"", "Ubuntu", "ubuntu:", "ubuntu:bad/tag", "ubuntu@sha256:short", ":tag", "foo//bar"} {
+		if _, _, _, err := Canonicalize(ref); err == nil {
+			t.Errorf("expected an error canonicalizing %q", ref)
+		}
+	}
+}
+
+func TestCanonicalString(t *testing.T) {
+	testCases := map[string]string{
+		"ubuntu":                  "docker.io/library/ubuntu:latest",
+		"localhost:5000/foo:bar":  "localhost:5000/foo:bar",
+		"ubuntu@" + testDigest:    "docker.io/library/ubuntu@" + testDigest,
+		"foo:1.0@" + testDigest:   "docker.io/library/foo:1.0@" + testDigest,
+		"gcr.io/foo/bar:prod-1.2": "gcr.io/foo/bar:prod-1.2",
+	}
+
+	for ref, expected := range testCases {
+		canonical, err := CanonicalString(ref)
+		if err != nil {
+			t.Errorf("unable to canonicalize %q: %s", ref, err)
+			continue
+		}
+
+		if canonical != expected {
+			t.Errorf("canonicalizing %q: expected %q, got %q", ref, expected, canonical)
+		}
+	}
+}